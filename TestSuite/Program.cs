@@ -39,8 +39,14 @@ internal class Program
         var parallelClients = AnsiConsole.Prompt(new MultiSelectionPrompt<int>()
             .Title("How many parallel client runs do you want to run?")
             .AddChoices(1, 5, 10, 20));
+
+        var campaignName = AnsiConsole.Ask("Campaign name:", $"{timeSlot} {DateTime.Now:yyyy-MM-dd HH:mm}");
+        var campaignDescription = AnsiConsole.Prompt(new TextPrompt<string>("Campaign description (optional):").AllowEmpty());
+        var campaignID = Tester.CreateCampaign(campaignName, campaignDescription, local, [timeSlot], protocols,
+            parallelClients, p => GetRerunsForParallels(p, timeSlot));
         
         Console.Clear();
+        AnsiConsole.Write(new Markup("[bold blue]Campaign ID: " + campaignID + "[/]\n"));
 
         try
         {
@@ -62,7 +68,7 @@ internal class Program
                                                      " for " + parallelClient + " parallel clients...[/]\n"));
                         
                         var client = GetTestClient(protocol);
-                        Tester.Run(client, local, timeSlot, parallelClient);
+                        Tester.Run(client, local, timeSlot, parallelClient, campaignID, i + 1);
                     }
 
                     AnsiConsole.Write(new Markup("[bold green]Finished running " + parallelClient +
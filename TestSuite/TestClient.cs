@@ -19,9 +19,12 @@ public class TestClient(string protocol)
     /// <param name="local">Whether the run is local or not.</param>
     public void Run(int id, bool local)
     {
+        var startInfo = CreateRunProcess(id, local);
+        startInfo.Environment["COLLECTOR_API_KEY"] = Tester.GetClientApiKey();
+
         var process = new Process
         {
-            StartInfo = CreateRunProcess(id, local),
+            StartInfo = startInfo,
             EnableRaisingEvents = true,
         };
 
@@ -20,12 +20,16 @@ public static class Tester
 
     /// <summary>
     /// Runs the test client and waits for the client to finish.
+    /// If a campaign is given, all parallel clients are started as one batch of it.
     /// </summary>
-    public static void Run(TestClient client, bool local, string timeSlot, int parallelClients = 1)
+    public static void Run(TestClient client, bool local, string timeSlot, int parallelClients = 1, long? campaignID = null, int sequence = 0)
     {
         var tasks = new List<Task>();
         var errors = new List<string>();
         var env = local ? EnvironmentLocal : EnvironmentRemote;
+        long? batchID = campaignID.HasValue
+            ? CreateBatch(campaignID.Value, client.Protocol, env, timeSlot, parallelClients, sequence)
+            : null;
         
         for (var i = 0; i < parallelClients; i++)
         {
@@ -35,7 +39,7 @@ public static class Tester
                 try
                 {
                     Console.WriteLine("Running client [#{0}] {1}...", cid, client.Protocol);
-                    var runID = GetRunID(client.Protocol, env, timeSlot, cid, parallelClients);
+                    var runID = GetRunID(client.Protocol, env, timeSlot, cid, parallelClients, campaignID, batchID);
                     Console.WriteLine("[#{0}] Run ID: {1}", cid, runID);
                     client.Run(runID, local);
                     Console.WriteLine("[#{0}.{1}] Finished running client {2}", cid, runID, client.Protocol);
@@ -69,11 +73,99 @@ public static class Tester
     #region Collector
     
     private static readonly RestClient RestClient = new("https://thkm25_collect.nauri.io");
+
+    /// <summary>
+    /// Returns the collector key of the runner from COLLECTOR_API_KEY. It needs the begin-run scope.
+    /// </summary>
+    private static string GetApiKey()
+    {
+        return Environment.GetEnvironmentVariable("COLLECTOR_API_KEY")
+               ?? throw new InvalidOperationException("No collector API key, set COLLECTOR_API_KEY");
+    }
+
+    /// <summary>
+    /// Returns the collector key the clients report with from COLLECTOR_CLIENT_API_KEY.
+    /// It needs the write-client-metrics scope.
+    /// </summary>
+    public static string GetClientApiKey()
+    {
+        return Environment.GetEnvironmentVariable("COLLECTOR_CLIENT_API_KEY")
+               ?? throw new InvalidOperationException("No collector API key for the clients, set COLLECTOR_CLIENT_API_KEY");
+    }
     
-    private static int GetRunID(string protocol, string env, string timeSlot, int clientID, int parallelClients = 1)
+    /// <summary>
+    /// Creates a new campaign in the collector and returns its ID.
+    /// </summary>
+    public static long CreateCampaign(string name, string description, bool local, string[] timeSlots, IEnumerable<string> protocols, IEnumerable<int> parallelClients, Func<int, int> reruns)
+    {
+        var payload = new FileInfo(GetPayloadFile());
+        string payloadHash;
+        using (var stream = payload.OpenRead())
+        {
+            payloadHash = Convert.ToHexString(System.Security.Cryptography.SHA256.HashData(stream)).ToLowerInvariant();
+        }
+
+        var parallels = parallelClients.ToArray();
+        
+        var request = new RestRequest("/campaigns");
+        request.AddHeader("X-API-Key", GetApiKey());
+        request.AddHeader("X-Collector-Host", Environment.MachineName);
+        request.AddHeader("Content-Type", "application/json");
+        request.AddJsonBody(new
+        {
+            Name = name,
+            Description = description,
+            StartedBy = Environment.UserName,
+            PayloadFileHash = payloadHash,
+            PayloadFileSize = payload.Length,
+            PlannedMatrix = new
+            {
+                Protocols = protocols.ToArray(),
+                Enviroments = new[] { local ? EnvironmentLocal : EnvironmentRemote },
+                TimeSlots = timeSlots,
+                ParallelClients = parallels,
+                Reruns = parallels.ToDictionary(p => p.ToString(), reruns)
+            }
+        });
+        
+        var response = RestClient.Post<CreatedEntity>(request);
+        if (response == null || response.ID == 0)
+        {
+            throw new Exception("Failed to create campaign");
+        }
+        
+        return response.ID;
+    }
+    
+    private static long CreateBatch(long campaignID, string protocol, string env, string timeSlot, int parallelClients, int sequence)
+    {
+        var request = new RestRequest($"/campaigns/{campaignID}/batches");
+        request.AddHeader("X-API-Key", GetApiKey());
+        request.AddHeader("X-Collector-Host", Environment.MachineName);
+        request.AddHeader("Content-Type", "application/json");
+        request.AddJsonBody(new
+        {
+            Protocol = protocol,
+            Enviroment = env,
+            TimeSlot = timeSlot,
+            ParallelClients = parallelClients,
+            Sequence = sequence
+        });
+        
+        var response = RestClient.Post<CreatedEntity>(request);
+        if (response == null || response.ID == 0)
+        {
+            throw new Exception("Failed to create batch");
+        }
+        
+        return response.ID;
+    }
+    
+    private static int GetRunID(string protocol, string env, string timeSlot, int clientID, int parallelClients = 1, long? campaignID = null, long? batchID = null)
     {
         var request = new RestRequest("/begin");
-        request.AddHeader("X-API-Key", "thk_masterthesis_2025_hwtwswrtc");
+        request.AddHeader("X-API-Key", GetApiKey());
+        request.AddHeader("X-Collector-Host", Environment.MachineName);
         request.AddHeader("Content-Type", "application/json");
         request.AddJsonBody(new
         {
@@ -81,7 +173,9 @@ public static class Tester
             Enviroment = env,
             TimeSlot = timeSlot,
             ClientID = clientID,
-            ParallelClients = parallelClients
+            ParallelClients = parallelClients,
+            CampaignID = campaignID,
+            BatchID = batchID
         });
         
         var response = RestClient.Post(request);
@@ -103,6 +197,16 @@ public static class Tester
         
         return id;
     }
+    
+    private static string GetPayloadFile()
+    {
+        return Path.Combine(Environment.CurrentDirectory, "..", "..", "..", "..", "assets", "sample_video.mp4");
+    }
+    
+    private class CreatedEntity
+    {
+        public long ID { get; set; }
+    }
 
     #endregion
     
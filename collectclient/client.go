@@ -0,0 +1,565 @@
+// Package collectclient delivers run metrics and resource samples to the
+// collector. Every request is written to an on-disk queue first and sent by a
+// background sender that retries with backoff, so neither a collector outage
+// nor a process exiting early loses measurements: whatever is left in the
+// queue is sent by the next process using the same queue directory.
+package collectclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultEndpoint = "https://thkm25_collect.nauri.io"
+
+	SideClient = "client"
+	SideServer = "server"
+)
+
+type Config struct {
+	Endpoint     string        // base URL of the collector
+	APIKey       string        // sent as X-API-KEY, needs the write scope of Side
+	Side         string        // sent as X-Collector-Side, SideClient or SideServer
+	Host         string        // sent as X-Collector-Host, the collector logs it with every write, defaults to the hostname
+	QueueDir     string        // directory of the write-ahead queue, defaults to collector-queue-<Side> in the temp dir, may be shared between processes
+	MinBackoff   time.Duration // delay before the first retry, doubled on every failed attempt
+	MaxBackoff   time.Duration
+	MaxBatch     int           // maximum number of queued entries merged into one request
+	FlushTimeout time.Duration // how long Close waits for the queue to drain
+	HTTPClient   *http.Client
+}
+
+// ConfigFromEnv reads COLLECTOR_URL, COLLECTOR_API_KEY, COLLECTOR_QUEUE_DIR
+// and COLLECTOR_FLUSH_TIMEOUT. Unset values fall back to the defaults, except
+// for the key, which is required.
+func ConfigFromEnv(side string) Config {
+	cfg := Config{
+		Endpoint: os.Getenv("COLLECTOR_URL"),
+		APIKey:   os.Getenv("COLLECTOR_API_KEY"),
+		Side:     side,
+		QueueDir: os.Getenv("COLLECTOR_QUEUE_DIR"),
+	}
+	if v, err := time.ParseDuration(os.Getenv("COLLECTOR_FLUSH_TIMEOUT")); err == nil {
+		cfg.FlushTimeout = v
+	}
+	return cfg
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = DefaultEndpoint
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.Host == "" {
+		cfg.Host, _ = os.Hostname()
+	}
+	if cfg.QueueDir == "" {
+		cfg.QueueDir = filepath.Join(os.TempDir(), "collector-queue-"+cfg.Side)
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = 50
+	}
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = 15 * time.Second
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return cfg
+}
+
+// errRetry marks a failed delivery that is worth retrying: network errors,
+// 5xx, 408, 429 and a rejected key. Every other rejection, e.g. a 400 or 422
+// for invalid metrics, is final.
+var errRetry = errors.New("collector unavailable")
+
+// errKeyRejected marks a 401 or 403. The key or its scopes are wrong, not the
+// entries, so they stay queued until a process with a valid key sends them.
+var errKeyRejected = errors.New("API key rejected")
+
+type Client struct {
+	cfg   Config
+	queue *queue
+
+	wake      chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	flushMu sync.Mutex // one flush pass at a time
+	backoff time.Duration
+}
+
+// New opens the queue and starts the background sender. Entries left over by
+// earlier processes are sent right away.
+func New(cfg Config) (*Client, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("no collector API key, set COLLECTOR_API_KEY")
+	}
+	cfg = cfg.withDefaults()
+
+	q, err := openQueue(cfg.QueueDir, 2*cfg.HTTPClient.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("open collector queue: %w", err)
+	}
+
+	c := &Client{
+		cfg:     cfg,
+		queue:   q,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.run()
+	c.notify()
+
+	return c, nil
+}
+
+// MustNew is New for package level variables, it exits if there is no API
+// key or the queue cannot be opened.
+func MustNew(cfg Config) *Client {
+	c, err := New(cfg)
+	if err != nil {
+		log.Fatalf("[COLLECTOR] %v", err)
+	}
+	return c
+}
+
+// Metrics queues a partial update of a run, see PUT /:id/update. Keys with a
+// namespace, e.g. "quic.handshake_rtt_ms", are stored as custom metrics
+// (numbers) or labels (strings).
+func (c *Client) Metrics(runID int, data map[string]any) {
+	c.enqueue("PUT", fmt.Sprintf("/%d/update", runID), kindMetrics, data)
+}
+
+// States of a run reported with State, see state.go of the collector. Runs
+// start as created and are ended with "@end" or Fail.
+const (
+	StateConnecting   = "connecting"
+	StateTransferring = "transferring"
+)
+
+// State queues a move of the run to another state. Clients report
+// StateConnecting before they dial, the Sampler reports StateTransferring at
+// the first transferred byte.
+func (c *Client) State(runID int, state string) {
+	c.Metrics(runID, map[string]any{"@state": state})
+}
+
+// Samples queues resource samples of a run, see POST /:id/samples.
+func (c *Client) Samples(runID int, samples any) {
+	c.enqueue("POST", fmt.Sprintf("/%d/samples", runID), kindSamples, map[string]any{"Samples": samples})
+}
+
+func (c *Client) enqueue(method, path, kind string, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("[COLLECTOR] Error marshalling data: %v", err)
+		return
+	}
+
+	if _, err := c.queue.push(entry{Method: method, Path: path, Side: c.cfg.Side, Kind: kind, Body: data}); err != nil {
+		// without the queue the data can at least be sent directly
+		log.Printf("[COLLECTOR] Error queueing request, sending it directly: %v", err)
+		if err := c.send(entry{Method: method, Path: path, Side: c.cfg.Side, Kind: kind, Body: data}); err != nil {
+			log.Printf("[COLLECTOR] Error sending request: %v", err)
+		}
+		return
+	}
+
+	c.notify()
+}
+
+func (c *Client) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) run() {
+	defer close(c.stopped)
+
+	for {
+		delay := 5 * time.Second // pick up entries other processes left behind
+		if err := c.flush(); err != nil {
+			delay = c.backoff
+			if errors.Is(err, errKeyRejected) {
+				log.Printf("[COLLECTOR] WARNING: the collector rejects the API key of the %s side, check COLLECTOR_API_KEY. Nothing is delivered until it is accepted, the entries stay queued in %s", c.cfg.Side, c.cfg.QueueDir)
+			}
+			log.Printf("[COLLECTOR] %v, retrying in %s", err, delay.Round(time.Millisecond))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.wake:
+		case <-timer.C:
+		case <-c.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// flush makes one pass over the queue. It stops at the first delivery that
+// should be retried and returns its error. Entries of the other side are left
+// for a process of that side sharing the queue, the key of this one may not
+// write them.
+func (c *Client) flush() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	names, err := c.queue.pending()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(names); {
+		groups := []group{}
+		for claimed := 0; i < len(names) && claimed < c.cfg.MaxBatch; i++ {
+			e, err := c.queue.claim(names[i])
+			if err != nil {
+				continue
+			}
+			if e.Side != c.cfg.Side {
+				c.queue.release(names[i])
+				continue
+			}
+			claimed++
+
+			if n := len(groups); n > 0 {
+				if merged, ok := merge(groups[n-1].entry, e); ok {
+					groups[n-1].entry = merged
+					groups[n-1].names = append(groups[n-1].names, names[i])
+					continue
+				}
+			}
+			groups = append(groups, group{entry: e, names: []string{names[i]}})
+		}
+
+		if err := c.deliver(groups); err != nil {
+			c.backoff = min(max(c.backoff*2, c.cfg.MinBackoff), c.cfg.MaxBackoff)
+			// jitter, so parallel clients do not retry in lockstep
+			c.backoff += time.Duration(rand.Int64N(int64(c.backoff)/5 + 1))
+			return err
+		}
+	}
+
+	c.backoff = 0
+	return nil
+}
+
+// group is one request made of one or more merged queue entries.
+type group struct {
+	entry entry
+	names []string
+}
+
+// deliver sends claimed groups. Metric updates of several runs go out as one
+// POST /batch, everything else one by one. Groups that should be retried are
+// released again and the error is returned.
+func (c *Client) deliver(groups []group) error {
+	results := make([]error, len(groups))
+	sent := make([]bool, len(groups))
+
+	metrics := []int{}
+	for i, g := range groups {
+		if g.entry.Kind == kindMetrics {
+			metrics = append(metrics, i)
+		}
+	}
+
+	if len(metrics) > 1 {
+		errs, err := c.sendBatch(groups, metrics)
+		if errors.Is(err, errRetry) {
+			for _, g := range groups {
+				c.queue.release(g.names...)
+			}
+			return err
+		}
+		// any other error means the collector has no /batch yet, so the
+		// updates are sent one by one below
+		if err == nil {
+			for k, i := range metrics {
+				results[i], sent[i] = errs[k], true
+			}
+		}
+	}
+
+	for i, g := range groups {
+		if !sent[i] {
+			results[i] = c.send(g.entry)
+		}
+		if errors.Is(results[i], errRetry) {
+			for j := i; j < len(groups); j++ {
+				if j > i && sent[j] && !errors.Is(results[j], errRetry) {
+					c.finish(groups[j], results[j])
+				} else {
+					c.queue.release(groups[j].names...)
+				}
+			}
+			return results[i]
+		}
+		c.finish(g, results[i])
+	}
+
+	return nil
+}
+
+// finish removes a delivered group from the queue, or buries it if the
+// collector rejected it.
+func (c *Client) finish(g group, err error) {
+	for _, name := range g.names {
+		if err != nil {
+			c.queue.bury(name)
+		} else {
+			c.queue.done(name)
+		}
+	}
+	if err != nil {
+		log.Printf("[COLLECTOR] %v, moved %d entries to %s", err, len(g.names), filepath.Join(c.cfg.QueueDir, deadDir))
+	} else {
+		log.Printf("[COLLECTOR] %s %s delivered (%d queued entries)", g.entry.Method, g.entry.Path, len(g.names))
+	}
+}
+
+// sendBatch sends the metric updates of the given groups as one POST /batch
+// and returns the outcome per group.
+func (c *Client) sendBatch(groups []group, indices []int) ([]error, error) {
+	type item struct {
+		RunID  int64
+		Fields json.RawMessage
+		Side   string
+	}
+
+	items := make([]item, len(indices))
+	for k, i := range indices {
+		e := groups[i].entry
+		if _, err := fmt.Sscanf(e.Path, "/%d/update", &items[k].RunID); err != nil {
+			return nil, fmt.Errorf("unexpected path %s: %w", e.Path, err)
+		}
+		items[k].Fields = e.Body
+		items[k].Side = e.Side
+	}
+
+	body, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do("POST", "/batch", c.cfg.Side, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := statusError(resp, "POST", "/batch"); err != nil {
+		return nil, err
+	}
+
+	result := struct {
+		Results []struct {
+			Status int             `json:"status"`
+			Error  string          `json:"error"`
+			Fields json.RawMessage `json:"fields"`
+		} `json:"results"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w: POST /batch: %v", errRetry, err)
+	}
+	if len(result.Results) != len(items) {
+		return nil, fmt.Errorf("%w: POST /batch: got %d results for %d updates", errRetry, len(result.Results), len(items))
+	}
+
+	errs := make([]error, len(items))
+	for k, r := range result.Results {
+		if r.Status >= 200 && r.Status < 300 {
+			continue
+		}
+		path := groups[indices[k]].entry.Path
+		errs[k] = retryError(r.Status, fmt.Errorf("PUT %s: %d %s %s", path, r.Status, r.Error, r.Fields))
+	}
+	return errs, nil
+}
+
+func (c *Client) send(e entry) error {
+	side := e.Side
+	if side == "" {
+		side = c.cfg.Side
+	}
+
+	resp, err := c.do(e.Method, e.Path, side, e.Body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return statusError(resp, e.Method, e.Path)
+}
+
+func (c *Client) do(method, path, side string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.cfg.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-API-KEY", c.cfg.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Collector-Side", side)
+	req.Header.Set("X-Collector-Host", c.cfg.Host)
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRetry, err)
+	}
+	return resp, nil
+}
+
+func statusError(resp *http.Response, method, path string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return retryError(resp.StatusCode, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(body)))
+}
+
+// retryError marks err with errRetry if a request answered with status should
+// be retried.
+func retryError(status int, err error) error {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return fmt.Errorf("%w: %w: %v", errRetry, errKeyRejected, err)
+	case status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %v", errRetry, err)
+	default:
+		return err
+	}
+}
+
+// Close stops the background sender and tries to deliver everything this
+// process queued within the flush timeout. Entries that could not be
+// delivered stay in the queue directory for the next process.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		<-c.stopped
+
+		deadline := time.Now().Add(c.cfg.FlushTimeout)
+		for {
+			owned, err := c.queue.owned()
+			if err != nil || !owned {
+				c.closeErr = err
+				return
+			}
+
+			delay := 100 * time.Millisecond // entries claimed by another process
+			err = c.flush()
+			if err != nil {
+				delay = c.backoff
+			}
+
+			if time.Now().Add(delay).After(deadline) {
+				c.closeErr = fmt.Errorf("collector not reachable, undelivered data stays queued in %s", c.cfg.QueueDir)
+				if errors.Is(err, errKeyRejected) {
+					c.closeErr = fmt.Errorf("%w by the collector, undelivered data stays queued in %s", errKeyRejected, c.cfg.QueueDir)
+				}
+				log.Printf("[COLLECTOR] %v", c.closeErr)
+				return
+			}
+			time.Sleep(delay)
+		}
+	})
+
+	return c.closeErr
+}
+
+// Fatalf logs like log.Fatalf, but flushes the queue before exiting.
+func (c *Client) Fatalf(format string, v ...any) {
+	log.Printf(format, v...)
+	c.Close()
+	os.Exit(1)
+}
+
+// FlushOnExit flushes the queue when the process is interrupted or
+// terminated before it exits.
+func (c *Client) FlushOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Printf("[COLLECTOR] Received %s, flushing queue", sig)
+		c.Close()
+		os.Exit(1)
+	}()
+}
+
+// merge combines two queued entries into one request if that does not change
+// their meaning: samples of the same run are concatenated, metric updates of
+// the same run are merged as long as the earlier one carries no control keys
+// like "@end" or "@state".
+func merge(a, b entry) (entry, bool) {
+	if a.Method != b.Method || a.Path != b.Path || a.Side != b.Side || a.Kind != b.Kind {
+		return a, false
+	}
+
+	var am, bm map[string]json.RawMessage
+	if json.Unmarshal(a.Body, &am) != nil || json.Unmarshal(b.Body, &bm) != nil {
+		return a, false
+	}
+
+	switch a.Kind {
+	case kindSamples:
+		var as, bs []json.RawMessage
+		if json.Unmarshal(am["Samples"], &as) != nil || json.Unmarshal(bm["Samples"], &bs) != nil {
+			return a, false
+		}
+		samples, err := json.Marshal(append(as, bs...))
+		if err != nil {
+			return a, false
+		}
+		am["Samples"] = samples
+	case kindMetrics:
+		for k := range am {
+			if strings.HasPrefix(k, "@") {
+				return a, false
+			}
+		}
+		for k, v := range bm {
+			am[k] = v
+		}
+	default:
+		return a, false
+	}
+
+	body, err := json.Marshal(am)
+	if err != nil {
+		return a, false
+	}
+	a.Body = body
+	return a, true
+}
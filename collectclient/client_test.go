@@ -0,0 +1,505 @@
+package collectclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeCollector records every accepted request and answers 503 while down,
+// or rejectKey if it is set.
+type fakeCollector struct {
+	down      atomic.Bool
+	rejectKey atomic.Int32
+
+	mu       sync.Mutex
+	metrics  map[string]map[string]any
+	samples  map[string]int
+	requests int
+	batches  int
+}
+
+func (f *fakeCollector) update(path string, data map[string]any) {
+	if f.metrics[path] == nil {
+		f.metrics[path] = map[string]any{}
+	}
+	for k, v := range data {
+		f.metrics[path][k] = v
+	}
+}
+
+func newFakeCollector(t *testing.T) (*fakeCollector, *httptest.Server) {
+	f := &fakeCollector{metrics: map[string]map[string]any{}, samples: map[string]int{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if status := f.rejectKey.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		if r.URL.Path == "/batch" {
+			items := []struct {
+				RunID  int
+				Fields map[string]any
+			}{}
+			if err := json.Unmarshal(body, &items); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.batches++
+			results := []map[string]any{}
+			for _, item := range items {
+				f.update(fmt.Sprintf("/%d/update", item.RunID), item.Fields)
+				results = append(results, map[string]any{"status": http.StatusNoContent})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"results": results})
+			return
+		}
+
+		data := map[string]any{}
+		if err := json.Unmarshal(body, &data); err != nil || r.Header.Get("X-Collector-Side") != SideClient {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.requests++
+		if samples, ok := data["Samples"].([]any); ok {
+			f.samples[r.URL.Path] += len(samples)
+		} else {
+			f.update(r.URL.Path, data)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func testConfig(endpoint, dir string) Config {
+	return Config{
+		Endpoint:     endpoint,
+		APIKey:       "thk_test",
+		Side:         SideClient,
+		QueueDir:     dir,
+		MinBackoff:   10 * time.Millisecond,
+		MaxBackoff:   50 * time.Millisecond,
+		FlushTimeout: 300 * time.Millisecond,
+	}
+}
+
+func queuedFiles(t *testing.T, dir string) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+entrySuffix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+// TestCollectorDownDuringRun queues a whole run while the collector is down,
+// lets the process exit and checks that the next process delivers all of it.
+func TestCollectorDownDuringRun(t *testing.T) {
+	f, srv := newFakeCollector(t)
+	dir := t.TempDir()
+	f.down.Store(true)
+
+	c, err := New(testConfig(srv.URL, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Metrics(7, map[string]any{"TransferStartUnix": 1})
+	c.Samples(7, []map[string]any{{"TimestampMs": 1}, {"TimestampMs": 2}})
+	c.Samples(7, []map[string]any{{"TimestampMs": 3}})
+	c.Metrics(7, map[string]any{"ConnectionDuration": 5})
+	c.Metrics(7, map[string]any{"@end": true, "TransferEndUnix": 9})
+
+	if err := c.Close(); err == nil {
+		t.Fatal("Close succeeded while the collector was down")
+	}
+	if n := queuedFiles(t, dir); n != 5 {
+		t.Fatalf("%d entries queued after exit, want 5", n)
+	}
+
+	f.down.Store(false)
+
+	c, err = New(testConfig(srv.URL, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for queuedFiles(t, dir) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	got := f.metrics["/7/update"]
+	for _, k := range []string{"TransferStartUnix", "ConnectionDuration", "TransferEndUnix", "@end"} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("metric %s was lost, got %v", k, got)
+		}
+	}
+	if n := f.samples["/7/samples"]; n != 3 {
+		t.Errorf("%d samples delivered, want 3", n)
+	}
+	if n := queuedFiles(t, dir); n != 0 {
+		t.Errorf("%d entries still queued", n)
+	}
+}
+
+// TestRetryUntilCollectorIsBack checks that a short outage is bridged by the
+// retries of the running process.
+func TestRetryUntilCollectorIsBack(t *testing.T) {
+	f, srv := newFakeCollector(t)
+	f.down.Store(true)
+
+	cfg := testConfig(srv.URL, t.TempDir())
+	cfg.FlushTimeout = 5 * time.Second
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Metrics(3, map[string]any{"BytesPayload": 42})
+	time.AfterFunc(200*time.Millisecond, func() { f.down.Store(false) })
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.metrics["/3/update"]["BytesPayload"] != float64(42) {
+		t.Errorf("metrics not delivered: %v", f.metrics)
+	}
+}
+
+// TestBatchAcrossRuns checks that updates of several runs are sent as one
+// POST /batch. They are queued by an earlier process, so the first pass of
+// the next one finds all of them.
+func TestBatchAcrossRuns(t *testing.T) {
+	f, srv := newFakeCollector(t)
+	f.down.Store(true)
+
+	cfg := testConfig(srv.URL, t.TempDir())
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for run := 1; run <= 20; run++ {
+		c.Metrics(run, map[string]any{"@end": true, "TransferEndUnix": run})
+	}
+	c.Close()
+	f.down.Store(false)
+
+	cfg.FlushTimeout = 5 * time.Second
+	c, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.metrics) != 20 {
+		t.Errorf("updates of %d runs delivered, want 20", len(f.metrics))
+	}
+	if f.batches == 0 || f.requests > 0 {
+		t.Errorf("%d batches and %d single requests sent, want batches only", f.batches, f.requests)
+	}
+}
+
+func TestRejectedEntriesAreNotRetried(t *testing.T) {
+	_, srv := newFakeCollector(t)
+	dir := t.TempDir()
+
+	cfg := testConfig(srv.URL, dir)
+	cfg.Side = SideServer // rejected by the fake collector
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Metrics(1, map[string]any{"BytesPayload": 1})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dead, err := os.ReadDir(filepath.Join(dir, deadDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || queuedFiles(t, dir) != 0 {
+		t.Errorf("want the rejected entry in %s only, got %d dead and %d queued", deadDir, len(dead), queuedFiles(t, dir))
+	}
+}
+
+// TestRejectedKeyStaysQueued checks that entries the collector refused for
+// the key are not buried but sent once the key is accepted.
+func TestRejectedKeyStaysQueued(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			f, srv := newFakeCollector(t)
+			f.rejectKey.Store(int32(status))
+			dir := t.TempDir()
+
+			cfg := testConfig(srv.URL, dir)
+			c, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Metrics(1, map[string]any{"BytesPayload": 1})
+			if err := c.Close(); !errors.Is(err, errKeyRejected) {
+				t.Errorf("close: %v, want the rejected key", err)
+			}
+
+			if dead, _ := os.ReadDir(filepath.Join(dir, deadDir)); len(dead) > 0 || queuedFiles(t, dir) != 1 {
+				t.Fatalf("%d entries dead and %d queued, want 1 queued", len(dead), queuedFiles(t, dir))
+			}
+
+			f.rejectKey.Store(0)
+			cfg.FlushTimeout = 5 * time.Second
+			c, err = New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.metrics["/1/update"]["BytesPayload"] != float64(1) || queuedFiles(t, dir) != 0 {
+				t.Errorf("metrics %v delivered, %d entries queued", f.metrics, queuedFiles(t, dir))
+			}
+		})
+	}
+}
+
+// TestSharedQueueDir runs a client and a server on one queue directory, each
+// with a key that may only write its own side. Every entry has to be sent by
+// the process of its side.
+func TestSharedQueueDir(t *testing.T) {
+	keys := map[string]string{"thk_client": SideClient, "thk_server": SideServer}
+
+	var down atomic.Bool
+	var mu sync.Mutex
+	delivered := map[string]int{}
+	forbidden := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		side := r.Header.Get("X-Collector-Side")
+		if keys[r.Header.Get("X-API-KEY")] != side {
+			forbidden++
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path != "/batch" {
+			delivered[side]++
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		items := []map[string]any{}
+		json.NewDecoder(r.Body).Decode(&items)
+		results := []map[string]any{}
+		for range items {
+			delivered[side]++
+			results = append(results, map[string]any{"status": http.StatusNoContent})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"results": results})
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	down.Store(true)
+
+	clients := []*Client{}
+	for key, side := range keys {
+		cfg := testConfig(srv.URL, dir)
+		cfg.APIKey = key
+		cfg.Side = side
+		cfg.FlushTimeout = 5 * time.Second
+		c, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for run := 1; run <= 5; run++ {
+			c.Metrics(run, map[string]any{"@end": true})
+		}
+		clients = append(clients, c)
+	}
+	down.Store(false)
+
+	for _, c := range clients {
+		if err := c.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if forbidden > 0 {
+		t.Errorf("%d requests sent with the key of the other side", forbidden)
+	}
+	if delivered[SideClient] != 5 || delivered[SideServer] != 5 {
+		t.Errorf("delivered %v, want 5 updates per side", delivered)
+	}
+	if dead, _ := os.ReadDir(filepath.Join(dir, deadDir)); len(dead) > 0 || queuedFiles(t, dir) > 0 {
+		t.Errorf("%d entries dead and %d queued, want none", len(dead), queuedFiles(t, dir))
+	}
+}
+
+func TestDefaultQueueDirPerSide(t *testing.T) {
+	client := Config{Side: SideClient}.withDefaults()
+	server := Config{Side: SideServer}.withDefaults()
+	if client.QueueDir == server.QueueDir {
+		t.Errorf("client and server default to the same queue %s", client.QueueDir)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := entry{Method: "PUT", Path: "/1/update", Kind: kindMetrics, Body: json.RawMessage(`{"A":1}`)}
+	b := entry{Method: "PUT", Path: "/1/update", Kind: kindMetrics, Body: json.RawMessage(`{"B":2,"@end":true}`)}
+
+	merged, ok := merge(a, b)
+	if !ok || string(merged.Body) != `{"@end":true,"A":1,"B":2}` {
+		t.Fatalf("merge = %s, %v", merged.Body, ok)
+	}
+
+	// nothing may follow a control key
+	if _, ok := merge(b, a); ok {
+		t.Error("merged into an update carrying @end")
+	}
+
+	other := b
+	other.Path = "/2/update"
+	if _, ok := merge(a, other); ok {
+		t.Error("merged updates of different runs")
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	_, dialErr := net.Dial("tcp", "127.0.0.1:1")
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{io.ErrUnexpectedEOF, CodeEOF},
+		{fmt.Errorf("read: %w", io.EOF), CodeEOF},
+		{context.Canceled, CodeCanceled},
+		{os.ErrDeadlineExceeded, CodeTimeout},
+		{dialErr, CodeConnectionRefused},
+		{&net.DNSError{Err: "no such host", Name: "invalid"}, CodeDNS},
+		{net.ErrClosed, CodeConnectionClosed},
+		{fmt.Errorf("something else"), CodeUnknown},
+	}
+	for _, tt := range tests {
+		if got := ClassifyError(tt.err); got != tt.want {
+			t.Errorf("ClassifyError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestFailProtocolCodeAbove2To53 checks that a QUIC error code a JSON number
+// cannot hold exactly reaches the collector unchanged.
+func TestFailProtocolCodeAbove2To53(t *testing.T) {
+	f, srv := newFakeCollector(t)
+	c, err := New(testConfig(srv.URL, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const code = 1<<62 - 1
+	c.Fail(5, NewFailure(PhaseRead, io.ErrUnexpectedEOF).WithProtocolCode(CodeApplicationError, KindQUICApplication, code))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	got := f.metrics["/5/update"]
+	if got["ErrorProtocolCode"] != "4611686018427387903" || got["ErrorProtocolCodeKind"] != KindQUICApplication {
+		t.Errorf("got %v, want the code %d as string", got, uint64(code))
+	}
+}
+
+// TestSamplerStreamsSamples checks that samples reach the collector while the
+// transfer runs, not only after Stop, and that the first transferred byte
+// moves the run to transferring.
+func TestSamplerStreamsSamples(t *testing.T) {
+	interval := sampleInterval
+	sampleInterval = 10 * time.Millisecond
+	t.Cleanup(func() { sampleInterval = interval })
+
+	f, srv := newFakeCollector(t)
+	c, err := New(testConfig(srv.URL, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.samples["/7/samples"]
+	}
+
+	sampler := c.StartSampler(7)
+	sampler.Add(0)
+	sampler.Add(100)
+	sampler.Add(100)
+	deadline := time.Now().Add(5 * time.Second)
+	for delivered() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := delivered(); n < 3 {
+		t.Fatalf("%d samples delivered during the transfer, want at least 3", n)
+	}
+
+	during := delivered()
+	sampler.Stop()
+	sampler.Stop()
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := delivered(); n <= during {
+		t.Errorf("%d samples delivered after Stop, want the last one on top of %d", n, during)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if state := f.metrics["/7/update"]["@state"]; state != StateTransferring {
+		t.Errorf("run reported as %v, want %s", state, StateTransferring)
+	}
+}
@@ -0,0 +1,163 @@
+package collectclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Phases of a run an error can occur in.
+const (
+	PhaseDial       = "dial"
+	PhaseHandshake  = "handshake"
+	PhaseUpgrade    = "upgrade"
+	PhaseStreamOpen = "stream-open"
+	PhaseRead       = "read"
+	PhaseWrite      = "write"
+	PhaseCollect    = "collect"
+)
+
+// Stable error codes, see errors.go of the collector for the full list.
+const (
+	CodeEOF               = "eof"
+	CodeTimeout           = "timeout"
+	CodeIdleTimeout       = "idle_timeout"
+	CodeHandshakeTimeout  = "handshake_timeout"
+	CodeConnectionRefused = "connection_refused"
+	CodeConnectionReset   = "connection_reset"
+	CodeConnectionClosed  = "connection_closed"
+	CodeTLS               = "tls"
+	CodeDNS               = "dns"
+	CodeCanceled          = "canceled"
+	CodeApplicationError  = "application_error"
+	CodeTransportError    = "transport_error"
+	CodeStreamReset       = "stream_reset"
+	CodeSessionClosed     = "session_closed"
+	CodeWebSocketClose    = "websocket_close"
+	CodeHTTPStatus        = "http_status"
+	CodeUnknown           = "unknown"
+)
+
+// Kinds of protocol error codes.
+const (
+	KindQUICApplication     = "quic_application"
+	KindQUICTransport       = "quic_transport"
+	KindHTTP3               = "http3"
+	KindWebTransportSession = "webtransport_session"
+	KindWebTransportStream  = "webtransport_stream"
+	KindWebSocketClose      = "websocket_close"
+	KindHTTPStatus          = "http_status"
+)
+
+// Failure is the structured error of a run: the phase it occurred in, a
+// stable code, the error code of the protocol if there is one and the raw
+// message.
+type Failure struct {
+	Phase            string
+	Code             string
+	ProtocolCode     *uint64
+	ProtocolCodeKind string
+	Message          string
+}
+
+// NewFailure classifies err with ClassifyError. Protocol specific errors are
+// added by the caller with WithProtocolCode.
+func NewFailure(phase string, err error) Failure {
+	return Failure{Phase: phase, Code: ClassifyError(err), Message: err.Error()}
+}
+
+// WithProtocolCode sets the protocol error code and the stable code it maps to.
+func (f Failure) WithProtocolCode(code string, kind string, protocolCode uint64) Failure {
+	f.Code = code
+	f.ProtocolCodeKind = kind
+	f.ProtocolCode = &protocolCode
+	return f
+}
+
+// DialOrHandshake sets the phase of a failure of a call that dials and
+// handshakes at once, like an HTTP request or a WebTransport dial: handshake
+// for TLS errors and handshake timeouts, dial otherwise.
+func (f Failure) DialOrHandshake() Failure {
+	f.Phase = PhaseDial
+	if f.Code == CodeTLS || f.Code == CodeHandshakeTimeout {
+		f.Phase = PhaseHandshake
+	}
+	return f
+}
+
+// Fields returns the failure as run metrics. The protocol code is sent as
+// string, since QUIC codes go up to 2^62 and JSON numbers only hold integers
+// up to 2^53 exactly.
+func (f Failure) Fields() map[string]any {
+	fields := map[string]any{
+		"Error":      f.Message,
+		"ErrorPhase": f.Phase,
+		"ErrorCode":  f.Code,
+	}
+	if f.ProtocolCode != nil {
+		fields["ErrorProtocolCode"] = strconv.FormatUint(*f.ProtocolCode, 10)
+		fields["ErrorProtocolCodeKind"] = f.ProtocolCodeKind
+	}
+	return fields
+}
+
+// Fail queues the failure of a run. Clients end the run with it, servers only
+// report it, since the client decides when a run is over.
+func (c *Client) Fail(runID int, f Failure) {
+	fields := f.Fields()
+	if c.cfg.Side != SideServer {
+		fields["@end"] = true
+	}
+	c.Metrics(runID, fields)
+}
+
+// Windows socket errors, which syscall.ECONNRESET and syscall.ECONNREFUSED do
+// not match on Windows.
+const (
+	wsaECONNRESET   syscall.Errno = 10054
+	wsaECONNREFUSED syscall.Errno = 10061
+)
+
+// ClassifyError maps errors of the standard library to a stable code.
+// Everything it does not know is CodeUnknown.
+func ClassifyError(err error) string {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return CodeEOF
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return CodeTimeout
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, wsaECONNREFUSED):
+		return CodeConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, wsaECONNRESET):
+		return CodeConnectionReset
+	case errors.Is(err, net.ErrClosed), errors.Is(err, syscall.EPIPE):
+		return CodeConnectionClosed
+	case errors.As(err, &dnsErr):
+		return CodeDNS
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &certErr),
+		errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		return CodeTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return CodeTimeout
+	default:
+		return CodeUnknown
+	}
+}
@@ -0,0 +1,183 @@
+package collectclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	entrySuffix = ".json"
+	claimSuffix = ".claim"
+	deadDir     = "dead"
+)
+
+// entry is one request waiting in the queue.
+type entry struct {
+	Method string
+	Path   string
+	Side   string
+	Kind   string // kindMetrics or kindSamples, used for batching
+	Body   json.RawMessage
+}
+
+const (
+	kindMetrics = "metrics"
+	kindSamples = "samples"
+)
+
+// queue is a write-ahead queue on disk. Every entry is a file, written before
+// the request is sent and removed once the collector accepted it, so nothing
+// is lost when the process exits early. Several processes may share one
+// directory: an entry is claimed by renaming it before it is sent.
+type queue struct {
+	dir   string
+	token string // identifies the entries written by this process
+	seq   atomic.Int64
+}
+
+func openQueue(dir string, staleClaimAge time.Duration) (*queue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, deadDir), 0o755); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	q := &queue{dir: dir, token: hex.EncodeToString(b)}
+	q.releaseStaleClaims(staleClaimAge)
+	return q, nil
+}
+
+// push writes an entry to disk and returns its file name.
+func (q *queue) push(e entry) (string, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	// names sort in the order entries were written
+	name := fmt.Sprintf("%020d-%s-%06d%s", time.Now().UnixNano(), q.token, q.seq.Add(1), entrySuffix)
+	tmp := filepath.Join(q.dir, "."+name+".tmp")
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return name, os.Rename(tmp, filepath.Join(q.dir, name))
+}
+
+// pending lists the unclaimed entries in the order they were written.
+func (q *queue) pending() ([]string, error) {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), entrySuffix) && !strings.HasPrefix(f.Name(), ".") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// owned reports whether entries written by this process are still queued,
+// claimed or not.
+func (q *queue) owned() (bool, error) {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range files {
+		if strings.Contains(f.Name(), "-"+q.token+"-") && !strings.HasPrefix(f.Name(), ".") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// claim takes an entry for sending. It fails if another process was faster.
+func (q *queue) claim(name string) (entry, error) {
+	path := filepath.Join(q.dir, name)
+	if err := os.Rename(path, path+claimSuffix); err != nil {
+		return entry{}, err
+	}
+	now := time.Now()
+	os.Chtimes(path+claimSuffix, now, now)
+
+	e := entry{}
+	data, err := os.ReadFile(path + claimSuffix)
+	if err == nil {
+		err = json.Unmarshal(data, &e)
+	}
+	if err != nil {
+		q.bury(name)
+		return entry{}, fmt.Errorf("corrupt queue entry %s: %w", name, err)
+	}
+	return e, nil
+}
+
+// release puts claimed entries back for a later attempt.
+func (q *queue) release(names ...string) {
+	for _, name := range names {
+		path := filepath.Join(q.dir, name)
+		os.Rename(path+claimSuffix, path)
+	}
+}
+
+// done removes a claimed entry after it was delivered.
+func (q *queue) done(name string) {
+	os.Remove(filepath.Join(q.dir, name+claimSuffix))
+}
+
+// bury moves a claimed entry the collector rejected to the dead letter
+// directory, so it can be inspected instead of being retried forever.
+func (q *queue) bury(name string) {
+	os.Rename(filepath.Join(q.dir, name+claimSuffix), filepath.Join(q.dir, deadDir, name))
+}
+
+// releaseStaleClaims returns entries claimed by processes that exited before
+// delivering them.
+func (q *queue) releaseStaleClaims(age time.Duration) {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), entrySuffix+claimSuffix) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil || time.Since(info.ModTime()) < age {
+			continue
+		}
+		q.release(strings.TrimSuffix(f.Name(), claimSuffix))
+	}
+}
@@ -0,0 +1,182 @@
+package collectclient
+
+import (
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/shirou/gopsutil/v4/mem"
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// Sample is one resource measurement sent to the collector's /:id/samples.
+type Sample struct {
+	TimestampMs      int64
+	CpuPercent       float64
+	RamUsedBytes     uint64
+	RssBytes         uint64
+	BytesTransferred int64
+}
+
+// sampleInterval can be set with the SAMPLE_INTERVAL_MS environment variable.
+var sampleInterval = func() time.Duration {
+	v := os.Getenv("SAMPLE_INTERVAL_MS")
+	if v == "" {
+		return 250 * time.Millisecond
+	}
+
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms <= 0 {
+		log.Fatalf("Invalid SAMPLE_INTERVAL_MS: %q", v)
+	}
+	return time.Duration(ms) * time.Millisecond
+}()
+
+// processCpu are the CPU times of the latest sample the process took. A new
+// sampler starts from them, so its first sample covers the time before its
+// transfer without waiting for an interval.
+var processCpu struct {
+	sync.Mutex
+	busy, total float64
+}
+
+func init() {
+	processCpu.busy, processCpu.total = getCpuTimes()
+}
+
+// Sampler takes a sample every sampleInterval while a transfer is running and
+// queues each one with Client.Samples right away, so a crash loses at most the
+// running interval. The first sample covers the time before the transfer, the
+// last one the interval after it. Bytes written through Writer are counted as
+// transferred, the first of them moves the run to StateTransferring.
+type Sampler struct {
+	client      *Client
+	runID       int
+	proc        *process.Process
+	transferred atomic.Int64
+	started     atomic.Bool
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        sync.WaitGroup
+
+	// CPU times of the previous sample, every sampler keeps its own so
+	// concurrent transfers do not skew each other's percentages
+	busy, total float64
+}
+
+// StartSampler takes the first sample of the run right away and keeps sampling
+// until Stop.
+func (c *Client) StartSampler(runID int) *Sampler {
+	s := &Sampler{client: c, runID: runID, stop: make(chan struct{})}
+	s.proc, _ = process.NewProcess(int32(os.Getpid()))
+
+	processCpu.Lock()
+	s.busy, s.total = processCpu.busy, processCpu.total
+	processCpu.Unlock()
+	s.sample()
+
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.sample()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Stop ends the sampling with a last sample one interval later. Calling it
+// again does nothing.
+func (s *Sampler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.done.Wait()
+
+		time.Sleep(sampleInterval)
+		s.sample()
+	})
+}
+
+// Add counts n more transferred bytes.
+func (s *Sampler) Add(n int) {
+	s.transferred.Add(int64(n))
+	if n > 0 && s.started.CompareAndSwap(false, true) {
+		s.client.State(s.runID, StateTransferring)
+	}
+}
+
+// Writer counts all bytes written to w as transferred.
+func (s *Sampler) Writer(w io.Writer) io.Writer {
+	return countingWriter{w, s}
+}
+
+func (s *Sampler) sample() {
+	busy, total := getCpuTimes()
+	cpuPercent := 0.0
+	if total > s.total {
+		cpuPercent = min(max((busy-s.busy)/(total-s.total)*100, 0), 100)
+	}
+	s.busy, s.total = busy, total
+
+	processCpu.Lock()
+	processCpu.busy, processCpu.total = busy, total
+	processCpu.Unlock()
+
+	sample := Sample{
+		TimestampMs:      time.Now().UnixMilli(),
+		CpuPercent:       cpuPercent,
+		RamUsedBytes:     getRamUsageBytes(),
+		BytesTransferred: s.transferred.Load(),
+	}
+	if s.proc != nil {
+		if info, err := s.proc.MemoryInfo(); err == nil {
+			sample.RssBytes = info.RSS
+		}
+	}
+
+	s.client.Samples(s.runID, []Sample{sample})
+}
+
+func getCpuTimes() (float64, float64) {
+	times, err := cpu.Times(false)
+	if err != nil || len(times) == 0 {
+		return 0, 0
+	}
+	t := times[0]
+	total := t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+	return total - t.Idle - t.Iowait, total
+}
+
+func getRamUsageBytes() uint64 {
+	vmStat, err := mem.VirtualMemory()
+	if err != nil {
+		return 0
+	}
+	return vmStat.Used
+}
+
+type countingWriter struct {
+	w       io.Writer
+	sampler *Sampler
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.sampler.Add(n)
+	return n, err
+}
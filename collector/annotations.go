@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RunExclusion takes a run out of exports, statistics and the dashboard
+// until the exclusion is undone. RunFilter leaves excluded runs out unless
+// IncludeExcluded is set.
+type RunExclusion struct {
+	RunID     int64  `gorm:"primaryKey;autoIncrement:false"`
+	BatchID   *int64 `gorm:"index"` // set if the run was excluded with its whole batch
+	Reason    string
+	Author    string
+	CreatedAt time.Time
+}
+
+type AnnotationAction string
+
+const (
+	AnnotationExclude AnnotationAction = "exclude"
+	AnnotationInclude AnnotationAction = "include" // an exclusion was undone
+	AnnotationNote    AnnotationAction = "note"
+)
+
+var annotationActions = []AnnotationAction{AnnotationExclude, AnnotationInclude, AnnotationNote}
+
+// RunAnnotation is one entry of the audit trail of exclusions and notes.
+// Entries are only ever appended, so the trail tells who excluded or included
+// a run when and why, even after the exclusion was undone.
+type RunAnnotation struct {
+	ID        int64            `gorm:"primaryKey;autoIncrement"`
+	RunID     int64            `gorm:"index"`
+	BatchID   *int64           `gorm:"index"` // set for changes made to a whole batch
+	Action    AnnotationAction `gorm:"index"`
+	Text      string           // reason of the exclusion or its undoing, or the note
+	Author    string           `gorm:"index"` // who made the change, as given in the request
+	Source    string           // name of the API key the change was made with
+	RequestID string           `json:",omitempty"`
+	CreatedAt time.Time
+}
+
+var (
+	ErrRunNotExcluded = errors.New("run is not excluded")
+	ErrBatchNoRuns    = errors.New("batch has no runs")
+)
+
+// annotationDto is the body of every annotation request. Exclusions need a
+// Reason, notes a Text, and all of them an Author.
+type annotationDto struct {
+	Author string
+	Reason string
+	Text   string
+}
+
+func parseAnnotationDto(c *fiber.Ctx, action AnnotationAction) (annotationDto, error) {
+	dto := annotationDto{}
+	if err := c.BodyParser(&dto); err != nil {
+		return dto, err
+	}
+	dto.Author = strings.TrimSpace(dto.Author)
+	dto.Reason = strings.TrimSpace(dto.Reason)
+	dto.Text = strings.TrimSpace(dto.Text)
+
+	switch {
+	case dto.Author == "":
+		return dto, errors.New("Author is required")
+	case action == AnnotationExclude && dto.Reason == "":
+		return dto, errors.New("Reason is required")
+	case action == AnnotationNote && dto.Text == "":
+		return dto, errors.New("Text is required")
+	}
+	return dto, nil
+}
+
+// newRunAnnotations returns the audit entries of one change to runs, with the
+// key and request id of the request that made it.
+func newRunAnnotations(c *fiber.Ctx, action AnnotationAction, runIDs []int64, batchID *int64, author, text string) []RunAnnotation {
+	src := requestWriteSource(c, SideAny)
+	entries := make([]RunAnnotation, len(runIDs))
+	for i, id := range runIDs {
+		entries[i] = RunAnnotation{RunID: id, BatchID: batchID, Action: action, Text: text, Author: author, Source: src.Component, RequestID: src.RequestID}
+	}
+	return entries
+}
+
+// excludeRuns excludes runs, replacing earlier exclusions of them with the
+// new reason, and records the change in the audit trail.
+func excludeRuns(tx *gorm.DB, runIDs []int64, batchID *int64, dto annotationDto, entries []RunAnnotation) error {
+	if len(runIDs) == 0 {
+		return nil
+	}
+	exclusions := make([]RunExclusion, len(runIDs))
+	for i, id := range runIDs {
+		exclusions[i] = RunExclusion{RunID: id, BatchID: batchID, Reason: dto.Reason, Author: dto.Author}
+	}
+	if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(exclusions, 500).Error; err != nil {
+		return err
+	}
+	return tx.CreateInBatches(entries, 500).Error
+}
+
+// includeRuns undoes the exclusions of those of the runs that are excluded
+// and returns their IDs.
+func includeRuns(tx *gorm.DB, runIDs []int64) ([]int64, error) {
+	excluded := []int64{}
+	if err := tx.Model(&RunExclusion{}).Where("run_id IN ?", runIDs).Order("run_id").Pluck("run_id", &excluded).Error; err != nil {
+		return nil, err
+	}
+	if len(excluded) == 0 {
+		return excluded, nil
+	}
+	return excluded, tx.Where("run_id IN ?", excluded).Delete(&RunExclusion{}).Error
+}
+
+// batchRunIDs returns the IDs of the runs of a batch.
+func batchRunIDs(db *gorm.DB, batchID int64) ([]int64, error) {
+	if err := db.First(&Batch{}, batchID).Error; err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	if err := db.Model(&TestRun{}).Where("batch_id = ?", batchID).Order("id").Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, ErrBatchNoRuns
+	}
+	return ids, nil
+}
+
+func findRunExclusion(db *gorm.DB, runID int64) (*RunExclusion, error) {
+	exclusion := RunExclusion{}
+	if err := db.Where("run_id = ?", runID).Limit(1).Find(&exclusion).Error; err != nil || exclusion.RunID == 0 {
+		return nil, err
+	}
+	return &exclusion, nil
+}
+
+func registerAnnotationRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	// findRun reads the run of the :id parameter, answering the request
+	// itself if that fails
+	findRun := func(c *fiber.Ctx) (int64, error) {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return 0, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := db.Select("id").First(&TestRun{}, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return 0, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return id, nil
+	}
+
+	// findBatchRuns reads the runs of the batch of the :id parameter like
+	// findRun
+	findBatchRuns := func(c *fiber.Ctx) (int64, []int64, error) {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return 0, nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		ids, err := batchRunIDs(db, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, ErrBatchNoRuns) {
+			return 0, nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return 0, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return id, ids, nil
+	}
+
+	app.Post("/runs/:id/exclusion", auth.require(ScopeAnnotate), func(c *fiber.Ctx) error {
+		id, err := findRun(c)
+		if id == 0 {
+			return err
+		}
+		dto, err := parseAnnotationDto(c, AnnotationExclude)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		entries := newRunAnnotations(c, AnnotationExclude, []int64{id}, nil, dto.Author, dto.Reason)
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return excludeRuns(tx, []int64{id}, nil, dto, entries)
+		}); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		exclusion, err := findRunExclusion(db, id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(exclusion)
+	})
+
+	// undoes an exclusion, the body needs an Author and may give a Reason
+	app.Delete("/runs/:id/exclusion", auth.require(ScopeAnnotate), func(c *fiber.Ctx) error {
+		id, err := findRun(c)
+		if id == 0 {
+			return err
+		}
+		dto, err := parseAnnotationDto(c, AnnotationInclude)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			included, err := includeRuns(tx, []int64{id})
+			if err != nil {
+				return err
+			}
+			if len(included) == 0 {
+				return ErrRunNotExcluded
+			}
+			return tx.Create(newRunAnnotations(c, AnnotationInclude, included, nil, dto.Author, dto.Reason)).Error
+		})
+		if errors.Is(err, ErrRunNotExcluded) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Post("/runs/:id/notes", auth.require(ScopeAnnotate), func(c *fiber.Ctx) error {
+		id, err := findRun(c)
+		if id == 0 {
+			return err
+		}
+		dto, err := parseAnnotationDto(c, AnnotationNote)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		note := newRunAnnotations(c, AnnotationNote, []int64{id}, nil, dto.Author, dto.Text)[0]
+		if err := db.Create(&note).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(note)
+	})
+
+	// the audit trail of a run: every exclusion, its undoing and every note
+	app.Get("/runs/:id/annotations", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		entries := []RunAnnotation{}
+		if err := db.Where("run_id = ?", id).Order("id").Find(&entries).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(entries)
+	})
+
+	// excludes every run of a batch, e.g. when the network was disturbed
+	// while it ran
+	app.Post("/batches/:id/exclusion", auth.require(ScopeAnnotate), func(c *fiber.Ctx) error {
+		batchID, ids, err := findBatchRuns(c)
+		if ids == nil {
+			return err
+		}
+		dto, err := parseAnnotationDto(c, AnnotationExclude)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		entries := newRunAnnotations(c, AnnotationExclude, ids, &batchID, dto.Author, dto.Reason)
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return excludeRuns(tx, ids, &batchID, dto, entries)
+		}); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{"excluded": ids})
+	})
+
+	// undoes the exclusions of every run of a batch, however they were
+	// excluded
+	app.Delete("/batches/:id/exclusion", auth.require(ScopeAnnotate), func(c *fiber.Ctx) error {
+		batchID, ids, err := findBatchRuns(c)
+		if ids == nil {
+			return err
+		}
+		dto, err := parseAnnotationDto(c, AnnotationInclude)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		included := []int64{}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if included, err = includeRuns(tx, ids); err != nil || len(included) == 0 {
+				return err
+			}
+			return tx.CreateInBatches(newRunAnnotations(c, AnnotationInclude, included, &batchID, dto.Author, dto.Reason), 500).Error
+		})
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{"included": included})
+	})
+
+	// the whole audit trail, optionally narrowed down by action, author, run
+	// or batch
+	app.Get("/annotations", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		q := db.Order("id")
+		if actions := splitQuery(c.Query("action")); len(actions) > 0 {
+			for _, a := range actions {
+				if !slices.Contains(annotationActions, AnnotationAction(a)) {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("action: unknown action %q", a)})
+				}
+			}
+			q = q.Where("action IN ?", actions)
+		}
+		if authors := splitQuery(c.Query("author")); len(authors) > 0 {
+			q = q.Where("author IN ?", authors)
+		}
+		for _, param := range []string{"run_id", "batch_id"} {
+			if v := c.Query(param); v != "" {
+				id, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("%s: %v", param, err)})
+				}
+				q = q.Where(param+" = ?", id)
+			}
+		}
+
+		entries := []RunAnnotation{}
+		if err := q.Find(&entries).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(entries)
+	})
+}
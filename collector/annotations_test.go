@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sendAnnotationTestRequest sends a request with the legacy key and returns
+// the body of the response, which has to have the given status.
+func sendAnnotationTestRequest(t *testing.T, app *fiber.App, method, path, body string, status int) []byte {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", "legacy")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode, status, data)
+	}
+	return data
+}
+
+func TestAnnotationRoutes(t *testing.T) {
+	db := openTestDB(t)
+	app := fiber.New()
+	registerAnnotationRoutes(app, db, newKeyStore(db, "legacy"))
+	send := func(method, path, body string, status int) []byte {
+		t.Helper()
+		return sendAnnotationTestRequest(t, app, method, path, body, status)
+	}
+
+	annotations := func(path string) []RunAnnotation {
+		t.Helper()
+		entries := []RunAnnotation{}
+		if err := json.Unmarshal(send("GET", path, "", 200), &entries); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	excluded := func(id int64) bool {
+		t.Helper()
+		exclusion, err := findRunExclusion(db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exclusion != nil
+	}
+
+	campaign := Campaign{Name: "April"}
+	if err := db.Create(&campaign).Error; err != nil {
+		t.Fatal(err)
+	}
+	batch, empty := Batch{CampaignID: campaign.ID}, Batch{CampaignID: campaign.ID}
+	if err := db.Create(&batch).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&empty).Error; err != nil {
+		t.Fatal(err)
+	}
+	runs := []TestRun{createTestRun(t, db, ProtocolHTTP3, 1), createTestRun(t, db, ProtocolHTTP3, 1), createTestRun(t, db, ProtocolHTTP3, 1)}
+	if err := db.Model(&TestRun{}).Where("id IN ?", []int64{runs[1].ID, runs[2].ID}).Update("batch_id", batch.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	runPath := fmt.Sprintf("/runs/%d", runs[0].ID)
+	batchPath := fmt.Sprintf("/batches/%d", batch.ID)
+
+	// exclusion of a single run
+	send("POST", runPath+"/exclusion", `{"Reason":"wifi"}`, 400)
+	send("POST", runPath+"/exclusion", `{"Author":"ana"}`, 400)
+	send("POST", "/runs/9999/exclusion", `{"Author":"ana","Reason":"wifi"}`, 404)
+	send("POST", "/runs/x/exclusion", `{"Author":"ana","Reason":"wifi"}`, 400)
+	send("DELETE", runPath+"/exclusion", `{"Author":"ana"}`, 404)
+
+	exclusion := RunExclusion{}
+	if err := json.Unmarshal(send("POST", runPath+"/exclusion", `{"Author":" ana ","Reason":" wifi "}`, 200), &exclusion); err != nil {
+		t.Fatal(err)
+	}
+	if exclusion.RunID != runs[0].ID || exclusion.Author != "ana" || exclusion.Reason != "wifi" || exclusion.BatchID != nil {
+		t.Errorf("excluded %+v", exclusion)
+	}
+	if err := json.Unmarshal(send("POST", runPath+"/exclusion", `{"Author":"ben","Reason":"cable unplugged"}`, 200), &exclusion); err != nil {
+		t.Fatal(err)
+	}
+	if exclusion.Author != "ben" || exclusion.Reason != "cable unplugged" {
+		t.Errorf("excluding again did not replace the reason: %+v", exclusion)
+	}
+
+	send("DELETE", runPath+"/exclusion", `{}`, 400)
+	send("DELETE", runPath+"/exclusion", `{"Author":"ana","Reason":"wifi was fine"}`, 204)
+	if excluded(runs[0].ID) {
+		t.Errorf("run %d still excluded", runs[0].ID)
+	}
+	send("DELETE", runPath+"/exclusion", `{"Author":"ana"}`, 404)
+
+	// notes
+	send("POST", runPath+"/notes", `{"Author":"ana"}`, 400)
+	send("POST", "/runs/9999/notes", `{"Author":"ana","Text":"x"}`, 404)
+	note := RunAnnotation{}
+	if err := json.Unmarshal(send("POST", runPath+"/notes", `{"Author":"ana","Text":"rerun tomorrow"}`, 201), &note); err != nil {
+		t.Fatal(err)
+	}
+	if note.ID == 0 || note.RunID != runs[0].ID || note.Action != AnnotationNote || note.Text != "rerun tomorrow" || note.Source != "API_KEY" {
+		t.Errorf("created note %+v", note)
+	}
+
+	// the audit trail keeps every change, in order
+	trail := annotations(runPath + "/annotations")
+	want := []struct {
+		action       AnnotationAction
+		author, text string
+	}{
+		{AnnotationExclude, "ana", "wifi"},
+		{AnnotationExclude, "ben", "cable unplugged"},
+		{AnnotationInclude, "ana", "wifi was fine"},
+		{AnnotationNote, "ana", "rerun tomorrow"},
+	}
+	if len(trail) != len(want) {
+		t.Fatalf("audit trail %+v, want %d entries", trail, len(want))
+	}
+	for i, w := range want {
+		if e := trail[i]; e.RunID != runs[0].ID || e.Action != w.action || e.Author != w.author || e.Text != w.text || e.Source != "API_KEY" || e.BatchID != nil {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+	send("GET", "/runs/x/annotations", "", 400)
+
+	// exclusion of a whole batch
+	send("POST", "/batches/9999/exclusion", `{"Author":"ana","Reason":"x"}`, 404)
+	send("POST", fmt.Sprintf("/batches/%d/exclusion", empty.ID), `{"Author":"ana","Reason":"x"}`, 404)
+	send("POST", batchPath+"/exclusion", `{"Author":"ana"}`, 400)
+
+	result := map[string][]int64{}
+	if err := json.Unmarshal(send("POST", batchPath+"/exclusion", `{"Author":"ben","Reason":"network disturbed"}`, 200), &result); err != nil {
+		t.Fatal(err)
+	}
+	if got := result["excluded"]; len(got) != 2 || got[0] != runs[1].ID || got[1] != runs[2].ID {
+		t.Errorf("batch excluded %v, want runs %d and %d", got, runs[1].ID, runs[2].ID)
+	}
+	if exclusion, err := findRunExclusion(db, runs[2].ID); err != nil || exclusion == nil || exclusion.BatchID == nil || *exclusion.BatchID != batch.ID {
+		t.Errorf("exclusion of run %d = %+v, %v, want one of batch %d", runs[2].ID, exclusion, err, batch.ID)
+	}
+
+	// a run of the batch included on its own is left out when the batch is
+	// included
+	send("DELETE", fmt.Sprintf("/runs/%d/exclusion", runs[1].ID), `{"Author":"ana"}`, 204)
+	result = map[string][]int64{}
+	if err := json.Unmarshal(send("DELETE", batchPath+"/exclusion", `{"Author":"ben"}`, 200), &result); err != nil {
+		t.Fatal(err)
+	}
+	if got := result["included"]; len(got) != 1 || got[0] != runs[2].ID {
+		t.Errorf("batch included %v, want only run %d", got, runs[2].ID)
+	}
+	result = map[string][]int64{}
+	if err := json.Unmarshal(send("DELETE", batchPath+"/exclusion", `{"Author":"ben"}`, 200), &result); err != nil {
+		t.Fatal(err)
+	}
+	if got := result["included"]; len(got) != 0 {
+		t.Errorf("batch without exclusions included %v", got)
+	}
+	if excluded(runs[1].ID) || excluded(runs[2].ID) {
+		t.Error("runs of the batch still excluded")
+	}
+
+	// the whole audit trail and its filters
+	tests := []struct {
+		query string
+		count int
+	}{
+		{"", 8},
+		{"?action=exclude", 4},
+		{"?action=include,note", 4},
+		{"?author=ben", 4},
+		{"?author=ana,ben&action=include", 3},
+		{fmt.Sprintf("?run_id=%d", runs[2].ID), 2},
+		{fmt.Sprintf("?batch_id=%d", batch.ID), 3},
+		{fmt.Sprintf("?batch_id=%d&action=include", batch.ID), 1},
+	}
+	for _, tt := range tests {
+		if entries := annotations("/annotations" + tt.query); len(entries) != tt.count {
+			t.Errorf("/annotations%s: %d entries, want %d", tt.query, len(entries), tt.count)
+		}
+	}
+	send("GET", "/annotations?action=delete", "", 400)
+	send("GET", "/annotations?run_id=x", "", 400)
+}
+
+// TestExcludedRunsLeftOut checks that the statistics, comparisons, exports
+// and the dashboard leave out an excluded run unless include_excluded is set.
+func TestExcludedRunsLeftOut(t *testing.T) {
+	db := openTestDB(t)
+	runs := []TestRun{
+		dashboardTestRun(ProtocolHTTP3, 1, TimeSlotMorning, 10),
+		dashboardTestRun(ProtocolHTTP3, 1, TimeSlotMorning, 20),
+		dashboardTestRun(ProtocolHTTP3, 1, TimeSlotMorning, 30),
+	}
+	if err := db.Create(&runs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	auth := newKeyStore(db, "legacy")
+	registerStatsRoutes(app, db, auth)
+	registerCompareRoutes(app, db, auth)
+	registerExportRoutes(app, db, auth)
+	registerLegacyCsvRoute(app, db, auth)
+	registerDashboardRoutes(app, db, auth)
+	registerAnnotationRoutes(app, db, auth)
+
+	sendAnnotationTestRequest(t, app, "POST", fmt.Sprintf("/runs/%d/exclusion", runs[2].ID), `{"Author":"ana","Reason":"wifi"}`, 200)
+
+	lines := func(data []byte) int {
+		return len(strings.Split(strings.TrimSpace(string(data)), "\n"))
+	}
+	tests := []struct {
+		name  string
+		path  string
+		count func(t *testing.T, data []byte) int
+	}{
+		{"stats", "/stats?format=json", func(t *testing.T, data []byte) int {
+			result := struct{ Groups []StatGroup }{}
+			if err := json.Unmarshal(data, &result); err != nil || len(result.Groups) != 1 {
+				t.Fatalf("got %s, %v", data, err)
+			}
+			return result.Groups[0].Metrics["ThroughputMbps"].Count
+		}},
+		{"compare", "/compare?format=json&metrics=ThroughputMbps&min_runs=2", func(t *testing.T, data []byte) int {
+			result := struct{ Results []CompareResult }{}
+			if err := json.Unmarshal(data, &result); err != nil || len(result.Results) != 1 {
+				t.Fatalf("got %s, %v", data, err)
+			}
+			if r := result.Results[0]; r.BaselineN != r.CandidateN {
+				t.Errorf("baseline has %d runs, candidate %d", r.BaselineN, r.CandidateN)
+			}
+			return result.Results[0].BaselineN
+		}},
+		{"export", "/export?format=ndjson", func(t *testing.T, data []byte) int {
+			return lines(data)
+		}},
+		{"legacy csv", "/csv", func(t *testing.T, data []byte) int {
+			return lines(data) - 1 // header
+		}},
+		{"dashboard", "/dashboard", func(t *testing.T, data []byte) int {
+			var completed, ended int
+			i := strings.Index(string(data), `<p class="summary">`)
+			if i < 0 {
+				t.Fatalf("no summary in %s", data)
+			}
+			if _, err := fmt.Sscanf(string(data[i:]), `<p class="summary">%d completed runs without error, %d ended runs`, &completed, &ended); err != nil {
+				t.Fatal(err)
+			}
+			if completed != ended {
+				t.Errorf("%d completed runs, %d ended runs", completed, ended)
+			}
+			return completed
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sep := "?"
+			if strings.Contains(tt.path, "?") {
+				sep = "&"
+			}
+			if n := tt.count(t, sendAnnotationTestRequest(t, app, "GET", tt.path, "", 200)); n != 2 {
+				t.Errorf("%s: %d runs, want the 2 not excluded", tt.path, n)
+			}
+			if n := tt.count(t, sendAnnotationTestRequest(t, app, "GET", tt.path+sep+"include_excluded=true", "", 200)); n != 3 {
+				t.Errorf("%s with include_excluded: %d runs, want 3", tt.path, n)
+			}
+		})
+	}
+}
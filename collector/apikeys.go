@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Scope is a permission of an API key.
+type Scope string
+
+const (
+	ScopeBeginRun           Scope = "begin-run"            // create runs, campaigns and batches (the test runner)
+	ScopeWriteClientMetrics Scope = "write-client-metrics" // report metrics and samples as client
+	ScopeWriteServerMetrics Scope = "write-server-metrics" // report metrics and samples as server
+	ScopeRead               Scope = "read"                 // query runs, statistics, exports, events and the dashboard
+	ScopeAnnotate           Scope = "annotate"             // exclude runs and batches and add notes, see annotations.go
+	ScopeAdmin              Scope = "admin"                // everything, including imports and deletions
+)
+
+var apiKeyScopes = []Scope{ScopeBeginRun, ScopeWriteClientMetrics, ScopeWriteServerMetrics, ScopeRead, ScopeAnnotate, ScopeAdmin}
+
+// apiKeyPrefix starts every key, so keys are recognizable in configs and logs.
+const apiKeyPrefix = "thk_"
+
+// apiKeyCacheTTL is how long a looked up key is trusted without asking the
+// database again. Revoking a key takes effect on a running collector after at
+// most this long.
+const apiKeyCacheTTL = 30 * time.Second
+
+// APIKey is a key of one component, e.g. the test runner or the HTTP/3
+// servers. Only a hash of the key is stored; the key itself is shown once
+// when it is created.
+type APIKey struct {
+	ID         int64   `gorm:"primaryKey;autoIncrement"`
+	Name       string  `gorm:"index"` // the component the key belongs to
+	Prefix     string  // the start of the key, to tell keys apart
+	Hash       string  `gorm:"uniqueIndex" json:"-"` // hex SHA-256 of the key
+	Scopes     []Scope `gorm:"serializer:json"`
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+	LastUsedAt *time.Time // updated at most every apiKeyCacheTTL
+}
+
+// Allows reports whether the key has one of the scopes. Admin keys have all.
+func (k *APIKey) Allows(scopes ...Scope) bool {
+	if slices.Contains(k.Scopes, ScopeAdmin) {
+		return true
+	}
+	for _, s := range scopes {
+		if slices.Contains(k.Scopes, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the key is neither revoked nor expired at t.
+func (k *APIKey) Active(t time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || t.Before(*k.ExpiresAt))
+}
+
+func (k *APIKey) status(t time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return "revoked"
+	case !k.Active(t):
+		return "expired"
+	case k.ExpiresAt != nil:
+		return "expires in " + k.ExpiresAt.Sub(t).Round(time.Minute).String()
+	default:
+		return "active"
+	}
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseScopes(s string) ([]Scope, error) {
+	scopes := []Scope{}
+	for _, name := range splitQuery(s) {
+		scope := Scope(name)
+		if !slices.Contains(apiKeyScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q, must be one of %v", name, apiKeyScopes)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("no scopes given")
+	}
+	return scopes, nil
+}
+
+// createAPIKey stores a new random key and returns it together with the key
+// itself, which cannot be recovered later.
+func createAPIKey(db *gorm.DB, name string, scopes []Scope, expiresAt *time.Time) (APIKey, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return APIKey{}, "", err
+	}
+	secret := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	key := APIKey{
+		Name:      name,
+		Prefix:    secret[:len(apiKeyPrefix)+8],
+		Hash:      hashAPIKey(secret),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	if err := db.Create(&key).Error; err != nil {
+		return APIKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+// findAPIKey looks a key up by its ID or its prefix.
+func findAPIKey(db *gorm.DB, ref string) (APIKey, error) {
+	key := APIKey{}
+	tx := db.Where("prefix = ?", ref)
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		tx = db.Where("id = ?", id)
+	}
+	if err := tx.Take(&key).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return key, fmt.Errorf("no key %q", ref)
+	} else if err != nil {
+		return key, err
+	}
+	return key, nil
+}
+
+type cachedAPIKey struct {
+	key     *APIKey // nil if there is no such key
+	fetched time.Time
+}
+
+// keyStore authenticates requests by their X-API-KEY header. The legacy
+// API_KEY, if set, is accepted as an admin key that is not stored, so clients
+// that still send it keep working until they have keys of their own.
+type keyStore struct {
+	db     *gorm.DB
+	legacy string
+
+	mu    sync.Mutex
+	cache map[string]cachedAPIKey // by hash
+}
+
+func newKeyStore(db *gorm.DB, legacy string) *keyStore {
+	return &keyStore{db: db, legacy: legacy, cache: map[string]cachedAPIKey{}}
+}
+
+// authenticate returns the active key for secret, or nil if there is none.
+func (s *keyStore) authenticate(secret string) (*APIKey, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	if s.legacy != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(s.legacy)) == 1 {
+		return &APIKey{Name: "API_KEY", Scopes: []Scope{ScopeAdmin}}, nil
+	}
+
+	hash := hashAPIKey(secret)
+	now := time.Now()
+
+	s.mu.Lock()
+	cached, ok := s.cache[hash]
+	s.mu.Unlock()
+
+	if !ok || now.Sub(cached.fetched) > apiKeyCacheTTL {
+		cached = cachedAPIKey{fetched: now}
+		key := APIKey{}
+		if err := s.db.Where("hash = ?", hash).Take(&key).Error; err == nil {
+			cached.key = &key
+			if key.Active(now) {
+				s.db.Model(&key).UpdateColumn("last_used_at", now)
+			}
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		// unknown keys are cached as well, bound the cache against guessing
+		if len(s.cache) >= 1024 {
+			clear(s.cache)
+		}
+		s.cache[hash] = cached
+		s.mu.Unlock()
+	}
+
+	if cached.key == nil || !cached.key.Active(now) {
+		return nil, nil
+	}
+	return cached.key, nil
+}
+
+// require authenticates the request and lets it through if its key has one
+// of the scopes. The key is left in the request's locals for requestKey.
+func (s *keyStore) require(scopes ...Scope) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key, err := s.authenticate(c.Get("X-API-KEY"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if key == nil {
+			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+		}
+		if !key.Allows(scopes...) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": fmt.Sprintf("key %q lacks the scope %s", key.Name, joinScopes(scopes, " or "))})
+		}
+
+		c.Locals("apiKey", key)
+		return c.Next()
+	}
+}
+
+func requestKey(c *fiber.Ctx) *APIKey {
+	key, _ := c.Locals("apiKey").(*APIKey)
+	return key
+}
+
+func joinScopes(scopes []Scope, sep string) string {
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = string(s)
+	}
+	return strings.Join(names, sep)
+}
+
+// ErrSideForbidden is returned for metrics of a side the key may not write.
+var ErrSideForbidden = errors.New("key may not write metrics of this side")
+
+// authorizeSide checks that the key of the request may write the metrics of
+// side. A key that may only write one side's metrics has SideAny narrowed
+// down to that side, so it cannot write the other side's fields unchecked.
+func authorizeSide(c *fiber.Ctx, side Side) (Side, error) {
+	key := requestKey(c)
+	client := key.Allows(ScopeWriteClientMetrics)
+	server := key.Allows(ScopeWriteServerMetrics)
+
+	switch {
+	case side == SideAny && client && !server:
+		return SideClient, nil
+	case side == SideAny && server && !client:
+		return SideServer, nil
+	case side == SideAny && client && server,
+		side == SideClient && client,
+		side == SideServer && server:
+		return side, nil
+	default:
+		return side, fmt.Errorf("%w: %q", ErrSideForbidden, side)
+	}
+}
+
+// logKeyStatus points out a missing key setup when the collector starts.
+func logKeyStatus(db *gorm.DB, legacy string) {
+	var count int64
+	if err := db.Model(&APIKey{}).Where("revoked_at IS NULL").Count(&count).Error; err != nil {
+		log.Printf("failed to count API keys: %v", err)
+		return
+	}
+	if legacy != "" {
+		log.Print("API_KEY is accepted as an admin key, replace it with per-component keys from `collector keys create`")
+	} else if count == 0 {
+		log.Print("no API keys exist, every request is rejected until one is created with `collector keys create`")
+	}
+}
+
+// runKeysCommand manages API keys:
+//
+//	collector keys create -scopes write-client-metrics [-expires 2160h] http3-client
+//	collector keys list
+//	collector keys revoke <id|prefix>
+//	collector keys rotate [-grace 24h] <id|prefix>
+func runKeysCommand(db *gorm.DB, args []string) error {
+	usage := errors.New("usage: collector keys create|list|revoke|rotate")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("keys create", flag.ExitOnError)
+		scopes := fs.String("scopes", "", "comma separated scopes: "+joinScopes(apiKeyScopes, ", "))
+		expires := fs.Duration("expires", 0, "lifetime of the key, 0 for none")
+		fs.Usage = func() {
+			fmt.Fprintln(fs.Output(), "usage: collector keys create -scopes scope,... [-expires duration] name")
+			fs.PrintDefaults()
+		}
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return errors.New("no name given")
+		}
+
+		parsed, err := parseScopes(*scopes)
+		if err != nil {
+			return err
+		}
+		var expiresAt *time.Time
+		if *expires > 0 {
+			t := time.Now().Add(*expires)
+			expiresAt = &t
+		}
+
+		key, secret, err := createAPIKey(db, fs.Arg(0), parsed, expiresAt)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created key %d %q with scopes %s\n", key.ID, key.Name, joinScopes(key.Scopes, ","))
+		fmt.Println(secret)
+		fmt.Fprintln(os.Stderr, "the key is only shown now, store it in the component's COLLECTOR_API_KEY")
+		return nil
+
+	case "list":
+		keys := []APIKey{}
+		if err := db.Order("name, id").Find(&keys).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tPREFIX\tSCOPES\tCREATED\tLAST USED\tSTATUS")
+		for _, k := range keys {
+			lastUsed := "never"
+			if k.LastUsedAt != nil {
+				lastUsed = k.LastUsedAt.Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Prefix, joinScopes(k.Scopes, ","), k.CreatedAt.Format(time.DateTime), lastUsed, k.status(now))
+		}
+		return w.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("usage: collector keys revoke <id|prefix>")
+		}
+		key, err := findAPIKey(db, args[1])
+		if err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return fmt.Errorf("key %d was already revoked", key.ID)
+		}
+		if err := db.Model(&key).Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		fmt.Printf("revoked key %d %q, running collectors reject it within %s\n", key.ID, key.Name, apiKeyCacheTTL)
+		return nil
+
+	case "rotate":
+		// the old key keeps working for the grace period, so the component
+		// can be switched over to the new one without losing measurements
+		fs := flag.NewFlagSet("keys rotate", flag.ExitOnError)
+		grace := fs.Duration("grace", 24*time.Hour, "how long the old key stays valid")
+		fs.Usage = func() {
+			fmt.Fprintln(fs.Output(), "usage: collector keys rotate [-grace duration] <id|prefix>")
+			fs.PrintDefaults()
+		}
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return errors.New("no key given")
+		}
+
+		old, err := findAPIKey(db, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if !old.Active(time.Now()) {
+			return fmt.Errorf("key %d is %s, create a new one instead", old.ID, old.status(time.Now()))
+		}
+
+		// a key with a lifetime is replaced by one with the same lifetime
+		var expiresAt *time.Time
+		if old.ExpiresAt != nil {
+			t := time.Now().Add(old.ExpiresAt.Sub(old.CreatedAt))
+			expiresAt = &t
+		}
+		oldExpiresAt := time.Now().Add(*grace)
+		if old.ExpiresAt != nil && old.ExpiresAt.Before(oldExpiresAt) {
+			oldExpiresAt = *old.ExpiresAt
+		}
+
+		var key APIKey
+		var secret string
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if key, secret, err = createAPIKey(tx, old.Name, old.Scopes, expiresAt); err != nil {
+				return err
+			}
+			return tx.Model(&old).Update("expires_at", oldExpiresAt).Error
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created key %d %q with scopes %s, key %d expires at %s\n", key.ID, key.Name, joinScopes(key.Scopes, ","), old.ID, oldExpiresAt.Format(time.DateTime))
+		fmt.Println(secret)
+		fmt.Fprintln(os.Stderr, "the key is only shown now, store it in the component's COLLECTOR_API_KEY")
+		return nil
+
+	default:
+		return usage
+	}
+}
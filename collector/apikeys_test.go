@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm/logger"
+)
+
+func TestAPIKeys(t *testing.T) {
+	db, err := openDatabase("sqlite:" + filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Discard
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(name string, scopes ...Scope) (APIKey, string) {
+		key, secret, err := createAPIKey(db, name, scopes, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, secret
+	}
+	_, reader := create("analyzer", ScopeRead)
+	_, client := create("http3-client", ScopeWriteClientMetrics)
+	revoked, revokedSecret := create("old", ScopeRead)
+	if err := db.Model(&revoked).Update("revoked_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	auth := newKeyStore(db, "legacy")
+	app := fiber.New()
+	registerCampaignRoutes(app, db, auth)
+	registerBatchRoutes(app, db, auth)
+
+	run := createTestRun(t, db, ProtocolHTTP3, 1)
+	batch := func(side Side, field string) string {
+		body, _ := json.Marshal([]batchItem{{RunID: run.ID, Fields: map[string]any{field: 1.0}, Side: side}})
+		return string(body)
+	}
+
+	tests := []struct {
+		name, method, path, key, body string
+		status                        int
+		result                        string // part of the response body
+	}{
+		{"no key", "GET", "/campaigns", "", "", 401, ""},
+		{"unknown key", "GET", "/campaigns", "thk_unknown", "", 401, ""},
+		{"revoked key", "GET", "/campaigns", revokedSecret, "", 401, ""},
+		{"read scope", "GET", "/campaigns", reader, "", 200, ""},
+		{"legacy key", "GET", "/campaigns", "legacy", "", 200, ""},
+		{"missing scope", "GET", "/campaigns", client, "", 403, "read"},
+		{"read only key writes", "POST", "/batch", reader, batch(SideAny, "RamClientBytesWhile"), 403, ""},
+		{"own side", "POST", "/batch", client, batch(SideAny, "RamClientBytesWhile"), 200, `"status":204`},
+		{"other side's fields", "POST", "/batch", client, batch(SideAny, "RamServerBytesWhile"), 200, `"status":400`},
+		{"other side", "POST", "/batch", client, batch(SideServer, "RamServerBytesWhile"), 403, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.key != "" {
+				req.Header.Set("X-API-KEY", tt.key)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if !strings.Contains(string(body), tt.result) {
+				t.Errorf("response %s, want it to contain %s", body, tt.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestBatchItemResults sends a batch through POST /batch whose rejected items
+// must neither roll back nor block the items around them.
+func TestBatchItemResults(t *testing.T) {
+	db := openTestDB(t)
+	applied := createTestRun(t, db, ProtocolHTTP3, 1)
+	invalid := createTestRun(t, db, ProtocolHTTP3, 1)
+	conflict := createTestRun(t, db, ProtocolHTTP3, 1)
+	ended := createTestRun(t, db, ProtocolHTTP3, 1)
+	if err := db.Model(&ended).Update("state", RunStateCompleted).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	registerBatchRoutes(app, db, newKeyStore(db, "legacy"))
+
+	body, err := json.Marshal([]batchItem{
+		{RunID: applied.ID, Fields: map[string]any{"CpuClientPercentWhile": 10}},
+		{RunID: invalid.ID, Fields: map[string]any{"CpuClientPercentWhile": 200}},
+		{RunID: 9999, Fields: map[string]any{"CpuClientPercentWhile": 10}},
+		{RunID: conflict.ID, Fields: map[string]any{"CpuClientPercentWhile": 10, "@version": 5}},
+		{RunID: ended.ID, Fields: map[string]any{"LostPackets": 3}, End: true},
+		{RunID: invalid.ID, Fields: map[string]any{"CpuClientPercentWhile": 20}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", "legacy")
+	req.Header.Set("X-Collector-Side", string(SideClient))
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	result := struct{ Results []BatchResult }{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		status  int
+		version int64
+	}{{204, 1}, {400, 0}, {404, 0}, {409, 0}, {409, 1}, {204, 1}}
+	if len(result.Results) != len(want) {
+		t.Fatalf("%d results, want %d", len(result.Results), len(want))
+	}
+	for i, r := range result.Results {
+		if r.Status != want[i].status || r.Version != want[i].version {
+			t.Errorf("item %d: status %d, version %d, want %d, %d: %s", i, r.Status, r.Version, want[i].status, want[i].version, r.Error)
+		}
+	}
+	if len(result.Results[1].Fields) != 1 || result.Results[1].Fields[0].Field != "CpuClientPercentWhile" {
+		t.Errorf("item 1: field errors %+v", result.Results[1].Fields)
+	}
+
+	runs := map[int64]TestRun{}
+	stored := []TestRun{}
+	if err := db.Find(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range stored {
+		runs[run.ID] = run
+	}
+	if r := runs[applied.ID]; r.CpuClientPercentWhile != 10 || r.Version != 1 {
+		t.Errorf("applied run: cpu %v, version %d", r.CpuClientPercentWhile, r.Version)
+	}
+	if r := runs[invalid.ID]; r.CpuClientPercentWhile != 20 || r.Version != 1 {
+		t.Errorf("run of the invalid item: cpu %v, version %d", r.CpuClientPercentWhile, r.Version)
+	}
+	if r := runs[conflict.ID]; r.CpuClientPercentWhile != 0 || r.Version != 0 {
+		t.Errorf("conflicting run was written: cpu %v, version %d", r.CpuClientPercentWhile, r.Version)
+	}
+	if r := runs[ended.ID]; r.LostPackets != 3 || r.State != RunStateCompleted || r.Version != 1 {
+		t.Errorf("ended run: lost packets %d, state %s, version %d", r.LostPackets, r.State, r.Version)
+	}
+}
+
+// BenchmarkApplyBatch applies batches of 100 client updates, one per run, to
+// a local SQLite database and reports the applied updates per second.
+func BenchmarkApplyBatch(b *testing.B) {
+	db := openTestDB(b)
+	items := make([]batchItem, 100)
+	for i := range items {
+		run := TestRun{Protocol: ProtocolHTTP3, ParallelClients: 1, TestBegin: time.Now(), State: RunStateCreated}
+		if err := db.Create(&run).Error; err != nil {
+			b.Fatal(err)
+		}
+		items[i] = batchItem{RunID: run.ID, Fields: map[string]any{"CpuClientPercentWhile": 12.5, "RamClientBytesWhile": float64(1 << 20)}}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		results, err := applyBatch(db, items, SideClient)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if results[0].Status != fiber.StatusNoContent {
+			b.Fatalf("got status %d: %s", results[0].Status, results[0].Error)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(items))/b.Elapsed().Seconds(), "updates/s")
+}
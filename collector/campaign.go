@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Campaign groups all runs of one measurement session together with the
+// metadata needed to reproduce it.
+type Campaign struct {
+	ID              int64 `gorm:"primaryKey;autoIncrement"`
+	Name            string
+	Description     string
+	StartedBy       string
+	PayloadFileHash string        // SHA-256 of the transferred file, hex encoded
+	PayloadFileSize int64         // size of the transferred file in bytes
+	ServerBuildInfo string        // e.g. git revision and dependency versions of the servers
+	PlannedMatrix   PlannedMatrix `gorm:"serializer:json"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// PlannedMatrix is the test matrix a campaign was started with.
+type PlannedMatrix struct {
+	Protocols       []Protocol
+	Enviroments     []Enviroment
+	TimeSlots       []TimeSlot
+	ParallelClients []int
+	Reruns          map[int]int // parallel clients -> number of batches
+}
+
+// Batch is one set of parallel clients started together within a campaign.
+// All runs of a batch share its ID, so batches with the same number of
+// parallel clients can be told apart.
+type Batch struct {
+	ID              int64 `gorm:"primaryKey;autoIncrement"`
+	CampaignID      int64 `gorm:"index"`
+	Protocol        Protocol
+	Enviroment      Enviroment
+	TimeSlot        TimeSlot
+	ParallelClients int
+	Sequence        int // rerun number of this batch within the campaign
+	CreatedAt       time.Time
+}
+
+type campaignDto struct {
+	Name            string
+	Description     string
+	StartedBy       string
+	PayloadFileHash string
+	PayloadFileSize int64
+	ServerBuildInfo string
+	PlannedMatrix   PlannedMatrix
+}
+
+func (dto campaignDto) apply(campaign *Campaign) {
+	campaign.Name = dto.Name
+	campaign.Description = dto.Description
+	campaign.StartedBy = dto.StartedBy
+	campaign.PayloadFileHash = dto.PayloadFileHash
+	campaign.PayloadFileSize = dto.PayloadFileSize
+	campaign.ServerBuildInfo = dto.ServerBuildInfo
+	campaign.PlannedMatrix = dto.PlannedMatrix
+}
+
+var (
+	ErrBatchCampaignMismatch = errors.New("batch does not belong to campaign")
+	ErrCampaignHasRuns       = errors.New("campaign still has runs")
+)
+
+// resolveRunGroup checks the campaign and batch a run is started with. A
+// batch alone is enough, its campaign is filled in. It runs in the
+// transaction that creates the run and locks the campaign, which keeps
+// DELETE /campaigns/:id from deleting it until the run is stored.
+func resolveRunGroup(tx *gorm.DB, campaignID, batchID *int64) (*int64, *int64, error) {
+	if batchID != nil {
+		batch := Batch{}
+		if err := tx.First(&batch, *batchID).Error; err != nil {
+			return nil, nil, err
+		}
+		if campaignID != nil && *campaignID != batch.CampaignID {
+			return nil, nil, ErrBatchCampaignMismatch
+		}
+		campaignID = &batch.CampaignID
+	}
+
+	if campaignID != nil {
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthShare}).First(&Campaign{}, *campaignID).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return campaignID, batchID, nil
+}
+
+// deleteCampaign deletes a campaign without runs and its batches. The
+// campaign is locked before its runs are counted, so a run started in the
+// meantime either makes the count or fails to find the campaign. SQLite
+// ignores the lock, its write transactions run one at a time anyway.
+func deleteCampaign(db *gorm.DB, id int64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(&Campaign{}, id).Error; err != nil {
+			return err
+		}
+
+		var runs int64
+		if err := tx.Model(&TestRun{}).Where("campaign_id = ?", id).Count(&runs).Error; err != nil {
+			return err
+		}
+		if runs > 0 {
+			return ErrCampaignHasRuns
+		}
+
+		if err := tx.Where("campaign_id = ?", id).Delete(&Batch{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Campaign{}, id).Error
+	})
+}
+
+func registerCampaignRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	findCampaign := func(c *fiber.Ctx) (*Campaign, error) {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		campaign := Campaign{}
+		if err := db.First(&campaign, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return &campaign, nil
+	}
+
+	app.Get("/campaigns", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		campaigns := []Campaign{}
+		if err := db.Order("id").Find(&campaigns).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(campaigns)
+	})
+
+	app.Post("/campaigns", auth.require(ScopeBeginRun), func(c *fiber.Ctx) error {
+		dto := campaignDto{}
+		if err := c.BodyParser(&dto); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if dto.Name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Name is required"})
+		}
+
+		campaign := Campaign{}
+		dto.apply(&campaign)
+		if err := db.Create(&campaign).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(campaign)
+	})
+
+	app.Get("/campaigns/:id", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		campaign, err := findCampaign(c)
+		if campaign == nil {
+			return err
+		}
+
+		return c.JSON(campaign)
+	})
+
+	app.Put("/campaigns/:id", auth.require(ScopeBeginRun), func(c *fiber.Ctx) error {
+		campaign, err := findCampaign(c)
+		if campaign == nil {
+			return err
+		}
+
+		dto := campaignDto{}
+		if err := c.BodyParser(&dto); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if dto.Name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Name is required"})
+		}
+
+		dto.apply(campaign)
+		if err := db.Save(campaign).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(campaign)
+	})
+
+	app.Delete("/campaigns/:id", auth.require(ScopeAdmin), func(c *fiber.Ctx) error {
+		campaign, err := findCampaign(c)
+		if campaign == nil {
+			return err
+		}
+
+		err = deleteCampaign(db, campaign.ID)
+		if errors.Is(err, ErrCampaignHasRuns) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/campaigns/:id/batches", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		campaign, err := findCampaign(c)
+		if campaign == nil {
+			return err
+		}
+
+		batches := []Batch{}
+		if err := db.Where("campaign_id = ?", campaign.ID).Order("id").Find(&batches).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(batches)
+	})
+
+	app.Post("/campaigns/:id/batches", auth.require(ScopeBeginRun), func(c *fiber.Ctx) error {
+		campaign, err := findCampaign(c)
+		if campaign == nil {
+			return err
+		}
+
+		dto := struct {
+			Protocol        Protocol
+			Enviroment      Enviroment
+			TimeSlot        TimeSlot
+			ParallelClients int
+			Sequence        int
+		}{}
+		if err := c.BodyParser(&dto); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		batch := Batch{
+			CampaignID:      campaign.ID,
+			Protocol:        dto.Protocol,
+			Enviroment:      dto.Enviroment,
+			TimeSlot:        dto.TimeSlot,
+			ParallelClients: dto.ParallelClients,
+			Sequence:        dto.Sequence,
+		}
+		if err := db.Create(&batch).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(batch)
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func TestCampaignRoutes(t *testing.T) {
+	db := openTestDB(t)
+	app := fiber.New()
+	registerCampaignRoutes(app, db, newKeyStore(db, "legacy"))
+
+	send := func(method, path, body string, status int, result any) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-KEY", "legacy")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode, status, data)
+		}
+		if result != nil {
+			if err := json.Unmarshal(data, result); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+	}
+
+	send("POST", "/campaigns", `{"Description":"no name"}`, 400, nil)
+
+	campaign := Campaign{}
+	send("POST", "/campaigns", `{"Name":"April","PayloadFileSize":42,"PlannedMatrix":{"Protocols":["http3"],"ParallelClients":[1,2]}}`, 201, &campaign)
+	if campaign.ID == 0 || campaign.Name != "April" || campaign.PayloadFileSize != 42 || len(campaign.PlannedMatrix.ParallelClients) != 2 {
+		t.Fatalf("created %+v", campaign)
+	}
+	path := fmt.Sprintf("/campaigns/%d", campaign.ID)
+
+	got := Campaign{}
+	send("GET", path, "", 200, &got)
+	if got.Name != "April" || got.PlannedMatrix.Protocols[0] != ProtocolHTTP3 {
+		t.Errorf("got %+v", got)
+	}
+	send("GET", "/campaigns/9999", "", 404, nil)
+	send("GET", "/campaigns/x", "", 400, nil)
+
+	send("PUT", path, `{"Description":"no name"}`, 400, nil)
+	send("PUT", path, `{"Name":"April rerun","StartedBy":"runner"}`, 200, &got)
+	if got.ID != campaign.ID || got.Name != "April rerun" || got.StartedBy != "runner" || got.PayloadFileSize != 0 {
+		t.Errorf("updated %+v", got)
+	}
+	send("PUT", "/campaigns/9999", `{"Name":"x"}`, 404, nil)
+
+	campaigns := []Campaign{}
+	send("GET", "/campaigns", "", 200, &campaigns)
+	if len(campaigns) != 1 || campaigns[0].Name != "April rerun" {
+		t.Errorf("listed %+v", campaigns)
+	}
+
+	batch := Batch{}
+	send("POST", path+"/batches", `{"Protocol":"http3","ParallelClients":2,"Sequence":3}`, 201, &batch)
+	if batch.CampaignID != campaign.ID || batch.ParallelClients != 2 || batch.Sequence != 3 {
+		t.Errorf("created batch %+v", batch)
+	}
+	send("POST", "/campaigns/9999/batches", `{"Protocol":"http3"}`, 404, nil)
+
+	batches := []Batch{}
+	send("GET", path+"/batches", "", 200, &batches)
+	if len(batches) != 1 || batches[0].ID != batch.ID {
+		t.Errorf("listed batches %+v", batches)
+	}
+
+	run := createTestRun(t, db, ProtocolHTTP3, 2)
+	if err := db.Model(&run).Updates(map[string]any{"CampaignID": campaign.ID, "BatchID": batch.ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+	send("DELETE", path, "", 409, nil)
+
+	if err := db.Delete(&run).Error; err != nil {
+		t.Fatal(err)
+	}
+	send("DELETE", path, "", 204, nil)
+	send("DELETE", path, "", 404, nil)
+
+	var left int64
+	if err := db.Model(&Batch{}).Where("campaign_id = ?", campaign.ID).Count(&left).Error; err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d batches left of the deleted campaign", left)
+	}
+}
+
+func TestResolveRunGroup(t *testing.T) {
+	db := openTestDB(t)
+	campaign, other := Campaign{Name: "a"}, Campaign{Name: "b"}
+	if err := db.Create(&campaign).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&other).Error; err != nil {
+		t.Fatal(err)
+	}
+	batch := Batch{CampaignID: campaign.ID}
+	if err := db.Create(&batch).Error; err != nil {
+		t.Fatal(err)
+	}
+	unknown := int64(9999)
+
+	tests := []struct {
+		name                    string
+		campaignID, batchID     *int64
+		wantCampaign, wantBatch *int64
+		err                     error
+	}{
+		{"neither", nil, nil, nil, nil, nil},
+		{"campaign", &campaign.ID, nil, &campaign.ID, nil, nil},
+		{"batch fills in its campaign", nil, &batch.ID, &campaign.ID, &batch.ID, nil},
+		{"batch of the campaign", &campaign.ID, &batch.ID, &campaign.ID, &batch.ID, nil},
+		{"batch of another campaign", &other.ID, &batch.ID, nil, nil, ErrBatchCampaignMismatch},
+		{"unknown campaign", &unknown, nil, nil, nil, gorm.ErrRecordNotFound},
+		{"unknown batch", &campaign.ID, &unknown, nil, nil, gorm.ErrRecordNotFound},
+	}
+	equal := func(a, b *int64) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var campaignID, batchID *int64
+			err := db.Transaction(func(tx *gorm.DB) error {
+				var err error
+				campaignID, batchID, err = resolveRunGroup(tx, tt.campaignID, tt.batchID)
+				return err
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !equal(campaignID, tt.wantCampaign) || !equal(batchID, tt.wantBatch) {
+				t.Errorf("campaign %v, batch %v, want %v and %v", campaignID, batchID, tt.wantCampaign, tt.wantBatch)
+			}
+		})
+	}
+}
+
+// TestDeleteCampaignCountsRunsInTransaction starts a run in a campaign while
+// it is deleted. Either the run is stored in the campaign and the campaign
+// stays, or the campaign is gone and the run is rejected, never both.
+func TestDeleteCampaignCountsRunsInTransaction(t *testing.T) {
+	db := openTestDB(t)
+
+	for i := 0; i < 20; i++ {
+		campaign := Campaign{Name: "race"}
+		if err := db.Create(&campaign).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		began := make(chan error, 1)
+		go func() {
+			began <- db.Transaction(func(tx *gorm.DB) error {
+				campaignID, _, err := resolveRunGroup(tx, &campaign.ID, nil)
+				if err != nil {
+					return err
+				}
+				return tx.Create(&TestRun{Protocol: ProtocolHTTP3, CampaignID: campaignID, State: RunStateCreated}).Error
+			})
+		}()
+		deleted := deleteCampaign(db, campaign.ID)
+		beginErr := <-began
+
+		switch {
+		case deleted == nil && beginErr == nil:
+			t.Fatal("run stored in a deleted campaign")
+		case deleted == nil && !errors.Is(beginErr, gorm.ErrRecordNotFound):
+			t.Fatalf("run in deleted campaign failed with %v", beginErr)
+		case beginErr == nil && !errors.Is(deleted, ErrCampaignHasRuns):
+			t.Fatalf("deleting a campaign with a run failed with %v", deleted)
+		}
+	}
+
+	var orphans int64
+	err := db.Model(&TestRun{}).Where("campaign_id IS NOT NULL AND campaign_id NOT IN (?)", db.Model(&Campaign{}).Select("id")).Count(&orphans).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphans > 0 {
+		t.Errorf("%d runs point at deleted campaigns", orphans)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// CleaningRule is one step of the cleaning pipeline that used to live in the
+// C# Cleaner (TestSuite/Cleaner.cs). Apply mutates the run in place and
+// returns false to stop the remaining rules for this run.
+type CleaningRule struct {
+	Name  string
+	Apply func(run *TestRun) bool
+}
+
+// CleaningChange records a single field a rule changed.
+type CleaningChange struct {
+	Rule  string `json:"rule"`
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+const (
+	ErrorEndTimeNotSet       = "ENDTIME NOT SET/COLLECTED"
+	ErrorTransferStartNotSet = "TRANSFERSTART NOT SET/COLLECTED"
+	ErrorTransferEndNotSet   = "TRANSFEREND NOT SET/COLLECTED"
+)
+
+var defaultCleaningRules = []CleaningRule{
+	{Name: "missing-test-end", Apply: cleanMissingTestEnd},
+	{Name: "restore-transfer-times", Apply: cleanRestoreTransferTimes},
+	{Name: "approximate-bytes-sent", Apply: cleanApproximateBytesSent},
+	{Name: "normalize-errors", Apply: cleanNormalizeErrors},
+}
+
+// retiredCleaningRules are still accepted by parseCleaningRules, so existing
+// queries keep working, but select nothing. "webrtc-millis" converted the
+// transfer start of WebRTC runs from milliseconds, which every transfer time
+// is stored in since, see normalizeUnixMillis.
+var retiredCleaningRules = []string{"webrtc-millis"}
+
+// parseCleaningRules selects rules by name, keeping the order of the default
+// chain. An empty selection means all rules.
+func parseCleaningRules(v string) ([]CleaningRule, error) {
+	names := splitQuery(v)
+	if len(names) == 0 {
+		return defaultCleaningRules, nil
+	}
+
+	selected := map[string]bool{}
+	for _, name := range names {
+		if slices.Contains(retiredCleaningRules, name) {
+			continue
+		}
+		found := false
+		for _, rule := range defaultCleaningRules {
+			if rule.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("rules: unknown cleaning rule %q", name)
+		}
+		selected[name] = true
+	}
+
+	rules := []CleaningRule{}
+	for _, rule := range defaultCleaningRules {
+		if selected[rule.Name] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// cleanRun applies the rules to a copy of the run and records every field
+// each rule changed. The stored run is never modified, so raw and cleaned data
+// always derive from the same rows. The derived metrics are recomputed from
+// the cleaned values and recorded as the pseudo rule "derive-metrics".
+func cleanRun(run TestRun, rules []CleaningRule) (TestRun, []CleaningChange) {
+	changes := []CleaningChange{}
+
+	for _, rule := range rules {
+		before := run
+		cont := rule.Apply(&run)
+		changes = append(changes, diffRuns(rule.Name, before, run)...)
+		if !cont {
+			break
+		}
+	}
+
+	before := run
+	deriveRunMetrics(&run)
+	changes = append(changes, diffRuns("derive-metrics", before, run)...)
+
+	return run, changes
+}
+
+func cleanRuns(runs []TestRun, rules []CleaningRule) ([]TestRun, map[int64][]CleaningChange) {
+	cleaned := make([]TestRun, len(runs))
+	changes := map[int64][]CleaningChange{}
+	for i, run := range runs {
+		var c []CleaningChange
+		cleaned[i], c = cleanRun(run, rules)
+		if len(c) > 0 {
+			changes[run.ID] = c
+		}
+	}
+	return cleaned, changes
+}
+
+// cleaningRuleNames lists the rules that made changes, in the order they
+// ran, separated by commas.
+func cleaningRuleNames(changes []CleaningChange) string {
+	names := []string{}
+	for _, c := range changes {
+		if !slices.Contains(names, c.Rule) {
+			names = append(names, c.Rule)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func diffRuns(rule string, before, after TestRun) []CleaningChange {
+	changes := []CleaningChange{}
+	bv, av := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < bv.NumField(); i++ {
+		b, a := bv.Field(i).Interface(), av.Field(i).Interface()
+		if !reflect.DeepEqual(b, a) {
+			changes = append(changes, CleaningChange{Rule: rule, Field: bv.Type().Field(i).Name, Old: b, New: a})
+		}
+	}
+	return changes
+}
+
+// cleanMissingTestEnd discards the metrics of runs that never reported their
+// end, usually because the client crashed before sending "@end".
+func cleanMissingTestEnd(run *TestRun) bool {
+	if !run.TestEnd.IsZero() {
+		return true
+	}
+
+	run.TransferStartUnixMs = 0
+	run.TransferEndUnixMs = 0
+	run.BytesPayload = 0
+	run.CpuClientPercentBefore = 0
+	run.CpuClientPercentAfter = 0
+	run.CpuClientPercentWhile = 0
+	run.CpuServerPercentBefore = 0
+	run.CpuServerPercentAfter = 0
+	run.CpuServerPercentWhile = 0
+	run.RamClientBytesBefore = 0
+	run.RamClientBytesAfter = 0
+	run.RamClientBytesWhile = 0
+	run.RamServerBytesBefore = 0
+	run.RamServerBytesAfter = 0
+	run.RamServerBytesWhile = 0
+	run.LostPackets = 0
+	setCollectError(run, ErrorEndTimeNotSet)
+	return false
+}
+
+// cleanRestoreTransferTimes falls back to the test begin/end for transfer
+// timestamps that were never collected.
+func cleanRestoreTransferTimes(run *TestRun) bool {
+	if run.TransferStartUnixMs == 0 && !run.TestBegin.IsZero() {
+		run.TransferStartUnixMs = run.TestBegin.UnixMilli()
+		setCollectError(run, ErrorTransferStartNotSet)
+	}
+
+	if run.TransferEndUnixMs == 0 && !run.TestEnd.IsZero() {
+		run.TransferEndUnixMs = run.TestEnd.UnixMilli()
+		if run.Error != "" {
+			run.Error += " / " + ErrorTransferEndNotSet
+		} else {
+			setCollectError(run, ErrorTransferEndNotSet)
+		}
+	}
+
+	return true
+}
+
+// setCollectError replaces the error of a run with one of the collect phase.
+func setCollectError(run *TestRun, message string) {
+	run.Error = message
+	run.ErrorPhase = ErrorPhaseCollect
+	run.ErrorCode = "not_collected"
+	run.ErrorProtocolCode = nil
+	run.ErrorProtocolCodeKind = ""
+	run.ErrorSide = SideAny
+}
+
+// cleanApproximateBytesSent replaces the unreliable netstat based
+// BytesSentTotal with an estimate of the protocol overhead per chunk.
+func cleanApproximateBytesSent(run *TestRun) bool {
+	payload := run.BytesPayload
+
+	switch run.Protocol {
+	case ProtocolHTTP3, ProtocolWebTransport:
+		const chunkSize = 16 * 1024 // typical DATA frame size
+		const overheadPerChunk = 60 // HTTP/3 + QUIC + UDP + IP
+		chunks := (payload + chunkSize - 1) / chunkSize
+		run.BytesSentTotal = payload + chunks*overheadPerChunk
+	case ProtocolWebSockets:
+		chunks := int64(math.Ceil(float64(payload) / (64 * 1024)))
+		run.BytesSentTotal = payload + chunks*8
+	case ProtocolWebRTC:
+		// a 64 KiB message is split into ~4 SCTP chunks of ~16 KiB, each
+		// carrying ~60 bytes of SCTP + DTLS + UDP + IP overhead
+		chunks := int64(math.Ceil(float64(payload) / (64 * 1024)))
+		run.BytesSentTotal = payload + chunks*240
+	}
+
+	return true
+}
+
+var errorNormalizations = []struct {
+	contains string
+	exact    bool
+	replace  string
+}{
+	{contains: "Failed to dial WebSockets: unexpected EOF", exact: true, replace: "WEBSOCKETS: UNEXPECTED EOF"},
+	{contains: "Eine vorhandene Verbindung wurde vom Remotehost geschlossen.", replace: "WEBSOCKETS: CONNECTION CLOSED"},
+	{contains: "An existing connection was forcibly closed by the remote host.", replace: "WEBSOCKETS: CONNECTION CLOSED"},
+}
+
+// cleanNormalizeErrors maps localized OS error messages to stable codes.
+func cleanNormalizeErrors(run *TestRun) bool {
+	for _, n := range errorNormalizations {
+		if (n.exact && run.Error == n.contains) || (!n.exact && strings.Contains(run.Error, n.contains)) {
+			run.Error = n.replace
+			break
+		}
+	}
+	return true
+}
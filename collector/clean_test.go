@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCleaningRules(t *testing.T) {
+	rules, err := parseCleaningRules("normalize-errors,missing-test-end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, rule := range rules {
+		names = append(names, rule.Name)
+	}
+	if want := []string{"missing-test-end", "normalize-errors"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got rules %v, want the default order %v", names, want)
+	}
+
+	if rules, err := parseCleaningRules(""); err != nil || len(rules) != len(defaultCleaningRules) {
+		t.Errorf("empty selection: got %d rules, %v", len(rules), err)
+	}
+	if _, err := parseCleaningRules("missing-test-end,bogus"); err == nil {
+		t.Error("unknown rule: got no error")
+	}
+
+	// webrtc-millis was removed, timestamps are normalized when they are stored
+	if rules, err := parseCleaningRules("webrtc-millis"); err != nil || rules == nil || len(rules) != 0 {
+		t.Errorf("retired rule: got %d rules, %v, want none", len(rules), err)
+	}
+	if rules, err := parseCleaningRules("webrtc-millis,normalize-errors"); err != nil || len(rules) != 1 || rules[0].Name != "normalize-errors" {
+		t.Errorf("retired and current rule: got %v, %v", rules, err)
+	}
+}
+
+func TestCleanRun(t *testing.T) {
+	begin := time.UnixMilli(1_700_000_000_000).UTC()
+	end := begin.Add(3 * time.Second)
+
+	t.Run("missing test end stops the chain", func(t *testing.T) {
+		run := TestRun{ID: 1, Protocol: ProtocolHTTP3, TestBegin: begin, BytesPayload: 1 << 20, CpuClientPercentWhile: 40, Error: "An existing connection was forcibly closed by the remote host."}
+		cleaned, changes := cleanRun(run, defaultCleaningRules)
+
+		if cleaned.BytesPayload != 0 || cleaned.CpuClientPercentWhile != 0 {
+			t.Errorf("metrics were kept: payload %d, cpu %v", cleaned.BytesPayload, cleaned.CpuClientPercentWhile)
+		}
+		if cleaned.Error != ErrorEndTimeNotSet || cleaned.ErrorPhase != ErrorPhaseCollect {
+			t.Errorf("got error %q in phase %q, want %q in collect", cleaned.Error, cleaned.ErrorPhase, ErrorEndTimeNotSet)
+		}
+		for _, c := range changes {
+			if c.Rule != "missing-test-end" && c.Rule != "derive-metrics" {
+				t.Errorf("rule %s ran after missing-test-end and changed %s", c.Rule, c.Field)
+			}
+		}
+		if run.BytesPayload != 1<<20 {
+			t.Error("the input run was modified")
+		}
+	})
+
+	t.Run("restores transfer times", func(t *testing.T) {
+		run := TestRun{ID: 2, Protocol: ProtocolWebSockets, TestBegin: begin, TestEnd: end}
+		rules, _ := parseCleaningRules("restore-transfer-times")
+		cleaned, _ := cleanRun(run, rules)
+
+		if cleaned.TransferStartUnixMs != begin.UnixMilli() || cleaned.TransferEndUnixMs != end.UnixMilli() {
+			t.Errorf("got transfer %d..%d, want %d..%d", cleaned.TransferStartUnixMs, cleaned.TransferEndUnixMs, begin.UnixMilli(), end.UnixMilli())
+		}
+		if want := ErrorTransferStartNotSet + " / " + ErrorTransferEndNotSet; cleaned.Error != want {
+			t.Errorf("got error %q, want %q", cleaned.Error, want)
+		}
+		if cleaned.TransferDurationMs == nil || *cleaned.TransferDurationMs != 3000 {
+			t.Errorf("got transfer duration %v, want it derived from the restored times", cleaned.TransferDurationMs)
+		}
+	})
+
+	t.Run("approximates bytes sent per protocol", func(t *testing.T) {
+		rules, _ := parseCleaningRules("approximate-bytes-sent")
+		for _, tt := range []struct {
+			protocol Protocol
+			want     int64
+		}{
+			{ProtocolHTTP3, 100_000 + 7*60},
+			{ProtocolWebTransport, 100_000 + 7*60},
+			{ProtocolWebSockets, 100_000 + 2*8},
+			{ProtocolWebRTC, 100_000 + 2*240},
+		} {
+			cleaned, _ := cleanRun(TestRun{Protocol: tt.protocol, TestEnd: end, BytesPayload: 100_000, BytesSentTotal: 1}, rules)
+			if cleaned.BytesSentTotal != tt.want {
+				t.Errorf("%s: got %d bytes sent, want %d", tt.protocol, cleaned.BytesSentTotal, tt.want)
+			}
+		}
+	})
+
+	t.Run("normalizes errors", func(t *testing.T) {
+		rules, _ := parseCleaningRules("normalize-errors")
+		for message, want := range map[string]string{
+			"Failed to dial WebSockets: unexpected EOF":                          "WEBSOCKETS: UNEXPECTED EOF",
+			"Failed to dial WebSockets: unexpected EOF (retry)":                  "Failed to dial WebSockets: unexpected EOF (retry)",
+			"read: Eine vorhandene Verbindung wurde vom Remotehost geschlossen.": "WEBSOCKETS: CONNECTION CLOSED",
+		} {
+			cleaned, changes := cleanRun(TestRun{TestEnd: end, Error: message}, rules)
+			if cleaned.Error != want {
+				t.Errorf("%q: got %q, want %q", message, cleaned.Error, want)
+			}
+			if changed := len(changes) > 0; changed != (message != want) {
+				t.Errorf("%q: got changes %v", message, changes)
+			}
+		}
+	})
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// defaultCompareMetrics are the metrics a regression check looks at.
+var defaultCompareMetrics = []string{
+	"ThroughputMbps", "TransferDurationMs",
+	"CpuClientPercentWhile", "CpuServerPercentWhile", "RamClientBytesWhile", "RamServerBytesWhile",
+}
+
+// higherIsBetter lists the metrics where an increase is an improvement. For
+// every other metric (durations, CPU, RAM) an increase is a regression.
+var higherIsBetter = map[string]bool{
+	"ThroughputMbps":      true,
+	"BandwidthEfficiency": true,
+}
+
+type Verdict string
+
+const (
+	VerdictPass         Verdict = "pass"
+	VerdictRegress      Verdict = "regress"
+	VerdictImprove      Verdict = "improve"
+	VerdictInsufficient Verdict = "insufficient"
+)
+
+// CompareOptions configures a comparison. A change is only reported as
+// regression or improvement if the Mann-Whitney U test is significant at
+// Alpha, the bootstrap confidence interval of the median difference (level
+// 1 - Alpha) excludes 0 and the median moved by at least Threshold relative to
+// the baseline.
+type CompareOptions struct {
+	Metrics   []StatMetric
+	GroupBy   []string
+	Alpha     float64
+	Threshold float64
+	Bootstrap int // number of bootstrap resamples
+	MinRuns   int // minimum number of runs on each side
+	Seed      int64
+}
+
+// CompareResult compares one metric of one group. Test statistics are nil if
+// either side has fewer than MinRuns values.
+type CompareResult struct {
+	Key             map[string]string `json:"key"`
+	Metric          string            `json:"metric"`
+	HigherIsBetter  bool              `json:"higher_is_better"`
+	BaselineN       int               `json:"baseline_n"`
+	CandidateN      int               `json:"candidate_n"`
+	BaselineMedian  *float64          `json:"baseline_median"`
+	CandidateMedian *float64          `json:"candidate_median"`
+	MedianDiff      *float64          `json:"median_diff"`     // candidate - baseline
+	RelativeChange  *float64          `json:"relative_change"` // MedianDiff / |baseline median|, nil for a baseline median of 0
+	CILow           *float64          `json:"ci_low"`
+	CIHigh          *float64          `json:"ci_high"`
+	U               *float64          `json:"u"`
+	P               *float64          `json:"p"`
+	RankBiserial    *float64          `json:"rank_biserial"` // effect size 2U / (n1 n2) - 1, positive if the candidate is larger
+	Verdict         Verdict           `json:"verdict"`
+}
+
+// parseCompareOptions reads the options shared by GET /compare and the
+// compare command.
+func parseCompareOptions(query func(string) string) (CompareOptions, error) {
+	opts := CompareOptions{Alpha: 0.05, Threshold: 0.05, Bootstrap: 2000, MinRuns: 5, Seed: 1}
+
+	names := splitQuery(query("metrics"))
+	if len(names) == 0 {
+		names = defaultCompareMetrics
+	}
+	for _, name := range names {
+		m, ok := lookupStatMetric(name)
+		if !ok {
+			return opts, fmt.Errorf("metrics: unknown metric %q", name)
+		}
+		opts.Metrics = append(opts.Metrics, m)
+	}
+
+	var err error
+	if opts.GroupBy, err = parseGroupBy(query("group_by")); err != nil {
+		return opts, err
+	}
+
+	if v := query("alpha"); v != "" {
+		if opts.Alpha, err = strconv.ParseFloat(v, 64); err != nil || opts.Alpha <= 0 || opts.Alpha >= 1 {
+			return opts, errors.New("alpha: must be a number between 0 and 1")
+		}
+	}
+	if v := query("threshold"); v != "" {
+		if opts.Threshold, err = strconv.ParseFloat(v, 64); err != nil || opts.Threshold < 0 {
+			return opts, errors.New("threshold: must be a non-negative number")
+		}
+	}
+	if v := query("bootstrap"); v != "" {
+		if opts.Bootstrap, err = strconv.Atoi(v); err != nil || opts.Bootstrap < 100 {
+			return opts, errors.New("bootstrap: must be at least 100")
+		}
+	}
+	if v := query("min_runs"); v != "" {
+		if opts.MinRuns, err = strconv.Atoi(v); err != nil || opts.MinRuns < 2 {
+			return opts, errors.New("min_runs: must be at least 2")
+		}
+	}
+	if v := query("seed"); v != "" {
+		if opts.Seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return opts, fmt.Errorf("seed: %w", err)
+		}
+	}
+
+	return opts, nil
+}
+
+// selectionQuery reads the parameters of one side of a comparison. A
+// parameter prefixed with the side ("baseline." or "candidate.") overrides the
+// unprefixed one, which applies to both sides.
+func selectionQuery(query func(string) string, side string) func(string) string {
+	return func(key string) string {
+		if v := query(side + "." + key); v != "" {
+			return v
+		}
+		return query(key)
+	}
+}
+
+func loadComparison(db *gorm.DB, query func(string) string) ([]TestRun, []TestRun, error) {
+	baselineFilter, err := parseRunFilterFrom(selectionQuery(query, "baseline"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("baseline: %w", err)
+	}
+	candidateFilter, err := parseRunFilterFrom(selectionQuery(query, "candidate"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("candidate: %w", err)
+	}
+
+	baseline, candidate := []TestRun{}, []TestRun{}
+	if err := baselineFilter.Apply(db).Find(&baseline).Error; err != nil {
+		return nil, nil, err
+	}
+	if err := candidateFilter.Apply(db).Find(&candidate).Error; err != nil {
+		return nil, nil, err
+	}
+	if err := attachCustomValues(db, baseline); err != nil {
+		return nil, nil, err
+	}
+	if err := attachCustomValues(db, candidate); err != nil {
+		return nil, nil, err
+	}
+	return baseline, candidate, nil
+}
+
+// compareRuns compares every metric per group between the two selections.
+func compareRuns(baseline, candidate []TestRun, opts CompareOptions) []CompareResult {
+	keys, _ := groupRuns(append(append([]TestRun{}, baseline...), candidate...), opts.GroupBy)
+	baselineGroups := groupsByKey(baseline, opts.GroupBy)
+	candidateGroups := groupsByKey(candidate, opts.GroupBy)
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+
+	results := []CompareResult{}
+	for _, key := range keys {
+		id := groupKeyID(key, opts.GroupBy)
+		for _, m := range opts.Metrics {
+			a := metricValues(baselineGroups[id], m)
+			b := metricValues(candidateGroups[id], m)
+			results = append(results, compareMetric(key, m.Name, a, b, opts, rng))
+		}
+	}
+	return results
+}
+
+func groupKeyID(key map[string]string, groupBy []string) string {
+	parts := make([]string, len(groupBy))
+	for i, col := range groupBy {
+		parts[i] = key[col]
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func groupsByKey(runs []TestRun, groupBy []string) map[string][]TestRun {
+	keys, groups := groupRuns(runs, groupBy)
+	m := make(map[string][]TestRun, len(keys))
+	for i, key := range keys {
+		m[groupKeyID(key, groupBy)] = groups[i]
+	}
+	return m
+}
+
+func compareMetric(key map[string]string, metric string, baseline, candidate []float64, opts CompareOptions, rng *rand.Rand) CompareResult {
+	result := CompareResult{
+		Key:            key,
+		Metric:         metric,
+		HigherIsBetter: higherIsBetter[metric],
+		BaselineN:      len(baseline),
+		CandidateN:     len(candidate),
+		Verdict:        VerdictInsufficient,
+	}
+	if len(baseline) < opts.MinRuns || len(candidate) < opts.MinRuns {
+		return result
+	}
+
+	medA, medB := median(baseline), median(candidate)
+	diff := medB - medA
+	result.BaselineMedian = &medA
+	result.CandidateMedian = &medB
+	result.MedianDiff = &diff
+	if medA != 0 {
+		rel := diff / math.Abs(medA)
+		result.RelativeChange = &rel
+	}
+
+	lo, hi := bootstrapMedianDiff(baseline, candidate, opts.Bootstrap, opts.Alpha, rng)
+	result.CILow = &lo
+	result.CIHigh = &hi
+
+	u, p := mannWhitneyU(baseline, candidate)
+	rb := 2*u/float64(len(baseline)*len(candidate)) - 1
+	result.U = &u
+	result.P = &p
+	result.RankBiserial = &rb
+
+	result.Verdict = VerdictPass
+	significant := p < opts.Alpha && (lo > 0 || hi < 0)
+	large := result.RelativeChange == nil || math.Abs(*result.RelativeChange) >= opts.Threshold
+	if significant && large {
+		if (diff > 0) == result.HigherIsBetter {
+			result.Verdict = VerdictImprove
+		} else {
+			result.Verdict = VerdictRegress
+		}
+	}
+	return result
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return quantile(sorted, 0.5)
+}
+
+// mannWhitneyU returns U of the candidate sample and the two-sided p-value of
+// the normal approximation with tie and continuity correction, the same as
+// scipy.stats.mannwhitneyu(method="asymptotic").
+func mannWhitneyU(baseline, candidate []float64) (float64, float64) {
+	rankSums, n, ties := rankSamples([][]float64{baseline, candidate})
+	n1, n2, N := float64(len(baseline)), float64(len(candidate)), float64(n)
+
+	u := rankSums[1] - n2*(n2+1)/2
+	mu := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((N + 1) - ties/(N*(N-1))))
+	if sigma == 0 {
+		return u, 1
+	}
+
+	z := (math.Abs(u-mu) - 0.5) / sigma
+	return u, math.Min(2*normalSurvival(math.Max(z, 0)), 1)
+}
+
+// bootstrapMedianDiff returns the percentile bootstrap confidence interval of
+// median(candidate) - median(baseline) at level 1 - alpha.
+func bootstrapMedianDiff(baseline, candidate []float64, iterations int, alpha float64, rng *rand.Rand) (float64, float64) {
+	resample := func(values, buf []float64) float64 {
+		for i := range buf {
+			buf[i] = values[rng.Intn(len(values))]
+		}
+		sort.Float64s(buf)
+		return quantile(buf, 0.5)
+	}
+
+	bufA, bufB := make([]float64, len(baseline)), make([]float64, len(candidate))
+	diffs := make([]float64, iterations)
+	for i := range diffs {
+		diffs[i] = resample(candidate, bufB) - resample(baseline, bufA)
+	}
+	sort.Float64s(diffs)
+	return quantile(diffs, alpha/2), quantile(diffs, 1-alpha/2)
+}
+
+func exportCompareToCsv(results []CompareResult, groupBy []string) string {
+	header := append(append([]string{}, groupBy...), "metric", "baseline_n", "candidate_n", "baseline_median", "candidate_median", "median_diff", "relative_change", "ci_low", "ci_high", "u", "p", "rank_biserial", "verdict")
+	lines := []string{strings.Join(header, ";")}
+
+	f := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+
+	for _, r := range results {
+		row := []string{}
+		for _, col := range groupBy {
+			row = append(row, r.Key[col])
+		}
+		row = append(row, r.Metric, strconv.Itoa(r.BaselineN), strconv.Itoa(r.CandidateN),
+			f(r.BaselineMedian), f(r.CandidateMedian), f(r.MedianDiff), f(r.RelativeChange),
+			f(r.CILow), f(r.CIHigh), f(r.U), f(r.P), f(r.RankBiserial), string(r.Verdict))
+		lines = append(lines, strings.Join(row, ";"))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func registerCompareRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	app.Get("/compare", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		query := func(key string) string { return c.Query(key) }
+
+		opts, err := parseCompareOptions(query)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		baseline, candidate, err := loadComparison(db, query)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		results := compareRuns(baseline, candidate, opts)
+
+		if c.Query("format") == "csv" || (c.Query("format") == "" && c.Accepts(fiber.MIMEApplicationJSON, "text/csv") == "text/csv") {
+			c.Set("Content-Type", "text/csv")
+			c.Set("Content-Disposition", "attachment; filename=compare.csv")
+			return c.SendString(exportCompareToCsv(results, opts.GroupBy))
+		}
+
+		return c.JSON(fiber.Map{
+			"group_by":  opts.GroupBy,
+			"alpha":     opts.Alpha,
+			"threshold": opts.Threshold,
+			"bootstrap": opts.Bootstrap,
+			"results":   results,
+		})
+	})
+}
+
+// errRegression is returned by the compare command if any metric regressed,
+// so scripts can fail on it.
+var errRegression = errors.New("regression detected")
+
+// runCompareCommand implements "collector compare -baseline <query>
+// -candidate <query> [options]". Selections use the query parameters of
+// GET /runs, e.g. -baseline "campaign_id=3" -candidate "campaign_id=4".
+func runCompareCommand(db *gorm.DB, args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	baseline := fs.String("baseline", "", "run selection of the baseline, as query string")
+	candidate := fs.String("candidate", "", "run selection of the candidate, as query string")
+	common := fs.String("filter", "", "run selection applied to both sides, as query string")
+	metrics := fs.String("metrics", "", "comma separated metrics (default "+strings.Join(defaultCompareMetrics, ",")+")")
+	groupBy := fs.String("group-by", "protocol", "comma separated columns to compare within")
+	alpha := fs.String("alpha", "0.05", "significance level, also sets the confidence interval level")
+	threshold := fs.String("threshold", "0.05", "minimum relative change of the median")
+	bootstrap := fs.String("bootstrap", "2000", "number of bootstrap resamples")
+	minRuns := fs.String("min-runs", "5", "minimum number of runs on each side")
+	seed := fs.String("seed", "1", "seed of the bootstrap")
+	csv := fs.Bool("csv", false, "print CSV instead of a table")
+	fs.Parse(args)
+
+	params := url.Values{}
+	for prefix, raw := range map[string]string{"": *common, "baseline.": *baseline, "candidate.": *candidate} {
+		values, err := url.ParseQuery(raw)
+		if err != nil {
+			return fmt.Errorf("%sselection: %w", prefix, err)
+		}
+		for k, v := range values {
+			params[prefix+k] = v
+		}
+	}
+	params.Set("metrics", *metrics)
+	params.Set("group_by", *groupBy)
+	params.Set("alpha", *alpha)
+	params.Set("threshold", *threshold)
+	params.Set("bootstrap", *bootstrap)
+	params.Set("min_runs", *minRuns)
+	params.Set("seed", *seed)
+
+	opts, err := parseCompareOptions(params.Get)
+	if err != nil {
+		return err
+	}
+	a, b, err := loadComparison(db, params.Get)
+	if err != nil {
+		return err
+	}
+	results := compareRuns(a, b, opts)
+
+	if *csv {
+		fmt.Println(exportCompareToCsv(results, opts.GroupBy))
+	} else {
+		printCompareTable(results, opts.GroupBy)
+	}
+
+	for _, r := range results {
+		if r.Verdict == VerdictRegress {
+			return errRegression
+		}
+	}
+	return nil
+}
+
+func printCompareTable(results []CompareResult, groupBy []string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(append(append([]string{}, groupBy...), "metric", "n", "baseline", "candidate", "change", "ci", "p", "verdict"), "\t"))
+
+	g := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return strconv.FormatFloat(*v, 'g', 4, 64)
+	}
+
+	for _, r := range results {
+		row := []string{}
+		for _, col := range groupBy {
+			row = append(row, r.Key[col])
+		}
+		change := "-"
+		if r.RelativeChange != nil {
+			change = fmt.Sprintf("%+.1f%%", *r.RelativeChange*100)
+		}
+		row = append(row, r.Metric, fmt.Sprintf("%d/%d", r.BaselineN, r.CandidateN), g(r.BaselineMedian), g(r.CandidateMedian),
+			change, "["+g(r.CILow)+", "+g(r.CIHigh)+"]", g(r.P), string(r.Verdict))
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
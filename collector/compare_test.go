@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMannWhitneyU(t *testing.T) {
+	// scipy.stats.mannwhitneyu(candidate, baseline, method="asymptotic")
+	u, p := mannWhitneyU([]float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10})
+	if u != 25 || math.Abs(p-0.012185780355344818) > 1e-12 {
+		t.Errorf("separated samples: got U %v, p %v, want 25, 0.0121858", u, p)
+	}
+
+	u, p = mannWhitneyU([]float64{3, 3, 3}, []float64{3, 3, 3})
+	if u != 4.5 || p != 1 {
+		t.Errorf("identical samples: got U %v, p %v, want 4.5, 1", u, p)
+	}
+}
+
+func TestCompareMetric(t *testing.T) {
+	opts := CompareOptions{Alpha: 0.05, Threshold: 0.05, Bootstrap: 500, MinRuns: 5}
+	around := func(center float64) []float64 {
+		values := make([]float64, 20)
+		for i := range values {
+			values[i] = center * (1 + float64(i%5-2)/100)
+		}
+		return values
+	}
+
+	tests := []struct {
+		metric              string
+		baseline, candidate []float64
+		want                Verdict
+	}{
+		{"ThroughputMbps", around(100), around(80), VerdictRegress},
+		{"ThroughputMbps", around(100), around(120), VerdictImprove},
+		{"TransferDurationMs", around(100), around(120), VerdictRegress},
+		{"TransferDurationMs", around(100), around(80), VerdictImprove},
+		// a change below the threshold
+		{"TransferDurationMs", around(100), around(102), VerdictPass},
+		{"TransferDurationMs", around(100), around(100), VerdictPass},
+		{"TransferDurationMs", around(100), around(120)[:4], VerdictInsufficient},
+	}
+	for _, tt := range tests {
+		r := compareMetric(nil, tt.metric, tt.baseline, tt.candidate, opts, rand.New(rand.NewSource(1)))
+		if r.Verdict != tt.want {
+			t.Errorf("%s %v -> %v: got %s, want %s", tt.metric, median(tt.baseline), median(tt.candidate), r.Verdict, tt.want)
+		}
+		if tt.want == VerdictInsufficient {
+			if r.P != nil || r.MedianDiff != nil {
+				t.Errorf("%s: got statistics for too few runs", tt.metric)
+			}
+			continue
+		}
+		if *r.CILow > *r.MedianDiff || *r.CIHigh < *r.MedianDiff {
+			t.Errorf("%s: median difference %v outside its interval [%v, %v]", tt.metric, *r.MedianDiff, *r.CILow, *r.CIHigh)
+		}
+	}
+
+	// a baseline median of 0 has no relative change, any significant
+	// change counts
+	r := compareMetric(nil, "LostPackets", make([]float64, 10), around(10), opts, rand.New(rand.NewSource(1)))
+	if r.RelativeChange != nil || r.Verdict != VerdictRegress {
+		t.Errorf("zero baseline: got relative change %v and %s, want none and regress", r.RelativeChange, r.Verdict)
+	}
+}
+
+func TestCompareRunsGroups(t *testing.T) {
+	runs := func(protocol Protocol, n int, mbps float64) []TestRun {
+		out := make([]TestRun, n)
+		for i := range out {
+			v := mbps + float64(i)
+			out[i] = TestRun{Protocol: protocol, ThroughputMbps: &v}
+		}
+		return out
+	}
+	baseline := append(runs(ProtocolHTTP3, 10, 100), runs(ProtocolWebSockets, 10, 100)...)
+	candidate := runs(ProtocolHTTP3, 10, 50)
+
+	opts := CompareOptions{Metrics: []StatMetric{statMetricsByName["ThroughputMbps"]}, GroupBy: []string{"protocol"}, Alpha: 0.05, Threshold: 0.05, Bootstrap: 200, MinRuns: 5, Seed: 1}
+	verdicts := map[string]Verdict{}
+	for _, r := range compareRuns(baseline, candidate, opts) {
+		verdicts[r.Key["protocol"]] = r.Verdict
+	}
+	if verdicts["http3"] != VerdictRegress || verdicts["websockets"] != VerdictInsufficient || len(verdicts) != 2 {
+		t.Errorf("got %v, want http3 regressed and websockets without candidate", verdicts)
+	}
+}
+
+func TestParseCompareOptions(t *testing.T) {
+	query := func(params map[string]string) func(string) string {
+		return func(key string) string { return params[key] }
+	}
+
+	opts, err := parseCompareOptions(query(map[string]string{"metrics": "ThroughputMbps", "alpha": "0.01"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Metrics) != 1 || opts.Alpha != 0.01 || opts.Bootstrap != 2000 {
+		t.Errorf("got %+v", opts)
+	}
+
+	for _, params := range []map[string]string{
+		{"metrics": "NoSuchMetric"},
+		{"alpha": "1"},
+		{"threshold": "-0.1"},
+		{"bootstrap": "10"},
+		{"min_runs": "1"},
+		{"seed": "x"},
+	} {
+		if _, err := parseCompareOptions(query(params)); err == nil {
+			t.Errorf("%v: got no error", params)
+		}
+	}
+
+	side := selectionQuery(query(map[string]string{"protocol": "http3", "candidate.protocol": "webtransport"}), "candidate")
+	if side("protocol") != "webtransport" {
+		t.Errorf("candidate.protocol did not override protocol")
+	}
+	if side := selectionQuery(query(map[string]string{"protocol": "http3"}), "baseline"); side("protocol") != "http3" {
+		t.Errorf("protocol did not apply to the baseline")
+	}
+}
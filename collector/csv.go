@@ -1,31 +1,93 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"log"
 	"strings"
 	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
-func exportToCsv(runs []TestRun) string {
-	csvLines := []string{
-		strings.Join([]string{
-			"id", "protocol", "enviroment", "time_slot", "test_begin", "test_end", "client_id", "parallel_clients",
-			"transfer_start_unix", "transfer_end_unix", "latency_ms", "throughput_mbps", "bytes_sent_total", "bytes_payload", "bandwidth_efficiency",
-			"cpu_client_percent_before", "cpu_client_percent_after", "cpu_client_percent_while", "cpu_server_percent_before", "cpu_server_percent_after", "cpu_server_percent_while",
-			"ram_client_bytes_before", "ram_client_bytes_after", "ram_client_bytes_while", "ram_server_bytes_before", "ram_server_bytes_after", "ram_server_bytes_while",
-			"lost_packets", "retransmissions", "connection_duration", "stream_duration", "error",
-		}, ";"),
+// legacyCsvHeader are the columns of the CSV the collector wrote before
+// /export, which TestSuite/Cleaner.cs and the analyzer scripts read.
+var legacyCsvHeader = []string{
+	"id", "protocol", "enviroment", "time_slot", "test_begin", "test_end", "client_id", "parallel_clients",
+	"transfer_start_unix", "transfer_end_unix", "latency_ms", "throughput_mbps", "bytes_sent_total", "bytes_payload", "bandwidth_efficiency",
+	"cpu_client_percent_before", "cpu_client_percent_after", "cpu_client_percent_while", "cpu_server_percent_before", "cpu_server_percent_after", "cpu_server_percent_while",
+	"ram_client_bytes_before", "ram_client_bytes_after", "ram_client_bytes_while", "ram_server_bytes_before", "ram_server_bytes_after", "ram_server_bytes_while",
+	"lost_packets", "retransmissions", "connection_duration", "stream_duration", "error",
+}
+
+// legacyTransferStart returns the transfer start in the unit the clients used
+// to report it: seconds, except for WebRTC, whose client reported
+// milliseconds. Cleaner.cs corrects WebRTC starts by dividing them by 1000.
+func legacyTransferStart(run *TestRun) int64 {
+	if run.Protocol == ProtocolWebRTC {
+		return run.TransferStartUnixMs
 	}
+	return run.TransferStartUnixMs / 1000
+}
 
-	for _, run := range runs {
-		csvLines = append(csvLines, strings.Join([]string{
-			fmt.Sprintf("%d", run.ID), string(run.Protocol), string(run.Enviroment), string(run.TimeSlot), run.TestBegin.Format(time.RFC3339), run.TestEnd.Format(time.RFC3339), fmt.Sprintf("%d", run.ClientID), fmt.Sprintf("%d", run.ParallelClients),
-			fmt.Sprintf("%d", run.TransferStartUnix), fmt.Sprintf("%d", run.TransferEndUnix), fmt.Sprintf("%d", run.LatencyMs()), fmt.Sprintf("%f", run.ThroughputMbps), fmt.Sprintf("%d", run.BytesSentTotal), fmt.Sprintf("%d", run.BytesPayload), fmt.Sprintf("%f", run.BandwidthEfficiency()),
-			fmt.Sprintf("%f", run.CpuClientPercentBefore), fmt.Sprintf("%f", run.CpuClientPercentAfter), fmt.Sprintf("%f", run.CpuClientPercentWhile), fmt.Sprintf("%f", run.CpuServerPercentBefore), fmt.Sprintf("%f", run.CpuServerPercentAfter), fmt.Sprintf("%f", run.CpuServerPercentWhile),
-			fmt.Sprintf("%d", run.RamClientBytesBefore), fmt.Sprintf("%d", run.RamClientBytesAfter), fmt.Sprintf("%d", run.RamClientBytesWhile), fmt.Sprintf("%d", run.RamServerBytesBefore), fmt.Sprintf("%d", run.RamServerBytesAfter), fmt.Sprintf("%d", run.RamServerBytesWhile),
-			fmt.Sprintf("%d", run.LostPackets), fmt.Sprintf("%d", run.Retransmissions), fmt.Sprintf("%d", run.ConnectionDuration), fmt.Sprintf("%d", run.StreamDuration), run.Error,
-		}, ";"))
+// legacyCsvLine formats a run like the collector did before /export: times in
+// seconds, unfinished runs with the zero time as their end and latency_ms as
+// the difference of the two transfer columns, whatever their unit. Only
+// throughput_mbps differs, it is the derived throughput instead of always 0.
+func legacyCsvLine(run *TestRun) string {
+	start, end := legacyTransferStart(run), run.TransferEndUnixMs/1000
+	throughput := 0.0
+	if run.ThroughputMbps != nil {
+		throughput = *run.ThroughputMbps
 	}
 
-	return strings.Join(csvLines, "\n")
+	return strings.Join([]string{
+		fmt.Sprintf("%d", run.ID), string(run.Protocol), string(run.Enviroment), string(run.TimeSlot), run.TestBegin.Format(time.RFC3339), run.TestEnd.Format(time.RFC3339), fmt.Sprintf("%d", run.ClientID), fmt.Sprintf("%d", run.ParallelClients),
+		fmt.Sprintf("%d", start), fmt.Sprintf("%d", end), fmt.Sprintf("%d", end-start), fmt.Sprintf("%f", throughput), fmt.Sprintf("%d", run.BytesSentTotal), fmt.Sprintf("%d", run.BytesPayload), fmt.Sprintf("%f", float64(run.BytesPayload)/float64(run.BytesSentTotal)),
+		fmt.Sprintf("%f", run.CpuClientPercentBefore), fmt.Sprintf("%f", run.CpuClientPercentAfter), fmt.Sprintf("%f", run.CpuClientPercentWhile), fmt.Sprintf("%f", run.CpuServerPercentBefore), fmt.Sprintf("%f", run.CpuServerPercentAfter), fmt.Sprintf("%f", run.CpuServerPercentWhile),
+		fmt.Sprintf("%d", run.RamClientBytesBefore), fmt.Sprintf("%d", run.RamClientBytesAfter), fmt.Sprintf("%d", run.RamClientBytesWhile), fmt.Sprintf("%d", run.RamServerBytesBefore), fmt.Sprintf("%d", run.RamServerBytesAfter), fmt.Sprintf("%d", run.RamServerBytesWhile),
+		fmt.Sprintf("%d", run.LostPackets), fmt.Sprintf("%d", run.Retransmissions), fmt.Sprintf("%d", run.ConnectionDurationMs), fmt.Sprintf("%d", run.StreamDurationMs/1000), run.Error,
+	}, ";")
+}
+
+// exportLegacyCsv streams the runs matching the filter in the legacy format,
+// lines separated by LF, without a line break after the last one.
+func exportLegacyCsv(db *gorm.DB, filter RunFilter, w io.Writer) error {
+	if _, err := io.WriteString(w, strings.Join(legacyCsvHeader, ";")); err != nil {
+		return err
+	}
+
+	batch := []TestRun{}
+	return filter.Apply(db).FindInBatches(&batch, exportBatchSize, func(*gorm.DB, int) error {
+		for i := range batch {
+			if _, err := io.WriteString(w, "\n"+legacyCsvLine(&batch[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// registerLegacyCsvRoute serves GET /csv, kept in its old format for
+// TestSuite/Cleaner.cs and other existing scripts. New columns, units and
+// formats are only on /export.
+func registerLegacyCsvRoute(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	app.Get("/csv", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		filter, err := parseRunFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		c.Set("Content-Type", "text/csv")
+		c.Set("Content-Disposition", "attachment; filename=results.csv")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			if err := exportLegacyCsv(db, filter, w); err != nil {
+				log.Printf("export failed: %v", err)
+			}
+			w.Flush()
+		})
+		return nil
+	})
 }
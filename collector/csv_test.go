@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestLegacyCsvMatchesResultsCsv imports a CSV the collector wrote before
+// /export and checks that /csv writes it again as it was, so Cleaner.cs keeps
+// working on it.
+func TestLegacyCsvMatchesResultsCsv(t *testing.T) {
+	data, err := os.ReadFile("../assets/results.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t)
+	if _, err := importRunsCsv(db, bytes.NewReader(data), ImportOptions{Mode: ImportModeSkip}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := exportLegacyCsv(db, RunFilter{}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file was checked out with CRLF, the old collector wrote LF
+	want := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	got := strings.Split(buf.String(), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("%d lines, want %d", len(got), len(want))
+	}
+	if got[0] != want[0] {
+		t.Fatalf("header\n%s\nwant\n%s", got[0], want[0])
+	}
+
+	throughput := strings.Index(want[0], "throughput_mbps")
+	throughput = strings.Count(want[0][:throughput], ";")
+	diffs := 0
+	for i := 1; i < len(want); i++ {
+		w, g := strings.Split(want[i], ";"), strings.Split(got[i], ";")
+		if len(g) == len(w) {
+			// the old collector never wrote a throughput
+			w[throughput], g[throughput] = "", ""
+		}
+		if strings.Join(g, ";") != strings.Join(w, ";") {
+			t.Errorf("line %d\n%s\nwant\n%s", i+1, got[i], want[i])
+			if diffs++; diffs == 5 {
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestLegacyCsvRoute(t *testing.T) {
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolWebSockets, 1)
+	if _, err := applyRunUpdate(db, run.ID, map[string]any{"TransferStartUnixMs": int64(1744755912345), "StreamDurationMs": int64(3000)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	registerLegacyCsvRoute(app, db, newKeyStore(db, "legacy"))
+
+	req := httptest.NewRequest("GET", "/csv", nil)
+	req.Header.Set("X-API-KEY", "legacy")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("status %d, content type %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	if bytes.Contains(body, []byte("\r")) {
+		t.Errorf("CR in %q", body)
+	}
+
+	lines := strings.Split(string(body), "\n")
+	if len(lines) != 2 || lines[0] != strings.Join(legacyCsvHeader, ";") {
+		t.Fatalf("lines %q", lines)
+	}
+	if lines[0] != "id;protocol;enviroment;time_slot;test_begin;test_end;client_id;parallel_clients;"+
+		"transfer_start_unix;transfer_end_unix;latency_ms;throughput_mbps;bytes_sent_total;bytes_payload;bandwidth_efficiency;"+
+		"cpu_client_percent_before;cpu_client_percent_after;cpu_client_percent_while;cpu_server_percent_before;cpu_server_percent_after;cpu_server_percent_while;"+
+		"ram_client_bytes_before;ram_client_bytes_after;ram_client_bytes_while;ram_server_bytes_before;ram_server_bytes_after;ram_server_bytes_while;"+
+		"lost_packets;retransmissions;connection_duration;stream_duration;error" {
+		t.Errorf("header %s", lines[0])
+	}
+
+	cells := strings.Split(lines[1], ";")
+	if len(cells) != len(legacyCsvHeader) {
+		t.Fatalf("%d cells: %s", len(cells), lines[1])
+	}
+	cell := func(name string) string {
+		for i, col := range legacyCsvHeader {
+			if col == name {
+				return cells[i]
+			}
+		}
+		t.Fatalf("no column %s", name)
+		return ""
+	}
+	for col, want := range map[string]string{
+		"test_end":            "0001-01-01T00:00:00Z",
+		"transfer_start_unix": "1744755912",
+		"transfer_end_unix":   "0",
+		"latency_ms":          "-1744755912",
+		"throughput_mbps":     "0.000000",
+		"stream_duration":     "3",
+		"error":               "",
+	} {
+		if got := cell(col); got != want {
+			t.Errorf("%s = %q, want %q", col, got, want)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Custom metrics and labels are values of a run outside the TestRun columns,
+// for experimental measurements that should not need a schema change. Their
+// names carry a namespace, e.g. "quic.handshake_rtt_ms" or "tls.cipher", so
+// update payloads tell them apart from the TestRun metrics: numbers are
+// stored as metrics, strings as labels.
+
+// RunCustomMetric is a numeric custom metric of a run.
+type RunCustomMetric struct {
+	RunID int64   `gorm:"primaryKey;autoIncrement:false"`
+	Name  string  `gorm:"primaryKey;index:idx_run_custom_metrics_name_value,priority:1"`
+	Value float64 `gorm:"index:idx_run_custom_metrics_name_value,priority:2"`
+}
+
+// RunLabel is a string custom value of a run.
+type RunLabel struct {
+	RunID int64  `gorm:"primaryKey;autoIncrement:false"`
+	Name  string `gorm:"primaryKey;index:idx_run_labels_name_value,priority:1"`
+	Value string `gorm:"index:idx_run_labels_name_value,priority:2"`
+}
+
+// customNamePattern is a lowercase namespace and name separated by dots.
+var customNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z0-9_]+)+$`)
+
+const maxCustomNameLength = 128
+
+func isCustomName(name string) bool {
+	return len(name) <= maxCustomNameLength && customNamePattern.MatchString(name)
+}
+
+// parseCustomValue adds a custom payload value to the Metrics or Labels of
+// an update's fields.
+func parseCustomValue(fields map[string]any, name string, raw any, verr *ValidationError) {
+	switch v := raw.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			verr.add(name, FieldErrorInvalidValue, "must be a finite number")
+			return
+		}
+		metrics, _ := fields["Metrics"].(map[string]float64)
+		if metrics == nil {
+			metrics = map[string]float64{}
+			fields["Metrics"] = metrics
+		}
+		metrics[name] = v
+	case string:
+		labels, _ := fields["Labels"].(map[string]string)
+		if labels == nil {
+			labels = map[string]string{}
+			fields["Labels"] = labels
+		}
+		labels[name] = v
+	default:
+		verr.add(name, FieldErrorType, "expected number or string for a custom value, got %s", jsonTypeName(raw))
+	}
+}
+
+// writeCustomValues stores the Metrics and Labels of an update's fields,
+// replacing earlier values of the same names.
+func writeCustomValues(tx *gorm.DB, runID int64, fields map[string]any) error {
+	if metrics, _ := fields["Metrics"].(map[string]float64); len(metrics) > 0 {
+		rows := make([]RunCustomMetric, 0, len(metrics))
+		for name, v := range metrics {
+			rows = append(rows, RunCustomMetric{RunID: runID, Name: name, Value: v})
+		}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&rows).Error; err != nil {
+			return err
+		}
+	}
+	if labels, _ := fields["Labels"].(map[string]string); len(labels) > 0 {
+		rows := make([]RunLabel, 0, len(labels))
+		for name, v := range labels {
+			rows = append(rows, RunLabel{RunID: runID, Name: name, Value: v})
+		}
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&rows).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachCustomValues loads the custom metrics and labels of runs into their
+// Metrics and Labels.
+func attachCustomValues(db *gorm.DB, runs []TestRun) error {
+	index := make(map[int64]int, len(runs))
+	ids := make([]int64, len(runs))
+	for i, run := range runs {
+		index[run.ID] = i
+		ids[i] = run.ID
+	}
+
+	// bounded chunks stay below the parameter limits of the databases
+	for chunk := range slices.Chunk(ids, 1000) {
+		metrics := []RunCustomMetric{}
+		if err := db.Where("run_id IN ?", chunk).Find(&metrics).Error; err != nil {
+			return err
+		}
+		for _, m := range metrics {
+			run := &runs[index[m.RunID]]
+			if run.Metrics == nil {
+				run.Metrics = map[string]float64{}
+			}
+			run.Metrics[m.Name] = m.Value
+		}
+
+		labels := []RunLabel{}
+		if err := db.Where("run_id IN ?", chunk).Find(&labels).Error; err != nil {
+			return err
+		}
+		for _, l := range labels {
+			run := &runs[index[l.RunID]]
+			if run.Labels == nil {
+				run.Labels = map[string]string{}
+			}
+			run.Labels[l.Name] = l.Value
+		}
+	}
+	return nil
+}
+
+// customNames returns the names of the custom metrics and labels the runs
+// matching the filter have, sorted.
+func customNames(db *gorm.DB, filter RunFilter) (metrics, labels []string, err error) {
+	runs := filter.Apply(db.Model(&TestRun{})).Select("id")
+	if err = db.Model(&RunCustomMetric{}).Distinct("name").Where("run_id IN (?)", runs).Order("name").Pluck("name", &metrics).Error; err != nil {
+		return nil, nil, err
+	}
+	if err = db.Model(&RunLabel{}).Distinct("name").Where("run_id IN (?)", runs).Order("name").Pluck("name", &labels).Error; err != nil {
+		return nil, nil, err
+	}
+	return metrics, labels, nil
+}
+
+// LabelCondition selects runs whose label has one of the values.
+type LabelCondition struct {
+	Name   string
+	Values []string
+}
+
+// MetricCondition selects runs that have a custom metric, compared to Value
+// if Op is set.
+type MetricCondition struct {
+	Name  string
+	Op    string
+	Value float64
+}
+
+var metricConditionOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// parseLabelConditions reads "name:value,..." pairs. Values of the same
+// label are alternatives, different labels must all match.
+func parseLabelConditions(v string) ([]LabelCondition, error) {
+	conds := []LabelCondition{}
+	for _, pair := range splitQuery(v) {
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok || !isCustomName(name) {
+			return nil, fmt.Errorf("must be name:value pairs with namespaced names, got %q", pair)
+		}
+		i := slices.IndexFunc(conds, func(c LabelCondition) bool { return c.Name == name })
+		if i < 0 {
+			conds = append(conds, LabelCondition{Name: name})
+			i = len(conds) - 1
+		}
+		conds[i].Values = append(conds[i].Values, value)
+	}
+	return conds, nil
+}
+
+// parseMetricConditions reads conditions like "quic.handshake_rtt_ms<50", or
+// just a name for runs that have the metric.
+func parseMetricConditions(v string) ([]MetricCondition, error) {
+	conds := []MetricCondition{}
+	for _, s := range splitQuery(v) {
+		cond := MetricCondition{Name: s}
+		for _, op := range metricConditionOps {
+			if name, value, ok := strings.Cut(s, op); ok {
+				n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil {
+					return nil, fmt.Errorf("%q: %w", s, err)
+				}
+				cond = MetricCondition{Name: strings.TrimSpace(name), Op: op, Value: n}
+				break
+			}
+		}
+		if !isCustomName(cond.Name) {
+			return nil, fmt.Errorf("%q is not a namespaced metric name", cond.Name)
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
+
+// customStatMetric extracts a custom metric from runs with attached custom
+// values, NaN if a run does not have it.
+func customStatMetric(name string) StatMetric {
+	return StatMetric{Name: name, Value: func(r TestRun) float64 {
+		if v, ok := r.Metrics[name]; ok {
+			return v
+		}
+		return math.NaN()
+	}}
+}
+
+// lookupStatMetric finds a TestRun metric or a custom metric by name.
+func lookupStatMetric(name string) (StatMetric, bool) {
+	if m, ok := statMetricsByName[name]; ok {
+		return m, true
+	}
+	if isCustomName(name) {
+		return customStatMetric(name), true
+	}
+	return StatMetric{}, false
+}
+
+// customStatMetrics returns the custom metrics any of the runs has, sorted.
+func customStatMetrics(runs []TestRun) []StatMetric {
+	names := []string{}
+	for _, run := range runs {
+		for name := range run.Metrics {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	metrics := make([]StatMetric, len(names))
+	for i, name := range names {
+		metrics[i] = customStatMetric(name)
+	}
+	return metrics
+}
+
+// labelGroupPrefix groups runs by a label, e.g. group_by=label.tls.cipher.
+const labelGroupPrefix = "label."
+
+// customExportColumns are the columns of the custom metrics and labels,
+// named metric.<name> and label.<name>.
+func customExportColumns(metrics, labels []string) []exportColumn {
+	cols := []exportColumn{}
+	for _, name := range metrics {
+		cols = append(cols, exportColumn{"metric." + name, exportFloat, func(r *TestRun) any {
+			if v, ok := r.Metrics[name]; ok {
+				return v
+			}
+			return nil
+		}})
+	}
+	for _, name := range labels {
+		cols = append(cols, exportColumn{"label." + name, exportString, func(r *TestRun) any {
+			if v, ok := r.Labels[name]; ok {
+				return v
+			}
+			return nil
+		}})
+	}
+	return cols
+}
+
+// CustomName is a custom metric or label name and the number of runs that
+// have it.
+type CustomName struct {
+	Name string `json:"name"`
+	Runs int64  `json:"runs"`
+}
+
+func registerCustomRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	// the custom metric and label names of the runs matching the filters of
+	// /runs
+	app.Get("/custom", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		filter, err := parseRunFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		runs := filter.Apply(db.Model(&TestRun{})).Select("id")
+		metrics, labels := []CustomName{}, []CustomName{}
+		err = db.Model(&RunCustomMetric{}).Select("name, COUNT(*) AS runs").Where("run_id IN (?)", runs).Group("name").Order("name").Scan(&metrics).Error
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		err = db.Model(&RunLabel{}).Select("name, COUNT(*) AS runs").Where("run_id IN (?)", runs).Group("name").Order("name").Scan(&labels).Error
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{"metrics": metrics, "labels": labels})
+	})
+}
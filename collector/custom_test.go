@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func TestParseCustomValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     any
+		metrics map[string]float64
+		labels  map[string]string
+		code    string // of the field error, if rejected
+	}{
+		{"number", 12.5, map[string]float64{"quic.rtt_ms": 12.5}, nil, ""},
+		{"string", "v1", nil, map[string]string{"quic.rtt_ms": "v1"}, ""},
+		{"NaN", math.NaN(), nil, nil, FieldErrorInvalidValue},
+		{"infinity", math.Inf(1), nil, nil, FieldErrorInvalidValue},
+		{"bool", true, nil, nil, FieldErrorType},
+		{"object", map[string]any{"a": 1.0}, nil, nil, FieldErrorType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := map[string]any{}
+			verr := &ValidationError{}
+			parseCustomValue(fields, "quic.rtt_ms", tt.raw, verr)
+
+			if tt.code != "" {
+				if len(verr.Fields) != 1 || verr.Fields[0].Field != "quic.rtt_ms" || verr.Fields[0].Code != tt.code {
+					t.Errorf("field errors %+v, want %s", verr.Fields, tt.code)
+				}
+				if len(fields) > 0 {
+					t.Errorf("rejected value ended up in %v", fields)
+				}
+				return
+			}
+			if len(verr.Fields) > 0 {
+				t.Fatalf("field errors %+v", verr.Fields)
+			}
+			metrics, _ := fields["Metrics"].(map[string]float64)
+			labels, _ := fields["Labels"].(map[string]string)
+			if !reflect.DeepEqual(metrics, tt.metrics) || !reflect.DeepEqual(labels, tt.labels) {
+				t.Errorf("metrics %v, labels %v, want %v and %v", metrics, labels, tt.metrics, tt.labels)
+			}
+		})
+	}
+
+	// values of one payload are collected in the same maps
+	fields := map[string]any{}
+	verr := &ValidationError{}
+	parseCustomValue(fields, "quic.rtt_ms", 1.0, verr)
+	parseCustomValue(fields, "quic.loss", 2.0, verr)
+	parseCustomValue(fields, "tls.cipher", "aes", verr)
+	if want := map[string]float64{"quic.rtt_ms": 1, "quic.loss": 2}; !reflect.DeepEqual(fields["Metrics"], want) {
+		t.Errorf("metrics %v, want %v", fields["Metrics"], want)
+	}
+	if want := map[string]string{"tls.cipher": "aes"}; !reflect.DeepEqual(fields["Labels"], want) {
+		t.Errorf("labels %v, want %v", fields["Labels"], want)
+	}
+}
+
+// createCustomTestRun stores an ended run with the given custom values.
+func createCustomTestRun(t *testing.T, db *gorm.DB, values map[string]any) int64 {
+	t.Helper()
+	run := createTestRun(t, db, ProtocolHTTP3, 1)
+	dto := map[string]any{"@end": true}
+	for k, v := range values {
+		dto[k] = v
+	}
+	fields, err := parseRunUpdate(dto, SideClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyRunUpdate(db, run.ID, fields, nil); err != nil {
+		t.Fatal(err)
+	}
+	return run.ID
+}
+
+func TestMetricConditions(t *testing.T) {
+	db := openTestDB(t)
+	fast := createCustomTestRun(t, db, map[string]any{"quic.rtt_ms": 10.0})
+	slow := createCustomTestRun(t, db, map[string]any{"quic.rtt_ms": 50.0})
+	createCustomTestRun(t, db, map[string]any{"quic.loss": 10.0})
+
+	tests := []struct {
+		conditions string
+		want       []int64
+	}{
+		{"quic.rtt_ms", []int64{fast, slow}},
+		{"quic.rtt_ms<50", []int64{fast}},
+		{"quic.rtt_ms<=50", []int64{fast, slow}},
+		{"quic.rtt_ms>10", []int64{slow}},
+		{"quic.rtt_ms>=10", []int64{fast, slow}},
+		{"quic.rtt_ms=10", []int64{fast}},
+		{"quic.rtt_ms!=10", []int64{slow}},
+		{"quic.rtt_ms > 5 , quic.rtt_ms < 20", []int64{fast}},
+		{"quic.rtt_ms<50,quic.loss", []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conditions, func(t *testing.T) {
+			conds, err := parseMetricConditions(tt.conditions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []int64{}
+			if err := (RunFilter{Metrics: conds}).Apply(db.Model(&TestRun{})).Order("id").Pluck("id", &ids).Error; err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("runs %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	for _, v := range []string{"quic.rtt_ms<fast", "rtt_ms<10", "Quic.rtt_ms", "quic.rtt_ms<"} {
+		if _, err := parseMetricConditions(v); err == nil {
+			t.Errorf("parseMetricConditions(%q) succeeded", v)
+		}
+	}
+}
+
+func TestCustomExportColumns(t *testing.T) {
+	runs := []TestRun{
+		{Metrics: map[string]float64{"quic.rtt_ms": 12.5}, Labels: map[string]string{"tls.cipher": "aes"}},
+		{Labels: map[string]string{"tls.cipher": ""}},
+		{},
+	}
+
+	cols := customExportColumns([]string{"quic.rtt_ms"}, []string{"tls.cipher"})
+	names := []string{}
+	for _, col := range cols {
+		names = append(names, col.Name)
+	}
+	if want := []string{"metric.quic.rtt_ms", "label.tls.cipher"}; !slices.Equal(names, want) {
+		t.Fatalf("columns %v, want %v", names, want)
+	}
+	if cols[0].Kind != exportFloat || cols[1].Kind != exportString {
+		t.Errorf("column kinds %v and %v", cols[0].Kind, cols[1].Kind)
+	}
+
+	want := [][]any{{12.5, "aes"}, {nil, ""}, {nil, nil}}
+	for i := range runs {
+		got := []any{cols[0].Value(&runs[i]), cols[1].Value(&runs[i])}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("run %d: %v, want %v", i, got, want[i])
+		}
+	}
+}
+
+// TestErrorsByLabel groups /errors by a label, which needs the custom values
+// of the runs attached.
+func TestErrorsByLabel(t *testing.T) {
+	db := openTestDB(t)
+	createCustomTestRun(t, db, map[string]any{"tls.cipher": "aes"})
+	createCustomTestRun(t, db, map[string]any{"tls.cipher": "aes", "Error": "x", "ErrorPhase": "read", "ErrorCode": "eof"})
+	createCustomTestRun(t, db, map[string]any{"tls.cipher": "chacha"})
+	createCustomTestRun(t, db, map[string]any{"Error": "x", "ErrorPhase": "dial", "ErrorCode": "timeout"})
+
+	app := fiber.New()
+	registerErrorRoutes(app, db, newKeyStore(db, "legacy"))
+
+	req := httptest.NewRequest("GET", "/errors?group_by=label.tls.cipher", nil)
+	req.Header.Set("X-API-KEY", "legacy")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	result := struct{ Groups []ErrorGroup }{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	type group struct {
+		cipher       string
+		runs, errors int
+	}
+	got := []group{}
+	for _, g := range result.Groups {
+		got = append(got, group{g.Key["label.tls.cipher"], g.Runs, g.Errors})
+	}
+	want := []group{{"", 1, 1}, {"aes", 2, 1}, {"chacha", 1, 0}}
+	if !slices.Equal(got, want) {
+		t.Errorf("groups %+v, want %+v", got, want)
+	}
+}
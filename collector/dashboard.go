@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+var dashboardTemplates = template.Must(template.ParseFS(dashboardFiles, "dashboard/*.html"))
+
+// dashboardKeyCookie holds the API key of a browser that logged in to the
+// dashboard, since browsers cannot send the X-API-KEY header on navigation.
+// The key needs the read scope.
+const dashboardKeyCookie = "collector_key"
+
+// dashboardRuns are the runs the charts are drawn from. Like
+// analyzer/gen_plots.py, performance charts only use completed runs without an
+// error, while error rates are relative to all runs that ended.
+type dashboardRuns struct {
+	Completed []TestRun
+	Ended     []TestRun
+}
+
+type dashboardChart struct {
+	Name   string
+	Title  string
+	Render func(dashboardRuns) string
+}
+
+type dashboardSection struct {
+	Title  string
+	Charts []dashboardChart
+}
+
+var dashboardSections = []dashboardSection{
+	{"Performance", []dashboardChart{
+		{"throughput", "Throughput per protocol", func(r dashboardRuns) string {
+			return metricBoxChart(r.Completed, "Throughput per protocol", "Throughput (Mbps)", "protocol", "ThroughputMbps")
+		}},
+		{"transfer-duration", "Transfer duration per protocol", func(r dashboardRuns) string {
+			return metricBoxChart(r.Completed, "Transfer duration per protocol", "Duration (ms)", "protocol", "TransferDurationMs")
+		}},
+		{"connection-duration", "Connection setup per protocol", func(r dashboardRuns) string {
+			return metricBoxChart(r.Completed, "Connection setup per protocol", "Duration (ms)", "protocol", "ConnectionDurationMs")
+		}},
+	}},
+	{"Resources", []dashboardChart{
+		{"cpu-client", "Client CPU per protocol", func(r dashboardRuns) string {
+			return phaseBarChart(r.Completed, "Client CPU per protocol", "CPU usage (%)", "CpuClientPercent", 1)
+		}},
+		{"ram-client", "Client RAM per protocol", func(r dashboardRuns) string {
+			return phaseBarChart(r.Completed, "Client RAM per protocol", "RAM usage (MiB)", "RamClientBytes", 1<<20)
+		}},
+		{"cpu-server", "Server CPU per protocol", func(r dashboardRuns) string {
+			return phaseBarChart(r.Completed, "Server CPU per protocol", "CPU usage (%)", "CpuServerPercent", 1)
+		}},
+		{"ram-server", "Server RAM per protocol", func(r dashboardRuns) string {
+			return phaseBarChart(r.Completed, "Server RAM per protocol", "RAM usage (MiB)", "RamServerBytes", 1<<20)
+		}},
+	}},
+	{"Scalability", []dashboardChart{
+		{"scalability-throughput", "Throughput vs parallel clients", func(r dashboardRuns) string {
+			return scalabilityChart(r.Completed, "Throughput vs parallel clients", "Throughput (Mbps)", "ThroughputMbps", 1)
+		}},
+		{"scalability-cpu", "Client CPU vs parallel clients", func(r dashboardRuns) string {
+			return scalabilityChart(r.Completed, "Client CPU while transferring vs parallel clients", "CPU usage (%)", "CpuClientPercentWhile", 1)
+		}},
+		{"scalability-ram", "Client RAM vs parallel clients", func(r dashboardRuns) string {
+			return scalabilityChart(r.Completed, "Client RAM while transferring vs parallel clients", "RAM usage (MiB)", "RamClientBytesWhile", 1<<20)
+		}},
+	}},
+	{"Time slots and environments", []dashboardChart{
+		{"time-slot-throughput", "Throughput per time slot", func(r dashboardRuns) string {
+			return meanBarChart(r.Completed, "Mean throughput per time slot", "Throughput (Mbps)", "time_slot", "ThroughputMbps")
+		}},
+		{"enviroment-throughput", "Throughput per environment", func(r dashboardRuns) string {
+			return meanBarChart(r.Completed, "Mean throughput per environment", "Throughput (Mbps)", "enviroment", "ThroughputMbps")
+		}},
+		{"enviroment-connection-duration", "Connection setup per environment", func(r dashboardRuns) string {
+			return meanBarChart(r.Completed, "Mean connection setup per environment", "Duration (ms)", "enviroment", "ConnectionDurationMs")
+		}},
+	}},
+	{"Errors", []dashboardChart{
+		{"error-rate", "Error rate per protocol and parallel clients", func(r dashboardRuns) string {
+			return errorRateChart(r.Ended)
+		}},
+		{"error-phases", "Error rate per protocol and phase", func(r dashboardRuns) string {
+			return errorPhaseChart(r.Ended)
+		}},
+	}},
+}
+
+var dashboardChartsByName = func() map[string]dashboardChart {
+	m := map[string]dashboardChart{}
+	for _, section := range dashboardSections {
+		for _, chart := range section.Charts {
+			m[chart.Name] = chart
+		}
+	}
+	return m
+}()
+
+// columnValues returns the distinct values of a group column in the order
+// groupRuns sorts them.
+func columnValues(runs []TestRun, col string) []string {
+	keys, _ := groupRuns(runs, []string{col})
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = key[col]
+	}
+	return values
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func metricBoxChart(runs []TestRun, title, yLabel, groupBy, metric string) string {
+	keys, groups := groupRuns(runs, []string{groupBy})
+	chart := boxChart{Title: title, YLabel: yLabel}
+	for i, group := range groups {
+		chart.Categories = append(chart.Categories, keys[i][groupBy])
+		chart.Values = append(chart.Values, metricValues(group, statMetricsByName[metric]))
+	}
+	return chart.SVG()
+}
+
+// phaseBarChart compares the mean of a resource metric before, while and
+// after the transfer per protocol. Values are divided by scale, e.g. to show
+// bytes in MiB.
+func phaseBarChart(runs []TestRun, title, yLabel, metricPrefix string, scale float64) string {
+	keys, groups := groupRuns(runs, []string{"protocol"})
+	chart := barChart{Title: title, YLabel: yLabel}
+	for _, key := range keys {
+		chart.Categories = append(chart.Categories, key["protocol"])
+	}
+	for _, phase := range []string{"Before", "While", "After"} {
+		series := chartSeries{Name: phase}
+		for _, group := range groups {
+			series.Values = append(series.Values, mean(metricValues(group, statMetricsByName[metricPrefix+phase]))/scale)
+		}
+		chart.Series = append(chart.Series, series)
+	}
+	return chart.SVG()
+}
+
+// meanBarChart compares the mean of a metric per protocol, with one bar per
+// value of the series column.
+func meanBarChart(runs []TestRun, title, yLabel, seriesBy, metric string) string {
+	protocols := columnValues(runs, "protocol")
+	chart := barChart{Title: title, YLabel: yLabel, Categories: protocols}
+	for _, name := range columnValues(runs, seriesBy) {
+		series := chartSeries{Name: name, Values: make([]float64, len(protocols))}
+		for i := range series.Values {
+			series.Values[i] = math.NaN()
+		}
+		chart.Series = append(chart.Series, series)
+	}
+
+	keys, groups := groupRuns(runs, []string{"protocol", seriesBy})
+	for i, group := range groups {
+		p := slices.Index(protocols, keys[i]["protocol"])
+		s := slices.IndexFunc(chart.Series, func(s chartSeries) bool { return s.Name == keys[i][seriesBy] })
+		chart.Series[s].Values[p] = mean(metricValues(group, statMetricsByName[metric]))
+	}
+	return chart.SVG()
+}
+
+func scalabilityChart(runs []TestRun, title, yLabel, metric string, scale float64) string {
+	chart := lineChart{Title: title, XLabel: "parallel clients", YLabel: yLabel}
+	clients := columnValues(runs, "parallel_clients")
+	for _, c := range clients {
+		n, _ := strconv.Atoi(c)
+		chart.X = append(chart.X, float64(n))
+	}
+
+	keys, groups := groupRuns(runs, []string{"protocol", "parallel_clients"})
+	for i, group := range groups {
+		protocol := keys[i]["protocol"]
+		if len(chart.Series) == 0 || chart.Series[len(chart.Series)-1].Name != protocol {
+			series := chartSeries{Name: protocol, Values: make([]float64, len(clients))}
+			for j := range series.Values {
+				series.Values[j] = math.NaN()
+			}
+			chart.Series = append(chart.Series, series)
+		}
+		series := &chart.Series[len(chart.Series)-1]
+		series.Values[slices.Index(clients, keys[i]["parallel_clients"])] = mean(metricValues(group, statMetricsByName[metric])) / scale
+	}
+	return chart.SVG()
+}
+
+func errorRateChart(runs []TestRun) string {
+	protocols := columnValues(runs, "protocol")
+	chart := barChart{Title: "Error rate per protocol and parallel clients", YLabel: "Error rate (%)", Categories: protocols}
+
+	clients := columnValues(runs, "parallel_clients")
+	for _, c := range clients {
+		series := chartSeries{Name: c + " clients", Values: make([]float64, len(protocols))}
+		for i := range series.Values {
+			series.Values[i] = math.NaN()
+		}
+		chart.Series = append(chart.Series, series)
+	}
+
+	for _, g := range aggregateErrors(runs, []string{"protocol", "parallel_clients"}) {
+		chart.Series[slices.Index(clients, g.Key["parallel_clients"])].Values[slices.Index(protocols, g.Key["protocol"])] = g.Rate * 100
+	}
+	return chart.SVG()
+}
+
+func errorPhaseChart(runs []TestRun) string {
+	groups := aggregateErrors(runs, []string{"protocol"})
+	chart := barChart{Title: "Error rate per protocol and phase", YLabel: "Error rate (%)"}
+	for _, g := range groups {
+		chart.Categories = append(chart.Categories, g.Key["protocol"])
+	}
+
+	for _, phase := range append(slices.Clone(errorPhases), "") {
+		series := chartSeries{Name: phase, Values: make([]float64, len(groups))}
+		if phase == "" {
+			series.Name = "unknown"
+		}
+		found := false
+		for i, g := range groups {
+			series.Values[i] = 0
+			for _, p := range g.Phases {
+				if p.Phase == phase {
+					series.Values[i] = p.Rate * 100
+					found = true
+				}
+			}
+		}
+		if found {
+			chart.Series = append(chart.Series, series)
+		}
+	}
+	return chart.SVG()
+}
+
+// loadDashboardRuns applies the filter of the request. Unless it says
+// otherwise, completed runs are those without an error and ended runs are all
+// runs in a terminal state.
+func loadDashboardRuns(db *gorm.DB, filter RunFilter) (dashboardRuns, error) {
+	runs := dashboardRuns{}
+
+	completed := filter
+	if len(completed.States) == 0 {
+		completed.States = []RunState{RunStateCompleted}
+	}
+	if completed.HasError == nil {
+		hasError := false
+		completed.HasError = &hasError
+	}
+	if err := completed.Apply(db).Find(&runs.Completed).Error; err != nil {
+		return runs, err
+	}
+
+	ended := filter
+	if len(ended.States) == 0 {
+		ended.States = []RunState{RunStateCompleted, RunStateFailed, RunStateTimedOut, RunStateAborted}
+	}
+	if err := ended.Apply(db).Find(&runs.Ended).Error; err != nil {
+		return runs, err
+	}
+
+	return runs, nil
+}
+
+func dashboardAuthorized(c *fiber.Ctx, auth *keyStore) bool {
+	for _, secret := range []string{c.Get("X-API-KEY"), c.Cookies(dashboardKeyCookie)} {
+		if key, _ := auth.authenticate(secret); key != nil && key.Allows(ScopeRead) {
+			return true
+		}
+	}
+	return false
+}
+
+func renderDashboardTemplate(c *fiber.Ctx, name string, data any) error {
+	var buf bytes.Buffer
+	if err := dashboardTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	c.Set("Content-Type", fiber.MIMETextHTMLCharsetUTF8)
+	return c.Send(buf.Bytes())
+}
+
+type dashboardPageChart struct {
+	Name  string
+	Title string
+	SVG   template.HTML
+}
+
+type dashboardPageSection struct {
+	Title  string
+	Charts []dashboardPageChart
+}
+
+type dashboardHiddenField struct {
+	Name, Value string
+}
+
+func registerDashboardRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	// the dashboard takes the filter parameters of /runs, the campaign
+	// selection of its form sets campaign_id
+	app.Get("/dashboard", func(c *fiber.Ctx) error {
+		if !dashboardAuthorized(c, auth) {
+			return renderDashboardTemplate(c.Status(fiber.StatusUnauthorized), "login.html", fiber.Map{"Next": c.OriginalURL()})
+		}
+
+		filter, err := parseRunFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		runs, err := loadDashboardRuns(db, filter)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		campaigns := []Campaign{}
+		if err := db.Order("id DESC").Find(&campaigns).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		sections := make([]dashboardPageSection, len(dashboardSections))
+		for i, section := range dashboardSections {
+			sections[i].Title = section.Title
+			for _, chart := range section.Charts {
+				sections[i].Charts = append(sections[i].Charts, dashboardPageChart{
+					Name:  chart.Name,
+					Title: chart.Title,
+					SVG:   template.HTML(chart.Render(runs)),
+				})
+			}
+		}
+
+		// parameters the form has no input for are carried over as they are
+		hidden := []dashboardHiddenField{}
+		c.Context().QueryArgs().VisitAll(func(k, v []byte) {
+			if name := string(k); name != "campaign_id" && name != "exclude_flagged" && name != "include_excluded" {
+				hidden = append(hidden, dashboardHiddenField{name, string(v)})
+			}
+		})
+
+		var campaignID int64
+		if len(filter.CampaignIDs) == 1 {
+			campaignID = filter.CampaignIDs[0]
+		}
+
+		query := ""
+		if q := string(c.Context().QueryArgs().QueryString()); q != "" {
+			query = "?" + q
+		}
+
+		return renderDashboardTemplate(c, "index.html", fiber.Map{
+			"Campaigns":       campaigns,
+			"CampaignID":      campaignID,
+			"ExcludeFlagged":  filter.ExcludeFlagged,
+			"IncludeExcluded": filter.IncludeExcluded,
+			"Hidden":          hidden,
+			"Query":           query,
+			"Completed":       len(runs.Completed),
+			"Ended":           len(runs.Ended),
+			"Sections":        sections,
+		})
+	})
+
+	app.Get("/dashboard/charts/:name.svg", func(c *fiber.Ctx) error {
+		if !dashboardAuthorized(c, auth) {
+			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+		}
+
+		chart, ok := dashboardChartsByName[c.Params("name")]
+		if !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "unknown chart"})
+		}
+
+		filter, err := parseRunFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		runs, err := loadDashboardRuns(db, filter)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		c.Set("Content-Type", "image/svg+xml")
+		return c.SendString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + chart.Render(runs))
+	})
+
+	app.Post("/dashboard/login", func(c *fiber.Ctx) error {
+		next := c.FormValue("next")
+		// only redirect within the collector
+		if u, err := url.Parse(next); err != nil || u.Host != "" || u.Scheme != "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+			next = "/dashboard"
+		}
+
+		key, err := auth.authenticate(c.FormValue("key"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if key == nil || !key.Allows(ScopeRead) {
+			return renderDashboardTemplate(c.Status(fiber.StatusUnauthorized), "login.html", fiber.Map{"Next": next, "Failed": true})
+		}
+
+		c.Cookie(&fiber.Cookie{
+			Name:     dashboardKeyCookie,
+			Value:    c.FormValue("key"),
+			Path:     "/dashboard",
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteStrictMode,
+		})
+		return c.Redirect(next, fiber.StatusSeeOther)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func dashboardTestRun(protocol Protocol, clients int, slot TimeSlot, throughput float64) TestRun {
+	return TestRun{
+		Protocol:              protocol,
+		ParallelClients:       clients,
+		TimeSlot:              slot,
+		Enviroment:            EnviromentLocal,
+		State:                 RunStateCompleted,
+		ThroughputMbps:        &throughput,
+		TransferDurationMs:    ptr(int64(8000 / throughput)),
+		CpuClientPercentWhile: throughput,
+		RamClientBytesWhile:   2 << 20,
+	}
+}
+
+// TestDashboardCharts checks the values the charts are drawn from. Every
+// bar, box and point carries its value in a tooltip.
+func TestDashboardCharts(t *testing.T) {
+	completed := []TestRun{
+		dashboardTestRun(ProtocolHTTP3, 1, TimeSlotMorning, 10),
+		dashboardTestRun(ProtocolHTTP3, 1, TimeSlotMorning, 20),
+		dashboardTestRun(ProtocolHTTP3, 1, TimeSlotMorning, 30),
+		dashboardTestRun(ProtocolHTTP3, 2, TimeSlotAfternoon, 40),
+		dashboardTestRun(ProtocolWebSockets, 1, TimeSlotMorning, 50),
+	}
+
+	dialFailed := TestRun{Protocol: ProtocolHTTP3, ParallelClients: 1, State: RunStateFailed, Error: "dial failed", ErrorPhase: ErrorPhaseDial}
+	unknownFailed := TestRun{Protocol: ProtocolWebSockets, ParallelClients: 1, State: RunStateFailed, Error: "failed"}
+	ended := append(append([]TestRun{}, completed...), dialFailed, unknownFailed)
+
+	tests := []struct {
+		name     string
+		svg      string
+		contains []string
+		excludes []string
+	}{
+		{
+			"box per protocol",
+			metricBoxChart(completed, "Throughput", "Mbps", "protocol", "ThroughputMbps"),
+			[]string{"http3 (n=4)", "http3: q1 17.5, median 25, q3 32.5", "websockets (n=1)", "websockets: q1 50, median 50, q3 50"},
+			nil,
+		},
+		{
+			"phases",
+			phaseBarChart(completed, "CPU", "%", "CpuClientPercent", 1),
+			[]string{"http3 Before: 0", "http3 While: 25", "websockets While: 50", "http3 After: 0"},
+			nil,
+		},
+		{
+			"mean per time slot",
+			meanBarChart(completed, "Throughput", "Mbps", "time_slot", "ThroughputMbps"),
+			[]string{"http3 morning: 20", "http3 afternoon: 40", "websockets morning: 50"},
+			[]string{"websockets afternoon"},
+		},
+		{
+			"scalability",
+			scalabilityChart(completed, "Throughput", "Mbps", "ThroughputMbps", 1),
+			[]string{"http3, 1 parallel clients: 20", "http3, 2 parallel clients: 40", "websockets, 1 parallel clients: 50"},
+			[]string{"websockets, 2 parallel clients"},
+		},
+		{
+			"scalability scaled to MiB",
+			scalabilityChart(completed, "RAM", "MiB", "RamClientBytesWhile", 1<<20),
+			[]string{"http3, 1 parallel clients: 2", "websockets, 1 parallel clients: 2"},
+			nil,
+		},
+		{
+			"error rate",
+			errorRateChart(ended),
+			[]string{"http3 1 clients: 25", "http3 2 clients: 0", "websockets 1 clients: 50"},
+			[]string{"websockets 2 clients"},
+		},
+		{
+			"error phases",
+			errorPhaseChart(ended),
+			[]string{"http3 dial: 20", "http3 unknown: 0", "websockets dial: 0", "websockets unknown: 50"},
+			[]string{ErrorPhaseRead},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, s := range tt.contains {
+				if !strings.Contains(tt.svg, "<title>"+s+"</title>") && !strings.Contains(tt.svg, ">"+s+"<") {
+					t.Errorf("chart lacks %q", s)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(tt.svg, s) {
+					t.Errorf("chart has %q", s)
+				}
+			}
+		})
+	}
+
+	charts := 0
+	for _, section := range dashboardSections {
+		for _, chart := range section.Charts {
+			charts++
+			if svg := chart.Render(dashboardRuns{}); !strings.Contains(svg, ">no data<") {
+				t.Errorf("chart %s without runs: %s", chart.Name, svg)
+			}
+			if svg := chart.Render(dashboardRuns{Completed: completed, Ended: ended}); strings.Contains(svg, ">no data<") {
+				t.Errorf("chart %s has no data", chart.Name)
+			}
+		}
+	}
+	if len(dashboardChartsByName) != charts {
+		t.Errorf("%d chart names for %d charts", len(dashboardChartsByName), charts)
+	}
+}
+
+func TestDashboardRoutes(t *testing.T) {
+	db := openTestDB(t)
+	_, reader, err := createAPIKey(db, "analyzer", []Scope{ScopeRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, client, err := createAPIKey(db, "http3-client", []Scope{ScopeWriteClientMetrics}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	registerDashboardRoutes(app, db, newKeyStore(db, ""))
+
+	login := func(key, next string) string {
+		return url.Values{"key": {key}, "next": {next}}.Encode()
+	}
+
+	tests := []struct {
+		name, method, path, key, cookie, body string
+		status                                int
+		result                                string // part of the response body
+		location                              string
+	}{
+		{"no key", "GET", "/dashboard", "", "", "", 401, `action="/dashboard/login"`, ""},
+		{"key without read scope", "GET", "/dashboard", client, "", "", 401, `action="/dashboard/login"`, ""},
+		{"read key", "GET", "/dashboard", reader, "", "", 200, "Throughput per protocol", ""},
+		{"cookie", "GET", "/dashboard", "", reader, "", 200, "<svg", ""},
+		{"bad filter", "GET", "/dashboard?campaign_id=x", reader, "", "", 400, "campaign_id", ""},
+		{"chart", "GET", "/dashboard/charts/error-rate.svg", reader, "", "", 200, `<?xml version="1.0" encoding="UTF-8"?>`, ""},
+		{"unknown chart", "GET", "/dashboard/charts/nope.svg", reader, "", "", 404, "unknown chart", ""},
+		{"chart without key", "GET", "/dashboard/charts/error-rate.svg", "", "", "", 401, "", ""},
+		{"login", "POST", "/dashboard/login", "", "", login(reader, "/dashboard?campaign_id=1"), 303, "", "/dashboard?campaign_id=1"},
+		{"login redirects within the collector", "POST", "/dashboard/login", "", "", login(reader, "//example.com/dashboard"), 303, "", "/dashboard"},
+		{"login with absolute url", "POST", "/dashboard/login", "", "", login(reader, "https://example.com/"), 303, "", "/dashboard"},
+		{"wrong key", "POST", "/dashboard/login", "", "", login("thk_unknown", "/dashboard"), 401, "Wrong API key", ""},
+		{"login without read scope", "POST", "/dashboard/login", "", "", login(client, "/dashboard"), 401, "Wrong API key", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.key != "" {
+				req.Header.Set("X-API-KEY", tt.key)
+			}
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", dashboardKeyCookie+"="+tt.cookie)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if !strings.Contains(string(body), tt.result) {
+				t.Errorf("response %s, want it to contain %s", body, tt.result)
+			}
+			if tt.location != "" {
+				if got := resp.Header.Get("Location"); got != tt.location {
+					t.Errorf("redirect to %q, want %q", got, tt.location)
+				}
+				cookies := resp.Cookies()
+				if len(cookies) != 1 || cookies[0].Name != dashboardKeyCookie || cookies[0].Value != reader || !cookies[0].HttpOnly {
+					t.Errorf("cookies %v, want the key in %s", cookies, dashboardKeyCookie)
+				}
+			}
+		})
+	}
+}
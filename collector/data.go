@@ -29,45 +29,56 @@ const (
 	TimeSlotNight     TimeSlot = "night"
 )
 
+// TestRun holds one client run. Fields carrying a `metric` tag can be written
+// through the update endpoints, see schema.go for the tag format. Times and
+// durations are stored in milliseconds and carry their unit in their name;
+// migrate.go converts databases written before.
 type TestRun struct {
-	ID                int64 `gorm:"primaryKey;autoIncrement"`
-	Protocol          Protocol
-	Enviroment        Enviroment
-	TimeSlot          TimeSlot
-	TestBegin         time.Time
-	TestEnd           time.Time
-	ClientID          int   // used for parallel runs identification
-	ParallelClients   int   // number of parallel clients (used for parallel runs identification)
-	TransferStartUnix int64 // unix timestamp in milliseconds when the transfer started
-	TransferEndUnix   int64 // unix timestamp in milliseconds when the transfer ended
-	//LatencyMs              int64   // difference between TransferStartUnix and TransferEndUnix
-	ThroughputMbps float64 // throughput in Mbps
-	BytesSentTotal int64   // total bytes sent
-	BytesPayload   int64   // bytes sent excluding headers
-	//BandwidthEfficiency    float64 // BytesPayload / BytesSentTotal
-	CpuClientPercentBefore float64 // CPU usage of the client before the transfer
-	CpuClientPercentAfter  float64 // CPU usage of the client after the transfer
-	CpuClientPercentWhile  float64 // CPU usage of the client while the transfer
-	CpuServerPercentBefore float64 // CPU usage of the server before the transfer
-	CpuServerPercentAfter  float64 // CPU usage of the server after the transfer
-	CpuServerPercentWhile  float64 // CPU usage of the server while the transfer
-	RamClientBytesBefore   int64   // RAM usage of the client before the transfer
-	RamClientBytesAfter    int64   // RAM usage of the client after the transfer
-	RamClientBytesWhile    int64   // RAM usage of the client while the transfer
-	RamServerBytesBefore   int64   // RAM usage of the server before the transfer
-	RamServerBytesAfter    int64   // RAM usage of the server after the transfer
-	RamServerBytesWhile    int64   // RAM usage of the server while the transfer
-	LostPackets            int64   // number of lost packets
-	Retransmissions        int64   // number of retransmissions
-	ConnectionDuration     int64   // duration of the connection in millis
-	StreamDuration         int64   // duration of the stream in seconds
-	Error                  string  // error message if the test failed, empty string otherwise
-}
-
-func (t TestRun) LatencyMs() int64 {
-	return t.TransferEndUnix - t.TransferStartUnix
-}
+	ID                     int64      `gorm:"primaryKey;autoIncrement"`
+	Protocol               Protocol   `gorm:"index"`
+	Enviroment             Enviroment `gorm:"index"`
+	TimeSlot               TimeSlot   `gorm:"index"`
+	TestBegin              time.Time  `gorm:"index"`
+	TestEnd                time.Time
+	ClientID               int      // used for parallel runs identification
+	ParallelClients        int      `gorm:"index"`                                                     // number of parallel clients (used for parallel runs identification)
+	CampaignID             *int64   `gorm:"index"`                                                     // campaign the run belongs to, nil for runs started without one
+	BatchID                *int64   `gorm:"index"`                                                     // batch of parallel clients the run was started in
+	TransferStartUnixMs    int64    `metric:",unit=unix_ms,min=0,side=server,alias=TransferStartUnix"` // unix timestamp in milliseconds when the transfer started, seconds are normalized
+	TransferEndUnixMs      int64    `metric:",unit=unix_ms,min=0,side=client,alias=TransferEndUnix"`   // unix timestamp in milliseconds when the transfer ended, seconds are normalized
+	TransferDurationMs     *int64   // TransferEndUnixMs - TransferStartUnixMs, derived, see derived.go
+	ThroughputMbps         *float64 // BytesPayload over TransferDurationMs in Mbps, derived
+	BytesSentTotal         int64    `metric:",unit=bytes,side=client"`       // total bytes sent
+	BytesPayload           int64    `metric:",unit=bytes,min=0,side=server"` // bytes sent excluding headers
+	BandwidthEfficiency    *float64 // BytesPayload / BytesSentTotal, derived
+	CpuClientPercentBefore float64  `metric:",unit=%,min=0,max=100,side=client"`                   // CPU usage of the client before the transfer
+	CpuClientPercentAfter  float64  `metric:",unit=%,min=0,max=100,side=client"`                   // CPU usage of the client after the transfer
+	CpuClientPercentWhile  float64  `metric:",unit=%,min=0,max=100,side=client"`                   // CPU usage of the client while the transfer
+	CpuServerPercentBefore float64  `metric:",unit=%,min=0,max=100,side=server"`                   // CPU usage of the server before the transfer
+	CpuServerPercentAfter  float64  `metric:",unit=%,min=0,max=100,side=server"`                   // CPU usage of the server after the transfer
+	CpuServerPercentWhile  float64  `metric:",unit=%,min=0,max=100,side=server"`                   // CPU usage of the server while the transfer
+	RamClientBytesBefore   int64    `metric:",unit=bytes,min=0,side=client"`                       // RAM usage of the client before the transfer
+	RamClientBytesAfter    int64    `metric:",unit=bytes,min=0,side=client"`                       // RAM usage of the client after the transfer
+	RamClientBytesWhile    int64    `metric:",unit=bytes,min=0,side=client"`                       // RAM usage of the client while the transfer
+	RamServerBytesBefore   int64    `metric:",unit=bytes,min=0,side=server"`                       // RAM usage of the server before the transfer
+	RamServerBytesAfter    int64    `metric:",unit=bytes,min=0,side=server"`                       // RAM usage of the server after the transfer
+	RamServerBytesWhile    int64    `metric:",unit=bytes,min=0,side=server"`                       // RAM usage of the server while the transfer
+	LostPackets            int64    `metric:",unit=packets,side=client"`                           // number of lost packets
+	Retransmissions        int64    `metric:",unit=packets"`                                       // number of retransmissions
+	ConnectionDurationMs   int64    `metric:",unit=ms,min=0,side=client,alias=ConnectionDuration"` // duration of the connection in millis
+	StreamDurationMs       int64    `metric:",unit=ms,min=0,alias=StreamDuration:s"`               // duration of the stream in millis
+	Error                  string   `metric:""`                                                    // error message if the test failed, empty string otherwise
+	ErrorPhase             string   `metric:",enum=error_phase"`                                   // phase the error occurred in, see errors.go
+	ErrorCode              string   `metric:",enum=error_code"`                                    // stable classification of the error
+	ErrorProtocolCode      *int64   `json:",string" metric:",min=0"`                               // error code of the protocol, e.g. a QUIC application error code or a WebSocket close code, a string in JSON since QUIC codes go up to 2^62
+	ErrorProtocolCodeKind  string   `metric:",enum=error_protocol_code_kind"`                      // which protocol ErrorProtocolCode belongs to
+	ErrorSide              Side     // side that reported the error, set by the collector
+	Version                int64    `gorm:"not null;default:0"`             // incremented on every update, used for optimistic concurrency
+	State                  RunState `gorm:"index;not null;default:created"` // lifecycle state, see state.go
+	StateReason            string   // why the run ended up in its state, e.g. set by the watchdog
+	FlaggedVersion         int64    `gorm:"not null;default:-1"` // Version the run was last evaluated at by the flagger, see flags.go
 
-func (t TestRun) BandwidthEfficiency() float64 {
-	return float64(t.BytesPayload) / float64(t.BytesSentTotal)
+	// custom values by namespaced name, stored in their own tables, see custom.go
+	Metrics map[string]float64 `gorm:"-" json:",omitempty"`
+	Labels  map[string]string  `gorm:"-" json:",omitempty"`
 }
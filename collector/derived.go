@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+
+	"gorm.io/gorm"
+)
+
+// unixMillisThreshold separates unix timestamps in seconds from ones in
+// milliseconds: 1e11 seconds lie in the year 5138, 1e11 milliseconds in 1973.
+const unixMillisThreshold = 1e11
+
+// normalizeUnixMillis converts a unix timestamp to milliseconds. The Go clients
+// used to send seconds while WebRTC always sent milliseconds, so stored runs
+// and old clients may still deliver either unit.
+func normalizeUnixMillis(ts int64) int64 {
+	if ts > 0 && ts < unixMillisThreshold {
+		return ts * 1000
+	}
+	return ts
+}
+
+// derivedMetricInputs are the fields the derived metrics are computed from.
+var derivedMetricInputs = []string{"TransferStartUnixMs", "TransferEndUnixMs", "BytesPayload", "BytesSentTotal"}
+
+// derivedMetricColumns are the stored columns deriveRunMetrics writes.
+var derivedMetricColumns = []string{"TransferDurationMs", "ThroughputMbps", "BandwidthEfficiency"}
+
+// deriveRunMetrics computes the derived metrics of a run from its raw values.
+// A metric is nil whenever one of its inputs was not collected, instead of
+// being 0 or Inf.
+func deriveRunMetrics(run *TestRun) {
+	run.TransferDurationMs = nil
+	run.ThroughputMbps = nil
+	run.BandwidthEfficiency = nil
+
+	start, end := normalizeUnixMillis(run.TransferStartUnixMs), normalizeUnixMillis(run.TransferEndUnixMs)
+	if start > 0 && end >= start {
+		duration := end - start
+		run.TransferDurationMs = &duration
+
+		if duration > 0 && run.BytesPayload > 0 {
+			mbps := float64(run.BytesPayload) * 8 / (float64(duration) / 1000) / 1e6
+			run.ThroughputMbps = &mbps
+		}
+	}
+
+	if run.BytesPayload > 0 && run.BytesSentTotal > 0 {
+		efficiency := float64(run.BytesPayload) / float64(run.BytesSentTotal)
+		run.BandwidthEfficiency = &efficiency
+	}
+}
+
+// touchesDerivedMetrics reports whether an update writes one of the inputs of
+// the derived metrics.
+func touchesDerivedMetrics(fields map[string]any) bool {
+	for _, f := range derivedMetricInputs {
+		if _, ok := fields[f]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshDerivedMetrics recomputes and stores the derived metrics of one run.
+func refreshDerivedMetrics(tx *gorm.DB, id int64) error {
+	run := TestRun{}
+	if err := tx.Select(append([]string{"id"}, derivedMetricInputs...)).Take(&run, id).Error; err != nil {
+		return err
+	}
+	deriveRunMetrics(&run)
+	return tx.Model(&TestRun{}).Where("id = ?", id).Select(derivedMetricColumns).Updates(&run).Error
+}
+
+// floatOrNaN returns the value of an optional metric, NaN if it is missing.
+func floatOrNaN[T int64 | float64](v *T) float64 {
+	if v == nil {
+		return math.NaN()
+	}
+	return float64(*v)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeUnixMillis(t *testing.T) {
+	tests := []struct {
+		ts, want int64
+	}{
+		{0, 0},
+		{-5, -5},
+		{1, 1000},
+		{1744763112, 1744763112000}, // seconds, 2025
+		{unixMillisThreshold - 1, (unixMillisThreshold - 1) * 1000}, // the last second
+		{unixMillisThreshold, unixMillisThreshold},                  // the first millisecond, 1973
+		{1744763112000, 1744763112000},
+	}
+	for _, tt := range tests {
+		if got := normalizeUnixMillis(tt.ts); got != tt.want {
+			t.Errorf("normalizeUnixMillis(%d) = %d, want %d", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveRunMetrics(t *testing.T) {
+	const startMs = 1744763112000
+
+	tests := []struct {
+		name                   string
+		run                    TestRun
+		duration               *int64
+		throughput, efficiency *float64
+	}{
+		{
+			name:       "complete",
+			run:        TestRun{TransferStartUnixMs: startMs, TransferEndUnixMs: startMs + 4000, BytesPayload: 5e6, BytesSentTotal: 1e7},
+			duration:   ptr(int64(4000)),
+			throughput: ptr(10.0),
+			efficiency: ptr(0.5),
+		},
+		{
+			name: "nothing collected",
+			run:  TestRun{},
+		},
+		{
+			name:       "no transfer start",
+			run:        TestRun{TransferEndUnixMs: startMs, BytesPayload: 5e6, BytesSentTotal: 1e7},
+			efficiency: ptr(0.5),
+		},
+		{
+			name:       "no transfer end",
+			run:        TestRun{TransferStartUnixMs: startMs, BytesPayload: 5e6, BytesSentTotal: 1e7},
+			efficiency: ptr(0.5),
+		},
+		{
+			name:       "end before start",
+			run:        TestRun{TransferStartUnixMs: startMs, TransferEndUnixMs: startMs - 1, BytesPayload: 5e6, BytesSentTotal: 1e7},
+			efficiency: ptr(0.5),
+		},
+		{
+			name:     "end equals start",
+			run:      TestRun{TransferStartUnixMs: startMs, TransferEndUnixMs: startMs, BytesPayload: 5e6},
+			duration: ptr(int64(0)),
+		},
+		{
+			name:       "seconds",
+			run:        TestRun{TransferStartUnixMs: startMs / 1000, TransferEndUnixMs: startMs/1000 + 4, BytesPayload: 5e6},
+			duration:   ptr(int64(4000)),
+			throughput: ptr(10.0),
+		},
+		{
+			name:       "start in seconds, end in milliseconds",
+			run:        TestRun{TransferStartUnixMs: startMs / 1000, TransferEndUnixMs: startMs + 4000, BytesPayload: 5e6},
+			duration:   ptr(int64(4000)),
+			throughput: ptr(10.0),
+		},
+		{
+			name:     "no payload",
+			run:      TestRun{TransferStartUnixMs: startMs, TransferEndUnixMs: startMs + 4000, BytesSentTotal: 1e7},
+			duration: ptr(int64(4000)),
+		},
+		{
+			name:       "nothing sent",
+			run:        TestRun{TransferStartUnixMs: startMs, TransferEndUnixMs: startMs + 4000, BytesPayload: 5e6},
+			duration:   ptr(int64(4000)),
+			throughput: ptr(10.0),
+		},
+		{
+			name: "stale values are cleared",
+			run: TestRun{
+				TransferDurationMs: ptr(int64(1)), ThroughputMbps: ptr(1.0), BandwidthEfficiency: ptr(1.0),
+			},
+		},
+	}
+
+	equal := func(a, b *float64) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && math.Abs(*a-*b) < 1e-9)
+	}
+	show := func(v *float64) any {
+		if v == nil {
+			return nil
+		}
+		return *v
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := tt.run
+			deriveRunMetrics(&run)
+
+			if (run.TransferDurationMs == nil) != (tt.duration == nil) || (tt.duration != nil && *run.TransferDurationMs != *tt.duration) {
+				t.Errorf("duration %v, want %v", floatOrNaN(run.TransferDurationMs), floatOrNaN(tt.duration))
+			}
+			if !equal(run.ThroughputMbps, tt.throughput) {
+				t.Errorf("throughput %v, want %v", show(run.ThroughputMbps), show(tt.throughput))
+			}
+			if !equal(run.BandwidthEfficiency, tt.efficiency) {
+				t.Errorf("efficiency %v, want %v", show(run.BandwidthEfficiency), show(tt.efficiency))
+			}
+			for _, v := range []*float64{run.ThroughputMbps, run.BandwidthEfficiency} {
+				if v != nil && (math.IsNaN(*v) || math.IsInf(*v, 0)) {
+					t.Errorf("derived %v", *v)
+				}
+			}
+		})
+	}
+}
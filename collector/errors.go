@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Error phases say at which point of a run the error occurred.
+const (
+	ErrorPhaseDial       = "dial"
+	ErrorPhaseHandshake  = "handshake"
+	ErrorPhaseUpgrade    = "upgrade"
+	ErrorPhaseStreamOpen = "stream-open"
+	ErrorPhaseRead       = "read"
+	ErrorPhaseWrite      = "write"
+	ErrorPhaseCollect    = "collect"
+)
+
+var errorPhases = []string{ErrorPhaseDial, ErrorPhaseHandshake, ErrorPhaseUpgrade, ErrorPhaseStreamOpen, ErrorPhaseRead, ErrorPhaseWrite, ErrorPhaseCollect}
+
+// errorCodes are the stable codes errors are classified into. They are
+// independent of the protocol and the language of the component that reported
+// the error, so runs of all protocols can be compared by them.
+var errorCodes = []string{
+	"eof",
+	"timeout",
+	"idle_timeout",
+	"handshake_timeout",
+	"connection_refused",
+	"connection_reset",
+	"connection_closed",
+	"tls",
+	"dns",
+	"canceled",
+	"application_error",
+	"transport_error",
+	"stream_reset",
+	"session_closed",
+	"websocket_close",
+	"http_status",
+	"ice_failure",
+	"not_collected",
+	"unknown",
+}
+
+// errorProtocolCodeKinds say what ErrorProtocolCode is: a QUIC application
+// or transport error code, an HTTP/3 error code, a WebTransport session or
+// stream error code, a WebSocket close code or an HTTP status.
+var errorProtocolCodeKinds = []string{
+	"quic_application",
+	"quic_transport",
+	"http3",
+	"webtransport_session",
+	"webtransport_stream",
+	"websocket_close",
+	"http_status",
+}
+
+// metricEnums are the value sets string metrics can be restricted to with the
+// enum option of the metric tag.
+var metricEnums = map[string][]string{
+	"error_phase":              errorPhases,
+	"error_code":               errorCodes,
+	"error_protocol_code_kind": errorProtocolCodeKinds,
+}
+
+// legacyErrorPhases map the message prefixes clients used before errors were
+// structured to their phase.
+var legacyErrorPhases = []struct{ Prefix, Phase string }{
+	{"Failed to dial", ErrorPhaseDial},
+	{"Failed to GET", ErrorPhaseDial},
+	{"Could not accept stream", ErrorPhaseStreamOpen},
+	{"Could not open stream", ErrorPhaseStreamOpen},
+	{"Failed to read", ErrorPhaseRead},
+	{"Could not copy stream data", ErrorPhaseRead},
+	{"Failed to write", ErrorPhaseWrite},
+	{ErrorEndTimeNotSet, ErrorPhaseCollect},
+	{ErrorTransferStartNotSet, ErrorPhaseCollect},
+	{ErrorTransferEndNotSet, ErrorPhaseCollect},
+}
+
+// legacyErrorCodes map substrings of Go and browser error messages, and of
+// the messages the cleaning rules write, to their code. They are matched
+// ignoring case and the first match wins, so more specific ones come first.
+var legacyErrorCodes = []struct{ Substring, Code string }{
+	{"unexpected EOF", "eof"},
+	{"handshake did not complete in time", "handshake_timeout"},
+	{"timeout: no recent network activity", "idle_timeout"},
+	{"i/o timeout", "timeout"},
+	{"deadline exceeded", "timeout"},
+	{"connection refused", "connection_refused"},
+	{"actively refused", "connection_refused"},
+	{"connection reset", "connection_reset"},
+	{"forcibly closed", "connection_reset"},
+	{"vom Remotehost geschlossen", "connection_reset"},
+	{"WEBSOCKETS: CONNECTION CLOSED", "connection_reset"},
+	{"use of closed network connection", "connection_closed"},
+	{"broken pipe", "connection_closed"},
+	{"no such host", "dns"},
+	{"tls:", "tls"},
+	{"x509:", "tls"},
+	{"context canceled", "canceled"},
+	{"Application error", "application_error"},
+	{"websocket: close", "websocket_close"},
+	{"bad handshake", "http_status"},
+	{"EOF", "eof"},
+	{"not set/collected", "not_collected"},
+}
+
+// classifyLegacyError derives phase and code from an unstructured error
+// message, as sent by clients that predate the error fields. Unknown
+// messages get the code unknown and no phase.
+func classifyLegacyError(message string) (phase, code string) {
+	for _, p := range legacyErrorPhases {
+		if strings.HasPrefix(message, p.Prefix) {
+			phase = p.Phase
+			break
+		}
+	}
+	code = "unknown"
+	lower := strings.ToLower(message)
+	for _, c := range legacyErrorCodes {
+		if strings.Contains(lower, strings.ToLower(c.Substring)) {
+			code = c.Code
+			break
+		}
+	}
+	return phase, code
+}
+
+// completeErrorFields fills in the error fields of an update that sets Error
+// without them and records which side reported the error. Clearing Error
+// clears the whole error.
+func completeErrorFields(fields map[string]any, side Side) {
+	msg, hasError := fields["Error"].(string)
+	_, hasPhase := fields["ErrorPhase"]
+	_, hasCode := fields["ErrorCode"]
+
+	switch {
+	case hasError && msg == "":
+		fields["ErrorPhase"], fields["ErrorCode"], fields["ErrorProtocolCodeKind"] = "", "", ""
+		fields["ErrorProtocolCode"] = nil
+		fields["ErrorSide"] = SideAny
+		return
+	case hasError && !hasPhase && !hasCode:
+		fields["ErrorPhase"], fields["ErrorCode"] = classifyLegacyError(msg)
+	case !hasError && !hasPhase && !hasCode:
+		return
+	case hasError && !hasCode:
+		fields["ErrorCode"] = "unknown"
+	}
+	fields["ErrorSide"] = side
+}
+
+// ErrorGroup holds the error rate of one group of runs, broken down by phase.
+type ErrorGroup struct {
+	Key    map[string]string `json:"key"`
+	Runs   int               `json:"runs"`
+	Errors int               `json:"errors"`
+	Rate   float64           `json:"rate"`
+	Phases []PhaseErrors     `json:"phases"`
+}
+
+// PhaseErrors counts the errors of one phase. Runs with an error but no
+// phase, e.g. unrecognized legacy messages, are counted under an empty phase.
+type PhaseErrors struct {
+	Phase  string         `json:"phase"`
+	Errors int            `json:"errors"`
+	Rate   float64        `json:"rate"`
+	Codes  map[string]int `json:"codes"`
+}
+
+// aggregateErrors computes the error rates per group. The rate of a phase is
+// relative to all runs of the group, so the phase rates add up to the rate of
+// the group.
+func aggregateErrors(runs []TestRun, groupBy []string) []ErrorGroup {
+	keys, groups := groupRuns(runs, groupBy)
+
+	result := make([]ErrorGroup, len(groups))
+	for i, group := range groups {
+		g := ErrorGroup{Key: keys[i], Runs: len(group), Phases: []PhaseErrors{}}
+
+		phases := map[string]*PhaseErrors{}
+		for _, run := range group {
+			if run.Error == "" {
+				continue
+			}
+			g.Errors++
+			p, ok := phases[run.ErrorPhase]
+			if !ok {
+				p = &PhaseErrors{Phase: run.ErrorPhase, Codes: map[string]int{}}
+				phases[run.ErrorPhase] = p
+			}
+			p.Errors++
+			p.Codes[run.ErrorCode]++
+		}
+
+		for _, phase := range append(slices.Clone(errorPhases), "") {
+			if p, ok := phases[phase]; ok {
+				p.Rate = float64(p.Errors) / float64(g.Runs)
+				g.Phases = append(g.Phases, *p)
+			}
+		}
+		g.Rate = float64(g.Errors) / float64(g.Runs)
+		result[i] = g
+	}
+	return result
+}
+
+func exportErrorsToCsv(groups []ErrorGroup, groupBy []string) string {
+	lines := []string{strings.Join(append(slices.Clone(groupBy), "runs", "phase", "code", "errors", "rate"), ";")}
+
+	for _, g := range groups {
+		key := make([]string, len(groupBy))
+		for i, col := range groupBy {
+			key[i] = g.Key[col]
+		}
+		for _, p := range g.Phases {
+			codes := make([]string, 0, len(p.Codes))
+			for code := range p.Codes {
+				codes = append(codes, code)
+			}
+			slices.Sort(codes)
+			for _, code := range codes {
+				lines = append(lines, strings.Join(append(slices.Clone(key),
+					fmt.Sprintf("%d", g.Runs), p.Phase, code, fmt.Sprintf("%d", p.Codes[code]), fmt.Sprintf("%f", float64(p.Codes[code])/float64(g.Runs)),
+				), ";"))
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func registerErrorRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	// error rates by phase and code, grouped like /stats. Only runs that
+	// ended are counted unless the state filter says otherwise.
+	app.Get("/errors", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		filter, err := parseRunFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(filter.States) == 0 {
+			filter.States = []RunState{RunStateCompleted, RunStateFailed, RunStateTimedOut, RunStateAborted}
+		}
+
+		groupBy, err := parseGroupBy(c.Query("group_by"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		runs := []TestRun{}
+		if err := filter.Apply(db).Find(&runs).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := attachCustomValues(db, runs); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		groups := aggregateErrors(runs, groupBy)
+
+		if c.Query("format") == "csv" {
+			c.Set("Content-Type", "text/csv")
+			c.Set("Content-Disposition", "attachment; filename=error_rates.csv")
+			return c.SendString(exportErrorsToCsv(groups, groupBy))
+		}
+
+		return c.JSON(fiber.Map{"group_by": groupBy, "groups": groups})
+	})
+}
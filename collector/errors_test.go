@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestClassifyLegacyError(t *testing.T) {
+	tests := []struct {
+		message     string
+		phase, code string
+	}{
+		{"Failed to dial WebSockets: unexpected EOF", ErrorPhaseDial, "eof"},
+		{"Failed to dial: timeout: no recent network activity", ErrorPhaseDial, "idle_timeout"},
+		{"Failed to GET: CRYPTO_ERROR 0x12a (local): tls: handshake did not complete in time", ErrorPhaseDial, "handshake_timeout"},
+		{"Could not open stream: Application error 0x100 (remote)", ErrorPhaseStreamOpen, "application_error"},
+		{"Failed to read: read tcp 127.0.0.1:1->127.0.0.1:2: wsarecv: An existing connection was forcibly closed by the remote host.", ErrorPhaseRead, "connection_reset"},
+		{"Failed to write: write: broken pipe", ErrorPhaseWrite, "connection_closed"},
+		{"WEBSOCKETS: CONNECTION CLOSED", "", "connection_reset"},
+		{ErrorEndTimeNotSet, ErrorPhaseCollect, "not_collected"},
+		{"something nobody has seen before", "", "unknown"},
+	}
+	for _, tt := range tests {
+		phase, code := classifyLegacyError(tt.message)
+		if phase != tt.phase || code != tt.code {
+			t.Errorf("%q: got %q/%q, want %q/%q", tt.message, phase, code, tt.phase, tt.code)
+		}
+	}
+}
+
+// TestLegacyErrorTablesUseKnownValues keeps the legacy mappings within the
+// enums the error fields are validated against.
+func TestLegacyErrorTablesUseKnownValues(t *testing.T) {
+	for _, p := range legacyErrorPhases {
+		if !slices.Contains(errorPhases, p.Phase) {
+			t.Errorf("prefix %q maps to unknown phase %q", p.Prefix, p.Phase)
+		}
+	}
+	for _, c := range legacyErrorCodes {
+		if !slices.Contains(errorCodes, c.Code) {
+			t.Errorf("substring %q maps to unknown code %q", c.Substring, c.Code)
+		}
+	}
+}
+
+func TestCompleteErrorFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]any
+		want   map[string]any
+	}{
+		{"legacy message", map[string]any{"Error": "Failed to dial: connection refused"},
+			map[string]any{"ErrorPhase": ErrorPhaseDial, "ErrorCode": "connection_refused", "ErrorSide": SideServer}},
+		{"phase without code", map[string]any{"Error": "boom", "ErrorPhase": ErrorPhaseRead},
+			map[string]any{"ErrorPhase": ErrorPhaseRead, "ErrorCode": "unknown", "ErrorSide": SideServer}},
+		{"structured", map[string]any{"Error": "boom", "ErrorPhase": ErrorPhaseWrite, "ErrorCode": "stream_reset"},
+			map[string]any{"ErrorPhase": ErrorPhaseWrite, "ErrorCode": "stream_reset", "ErrorSide": SideServer}},
+		{"cleared", map[string]any{"Error": ""},
+			map[string]any{"ErrorPhase": "", "ErrorCode": "", "ErrorProtocolCodeKind": "", "ErrorProtocolCode": nil, "ErrorSide": SideAny}},
+		{"no error", map[string]any{"BytesPayload": int64(1)}, map[string]any{}},
+	}
+	for _, tt := range tests {
+		completeErrorFields(tt.fields, SideServer)
+		for k, want := range tt.want {
+			if got, ok := tt.fields[k]; !ok || got != want {
+				t.Errorf("%s: %s is %v, want %v", tt.name, k, got, want)
+			}
+		}
+		if _, ok := tt.fields["ErrorSide"]; ok && len(tt.want) == 0 {
+			t.Errorf("%s: got an error side for an update without error", tt.name)
+		}
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	runs := []TestRun{
+		{Protocol: ProtocolHTTP3},
+		{Protocol: ProtocolHTTP3},
+		{Protocol: ProtocolHTTP3, Error: "x", ErrorPhase: ErrorPhaseDial, ErrorCode: "timeout"},
+		{Protocol: ProtocolHTTP3, Error: "x", ErrorPhase: ErrorPhaseDial, ErrorCode: "dns"},
+		{Protocol: ProtocolWebSockets, Error: "x", ErrorCode: "unknown"},
+	}
+
+	groups := aggregateErrors(runs, []string{"protocol"})
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(groups))
+	}
+
+	http3 := groups[0]
+	if http3.Key["protocol"] != "http3" || http3.Runs != 4 || http3.Errors != 2 || http3.Rate != 0.5 {
+		t.Errorf("http3: got %+v", http3)
+	}
+	if len(http3.Phases) != 1 || http3.Phases[0].Phase != ErrorPhaseDial || http3.Phases[0].Rate != 0.5 || http3.Phases[0].Codes["dns"] != 1 {
+		t.Errorf("http3: got phases %+v", http3.Phases)
+	}
+
+	websockets := groups[1]
+	if websockets.Rate != 1 || len(websockets.Phases) != 1 || websockets.Phases[0].Phase != "" {
+		t.Errorf("websockets: got %+v, want its error under an empty phase", websockets)
+	}
+
+	csv := strings.Split(exportErrorsToCsv(groups, []string{"protocol"}), "\n")
+	want := []string{
+		"protocol;runs;phase;code;errors;rate",
+		"http3;4;dial;dns;1;0.250000",
+		"http3;4;dial;timeout;1;0.250000",
+		"websockets;1;;unknown;1;1.000000",
+	}
+	if !slices.Equal(csv, want) {
+		t.Errorf("got CSV\n%s\nwant\n%s", strings.Join(csv, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestProtocolCodeAbove2To53 checks that a QUIC error code beyond the 2^53 a
+// JSON number holds exactly survives the run JSON, the events and the exports.
+func TestProtocolCodeAbove2To53(t *testing.T) {
+	const code = "9007199254740993" // 2^53 + 1
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolWebTransport, 1)
+	fields, err := parseRunUpdate(map[string]any{"Error": "Application error 0x20000000000001 (remote)", "ErrorCode": "application_error", "ErrorProtocolCode": code, "ErrorProtocolCodeKind": "quic_application"}, SideClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyRunUpdate(db, run.ID, fields, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&run, run.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"ErrorProtocolCode":"`+code+`"`) {
+		t.Errorf("run JSON %s, want the protocol code %s as string", data, code)
+	}
+	decoded := TestRun{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ErrorProtocolCode == nil || *decoded.ErrorProtocolCode != *run.ErrorProtocolCode {
+		t.Errorf("decoded protocol code %v, want %s", decoded.ErrorProtocolCode, code)
+	}
+
+	for _, event := range runUpdateEvents(run, fields) {
+		if v, ok := event.Data["ErrorProtocolCode"]; ok && v != code {
+			t.Errorf("%s event carries protocol code %#v, want %q", event.Type, v, code)
+		}
+	}
+
+	ndjson := exportTestRuns(t, db, ExportOptions{Format: ExportFormatNDJSON})
+	if !strings.Contains(string(ndjson), `"error_protocol_code":"`+code+`"`) {
+		t.Errorf("NDJSON export %s, want the protocol code %s as string", ndjson, code)
+	}
+
+	imported := openTestDB(t)
+	csv := exportTestRuns(t, db, ExportOptions{Format: ExportFormatCSV, Delimiter: ';'})
+	if _, err := importRunsCsv(imported, bytes.NewReader(csv), ImportOptions{Mode: ImportModeSkip}); err != nil {
+		t.Fatal(err)
+	}
+	again := TestRun{}
+	if err := imported.First(&again, run.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if again.ErrorProtocolCode == nil || *again.ErrorProtocolCode != *run.ErrorProtocolCode {
+		t.Errorf("imported protocol code %v, want %s", again.ErrorProtocolCode, code)
+	}
+}
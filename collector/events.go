@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Run lifecycle events published on GET /events.
+type RunEventType string
+
+const (
+	RunEventBegin   RunEventType = "begin"   // a run was created by /begin
+	RunEventUpdate  RunEventType = "update"  // metrics or the state of a run were written
+	RunEventError   RunEventType = "error"   // an update reported an error
+	RunEventEnd     RunEventType = "end"     // a run reached a terminal state
+	RunEventFlagged RunEventType = "flagged" // the flagger raised flags on a run
+)
+
+var runEventTypes = []RunEventType{RunEventBegin, RunEventUpdate, RunEventError, RunEventEnd, RunEventFlagged}
+
+const (
+	// runEventHistory is the number of recent events kept for subscribers
+	// that resume with Last-Event-ID.
+	runEventHistory = 4096
+	// runEventBuffer is the number of events a subscriber may lag behind
+	// before it is disconnected.
+	runEventBuffer = 1024
+	// runEventHeartbeat keeps idle streams open through proxies.
+	runEventHeartbeat = 15 * time.Second
+)
+
+// RunEvent is one lifecycle event of a run. ID increases by one with every
+// event published since the collector started. Data holds what the event is
+// about: the written metrics of an update, the error fields of an error, the
+// reason of an end or the flags of a flagged event.
+type RunEvent struct {
+	ID         int64          `json:"id"`
+	Type       RunEventType   `json:"type"`
+	Time       time.Time      `json:"time"`
+	RunID      int64          `json:"run_id"`
+	CampaignID *int64         `json:"campaign_id,omitempty"`
+	BatchID    *int64         `json:"batch_id,omitempty"`
+	Protocol   Protocol       `json:"protocol"`
+	State      RunState       `json:"state"`
+	Version    int64          `json:"version"`
+	Data       map[string]any `json:"data,omitempty"`
+}
+
+func newRunEvent(typ RunEventType, run TestRun, data map[string]any) RunEvent {
+	return RunEvent{
+		Type:       typ,
+		Time:       time.Now(),
+		RunID:      run.ID,
+		CampaignID: run.CampaignID,
+		BatchID:    run.BatchID,
+		Protocol:   run.Protocol,
+		State:      run.State,
+		Version:    run.Version,
+		Data:       data,
+	}
+}
+
+// runUpdateEvents are the events of an update that was applied to run: always
+// an update, an error if the update reported one and an end if it moved the
+// run to a terminal state.
+func runUpdateEvents(run TestRun, fields map[string]any) []RunEvent {
+	// like TestRun, events carry the protocol code as string, QUIC codes go
+	// beyond the 2^53 a JSON number holds exactly
+	if code, ok := fields["ErrorProtocolCode"].(int64); ok {
+		fields = maps.Clone(fields)
+		fields["ErrorProtocolCode"] = strconv.FormatInt(code, 10)
+	}
+
+	events := []RunEvent{newRunEvent(RunEventUpdate, run, fields)}
+
+	if msg, _ := fields["Error"].(string); msg != "" {
+		data := map[string]any{}
+		for _, k := range []string{"Error", "ErrorPhase", "ErrorCode", "ErrorProtocolCode", "ErrorProtocolCodeKind", "ErrorSide"} {
+			if v, ok := fields[k]; ok {
+				data[k] = v
+			}
+		}
+		events = append(events, newRunEvent(RunEventError, run, data))
+	}
+
+	if state, ok := fields["State"].(RunState); ok && state.Terminal() {
+		events = append(events, newRunEvent(RunEventEnd, run, map[string]any{"StateReason": run.StateReason}))
+	}
+
+	return events
+}
+
+// EventFilter selects the events a subscriber receives. Empty fields do not
+// filter.
+type EventFilter struct {
+	Types       []RunEventType
+	CampaignIDs []int64
+	BatchIDs    []int64
+	RunIDs      []int64
+	Protocols   []Protocol
+}
+
+func parseEventFilter(c *fiber.Ctx) (EventFilter, error) {
+	f := EventFilter{}
+
+	for _, v := range splitQuery(c.Query("type")) {
+		typ := RunEventType(v)
+		if !slices.Contains(runEventTypes, typ) {
+			return f, fmt.Errorf("type: unknown event type %q", v)
+		}
+		f.Types = append(f.Types, typ)
+	}
+	for _, v := range splitQuery(c.Query("protocol")) {
+		f.Protocols = append(f.Protocols, Protocol(v))
+	}
+
+	var err error
+	if f.CampaignIDs, err = splitQueryInt64s(c.Query("campaign_id")); err != nil {
+		return f, fmt.Errorf("campaign_id: %w", err)
+	}
+	if f.BatchIDs, err = splitQueryInt64s(c.Query("batch_id")); err != nil {
+		return f, fmt.Errorf("batch_id: %w", err)
+	}
+	if f.RunIDs, err = splitQueryInt64s(c.Query("run_id")); err != nil {
+		return f, fmt.Errorf("run_id: %w", err)
+	}
+
+	return f, nil
+}
+
+func (f EventFilter) Match(e RunEvent) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type) {
+		return false
+	}
+	if len(f.CampaignIDs) > 0 && (e.CampaignID == nil || !slices.Contains(f.CampaignIDs, *e.CampaignID)) {
+		return false
+	}
+	if len(f.BatchIDs) > 0 && (e.BatchID == nil || !slices.Contains(f.BatchIDs, *e.BatchID)) {
+		return false
+	}
+	if len(f.RunIDs) > 0 && !slices.Contains(f.RunIDs, e.RunID) {
+		return false
+	}
+	if len(f.Protocols) > 0 && !slices.Contains(f.Protocols, e.Protocol) {
+		return false
+	}
+	return true
+}
+
+// eventHub fans published events out to the subscribers. Publishing never
+// blocks: a subscriber that falls runEventBuffer events behind is
+// disconnected and can resume from the history with Last-Event-ID.
+type eventHub struct {
+	mu      sync.Mutex
+	lastID  int64
+	history []RunEvent
+	subs    map[*eventSubscription]struct{}
+}
+
+type eventSubscription struct {
+	filter EventFilter
+	C      chan RunEvent // closed when the subscriber was too slow
+}
+
+var runEvents = &eventHub{subs: map[*eventSubscription]struct{}{}}
+
+func (h *eventHub) publish(events ...RunEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, e := range events {
+		h.lastID++
+		e.ID = h.lastID
+
+		h.history = append(h.history, e)
+		if len(h.history) > runEventHistory {
+			// reslicing instead of shifting, append copies the kept
+			// events once the capacity runs out
+			h.history = h.history[len(h.history)-runEventHistory:]
+		}
+
+		for sub := range h.subs {
+			if !sub.filter.Match(e) {
+				continue
+			}
+			select {
+			case sub.C <- e:
+			default:
+				close(sub.C)
+				delete(h.subs, sub)
+			}
+		}
+	}
+}
+
+// subscribe registers a subscriber. If lastID is given, the events after it
+// that are still in the history are delivered first.
+func (h *eventHub) subscribe(filter EventFilter, lastID *int64) *eventSubscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	backlog := []RunEvent{}
+	if lastID != nil {
+		for _, e := range h.history {
+			if e.ID > *lastID && filter.Match(e) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	sub := &eventSubscription{filter: filter, C: make(chan RunEvent, runEventBuffer+len(backlog))}
+	for _, e := range backlog {
+		sub.C <- e
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub *eventSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[sub]; ok {
+		close(sub.C)
+		delete(h.subs, sub)
+	}
+}
+
+type pendingEventsKey struct{}
+
+type pendingEvents struct {
+	mu     sync.Mutex
+	events []RunEvent
+}
+
+// deferRunEvents returns db with a buffer that holds back the events raised
+// through it until release is called. Callers that wrap applyRunUpdate in an
+// enclosing transaction use it to publish only once that transaction has
+// committed; events of a transaction that was rolled back are never released.
+func deferRunEvents(db *gorm.DB) (*gorm.DB, *pendingEvents) {
+	pending := &pendingEvents{}
+	return db.WithContext(context.WithValue(db.Statement.Context, pendingEventsKey{}, pending)), pending
+}
+
+func (p *pendingEvents) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	runEvents.publish(p.events...)
+	p.events = nil
+}
+
+// runEventOrder keeps the events of a run in the order of its versions. A
+// transaction takes it as its last step, while it still holds the rows it
+// wrote, and lets go of it once it committed and published its events. An
+// update committed after another one is thus never published before it.
+var runEventOrder sync.Mutex
+
+// transactionInEventOrder runs fn in a transaction on db like db.Transaction
+// and calls publish if it committed, both holding runEventOrder.
+func transactionInEventOrder(db *gorm.DB, fn func(tx *gorm.DB) error, publish func()) error {
+	locked := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		runEventOrder.Lock()
+		locked = true
+		return nil
+	})
+	if locked {
+		defer runEventOrder.Unlock()
+	}
+	if err == nil {
+		publish()
+	}
+	return err
+}
+
+// publishRunEvents publishes events raised on db, or holds them back if db
+// was prepared with deferRunEvents.
+func publishRunEvents(db *gorm.DB, events ...RunEvent) {
+	if p, ok := db.Statement.Context.Value(pendingEventsKey{}).(*pendingEvents); ok {
+		p.mu.Lock()
+		p.events = append(p.events, events...)
+		p.mu.Unlock()
+		return
+	}
+	runEvents.publish(events...)
+}
+
+// parseLastEventID reads where a subscriber resumes: the Last-Event-ID header
+// EventSource sends on reconnect, or the last_event_id query parameter.
+func parseLastEventID(c *fiber.Ctx) (*int64, error) {
+	v := c.Get("Last-Event-ID")
+	if v == "" {
+		v = c.Query("last_event_id")
+	}
+	if v == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("last event id: %w", err)
+	}
+	return &id, nil
+}
+
+func streamEventsSSE(c *fiber.Ctx, filter EventFilter, lastID *int64) error {
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	sub := runEvents.subscribe(filter, lastID)
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer runEvents.unsubscribe(sub)
+
+		heartbeat := time.NewTicker(runEventHeartbeat)
+		defer heartbeat.Stop()
+
+		// sent right away, so clients see the stream is open
+		fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+
+		for {
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			}
+		}
+	})
+
+	return nil
+}
+
+func streamEventsWebSocket(conn *websocket.Conn) {
+	filter := conn.Locals("eventFilter").(EventFilter)
+	lastID := conn.Locals("lastEventID").(*int64)
+
+	sub := runEvents.subscribe(filter, lastID)
+	defer runEvents.unsubscribe(sub)
+
+	// the stream is one-way, reading only notices the client going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(runEventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber too slow, resume with last_event_id")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				return
+			}
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func registerEventRoutes(app *fiber.App, auth *keyStore) {
+	upgrade := websocket.New(streamEventsWebSocket)
+
+	// live run events as Server-Sent Events, or as JSON messages on a
+	// WebSocket if the request asks for an upgrade
+	app.Get("/events", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		filter, err := parseEventFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		lastID, err := parseLastEventID(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if websocket.IsWebSocketUpgrade(c) {
+			c.Locals("eventFilter", filter)
+			c.Locals("lastEventID", lastID)
+			return upgrade(c)
+		}
+
+		return streamEventsSSE(c, filter, lastID)
+	})
+}
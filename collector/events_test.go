@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestRunEventsInVersionOrder publishes concurrent updates of one run, single
+// ones and in batches. A subscriber has to receive them in the order they were
+// committed, which is the order of their versions.
+func TestRunEventsInVersionOrder(t *testing.T) {
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolHTTP3, 1)
+
+	const updates = 200
+	sub := runEvents.subscribe(EventFilter{Types: []RunEventType{RunEventUpdate}, RunIDs: []int64{run.ID}}, nil)
+	defer runEvents.unsubscribe(sub)
+
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fields := map[string]any{"LostPackets": float64(i)}
+			if i%2 == 0 {
+				if _, err := applyRunUpdate(db, run.ID, fields, nil); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			results, err := applyBatch(db, []batchItem{{RunID: run.ID, Fields: fields}}, SideClient)
+			if err != nil {
+				t.Error(err)
+			} else if results[0].Status != fiber.StatusNoContent {
+				t.Errorf("batch item: status %d: %s", results[0].Status, results[0].Error)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for want := int64(1); want <= updates; want++ {
+		select {
+		case e := <-sub.C:
+			if e.Version != want {
+				t.Fatalf("got version %d, want %d", e.Version, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event for version %d", want)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/parquet-go/parquet-go"
+	"gorm.io/gorm"
+)
+
+type ExportFormat string
+
+const (
+	ExportFormatCSV     ExportFormat = "csv"
+	ExportFormatJSON    ExportFormat = "json"
+	ExportFormatNDJSON  ExportFormat = "ndjson"
+	ExportFormatParquet ExportFormat = "parquet"
+)
+
+// exportFormats are in the order they are offered for content negotiation,
+// so clients accepting anything get CSV.
+var exportFormats = []ExportFormat{ExportFormatCSV, ExportFormatJSON, ExportFormatNDJSON, ExportFormatParquet}
+
+var exportMimeTypes = map[ExportFormat]string{
+	ExportFormatCSV:     "text/csv",
+	ExportFormatJSON:    fiber.MIMEApplicationJSON,
+	ExportFormatNDJSON:  "application/x-ndjson",
+	ExportFormatParquet: "application/vnd.apache.parquet",
+}
+
+// exportBatchSize is the number of runs read from the database and written
+// at once, so exports never hold the whole table in memory.
+const exportBatchSize = 500
+
+// ExportOptions select the format of an export. Delimiter and DecimalComma
+// only apply to CSV, e.g. delimiter=; and decimal=, for a German Excel.
+type ExportOptions struct {
+	Format       ExportFormat
+	Delimiter    rune
+	DecimalComma bool
+	Clean        []CleaningRule // cleaning rules applied before writing, nil for raw runs
+}
+
+// parseExportOptions reads format, delimiter, decimal and the cleaning rules
+// from the query. Without a format query the given default is used, or the
+// format is negotiated from the Accept header if there is none.
+func parseExportOptions(c *fiber.Ctx, defaultFormat ExportFormat) (ExportOptions, error) {
+	opts := ExportOptions{Format: ExportFormat(c.Query("format", string(defaultFormat))), Delimiter: ';'}
+
+	if opts.Format == "" {
+		offers := make([]string, len(exportFormats))
+		for i, f := range exportFormats {
+			offers[i] = exportMimeTypes[f]
+		}
+		accepted := c.Accepts(offers...)
+		if accepted == "" {
+			return opts, fmt.Errorf("none of the export formats %s is acceptable", strings.Join(offers, ", "))
+		}
+		for f, mime := range exportMimeTypes {
+			if mime == accepted {
+				opts.Format = f
+			}
+		}
+	} else if _, ok := exportMimeTypes[opts.Format]; !ok {
+		return opts, fmt.Errorf("format: unknown export format %q", opts.Format)
+	}
+
+	switch d := c.Query("delimiter"); d {
+	case "", ";":
+	case ",", "|":
+		opts.Delimiter = rune(d[0])
+	case "tab", "\t":
+		opts.Delimiter = '\t'
+	default:
+		return opts, fmt.Errorf("delimiter: must be ;, ,, | or tab, got %q", d)
+	}
+
+	switch d := c.Query("decimal"); d {
+	case "", ".":
+	case ",":
+		opts.DecimalComma = true
+	default:
+		return opts, fmt.Errorf("decimal: must be . or ,, got %q", d)
+	}
+	if opts.DecimalComma && opts.Delimiter == ',' {
+		return opts, fmt.Errorf("decimal: a decimal comma needs a delimiter other than ,")
+	}
+
+	if c.QueryBool("clean") {
+		rules, err := parseCleaningRules(c.Query("rules"))
+		if err != nil {
+			return opts, err
+		}
+		opts.Clean = rules
+	}
+
+	return opts, nil
+}
+
+type exportKind int
+
+const (
+	exportInt exportKind = iota
+	exportFloat
+	exportString
+	exportTime
+)
+
+// exportColumn is one column of every export format. Value returns an int64,
+// float64, string or time.Time, or nil for a missing value.
+type exportColumn struct {
+	Name  string
+	Kind  exportKind
+	Value func(r *TestRun) any
+}
+
+func optionalInt(v *int64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// optionalIntString is for integers beyond the 2^53 a JSON number holds
+// exactly, e.g. QUIC error codes.
+func optionalIntString(v *int64) any {
+	if v == nil {
+		return nil
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+func optionalFloat(v *float64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func optionalTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// exportColumns are the columns of an export, named after the database
+// columns so an export can be imported again. The custom metrics and labels
+// of the exported runs follow them, see customExportColumns.
+var exportColumns = []exportColumn{
+	{"id", exportInt, func(r *TestRun) any { return r.ID }},
+	{"protocol", exportString, func(r *TestRun) any { return string(r.Protocol) }},
+	{"enviroment", exportString, func(r *TestRun) any { return string(r.Enviroment) }},
+	{"time_slot", exportString, func(r *TestRun) any { return string(r.TimeSlot) }},
+	{"test_begin", exportTime, func(r *TestRun) any { return optionalTime(r.TestBegin) }},
+	{"test_end", exportTime, func(r *TestRun) any { return optionalTime(r.TestEnd) }},
+	{"client_id", exportInt, func(r *TestRun) any { return int64(r.ClientID) }},
+	{"parallel_clients", exportInt, func(r *TestRun) any { return int64(r.ParallelClients) }},
+	{"transfer_start_unix_ms", exportInt, func(r *TestRun) any { return r.TransferStartUnixMs }},
+	{"transfer_end_unix_ms", exportInt, func(r *TestRun) any { return r.TransferEndUnixMs }},
+	{"transfer_duration_ms", exportInt, func(r *TestRun) any { return optionalInt(r.TransferDurationMs) }},
+	{"throughput_mbps", exportFloat, func(r *TestRun) any { return optionalFloat(r.ThroughputMbps) }},
+	{"bytes_sent_total", exportInt, func(r *TestRun) any { return r.BytesSentTotal }},
+	{"bytes_payload", exportInt, func(r *TestRun) any { return r.BytesPayload }},
+	{"bandwidth_efficiency", exportFloat, func(r *TestRun) any { return optionalFloat(r.BandwidthEfficiency) }},
+	{"cpu_client_percent_before", exportFloat, func(r *TestRun) any { return r.CpuClientPercentBefore }},
+	{"cpu_client_percent_after", exportFloat, func(r *TestRun) any { return r.CpuClientPercentAfter }},
+	{"cpu_client_percent_while", exportFloat, func(r *TestRun) any { return r.CpuClientPercentWhile }},
+	{"cpu_server_percent_before", exportFloat, func(r *TestRun) any { return r.CpuServerPercentBefore }},
+	{"cpu_server_percent_after", exportFloat, func(r *TestRun) any { return r.CpuServerPercentAfter }},
+	{"cpu_server_percent_while", exportFloat, func(r *TestRun) any { return r.CpuServerPercentWhile }},
+	{"ram_client_bytes_before", exportInt, func(r *TestRun) any { return r.RamClientBytesBefore }},
+	{"ram_client_bytes_after", exportInt, func(r *TestRun) any { return r.RamClientBytesAfter }},
+	{"ram_client_bytes_while", exportInt, func(r *TestRun) any { return r.RamClientBytesWhile }},
+	{"ram_server_bytes_before", exportInt, func(r *TestRun) any { return r.RamServerBytesBefore }},
+	{"ram_server_bytes_after", exportInt, func(r *TestRun) any { return r.RamServerBytesAfter }},
+	{"ram_server_bytes_while", exportInt, func(r *TestRun) any { return r.RamServerBytesWhile }},
+	{"lost_packets", exportInt, func(r *TestRun) any { return r.LostPackets }},
+	{"retransmissions", exportInt, func(r *TestRun) any { return r.Retransmissions }},
+	{"connection_duration_ms", exportInt, func(r *TestRun) any { return r.ConnectionDurationMs }},
+	{"stream_duration_ms", exportInt, func(r *TestRun) any { return r.StreamDurationMs }},
+	{"error", exportString, func(r *TestRun) any { return r.Error }},
+	{"error_phase", exportString, func(r *TestRun) any { return r.ErrorPhase }},
+	{"error_code", exportString, func(r *TestRun) any { return r.ErrorCode }},
+	{"error_protocol_code", exportString, func(r *TestRun) any { return optionalIntString(r.ErrorProtocolCode) }},
+	{"error_protocol_code_kind", exportString, func(r *TestRun) any { return r.ErrorProtocolCodeKind }},
+	{"error_side", exportString, func(r *TestRun) any { return string(r.ErrorSide) }},
+	{"campaign_id", exportInt, func(r *TestRun) any { return optionalInt(r.CampaignID) }},
+	{"batch_id", exportInt, func(r *TestRun) any { return optionalInt(r.BatchID) }},
+	{"state", exportString, func(r *TestRun) any { return string(r.State) }},
+	{"state_reason", exportString, func(r *TestRun) any { return r.StateReason }},
+}
+
+// runExporter writes runs in one format. Write is called once per batch,
+// Close finishes the file.
+type runExporter interface {
+	Write(runs []TestRun) error
+	Close() error
+}
+
+func newRunExporter(w io.Writer, opts ExportOptions, columns []exportColumn) runExporter {
+	switch opts.Format {
+	case ExportFormatJSON:
+		return &jsonExporter{w: w, columns: columns, array: true}
+	case ExportFormatNDJSON:
+		return &jsonExporter{w: w, columns: columns}
+	case ExportFormatParquet:
+		return newParquetExporter(w, columns)
+	default:
+		return newCsvExporter(w, opts, columns)
+	}
+}
+
+// csvExporter writes RFC 4180 CSV: fields containing the delimiter, quotes or
+// line breaks are quoted and lines end with CRLF. Missing values are empty.
+type csvExporter struct {
+	w            *csv.Writer
+	columns      []exportColumn
+	decimalComma bool
+	header       bool
+	record       []string
+}
+
+func newCsvExporter(w io.Writer, opts ExportOptions, columns []exportColumn) *csvExporter {
+	cw := csv.NewWriter(w)
+	cw.Comma = opts.Delimiter
+	cw.UseCRLF = true
+	return &csvExporter{w: cw, columns: columns, decimalComma: opts.DecimalComma, record: make([]string, len(columns))}
+}
+
+func (e *csvExporter) Write(runs []TestRun) error {
+	if !e.header {
+		for i, col := range e.columns {
+			e.record[i] = col.Name
+		}
+		if err := e.w.Write(e.record); err != nil {
+			return err
+		}
+		e.header = true
+	}
+
+	for i := range runs {
+		for j, col := range e.columns {
+			e.record[j] = e.format(col.Value(&runs[i]))
+		}
+		if err := e.w.Write(e.record); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExporter) format(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if e.decimalComma {
+			s = strings.Replace(s, ".", ",", 1)
+		}
+		return s
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (e *csvExporter) Close() error {
+	// an empty export still gets its header
+	return e.Write(nil)
+}
+
+// jsonExporter writes one object per run, keyed by the column names, either
+// as a JSON array or as newline delimited JSON.
+type jsonExporter struct {
+	w       io.Writer
+	columns []exportColumn
+	array   bool
+	count   int
+}
+
+func (e *jsonExporter) Write(runs []TestRun) error {
+	for i := range runs {
+		obj := make(map[string]any, len(e.columns))
+		for _, col := range e.columns {
+			obj[col.Name] = col.Value(&runs[i])
+		}
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+
+		sep := "\n"
+		if e.array {
+			sep = ","
+			if e.count == 0 {
+				sep = "["
+			}
+		}
+		if e.array || e.count > 0 {
+			if _, err := io.WriteString(e.w, sep); err != nil {
+				return err
+			}
+		}
+		if _, err := e.w.Write(data); err != nil {
+			return err
+		}
+		e.count++
+	}
+	return nil
+}
+
+func (e *jsonExporter) Close() error {
+	switch {
+	case e.array && e.count == 0:
+		_, err := io.WriteString(e.w, "[]\n")
+		return err
+	case e.array:
+		_, err := io.WriteString(e.w, "]\n")
+		return err
+	case e.count > 0:
+		_, err := io.WriteString(e.w, "\n")
+		return err
+	}
+	return nil
+}
+
+// exportSchema is the Parquet schema of the export columns. Every column is
+// optional, missing values are stored as null.
+func exportSchema(columns []exportColumn) *parquet.Schema {
+	group := parquet.Group{}
+	for _, col := range columns {
+		var node parquet.Node
+		switch col.Kind {
+		case exportInt:
+			node = parquet.Int(64)
+		case exportFloat:
+			node = parquet.Leaf(parquet.DoubleType)
+		case exportString:
+			node = parquet.String()
+		case exportTime:
+			node = parquet.Timestamp(parquet.Millisecond)
+		}
+		group[col.Name] = parquet.Optional(node)
+	}
+	return parquet.NewSchema("test_runs", group)
+}
+
+// parquetExporter writes Snappy compressed Parquet. Row groups are written
+// every exportRowGroupSize runs, the file footer on Close.
+type parquetExporter struct {
+	w       *parquet.Writer
+	columns []exportColumn
+	// index of every export column in the schema, which orders its fields
+	// by name
+	index []int
+	rows  []parquet.Row
+}
+
+const exportRowGroupSize = 64 * 1024
+
+func newParquetExporter(w io.Writer, columns []exportColumn) *parquetExporter {
+	schema := exportSchema(columns)
+	index := make([]int, len(columns))
+	fields := schema.Fields()
+	for i, col := range columns {
+		for j, f := range fields {
+			if f.Name() == col.Name {
+				index[i] = j
+			}
+		}
+	}
+
+	return &parquetExporter{
+		w:       parquet.NewWriter(w, schema, parquet.Compression(&parquet.Snappy), parquet.MaxRowsPerRowGroup(exportRowGroupSize)),
+		columns: columns,
+		index:   index,
+	}
+}
+
+func (e *parquetExporter) Write(runs []TestRun) error {
+	e.rows = e.rows[:0]
+	for i := range runs {
+		row := make(parquet.Row, len(e.columns))
+		for j, col := range e.columns {
+			idx := e.index[j]
+			switch v := col.Value(&runs[i]).(type) {
+			case nil:
+				row[idx] = parquet.Value{}.Level(0, 0, idx)
+			case int64:
+				row[idx] = parquet.Int64Value(v).Level(0, 1, idx)
+			case float64:
+				row[idx] = parquet.DoubleValue(v).Level(0, 1, idx)
+			case string:
+				row[idx] = parquet.ByteArrayValue([]byte(v)).Level(0, 1, idx)
+			case time.Time:
+				row[idx] = parquet.Int64Value(v.UnixMilli()).Level(0, 1, idx)
+			}
+		}
+		e.rows = append(e.rows, row)
+	}
+	_, err := e.w.WriteRows(e.rows)
+	return err
+}
+
+func (e *parquetExporter) Close() error {
+	return e.w.Close()
+}
+
+// exportRuns streams the runs matching the filter in batches of
+// exportBatchSize. FindInBatches pages by ID, so runs are ordered by ID.
+func exportRuns(db *gorm.DB, filter RunFilter, w io.Writer, opts ExportOptions) error {
+	metrics, labels, err := customNames(db, filter)
+	if err != nil {
+		return err
+	}
+	columns := append(append([]exportColumn{}, exportColumns...), customExportColumns(metrics, labels)...)
+
+	// cleaned exports name the rules that changed each run, like the changes
+	// of /runs?clean=true
+	var changes map[int64][]CleaningChange
+	if opts.Clean != nil {
+		columns = append(columns, exportColumn{"clean_rules", exportString, func(r *TestRun) any {
+			return cleaningRuleNames(changes[r.ID])
+		}})
+	}
+	exp := newRunExporter(w, opts, columns)
+
+	batch := []TestRun{}
+	err = filter.Apply(db).FindInBatches(&batch, exportBatchSize, func(*gorm.DB, int) error {
+		if err := attachCustomValues(db, batch); err != nil {
+			return err
+		}
+		runs := batch
+		if opts.Clean != nil {
+			runs, changes = cleanRuns(batch, opts.Clean)
+		}
+		return exp.Write(runs)
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	return exp.Close()
+}
+
+// sendExport answers with a streamed export. Errors after the first bytes
+// were sent can only be logged, the client sees a truncated file.
+func sendExport(c *fiber.Ctx, db *gorm.DB, filter RunFilter, opts ExportOptions, filename string) error {
+	c.Set("Content-Type", exportMimeTypes[opts.Format])
+	c.Set("Content-Disposition", "attachment; filename="+filename+"."+string(opts.Format))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := exportRuns(db, filter, w, opts); err != nil {
+			log.Printf("export failed: %v", err)
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+func registerExportRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	// every run matching the filters of /runs in CSV, JSON, NDJSON or Parquet
+	app.Get("/export", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		filter, err := parseRunFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		opts, err := parseExportOptions(c, "")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return sendExport(c, db, filter, opts, "results")
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/parquet-go/parquet-go"
+	"gorm.io/gorm"
+)
+
+// createExportTestRuns stores a run with every kind of value, including a
+// custom metric and label, and one that never reported its transfer.
+func createExportTestRuns(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	begin := time.Date(2025, 4, 16, 0, 25, 11, 0, time.UTC)
+
+	full := createTestRun(t, db, ProtocolHTTP3, 2)
+	update, err := parseRunUpdate(map[string]any{
+		"TransferStartUnixMs":   float64(begin.UnixMilli() + 1000),
+		"TransferEndUnixMs":     float64(begin.UnixMilli() + 5000),
+		"CpuClientPercentWhile": 21.5,
+		"Error":                 `Failed to read: "stream"; closed`,
+		"quic.handshake_rtt_ms": 12.5,
+		"quic.version":          "v1",
+	}, SideAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update["TestBegin"] = begin
+	update["TestEnd"] = begin.Add(6 * time.Second)
+	if _, err := applyRunUpdate(db, full.ID, update, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyRunUpdate(db, full.ID, map[string]any{"BytesPayload": int64(312214163), "BytesSentTotal": int64(313357583)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := createTestRun(t, db, ProtocolWebSockets, 1)
+	if err := db.Model(&empty).Update("test_begin", begin).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exportTestRuns(t *testing.T, db *gorm.DB, opts ExportOptions) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := exportRuns(db, RunFilter{}, buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestExportCsvRoundTrip imports a CSV export into an empty database, which
+// has to end up with the same runs.
+func TestExportCsvRoundTrip(t *testing.T) {
+	db := openTestDB(t)
+	createExportTestRuns(t, db)
+	data := exportTestRuns(t, db, ExportOptions{Format: ExportFormatCSV, Delimiter: ';'})
+
+	imported := openTestDB(t)
+	result, err := importRunsCsv(imported, bytes.NewReader(data), ImportOptions{Mode: ImportModeSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Format != ImportFormatCollector || result.Imported != 2 || len(result.Errors) > 0 {
+		t.Fatalf("got %+v", result)
+	}
+
+	load := func(db *gorm.DB) []TestRun {
+		runs := []TestRun{}
+		if err := db.Order("id").Find(&runs).Error; err != nil {
+			t.Fatal(err)
+		}
+		for i := range runs {
+			runs[i].Version, runs[i].FlaggedVersion = 0, 0
+			runs[i].TestBegin, runs[i].TestEnd = runs[i].TestBegin.UTC(), runs[i].TestEnd.UTC()
+		}
+		return runs
+	}
+	want, got := load(db), load(imported)
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("run %d changed on the round trip:\ngot  %+v\nwant %+v", want[i].ID, got[i], want[i])
+		}
+	}
+}
+
+func TestExportCsvFormatting(t *testing.T) {
+	db := openTestDB(t)
+	createExportTestRuns(t, db)
+	data := string(exportTestRuns(t, db, ExportOptions{Format: ExportFormatCSV, Delimiter: '\t', DecimalComma: true}))
+
+	lines := strings.Split(strings.TrimSuffix(data, "\r\n"), "\r\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d CRLF terminated lines, want a header and 2 runs:\n%s", len(lines), data)
+	}
+	header := strings.Split(lines[0], "\t")
+	if header[len(header)-2] != "metric.quic.handshake_rtt_ms" || header[len(header)-1] != "label.quic.version" {
+		t.Errorf("got custom columns %v", header[len(header)-2:])
+	}
+	for _, want := range []string{"\t21,5\t", `"Failed to read: ""stream""; closed"`, "\t12,5\tv1"} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("run 1 does not contain %q: %s", want, lines[1])
+		}
+	}
+
+	// an empty export still has its header
+	empty := string(exportTestRuns(t, openTestDB(t), ExportOptions{Format: ExportFormatCSV, Delimiter: ';'}))
+	if !strings.HasPrefix(empty, "id;protocol;") || strings.Count(empty, "\r\n") != 1 {
+		t.Errorf("got empty export %q", empty)
+	}
+}
+
+// TestExportCleanRules checks that cleaned exports name the rules that
+// changed each run, and that raw exports have no such column.
+func TestExportCleanRules(t *testing.T) {
+	db := openTestDB(t)
+	createExportTestRuns(t, db)
+
+	rows := func(opts ExportOptions) []map[string]any {
+		t.Helper()
+		rows := []map[string]any{}
+		if err := json.Unmarshal(exportTestRuns(t, db, opts), &rows); err != nil {
+			t.Fatal(err)
+		}
+		return rows
+	}
+
+	for _, row := range rows(ExportOptions{Format: ExportFormatJSON}) {
+		if _, ok := row["clean_rules"]; ok {
+			t.Errorf("raw export has clean_rules: %v", row)
+		}
+	}
+
+	cleaned := rows(ExportOptions{Format: ExportFormatJSON, Clean: defaultCleaningRules})
+	if len(cleaned) != 2 || cleaned[0]["clean_rules"] != "" || cleaned[1]["clean_rules"] != "missing-test-end" {
+		t.Errorf("got clean_rules %q and %q, want none and missing-test-end", cleaned[0]["clean_rules"], cleaned[1]["clean_rules"])
+	}
+
+	app := fiber.New()
+	registerExportRoutes(app, db, newKeyStore(db, "legacy"))
+	for query, status := range map[string]int{
+		"clean=true&rules=webrtc-millis":                  200,
+		"clean=true&rules=webrtc-millis,missing-test-end": 200,
+		"clean=true&rules=bogus":                          400,
+	} {
+		req := httptest.NewRequest("GET", "/export?format=csv&"+query, nil)
+		req.Header.Set("X-API-KEY", "legacy")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: status %d, want %d: %s", query, resp.StatusCode, status, body)
+		}
+		if status == 200 && !strings.Contains(string(body), ";clean_rules\r\n") {
+			t.Errorf("%s: no clean_rules column: %s", query, body)
+		}
+	}
+}
+
+func TestExportJson(t *testing.T) {
+	db := openTestDB(t)
+	createExportTestRuns(t, db)
+
+	array := []map[string]any{}
+	if err := json.Unmarshal(exportTestRuns(t, db, ExportOptions{Format: ExportFormatJSON}), &array); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(exportTestRuns(t, db, ExportOptions{Format: ExportFormatNDJSON}))), "\n")
+	if len(array) != 2 || len(lines) != 2 {
+		t.Fatalf("got %d array elements and %d lines, want 2", len(array), len(lines))
+	}
+	for i, line := range lines {
+		obj := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(obj, array[i]) {
+			t.Errorf("run %d differs between JSON and NDJSON", i+1)
+		}
+	}
+
+	if array[0]["throughput_mbps"] == nil || array[0]["metric.quic.handshake_rtt_ms"] != 12.5 || array[0]["test_begin"] != "2025-04-16T00:25:11Z" {
+		t.Errorf("run 1: got %v", array[0])
+	}
+	if v, ok := array[1]["throughput_mbps"]; !ok || v != nil {
+		t.Errorf("run 2: got throughput %v, want null", v)
+	}
+
+	var empty []map[string]any
+	if err := json.Unmarshal(exportTestRuns(t, openTestDB(t), ExportOptions{Format: ExportFormatJSON}), &empty); err != nil || empty == nil {
+		t.Errorf("empty export is not an empty array: %v", err)
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	db := openTestDB(t)
+	createExportTestRuns(t, db)
+	data := exportTestRuns(t, db, ExportOptions{Format: ExportFormatParquet})
+
+	type row struct {
+		ID             *int64   `parquet:"id,optional"`
+		Protocol       *string  `parquet:"protocol,optional"`
+		TestBegin      *int64   `parquet:"test_begin,optional"` // milliseconds
+		ThroughputMbps *float64 `parquet:"throughput_mbps,optional"`
+		HandshakeRtt   *float64 `parquet:"metric.quic.handshake_rtt_ms,optional"`
+		Version        *string  `parquet:"label.quic.version,optional"`
+	}
+	rows, err := parquet.Read[row](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+
+	full := rows[0]
+	if full.ID == nil || *full.ID != 1 || *full.Protocol != "http3" || *full.TestBegin != time.Date(2025, 4, 16, 0, 25, 11, 0, time.UTC).UnixMilli() {
+		t.Errorf("run 1: got ID %v, protocol %v, begin %v", full.ID, full.Protocol, full.TestBegin)
+	}
+	if full.ThroughputMbps == nil || full.HandshakeRtt == nil || *full.HandshakeRtt != 12.5 || full.Version == nil || *full.Version != "v1" {
+		t.Errorf("run 1: got throughput %v, custom metric %v, label %v", full.ThroughputMbps, full.HandshakeRtt, full.Version)
+	}
+	if rows[1].ThroughputMbps != nil || rows[1].HandshakeRtt != nil || rows[1].Version != nil {
+		t.Errorf("run 2: got throughput %v, custom metric %v, label %v, want nulls", rows[1].ThroughputMbps, rows[1].HandshakeRtt, rows[1].Version)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// RunFlag marks a suspicious value of a completed run. A run may carry several
+// flags; they are replaced whenever the run is evaluated again.
+type RunFlag struct {
+	ID        int64   `gorm:"primaryKey;autoIncrement"`
+	RunID     int64   `gorm:"index"`
+	Rule      string  `gorm:"index"`
+	Metric    string  // the metric the flag is about, empty for run wide flags
+	Value     float64 // the flagged value
+	Reason    string
+	CreatedAt time.Time
+}
+
+const (
+	FlagRuleMissing    = "missing-value"    // a mandatory metric was never reported
+	FlagRuleImpossible = "impossible-value" // a value outside its physically possible range
+	FlagRuleRamJump    = "ram-jump"         // RAM changed by more than MaxRamJumpBytes during the run
+	FlagRuleOutlier    = "outlier"          // robust z-score against the protocol/enviroment group
+)
+
+var flagRules = []string{FlagRuleMissing, FlagRuleImpossible, FlagRuleRamJump, FlagRuleOutlier}
+
+// FlagConfig configures the flagging rules. It is read from the JSON file
+// named by FLAG_RULES; missing keys keep their defaults.
+type FlagConfig struct {
+	Disabled []string `json:"disabled"` // rules not to evaluate
+
+	// Mandatory metrics are flagged as missing when they are 0 or missing,
+	// e.g. CpuClientPercentWhile when the sampler never fired.
+	Mandatory []string `json:"mandatory"`
+
+	MaxRamJumpBytes int64 `json:"max_ram_jump_bytes"`
+
+	// OutlierMetrics are compared against the completed runs of the same
+	// protocol and enviroment. The robust z-score is 0.6745 * (x - median) /
+	// MAD (Iglewicz and Hoaglin); groups smaller than MinGroupSize and metrics
+	// with a MAD of 0 are skipped.
+	OutlierMetrics   []string `json:"outlier_metrics"`
+	OutlierThreshold float64  `json:"outlier_threshold"`
+	MinGroupSize     int      `json:"min_group_size"`
+}
+
+var defaultFlagConfig = FlagConfig{
+	Mandatory: []string{
+		"TransferStartUnixMs", "TransferEndUnixMs", "BytesPayload",
+		"CpuClientPercentWhile", "CpuServerPercentWhile", "RamClientBytesWhile", "RamServerBytesWhile",
+	},
+	MaxRamJumpBytes: 1 << 30,
+	OutlierMetrics: []string{
+		"TransferDurationMs", "ThroughputMbps",
+		"CpuClientPercentWhile", "CpuServerPercentWhile", "RamClientBytesWhile", "RamServerBytesWhile",
+	},
+	OutlierThreshold: 3.5,
+	MinGroupSize:     10,
+}
+
+func loadFlagConfig(path string) (FlagConfig, error) {
+	cfg := defaultFlagConfig
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, rule := range cfg.Disabled {
+		if !slices.Contains(flagRules, rule) {
+			return cfg, fmt.Errorf("%s: disabled: unknown rule %q", path, rule)
+		}
+	}
+	for _, name := range append(append([]string{}, cfg.Mandatory...), cfg.OutlierMetrics...) {
+		if _, ok := statMetricsByName[name]; !ok {
+			return cfg, fmt.Errorf("%s: unknown metric %q", path, name)
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg FlagConfig) enabled(rule string) bool {
+	return !slices.Contains(cfg.Disabled, rule)
+}
+
+// groupBaseline holds the median and MAD of each outlier metric within one
+// protocol/enviroment group.
+type groupBaseline struct {
+	N      int
+	Median map[string]float64
+	MAD    map[string]float64
+}
+
+func newGroupBaseline(runs []TestRun, metrics []string) groupBaseline {
+	b := groupBaseline{N: len(runs), Median: map[string]float64{}, MAD: map[string]float64{}}
+	for _, name := range metrics {
+		values := metricValues(runs, statMetricsByName[name])
+		if len(values) == 0 {
+			continue
+		}
+		sort.Float64s(values)
+		median := quantile(values, 0.5)
+
+		deviations := make([]float64, len(values))
+		for i, v := range values {
+			deviations[i] = math.Abs(v - median)
+		}
+		sort.Float64s(deviations)
+
+		b.Median[name] = median
+		b.MAD[name] = quantile(deviations, 0.5)
+	}
+	return b
+}
+
+// evaluateRun applies every enabled rule to a completed run.
+func evaluateRun(run TestRun, baseline groupBaseline, cfg FlagConfig) []RunFlag {
+	flags := []RunFlag{}
+	add := func(rule, metric string, value float64, format string, args ...any) {
+		flags = append(flags, RunFlag{RunID: run.ID, Rule: rule, Metric: metric, Value: value, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if cfg.enabled(FlagRuleMissing) {
+		for _, name := range cfg.Mandatory {
+			v := statMetricsByName[name].Value(run)
+			if v == 0 || math.IsNaN(v) {
+				add(FlagRuleMissing, name, v, "%s was not reported", name)
+			}
+		}
+	}
+
+	if cfg.enabled(FlagRuleImpossible) {
+		for _, f := range runMetrics {
+			m, ok := statMetricsByName[f.Name]
+			if !ok {
+				continue
+			}
+			v := m.Value(run)
+			if f.Min != nil && v < *f.Min {
+				add(FlagRuleImpossible, f.Name, v, "%s is %v, below the minimum of %v", f.Name, v, *f.Min)
+			}
+			if f.Max != nil && v > *f.Max {
+				add(FlagRuleImpossible, f.Name, v, "%s is %v, above the maximum of %v", f.Name, v, *f.Max)
+			}
+		}
+		if run.TransferStartUnixMs > 0 && run.TransferEndUnixMs > 0 && run.TransferEndUnixMs < run.TransferStartUnixMs {
+			add(FlagRuleImpossible, "TransferEndUnixMs", float64(run.TransferEndUnixMs), "transfer ended %d ms before it started", run.TransferStartUnixMs-run.TransferEndUnixMs)
+		}
+		if run.BandwidthEfficiency != nil && *run.BandwidthEfficiency > 1 {
+			add(FlagRuleImpossible, "BandwidthEfficiency", *run.BandwidthEfficiency, "more payload than bytes sent in total")
+		}
+	}
+
+	if cfg.enabled(FlagRuleRamJump) {
+		for _, side := range []struct {
+			name          string
+			before, after int64
+		}{
+			{"RamClientBytes", run.RamClientBytesBefore, run.RamClientBytesAfter},
+			{"RamServerBytes", run.RamServerBytesBefore, run.RamServerBytesAfter},
+		} {
+			if side.before == 0 || side.after == 0 {
+				continue
+			}
+			jump := side.after - side.before
+			if jump > cfg.MaxRamJumpBytes || -jump > cfg.MaxRamJumpBytes {
+				add(FlagRuleRamJump, side.name+"After", float64(side.after), "RAM changed by %d bytes during the run", jump)
+			}
+		}
+	}
+
+	if cfg.enabled(FlagRuleOutlier) && baseline.N >= cfg.MinGroupSize {
+		for _, name := range cfg.OutlierMetrics {
+			mad, ok := baseline.MAD[name]
+			if !ok || mad == 0 {
+				continue
+			}
+			v := statMetricsByName[name].Value(run)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			z := 0.6745 * (v - baseline.Median[name]) / mad
+			if math.Abs(z) > cfg.OutlierThreshold {
+				add(FlagRuleOutlier, name, v, "robust z-score %.1f against %s/%s (median %v, n=%d)",
+					z, run.Protocol, run.Enviroment, baseline.Median[name], baseline.N)
+			}
+		}
+	}
+
+	return flags
+}
+
+// flagRuns evaluates the completed runs changed since their last evaluation,
+// or all completed runs. A run counts as evaluated at the version it had; any
+// later update makes it due again. It returns the number of evaluated runs.
+func flagRuns(db *gorm.DB, cfg FlagConfig, all bool) (int, error) {
+	due := []TestRun{}
+	q := db.Where("state = ?", RunStateCompleted)
+	if !all {
+		q = q.Where("flagged_version <> version")
+	}
+	if err := q.Find(&due).Error; err != nil {
+		return 0, err
+	}
+	if len(due) == 0 {
+		return 0, nil
+	}
+
+	type groupKey struct {
+		Protocol   Protocol
+		Enviroment Enviroment
+	}
+	baselines := map[groupKey]groupBaseline{}
+	for _, run := range due {
+		key := groupKey{run.Protocol, run.Enviroment}
+		if _, ok := baselines[key]; ok {
+			continue
+		}
+		group := []TestRun{}
+		err := db.Where("state = ? AND protocol = ? AND enviroment = ?", RunStateCompleted, key.Protocol, key.Enviroment).Find(&group).Error
+		if err != nil {
+			return 0, err
+		}
+		baselines[key] = newGroupBaseline(group, cfg.OutlierMetrics)
+	}
+
+	events := []RunEvent{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, run := range due {
+			flags := evaluateRun(run, baselines[groupKey{run.Protocol, run.Enviroment}], cfg)
+
+			if err := tx.Where("run_id = ?", run.ID).Delete(&RunFlag{}).Error; err != nil {
+				return err
+			}
+			if len(flags) > 0 {
+				if err := tx.Create(&flags).Error; err != nil {
+					return err
+				}
+				events = append(events, newRunEvent(RunEventFlagged, run, map[string]any{"Flags": flags}))
+			}
+
+			// an update in the meantime leaves the run due for the next pass
+			err := tx.Model(&TestRun{}).Where("id = ? AND version = ?", run.ID, run.Version).UpdateColumn("flagged_version", run.Version).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	runEvents.publish(events...)
+	return len(due), nil
+}
+
+// startRunFlagger periodically evaluates completed runs. Running apart from
+// the update path keeps ingest fast and lets the server's late metrics and
+// samples arrive before a run is judged.
+func startRunFlagger(db *gorm.DB, cfg FlagConfig, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if n, err := flagRuns(db, cfg, false); err != nil {
+				log.Printf("flagger: %v", err)
+			} else if n > 0 {
+				log.Printf("flagger: %d runs evaluated", n)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func registerFlagRoutes(app *fiber.App, db *gorm.DB, auth *keyStore, cfg FlagConfig) {
+	app.Get("/flags", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		q := db.Order("run_id, id")
+		if rules := splitQuery(c.Query("rule")); len(rules) > 0 {
+			q = q.Where("rule IN ?", rules)
+		}
+		if metrics := splitQuery(c.Query("metric")); len(metrics) > 0 {
+			q = q.Where("metric IN ?", metrics)
+		}
+
+		flags := []RunFlag{}
+		if err := q.Find(&flags).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(flags)
+	})
+
+	app.Get("/runs/:id/flags", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		flags := []RunFlag{}
+		if err := db.Where("run_id = ?", id).Order("id").Find(&flags).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(flags)
+	})
+
+	// re-evaluates every completed run, e.g. after the rules were changed
+	app.Post("/flags/evaluate", auth.require(ScopeAdmin), func(c *fiber.Ctx) error {
+		n, err := flagRuns(db, cfg, true)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"evaluated": n})
+	})
+}
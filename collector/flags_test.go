@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// flaggedTestRun returns a completed run reporting every mandatory metric.
+func flaggedTestRun(transferMs int64) TestRun {
+	run := TestRun{
+		Protocol:              ProtocolHTTP3,
+		Enviroment:            EnviromentLocal,
+		TestBegin:             time.UnixMilli(1744755911000),
+		TestEnd:               time.UnixMilli(1744755920000),
+		State:                 RunStateCompleted,
+		TransferStartUnixMs:   1744755912000,
+		TransferEndUnixMs:     1744755912000 + transferMs,
+		BytesPayload:          312214163,
+		BytesSentTotal:        313357583,
+		CpuClientPercentWhile: 20,
+		CpuServerPercentWhile: 20,
+		RamClientBytesBefore:  4 << 30,
+		RamClientBytesAfter:   4 << 30,
+		RamClientBytesWhile:   4 << 30,
+		RamServerBytesWhile:   4 << 30,
+	}
+	deriveRunMetrics(&run)
+	return run
+}
+
+func TestEvaluateRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(run *TestRun)
+		disabled []string
+		want     []string // rule:metric
+	}{
+		{"complete run", func(run *TestRun) {}, nil, nil},
+		{"sampler never fired", func(run *TestRun) { run.CpuServerPercentWhile = 0 }, nil, []string{"missing-value:CpuServerPercentWhile"}},
+		{"cpu above 100%", func(run *TestRun) { run.CpuClientPercentWhile = 150 }, nil, []string{"impossible-value:CpuClientPercentWhile"}},
+		{"end before start", func(run *TestRun) { run.TransferEndUnixMs = run.TransferStartUnixMs - 10 }, nil, []string{"impossible-value:TransferEndUnixMs"}},
+		{"more payload than sent", func(run *TestRun) { run.BytesSentTotal = 1; deriveRunMetrics(run) }, nil, []string{"impossible-value:BandwidthEfficiency"}},
+		{"ram jump", func(run *TestRun) { run.RamClientBytesAfter += 2 << 30 }, nil, []string{"ram-jump:RamClientBytesAfter"}},
+		{"ram jump disabled", func(run *TestRun) { run.RamClientBytesAfter += 2 << 30 }, []string{FlagRuleRamJump}, nil},
+	}
+
+	for _, tt := range tests {
+		run := flaggedTestRun(4000)
+		tt.change(&run)
+		cfg := defaultFlagConfig
+		cfg.Disabled = tt.disabled
+
+		got := []string{}
+		for _, f := range evaluateRun(run, groupBaseline{}, cfg) {
+			got = append(got, f.Rule+":"+f.Metric)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got flags %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFlagRunsOutliers(t *testing.T) {
+	db := openTestDB(t)
+	for i := int64(0); i < 12; i++ {
+		run := flaggedTestRun(4000 + i*10)
+		if i == 11 {
+			run = flaggedTestRun(40000)
+		}
+		if err := db.Create(&run).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := flagRuns(db, defaultFlagConfig, true); err != nil || n != 12 {
+		t.Fatalf("evaluated %d runs, %v, want 12", n, err)
+	}
+
+	flags := []RunFlag{}
+	if err := db.Order("run_id, metric").Find(&flags).Error; err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, f := range flags {
+		if f.RunID != 12 || f.Rule != FlagRuleOutlier {
+			t.Errorf("run %d: unexpected flag %s of %s: %s", f.RunID, f.Rule, f.Metric, f.Reason)
+			continue
+		}
+		got = append(got, f.Metric)
+	}
+	if want := []string{"ThroughputMbps", "TransferDurationMs"}; !slices.Equal(got, want) {
+		t.Errorf("got outliers %v, want %v", got, want)
+	}
+
+	// only runs updated since their evaluation are due again
+	if n, err := flagRuns(db, defaultFlagConfig, false); err != nil || n != 0 {
+		t.Errorf("evaluated %d runs again, %v, want none", n, err)
+	}
+	if _, err := applyRunUpdate(db, 1, map[string]any{"LostPackets": int64(3)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := flagRuns(db, defaultFlagConfig, false); err != nil || n != 1 {
+		t.Errorf("evaluated %d runs after an update, %v, want 1", n, err)
+	}
+}
+
+func TestLoadFlagConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	cfg, err := loadFlagConfig(write("partial.json", `{"disabled": ["outlier"], "max_ram_jump_bytes": 1024}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.enabled(FlagRuleOutlier) || cfg.MaxRamJumpBytes != 1024 || cfg.OutlierThreshold != defaultFlagConfig.OutlierThreshold {
+		t.Errorf("got %+v, want outlier disabled and the other defaults kept", cfg)
+	}
+
+	for name, content := range map[string]string{
+		"rule.json":   `{"disabled": ["bogus"]}`,
+		"metric.json": `{"mandatory": ["NoSuchMetric"]}`,
+		"syntax.json": `{"disabled": `,
+	} {
+		if _, err := loadFlagConfig(write(name, content)); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type ImportFormat string
+
+const (
+	ImportFormatCollector ImportFormat = "collector" // exportColumns, column names are the DB column names
+	ImportFormatCleaner   ImportFormat = "cleaner"   // TestSuite/Cleaner.cs, column names are C# property names
+)
+
+// cleanerColumns maps the columns of the Cleaner's output to DB columns.
+var cleanerColumns = map[string]string{
+	"Id":              "id",
+	"Protocol":        "protocol",
+	"Environment":     "enviroment",
+	"TimeSlot":        "time_slot",
+	"TestBegin":       "test_begin",
+	"TestEnd":         "test_end",
+	"ClientId":        "client_id",
+	"ParallelClients": "parallel_clients",
+	"TransferStart":   "transfer_start_unix_ms",
+	"TransferEnd":     "transfer_end_unix_ms",
+	"BytesPayload":    "bytes_payload",
+	"CpuClientBefore": "cpu_client_percent_before",
+	"CpuClientAfter":  "cpu_client_percent_after",
+	"CpuClientWhile":  "cpu_client_percent_while",
+	"CpuServerBefore": "cpu_server_percent_before",
+	"CpuServerAfter":  "cpu_server_percent_after",
+	"CpuServerWhile":  "cpu_server_percent_while",
+	"RamClientBefore": "ram_client_bytes_before",
+	"RamClientAfter":  "ram_client_bytes_after",
+	"RamClientWhile":  "ram_client_bytes_while",
+	"RamServerBefore": "ram_server_bytes_before",
+	"RamServerAfter":  "ram_server_bytes_after",
+	"RamServerWhile":  "ram_server_bytes_while",
+	"LostPackets":     "lost_packets",
+	"Error":           "error",
+	"BytesSentTotal":  "bytes_sent_total",
+}
+
+// legacyColumns maps the columns of collector exports written before times
+// carried their unit in their name. Transfer timestamps in seconds are
+// normalized like stored ones, StreamDuration was reported in seconds.
+var legacyColumns = map[string]struct {
+	Column string
+	Scale  int64
+}{
+	"transfer_start_unix": {"transfer_start_unix_ms", 1},
+	"transfer_end_unix":   {"transfer_end_unix_ms", 1},
+	"connection_duration": {"connection_duration_ms", 1},
+	"stream_duration":     {"stream_duration_ms", 1000},
+}
+
+// importIgnoredColumns are derived values both formats export. They are
+// recomputed from the imported raw values instead. The Cleaner's
+// ConnectionDuration is TestEnd - TestBegin in seconds, not the connection
+// duration the clients report.
+var importIgnoredColumns = map[string]bool{
+	"latency_ms": true, "transfer_duration_ms": true, "throughput_mbps": true, "bandwidth_efficiency": true,
+	"ThroughputMbps": true, "BandwidthEfficiency": true, "TransferDuration": true, "ConnectionDuration": true,
+}
+
+// importProtectedColumns are never taken from a file.
+var importProtectedColumns = map[string]bool{"version": true, "flagged_version": true}
+
+type ImportMode string
+
+const (
+	ImportModeSkip    ImportMode = "skip"    // keep the stored run
+	ImportModeReplace ImportMode = "replace" // overwrite the stored run with the imported one
+)
+
+type ImportOptions struct {
+	Mode   ImportMode
+	DryRun bool
+}
+
+type ImportError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// ImportResult summarizes one imported file. Duplicates are runs that were
+// already stored, either under the same ID or under another ID with the same
+// natural key. Renumbered runs got a new ID because theirs was taken by a
+// different run.
+type ImportResult struct {
+	Format         ImportFormat  `json:"format"`
+	Rows           int           `json:"rows"`
+	Imported       int           `json:"imported"`
+	Renumbered     int           `json:"renumbered"`
+	Duplicates     int           `json:"duplicates"`
+	Replaced       int           `json:"replaced"`
+	IgnoredColumns []string      `json:"ignored_columns,omitempty"`
+	Errors         []ImportError `json:"errors,omitempty"`
+	DryRun         bool          `json:"dry_run,omitempty"`
+}
+
+func parseImportOptions(mode string, dryRun bool) (ImportOptions, error) {
+	switch ImportMode(mode) {
+	case "":
+		return ImportOptions{Mode: ImportModeSkip, DryRun: dryRun}, nil
+	case ImportModeSkip, ImportModeReplace:
+		return ImportOptions{Mode: ImportMode(mode), DryRun: dryRun}, nil
+	default:
+		return ImportOptions{}, fmt.Errorf("mode: unknown import mode %q", mode)
+	}
+}
+
+// runNaturalKey identifies a run independent of its ID. The Cleaner writes
+// local times with a "Z" suffix, so the begin is compared by its wall clock.
+type runNaturalKey struct {
+	Protocol        Protocol
+	Enviroment      Enviroment
+	TimeSlot        TimeSlot
+	TestBegin       string
+	ClientID        int
+	ParallelClients int
+}
+
+func naturalKeyOf(run TestRun) runNaturalKey {
+	return runNaturalKey{
+		Protocol:        run.Protocol,
+		Enviroment:      run.Enviroment,
+		TimeSlot:        run.TimeSlot,
+		TestBegin:       run.TestBegin.Format("2006-01-02T15:04:05"),
+		ClientID:        run.ClientID,
+		ParallelClients: run.ParallelClients,
+	}
+}
+
+// parseRunsCsv reads an export of either format. The delimiter is detected
+// from the header, decimal commas are not supported. Rows that cannot be
+// parsed are reported and skipped.
+func parseRunsCsv(r io.Reader) ([]TestRun, []int, ImportResult, error) {
+	result := ImportResult{}
+
+	br := bufio.NewReader(r)
+	reader := csv.NewReader(br)
+	reader.Comma = detectCsvDelimiter(br)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, result, errors.New("empty file")
+	} else if err != nil {
+		return nil, nil, result, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	result.Format = ImportFormatCollector
+	if _, ok := cleanerColumns[header[0]]; ok {
+		result.Format = ImportFormatCleaner
+	}
+
+	columns := make([]*reflect.StructField, len(header))
+	scales := make([]int64, len(header))
+	hasID := false
+	for i, name := range header {
+		col := name
+		scales[i] = 1
+		if result.Format == ImportFormatCleaner {
+			col = cleanerColumns[name]
+		} else if legacy, ok := legacyColumns[name]; ok {
+			col, scales[i] = legacy.Column, legacy.Scale
+		}
+
+		field, ok := testRunSchema.FieldsByDBName[col]
+		if !ok || importIgnoredColumns[name] || importProtectedColumns[col] {
+			result.IgnoredColumns = append(result.IgnoredColumns, name)
+			continue
+		}
+		sf, _ := reflect.TypeOf(TestRun{}).FieldByName(field.Name)
+		columns[i] = &sf
+		hasID = hasID || col == "id"
+	}
+	if !hasID {
+		return nil, nil, result, errors.New("no id column found, not a collector or Cleaner export")
+	}
+
+	runs := []TestRun{}
+	lines := []int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Line: line, Message: err.Error()})
+			continue
+		}
+		if len(record) == 1 && record[0] == "" {
+			continue
+		}
+		result.Rows++
+
+		if len(record) != len(header) {
+			result.Errors = append(result.Errors, ImportError{Line: line, Message: fmt.Sprintf("expected %d columns, got %d", len(header), len(record))})
+			continue
+		}
+
+		run := TestRun{}
+		v := reflect.ValueOf(&run).Elem()
+		var rowErr error
+		for i, raw := range record {
+			if columns[i] == nil {
+				continue
+			}
+			field := v.FieldByIndex(columns[i].Index)
+			if err := setImportValue(field, raw); err != nil {
+				rowErr = fmt.Errorf("%s: %w", header[i], err)
+				break
+			}
+			if scales[i] != 1 {
+				field.SetInt(field.Int() * scales[i])
+			}
+		}
+		if rowErr != nil {
+			result.Errors = append(result.Errors, ImportError{Line: line, Message: rowErr.Error()})
+			continue
+		}
+
+		run.TransferStartUnixMs = normalizeUnixMillis(run.TransferStartUnixMs)
+		run.TransferEndUnixMs = normalizeUnixMillis(run.TransferEndUnixMs)
+		deriveRunMetrics(&run)
+
+		// exports that predate the error fields only carry the message
+		if run.Error != "" && run.ErrorCode == "" {
+			run.ErrorPhase, run.ErrorCode = classifyLegacyError(run.Error)
+			run.ErrorSide = SideClient
+		}
+
+		if run.State == "" {
+			run.State, run.StateReason = importedRunState(run)
+		}
+
+		runs = append(runs, run)
+		lines = append(lines, line)
+	}
+
+	return runs, lines, result, nil
+}
+
+func setImportValue(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	switch v.Interface().(type) {
+	case time.Time:
+		if raw == "" {
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case *int64:
+		if raw == "" {
+			return nil
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(&n))
+		return nil
+	case RunState:
+		if raw == "" {
+			return nil
+		}
+		state, err := parseRunState(raw)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(state))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		if raw == "" {
+			return nil
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		if raw == "" {
+			return nil
+		}
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// detectCsvDelimiter returns the most frequent of the delimiters exportRuns
+// can write in the first line, ; if there is none.
+func detectCsvDelimiter(br *bufio.Reader) rune {
+	head, _ := br.Peek(br.Size())
+	line, _, _ := bytes.Cut(head, []byte("\n"))
+
+	delim, best := ';', 0
+	for _, d := range []rune{';', ',', '\t', '|'} {
+		if n := bytes.Count(line, []byte(string(d))); n > best {
+			delim, best = d, n
+		}
+	}
+	return delim
+}
+
+// importedRunState derives the state of runs from exports that predate run
+// states, the same way backfillRunStates does for stored runs. Runs that
+// never ended are timed out right away instead of waiting for the watchdog.
+func importedRunState(run TestRun) (RunState, string) {
+	switch {
+	case run.Error != "":
+		return RunStateFailed, ""
+	case run.TestEnd.IsZero() || run.TestEnd.Year() <= 1:
+		return RunStateTimedOut, "imported without test end"
+	default:
+		return RunStateCompleted, ""
+	}
+}
+
+// importRuns stores parsed runs in one transaction. Runs keep their ID if it
+// is free, so a fresh database ends up with the IDs of the export.
+func importRuns(db *gorm.DB, runs []TestRun, lines []int, result ImportResult, opts ImportOptions) (ImportResult, error) {
+	result.DryRun = opts.DryRun
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		stored := []TestRun{}
+		err := tx.Select("id", "protocol", "enviroment", "time_slot", "test_begin", "client_id", "parallel_clients", "version").Find(&stored).Error
+		if err != nil {
+			return err
+		}
+
+		byID := make(map[int64]TestRun, len(stored))
+		byKey := make(map[runNaturalKey]TestRun, len(stored))
+		for _, run := range stored {
+			byID[run.ID] = run
+			byKey[naturalKeyOf(run)] = run
+		}
+
+		inFile := map[runNaturalKey]bool{}
+		keepID := []TestRun{}
+		newID := []TestRun{}
+		for i, run := range runs {
+			key := naturalKeyOf(run)
+			if inFile[key] {
+				result.Errors = append(result.Errors, ImportError{Line: lines[i], Message: "duplicate of an earlier row"})
+				continue
+			}
+			inFile[key] = true
+
+			existing, found := byKey[key]
+			if !found {
+				if sameID, ok := byID[run.ID]; ok && naturalKeyOf(sameID) == key {
+					existing, found = sameID, true
+				}
+			}
+
+			if found {
+				result.Duplicates++
+				if opts.Mode != ImportModeReplace {
+					continue
+				}
+				run.ID = existing.ID
+				run.Version = existing.Version + 1
+				if !opts.DryRun {
+					if err := tx.Save(&run).Error; err != nil {
+						return err
+					}
+					if err := appendRunLog(tx, run.ID, run.Version, runSnapshot(run), true); err != nil {
+						return err
+					}
+				}
+				result.Replaced++
+				continue
+			}
+
+			if _, taken := byID[run.ID]; taken || run.ID <= 0 {
+				result.Renumbered++
+				run.ID = 0
+				newID = append(newID, run)
+				continue
+			}
+
+			byID[run.ID] = run
+			keepID = append(keepID, run)
+		}
+
+		sort.SliceStable(result.Errors, func(i, j int) bool { return result.Errors[i].Line < result.Errors[j].Line })
+		result.Imported = len(keepID) + len(newID)
+		if opts.DryRun {
+			return nil
+		}
+
+		// runs keeping their ID go first, so no new ID can collide with them
+		if len(keepID) > 0 {
+			if err := tx.CreateInBatches(&keepID, 500).Error; err != nil {
+				return err
+			}
+			if err := syncIDSequence(tx, "test_runs"); err != nil {
+				return err
+			}
+			if err := logRunSnapshots(tx, keepID); err != nil {
+				return err
+			}
+		}
+		if len(newID) > 0 {
+			if err := tx.CreateInBatches(&newID, 500).Error; err != nil {
+				return err
+			}
+			if err := logRunSnapshots(tx, newID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func importRunsCsv(db *gorm.DB, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	runs, lines, result, err := parseRunsCsv(r)
+	if err != nil {
+		return result, err
+	}
+	return importRuns(db, runs, lines, result, opts)
+}
+
+func registerImportRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	app.Post("/import", auth.require(ScopeAdmin), func(c *fiber.Ctx) error {
+		opts, err := parseImportOptions(c.Query("mode"), c.QueryBool("dry_run"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var body io.Reader = bytes.NewReader(c.Body())
+		if file, err := c.FormFile("file"); err == nil {
+			f, err := file.Open()
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			defer f.Close()
+			body = f
+		}
+
+		result, err := importRunsCsv(withWriteSource(db, requestWriteSource(c, SideAny)), body, opts)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(result)
+	})
+}
+
+// runImportCommand implements "collector import [-mode skip|replace]
+// [-dry-run] file.csv...".
+func runImportCommand(db *gorm.DB, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	mode := fs.String("mode", string(ImportModeSkip), "how to handle runs that are already stored: skip or replace")
+	dryRun := fs.Bool("dry-run", false, "only report what would be imported")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: collector import [-mode skip|replace] [-dry-run] file.csv...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	opts, err := parseImportOptions(*mode, *dryRun)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no files given")
+	}
+
+	// large files trip the slow query warning on every insert batch
+	db = db.Session(&gorm.Session{Logger: db.Logger.LogMode(logger.Error)})
+	host, _ := os.Hostname()
+	db = withWriteSource(db, WriteSource{Component: "import", Host: host})
+
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		result, err := importRunsCsv(db, f, opts)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		fmt.Printf("%s (%s format): %d rows, %d imported (%d renumbered), %d duplicates (%d replaced)\n",
+			path, result.Format, result.Rows, result.Imported, result.Renumbered, result.Duplicates, result.Replaced)
+		for _, e := range result.Errors {
+			fmt.Printf("  line %d: %s\n", e.Line, e.Message)
+		}
+		if len(result.IgnoredColumns) > 0 {
+			fmt.Printf("  ignored columns: %s\n", strings.Join(result.IgnoredColumns, ", "))
+		}
+	}
+
+	if *dryRun {
+		fmt.Println("dry run, nothing was written")
+	}
+	return nil
+}
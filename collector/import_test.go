@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+const cleanerCsv = `Id;Protocol;Environment;TimeSlot;TestBegin;TestEnd;ClientId;ParallelClients;TransferStart;TransferEnd;BytesPayload;CpuClientWhile;Error;ThroughputMbps;ConnectionDuration
+1;http3;local;night;2025-04-16T00:25:11Z;2025-04-16T00:25:16Z;1;1;1744755912;1744755916;312214163;21.663443;;624.43;5
+2;websockets;local;night;2025-04-16T00:25:16Z;2025-04-16T00:25:22Z;1;1;1744755917;1744755922;312214163;10.164569;Failed to dial WebSockets: unexpected EOF;499.54;6
+3;http3;local;night;not a time;2025-04-16T00:25:30Z;1;1;1744755925;1744755929;312214163;8.5;;1;4
+`
+
+func TestImportCleanerCsv(t *testing.T) {
+	db := openTestDB(t)
+
+	result, err := importRunsCsv(db, strings.NewReader(cleanerCsv), ImportOptions{Mode: ImportModeSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Format != ImportFormatCleaner || result.Rows != 3 || result.Imported != 2 {
+		t.Errorf("got format %s, %d rows, %d imported, want cleaner, 3, 2", result.Format, result.Rows, result.Imported)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Line != 4 || !strings.HasPrefix(result.Errors[0].Message, "TestBegin:") {
+		t.Errorf("got errors %v, want TestBegin of line 4", result.Errors)
+	}
+	for _, column := range []string{"ThroughputMbps", "ConnectionDuration"} {
+		if !slices.Contains(result.IgnoredColumns, column) {
+			t.Errorf("derived column %s was not ignored, got %v", column, result.IgnoredColumns)
+		}
+	}
+
+	runs := []TestRun{}
+	if err := db.Order("id").Find(&runs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("got %d runs, want 2", len(runs))
+	}
+
+	ok := runs[0]
+	if ok.ID != 1 || ok.State != RunStateCompleted || ok.TransferStartUnixMs != 1744755912000 {
+		t.Errorf("run 1: got ID %d, state %s, transfer start %d", ok.ID, ok.State, ok.TransferStartUnixMs)
+	}
+	// the throughput is derived from the imported times, not taken from the file
+	if ok.TransferDurationMs == nil || *ok.TransferDurationMs != 4000 || ok.ThroughputMbps == nil || *ok.ThroughputMbps == 624.43 {
+		t.Errorf("run 1: got transfer duration %v and throughput %v", ok.TransferDurationMs, ok.ThroughputMbps)
+	}
+
+	failed := runs[1]
+	if failed.State != RunStateFailed || failed.ErrorCode == "" || failed.ErrorSide != SideClient {
+		t.Errorf("run 2: got state %s, error code %q, side %q", failed.State, failed.ErrorCode, failed.ErrorSide)
+	}
+}
+
+func TestImportLegacyCollectorColumns(t *testing.T) {
+	db := openTestDB(t)
+	csv := "id,protocol,test_begin,transfer_start_unix,transfer_end_unix,stream_duration\n" +
+		"5,webtransport,2025-04-16T00:25:11Z,1744755912,1744755913500,3\n"
+
+	result, err := importRunsCsv(db, strings.NewReader(csv), ImportOptions{Mode: ImportModeSkip})
+	if err != nil || result.Format != ImportFormatCollector || result.Imported != 1 {
+		t.Fatalf("got %+v, %v", result, err)
+	}
+
+	run := TestRun{}
+	if err := db.First(&run, 5).Error; err != nil {
+		t.Fatal(err)
+	}
+	if run.TransferStartUnixMs != 1744755912000 || run.TransferEndUnixMs != 1744755913500 || run.StreamDurationMs != 3000 {
+		t.Errorf("got transfer %d..%d and stream duration %d ms", run.TransferStartUnixMs, run.TransferEndUnixMs, run.StreamDurationMs)
+	}
+	if run.State != RunStateTimedOut {
+		t.Errorf("got state %s, want timed_out for a run without end", run.State)
+	}
+}
+
+func TestImportDuplicates(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := importRunsCsv(db, strings.NewReader(cleanerCsv), ImportOptions{Mode: ImportModeSkip}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a run stored under ID 1 since, the file's run 1 is its duplicate under
+	// another ID and run 2 gets a new ID
+	other := strings.NewReplacer("\n1;http3", "\n7;http3", "\n2;websockets;local;night;2025-04-16T00:25:16Z", "\n1;websockets;local;night;2025-04-16T00:26:16Z").Replace(cleanerCsv)
+
+	tests := []struct {
+		name string
+		opts ImportOptions
+		want ImportResult
+		runs int64
+	}{
+		{"dry run", ImportOptions{Mode: ImportModeReplace, DryRun: true}, ImportResult{Duplicates: 1, Replaced: 1, Imported: 1, Renumbered: 1}, 2},
+		{"skip", ImportOptions{Mode: ImportModeSkip}, ImportResult{Duplicates: 1, Imported: 1, Renumbered: 1}, 3},
+		{"replace", ImportOptions{Mode: ImportModeReplace}, ImportResult{Duplicates: 2, Replaced: 2}, 3},
+	}
+	for _, tt := range tests {
+		result, err := importRunsCsv(db, strings.NewReader(other), tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Duplicates != tt.want.Duplicates || result.Replaced != tt.want.Replaced || result.Imported != tt.want.Imported || result.Renumbered != tt.want.Renumbered {
+			t.Errorf("%s: got %d duplicates, %d replaced, %d imported, %d renumbered, want %+v", tt.name, result.Duplicates, result.Replaced, result.Imported, result.Renumbered, tt.want)
+		}
+
+		var n int64
+		if err := db.Model(&TestRun{}).Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.runs {
+			t.Errorf("%s: %d runs stored, want %d", tt.name, n, tt.runs)
+		}
+	}
+
+	replaced := TestRun{}
+	if err := db.First(&replaced, 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Protocol != ProtocolHTTP3 || replaced.Version != 1 {
+		t.Errorf("run 1: got %s at version %d, want the replaced http3 run at version 1", replaced.Protocol, replaced.Version)
+	}
+}
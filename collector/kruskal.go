@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// defaultKruskalMetrics are the metrics analyzer/gen_kruskal_stats.py tests.
+var defaultKruskalMetrics = []string{"TransferDurationMs", "ThroughputMbps", "BandwidthEfficiency", "CpuClientPercentWhile", "RamClientBytesWhile"}
+
+type PAdjust string
+
+const (
+	PAdjustNone       PAdjust = "none"
+	PAdjustBonferroni PAdjust = "bonferroni"
+	PAdjustHolm       PAdjust = "holm"
+)
+
+type RankGroup struct {
+	Name     string  `json:"name"`
+	N        int     `json:"n"`
+	MeanRank float64 `json:"mean_rank"`
+	Median   float64 `json:"median"`
+}
+
+// DunnPair is the post-hoc comparison of two groups. R is the effect size
+// z / sqrt(n_a + n_b).
+type DunnPair struct {
+	A           string  `json:"a"`
+	B           string  `json:"b"`
+	Z           float64 `json:"z"`
+	P           float64 `json:"p"`
+	PAdjusted   float64 `json:"p_adjusted"`
+	R           float64 `json:"r"`
+	Significant bool    `json:"significant"`
+}
+
+// KruskalResult is the Kruskal-Wallis H test of one metric across groups.
+// Effect sizes are epsilon² = H / (N - 1) and eta² = (H - k + 1) / (N - k).
+type KruskalResult struct {
+	Metric         string      `json:"metric"`
+	Groups         []RankGroup `json:"groups"`
+	H              *float64    `json:"h"`
+	DF             int         `json:"df"`
+	P              *float64    `json:"p"`
+	EpsilonSquared *float64    `json:"epsilon_squared"`
+	EtaSquared     *float64    `json:"eta_squared"`
+	Significant    bool        `json:"significant"`
+	Note           string      `json:"note,omitempty"`
+	Dunn           []DunnPair  `json:"dunn,omitempty"`
+}
+
+func parsePAdjust(v string) (PAdjust, error) {
+	switch PAdjust(v) {
+	case "":
+		return PAdjustBonferroni, nil
+	case PAdjustNone, PAdjustBonferroni, PAdjustHolm:
+		return PAdjust(v), nil
+	default:
+		return "", fmt.Errorf("p_adjust: unknown method %q", v)
+	}
+}
+
+// kruskalRuns runs a Kruskal-Wallis test per metric over the runs grouped by
+// the given column, followed by a Dunn post-hoc test. NaN and infinite values
+// are dropped like pandas' dropna does.
+func kruskalRuns(runs []TestRun, groupBy string, metrics []StatMetric, adjust PAdjust, alpha float64) []KruskalResult {
+	keys, groups := groupRuns(runs, []string{groupBy})
+
+	results := make([]KruskalResult, 0, len(metrics))
+	for _, m := range metrics {
+		names := []string{}
+		samples := [][]float64{}
+		for i, g := range groups {
+			values := metricValues(g, m)
+			if len(values) == 0 {
+				continue
+			}
+			names = append(names, keys[i][groupBy])
+			samples = append(samples, values)
+		}
+
+		result := kruskalWallis(names, samples, alpha)
+		result.Metric = m.Name
+		if result.H != nil {
+			result.Dunn = dunn(names, samples, adjust, alpha)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// rankSamples assigns average ranks over all samples combined and returns the
+// rank sums per sample, the total count and the tie term sum(t³ - t).
+func rankSamples(samples [][]float64) ([]float64, int, float64) {
+	type obs struct {
+		value float64
+		group int
+	}
+
+	all := []obs{}
+	for g, s := range samples {
+		for _, v := range s {
+			all = append(all, obs{v, g})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].value < all[j].value })
+
+	rankSums := make([]float64, len(samples))
+	ties := 0.0
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].value == all[i].value {
+			j++
+		}
+		t := float64(j - i)
+		rank := float64(i+j+1) / 2 // average of ranks i+1 .. j
+		for k := i; k < j; k++ {
+			rankSums[all[k].group] += rank
+		}
+		ties += t*t*t - t
+		i = j
+	}
+
+	return rankSums, len(all), ties
+}
+
+func kruskalWallis(names []string, samples [][]float64, alpha float64) KruskalResult {
+	result := KruskalResult{Groups: make([]RankGroup, len(samples))}
+
+	rankSums, n, ties := rankSamples(samples)
+	N := float64(n)
+	k := len(samples)
+
+	for i, s := range samples {
+		sorted := append([]float64(nil), s...)
+		sort.Float64s(sorted)
+		result.Groups[i] = RankGroup{Name: names[i], N: len(s), MeanRank: rankSums[i] / float64(len(s)), Median: quantile(sorted, 0.5)}
+	}
+
+	if k < 2 {
+		result.Note = "at least two groups are required"
+		return result
+	}
+
+	varies := false
+	for _, s := range samples {
+		for _, v := range s {
+			if v != s[0] {
+				varies = true
+			}
+		}
+	}
+	if !varies {
+		result.Note = "no variance within any group"
+		return result
+	}
+
+	h := 0.0
+	for i, s := range samples {
+		h += rankSums[i] * rankSums[i] / float64(len(s))
+	}
+	h = 12/(N*(N+1))*h - 3*(N+1)
+	h /= 1 - ties/(N*N*N-N)
+
+	p := chiSquareSurvival(h, float64(k-1))
+	eps := h / (N - 1)
+	eta := (h - float64(k) + 1) / (N - float64(k))
+
+	result.H = &h
+	result.DF = k - 1
+	result.P = &p
+	result.EpsilonSquared = &eps
+	result.EtaSquared = &eta
+	result.Significant = p < alpha
+	return result
+}
+
+// dunn compares every pair of samples with Dunn's z test using the tie
+// corrected variance, the same way scikit-posthocs' posthoc_dunn does.
+func dunn(names []string, samples [][]float64, adjust PAdjust, alpha float64) []DunnPair {
+	rankSums, n, ties := rankSamples(samples)
+	N := float64(n)
+
+	pairs := []DunnPair{}
+	for i := 0; i < len(samples); i++ {
+		for j := i + 1; j < len(samples); j++ {
+			ni, nj := float64(len(samples[i])), float64(len(samples[j]))
+			diff := rankSums[i]/ni - rankSums[j]/nj
+			sigma := math.Sqrt((N*(N+1)/12 - ties/(12*(N-1))) * (1/ni + 1/nj))
+			z := diff / sigma
+			pairs = append(pairs, DunnPair{
+				A: names[i],
+				B: names[j],
+				Z: z,
+				P: 2 * normalSurvival(math.Abs(z)),
+				R: z / math.Sqrt(ni+nj),
+			})
+		}
+	}
+
+	p := make([]float64, len(pairs))
+	for i := range pairs {
+		p[i] = pairs[i].P
+	}
+	adjusted := adjustPValues(p, adjust)
+	for i := range pairs {
+		pairs[i].PAdjusted = adjusted[i]
+		pairs[i].Significant = adjusted[i] < alpha
+	}
+
+	return pairs
+}
+
+func adjustPValues(p []float64, method PAdjust) []float64 {
+	m := float64(len(p))
+	adjusted := make([]float64, len(p))
+
+	switch method {
+	case PAdjustBonferroni:
+		for i, v := range p {
+			adjusted[i] = math.Min(v*m, 1)
+		}
+	case PAdjustHolm:
+		order := make([]int, len(p))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool { return p[order[a]] < p[order[b]] })
+
+		running := 0.0
+		for rank, i := range order {
+			running = math.Max(running, math.Min(p[i]*(m-float64(rank)), 1))
+			adjusted[i] = running
+		}
+	default:
+		copy(adjusted, p)
+	}
+
+	return adjusted
+}
+
+// minP is the smallest normal float64. P values below it are subnormal, carry
+// no meaningful digits and are reported as 0 like the analyzer's rounding does.
+const minP = 0x1p-1022
+
+func clampP(p float64) float64 {
+	if p < minP {
+		return 0
+	}
+	return p
+}
+
+func normalSurvival(z float64) float64 {
+	return clampP(0.5 * math.Erfc(z/math.Sqrt2))
+}
+
+func chiSquareSurvival(x, df float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return clampP(upperIncompleteGamma(df/2, x/2))
+}
+
+// upperIncompleteGamma is the regularized upper incomplete gamma function
+// Q(a, x), evaluated by series expansion for x < a+1 and by continued
+// fraction otherwise.
+func upperIncompleteGamma(a, x float64) float64 {
+	const (
+		eps     = 1e-15
+		maxIter = 1000
+		tiny    = 1e-300
+	)
+
+	lgamma, _ := math.Lgamma(a)
+
+	if x < a+1 {
+		sum := 1 / a
+		term := sum
+		for n := 1; n < maxIter; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*eps {
+				break
+			}
+		}
+		return 1 - sum*math.Exp(-x+a*math.Log(x)-lgamma)
+	}
+
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < maxIter; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < eps {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lgamma) * h
+}
+
+func registerKruskalRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	app.Get("/kruskal", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		filter, err := parseRunFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		groupBy := c.Query("group_by", "protocol")
+		if _, ok := statGroupValue(groupBy); !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("group_by: unknown column %q", groupBy)})
+		}
+
+		names := splitQuery(c.Query("metrics"))
+		if len(names) == 0 {
+			names = defaultKruskalMetrics
+		}
+		metrics := []StatMetric{}
+		for _, name := range names {
+			m, ok := lookupStatMetric(name)
+			if !ok {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("metrics: unknown metric %q", name)})
+			}
+			metrics = append(metrics, m)
+		}
+
+		adjust, err := parsePAdjust(c.Query("p_adjust"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		alpha, err := strconv.ParseFloat(c.Query("alpha", "0.05"), 64)
+		if err != nil || alpha <= 0 || alpha >= 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "alpha: must be a number between 0 and 1"})
+		}
+
+		runs := []TestRun{}
+		if err := filter.Apply(db).Find(&runs).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := attachCustomValues(db, runs); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{
+			"group_by": groupBy,
+			"p_adjust": adjust,
+			"alpha":    alpha,
+			"results":  kruskalRuns(runs, groupBy, metrics, adjust, alpha),
+		})
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// analyzerKruskalMetrics maps the analyzer's columns to the metrics tested.
+var analyzerKruskalMetrics = map[string]string{
+	"TransferDuration": "TransferDurationMs",
+	"ThroughputMbps":   "ThroughputMbps",
+	"CpuClientWhile":   "CpuClientPercentWhile",
+	"RamClientWhile":   "RamClientBytesWhile",
+}
+
+func readAnalyzerCsv(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comma = ';'
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// TestKruskalRunsMatchesAnalyzer checks H of the Kruskal-Wallis test per
+// protocol against kruskal_results.csv and the Bonferroni adjusted Dunn p
+// values against the posthoc_dunn matrices of analyzer/gen_kruskal_stats.py.
+func TestKruskalRunsMatchesAnalyzer(t *testing.T) {
+	runs := loadAnalyzerRuns(t)
+
+	metrics := []StatMetric{statMetricsByName["BandwidthEfficiency"]}
+	for _, name := range analyzerKruskalMetrics {
+		metrics = append(metrics, statMetricsByName[name])
+	}
+	results := map[string]KruskalResult{}
+	for _, r := range kruskalRuns(runs, "protocol", metrics, PAdjustBonferroni, 0.05) {
+		results[r.Metric] = r
+	}
+
+	if r := results["BandwidthEfficiency"]; r.H != nil || r.Note == "" {
+		t.Errorf("BandwidthEfficiency: got H %v, want no variance like the analyzer", r.H)
+	}
+
+	expectedH := map[string]float64{
+		"Latenz (Transferdauer)": 1429.5739,
+		"Durchsatz":              1429.5739,
+		"CPU-Nutzung":            56.7635,
+		"RAM-Nutzung":            41.2432,
+	}
+	labels := map[string]string{
+		"Latenz (Transferdauer)": "TransferDurationMs",
+		"Durchsatz":              "ThroughputMbps",
+		"CPU-Nutzung":            "CpuClientPercentWhile",
+		"RAM-Nutzung":            "RamClientBytesWhile",
+	}
+	for _, record := range readAnalyzerCsv(t, "../assets/output/stats/kruskal_results.csv")[1:] {
+		want, ok := expectedH[record[0]]
+		if !ok {
+			continue
+		}
+		if h, err := strconv.ParseFloat(record[2], 64); err != nil || h != want {
+			t.Fatalf("%s: kruskal_results.csv has H %q, want %v", record[0], record[2], want)
+		}
+
+		r := results[labels[record[0]]]
+		if r.H == nil {
+			t.Errorf("%s: got no H (%s)", r.Metric, r.Note)
+			continue
+		}
+		if got := math.Round(*r.H*1e4) / 1e4; got != want {
+			t.Errorf("%s: H = %v, want %v", r.Metric, got, want)
+		}
+		if *r.P != 0 && *r.P < minP {
+			t.Errorf("%s: p = %v is subnormal", r.Metric, *r.P)
+		}
+	}
+
+	for column, metric := range analyzerKruskalMetrics {
+		records := readAnalyzerCsv(t, "../assets/output/stats/posthoc_dunn/posthoc_dunn_"+column+".csv")
+		header := records[0]
+
+		compared := 0
+		for _, pair := range results[metric].Dunn {
+			for _, record := range records[1:] {
+				if record[0] != pair.A {
+					continue
+				}
+				for j, name := range header {
+					if name != pair.B {
+						continue
+					}
+					want, err := strconv.ParseFloat(record[j], 64)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !closeP(pair.PAdjusted, want) {
+						t.Errorf("%s %s-%s: p_adjusted = %v, want %v", metric, pair.A, pair.B, pair.PAdjusted, want)
+					}
+					compared++
+				}
+			}
+		}
+		if want := len(header) - 1; compared != want*(want-1)/2 {
+			t.Errorf("%s: compared %d pairs of %s", metric, compared, strings.Join(header[1:], ", "))
+		}
+	}
+}
+
+// closeP compares p values relatively, tiny ones differ in the last digits
+// between the normal distribution implementations.
+func closeP(got, want float64) bool {
+	return math.Abs(got-want) <= 1e-6*math.Max(math.Abs(want), 1e-300)
+}
@@ -7,10 +7,10 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/glebarez/sqlite"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	_ "github.com/joho/godotenv/autoload"
 	"gorm.io/gorm"
 )
@@ -21,51 +21,142 @@ func main() {
 		port = "2500"
 	}
 
-	key := os.Getenv("API_KEY")
-	if key == "" {
-		key = "thk_masterthesis_2025_hwtwswrtc"
+	db, err := openDatabase(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		panic("failed to connect database: " + err.Error())
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		panic("failed to migrate database: " + err.Error())
+	}
+
+	if len(os.Args) > 1 {
+		commands := map[string]func(*gorm.DB, []string) error{
+			"import":  runImportCommand,
+			"compare": runCompareCommand,
+			"keys":    runKeysCommand,
+		}
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(db, os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
 
-	db, err := gorm.Open(sqlite.Open("sqlite.db"), &gorm.Config{})
+	runDeadline, err := time.ParseDuration(os.Getenv("RUN_DEADLINE"))
 	if err != nil {
-		panic("failed to connect database")
+		runDeadline = 10 * time.Minute
 	}
 
-	if err := db.AutoMigrate(&TestRun{}); err != nil {
-		panic("failed to migrate database")
+	watchdogInterval, err := time.ParseDuration(os.Getenv("WATCHDOG_INTERVAL"))
+	if err != nil {
+		watchdogInterval = 30 * time.Second
 	}
 
+	startRunWatchdog(db, runDeadline, watchdogInterval)
+
+	flagConfig, err := loadFlagConfig(os.Getenv("FLAG_RULES"))
+	if err != nil {
+		panic("failed to load flag rules: " + err.Error())
+	}
+
+	flagInterval, err := time.ParseDuration(os.Getenv("FLAG_INTERVAL"))
+	if err != nil {
+		flagInterval = 30 * time.Second
+	}
+
+	startRunFlagger(db, flagConfig, flagInterval)
+
+	// API_KEY is the key all components shared before they had keys of
+	// their own, it is only accepted if it is set
+	legacyKey := os.Getenv("API_KEY")
+	logKeyStatus(db, legacyKey)
+	auth := newKeyStore(db, legacyKey)
+
 	app := fiber.New()
 	app.Use(logger.New())
 	app.Use(recover.New())
+	app.Use(requestid.New())
 
-	app.Get("/csv", func(c *fiber.Ctx) error {
-		if c.Get("X-API-KEY") != key {
-			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+	app.Get("/runs", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		q, err := parseRunQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		runs := []TestRun{}
-		if err := db.Find(&runs).Error; err != nil {
+		runs, next, err := listRuns(db, q)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := attachCustomValues(db, runs); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		csv := exportToCsv(runs)
-		c.Set("Content-Type", "text/csv")
-		c.Set("Content-Disposition", "attachment; filename=results.csv")
-		return c.SendString(csv)
+		if c.QueryBool("clean") {
+			rules, err := parseCleaningRules(c.Query("rules"))
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+			cleaned, changes := cleanRuns(runs, rules)
+			return c.JSON(fiber.Map{"runs": cleaned, "changes": changes, "next_cursor": next})
+		}
+
+		return c.JSON(fiber.Map{"runs": runs, "next_cursor": next})
 	})
 
-	app.Post("/begin", func(c *fiber.Ctx) error {
-		if c.Get("X-API-KEY") != key {
-			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+	app.Get("/runs/:id", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		idStr := c.Params("id")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		run := TestRun{}
+		if err := db.First(&run, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
+		runs := []TestRun{run}
+		if err := attachCustomValues(db, runs); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		run = runs[0]
+
+		entries, err := loadRunLog(db, id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		exclusion, err := findRunExclusion(db, id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// who last wrote each field, see /runs/:id/log for every write
+		return c.JSON(struct {
+			TestRun
+			Provenance map[string]FieldProvenance
+			Exclusion  *RunExclusion `json:",omitempty"`
+		}{run, runProvenance(entries), exclusion})
+	})
+
+	app.Get("/schema", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		return c.JSON(runMetrics)
+	})
+
+	app.Post("/begin", auth.require(ScopeBeginRun), func(c *fiber.Ctx) error {
 		dto := struct {
 			Protocol        Protocol
 			Enviroment      Enviroment
 			TimeSlot        TimeSlot
 			ClientID        int
 			ParallelClients int
+			CampaignID      *int64
+			BatchID         *int64
 		}{}
 		if err := c.BodyParser(&dto); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
@@ -78,271 +169,115 @@ func main() {
 			ClientID:        dto.ClientID,
 			ParallelClients: dto.ParallelClients,
 			TestBegin:       time.Now(),
+			State:           RunStateCreated,
 		}
 
-		if err := db.Create(&run).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-		}
-
-		return c.SendString(fmt.Sprintf("%d", run.ID))
-	})
-
-	updateRun := func(c *fiber.Ctx, run *TestRun) error {
-		dto := map[string]any{}
-		if err := c.BodyParser(&dto); err != nil {
-			return err
-		}
-
-		nfe := errors.New("key not found")
-
-		getInt64 := func(key string) (int64, error) {
-			if val, ok := dto[key]; ok {
-				switch v := val.(type) {
-				case string:
-					return strconv.ParseInt(v, 10, 64)
-				case float64:
-					return int64(v), nil
-				case int64:
-					return v, nil
-				case int:
-					return int64(v), nil
-				default:
-					return 0, fmt.Errorf("type %T not supported", v)
-				}
+		err := withWriteSource(db, requestWriteSource(c, SideAny)).Transaction(func(tx *gorm.DB) error {
+			var err error
+			if run.CampaignID, run.BatchID, err = resolveRunGroup(tx, dto.CampaignID, dto.BatchID); err != nil {
+				return err
 			}
-			return 0, nfe
-		}
-
-		getFloat64 := func(key string) (float64, error) {
-			if val, ok := dto[key]; ok {
-				switch v := val.(type) {
-				case string:
-					return strconv.ParseFloat(v, 64)
-				case float64:
-					return v, nil
-				case int64:
-					return float64(v), nil
-				case int:
-					return float64(v), nil
-				default:
-					return 0, fmt.Errorf("type %T not supported", v)
-				}
-			}
-			return 0, nfe
-		}
-
-		getString := func(key string) (string, error) {
-			if val, ok := dto[key]; ok {
-				switch v := val.(type) {
-				case string:
-					return v, nil
-				case float64:
-					return strconv.FormatFloat(v, 'f', -1, 64), nil
-				case int64:
-					return strconv.FormatInt(v, 10), nil
-				case int:
-					return strconv.Itoa(v), nil
-				default:
-					return "", fmt.Errorf("type %T not supported", v)
-				}
+			if err := tx.Create(&run).Error; err != nil {
+				return err
 			}
-			return "", nfe
-		}
-
-		if v, err := getInt64("TransferStartUnix"); err == nil {
-			run.TransferStartUnix = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("TransferEndUnix"); err == nil {
-			run.TransferEndUnix = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getFloat64("ThroughputMbps"); err == nil {
-			run.ThroughputMbps = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("BytesSentTotal"); err == nil {
-			run.BytesSentTotal = int64(v)
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("BytesPayload"); err == nil {
-			run.BytesPayload = int64(v)
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getFloat64("CpuClientPercentBefore"); err == nil {
-			run.CpuClientPercentBefore = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getFloat64("CpuClientPercentAfter"); err == nil {
-			run.CpuClientPercentAfter = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getFloat64("CpuClientPercentWhile"); err == nil {
-			run.CpuClientPercentWhile = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getFloat64("CpuServerPercentBefore"); err == nil {
-			run.CpuServerPercentBefore = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getFloat64("CpuServerPercentAfter"); err == nil {
-			run.CpuServerPercentAfter = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getFloat64("CpuServerPercentWhile"); err == nil {
-			run.CpuServerPercentWhile = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("RamClientBytesBefore"); err == nil {
-			run.RamClientBytesBefore = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("RamClientBytesAfter"); err == nil {
-			run.RamClientBytesAfter = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("RamClientBytesWhile"); err == nil {
-			run.RamClientBytesWhile = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("RamServerBytesBefore"); err == nil {
-			run.RamServerBytesBefore = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("RamServerBytesAfter"); err == nil {
-			run.RamServerBytesAfter = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("RamServerBytesWhile"); err == nil {
-			run.RamServerBytesWhile = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("LostPackets"); err == nil {
-			run.LostPackets = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("Retransmissions"); err == nil {
-			run.Retransmissions = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("ConnectionDuration"); err == nil {
-			run.ConnectionDuration = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getInt64("StreamDuration"); err == nil {
-			run.StreamDuration = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if v, err := getString("Error"); err == nil {
-			run.Error = v
-		} else if err.Error() != "key not found" {
-			return err
-		}
-
-		if _, ok := dto["@end"]; ok {
-			run.TestEnd = time.Now()
+			return appendRunLog(tx, run.ID, run.Version, runSnapshot(run), true)
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, ErrBatchCampaignMismatch) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		return nil
-	}
+		runEvents.publish(newRunEvent(RunEventBegin, run, map[string]any{
+			"Enviroment":      run.Enviroment,
+			"TimeSlot":        run.TimeSlot,
+			"ClientID":        run.ClientID,
+			"ParallelClients": run.ParallelClients,
+		}))
 
-	app.Put("/:id/update", func(c *fiber.Ctx) error {
-		if c.Get("X-API-KEY") != key {
-			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
-		}
+		return c.SendString(fmt.Sprintf("%d", run.ID))
+	})
 
+	updateRun := func(c *fiber.Ctx, end bool) error {
 		idStr := c.Params("id")
 		id, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		run := TestRun{}
-		if err := db.First(&run, id).Error; err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
-		}
-
-		if err := updateRun(c, &run); err != nil {
+		dto := map[string]any{}
+		if err := c.BodyParser(&dto); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 		}
-
-		if err := db.Save(&run).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
-		}
-
-		return c.SendStatus(fiber.StatusNoContent)
-	})
-
-	app.Post("/:id/end", func(c *fiber.Ctx) error {
-		if c.Get("X-API-KEY") != key {
-			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+		if end {
+			dto["@end"] = true
 		}
 
-		idStr := c.Params("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
+		side, err := parseSide(c.Get("X-Collector-Side"))
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 		}
-
-		run := TestRun{}
-		if err := db.First(&run, id).Error; err != nil {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		if side, err = authorizeSide(c, side); err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		if err := updateRun(c, &run); err != nil {
+		fields, err := parseRunUpdate(dto, side)
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid metrics", "fields": verr.Fields})
+		} else if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		run.TestEnd = time.Now()
+		expectedVersion, err := parseExpectedVersion(dto)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
 
-		if err := db.Save(&run).Error; err != nil {
+		version, err := applyRunUpdate(withWriteSource(db, requestWriteSource(c, side)), id, fields, expectedVersion)
+		if errors.Is(err, ErrRunNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if errors.Is(err, ErrVersionConflict) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		} else if errors.Is(err, ErrInvalidTransition) {
+			// the rest of the update was written if it bumped the version
+			if version == 0 {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+			}
+			c.Set("ETag", fmt.Sprintf("%d", version))
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error(), "version": version})
+		} else if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
+		c.Set("ETag", fmt.Sprintf("%d", version))
 		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	app.Put("/:id/update", auth.require(ScopeWriteClientMetrics, ScopeWriteServerMetrics), func(c *fiber.Ctx) error {
+		return updateRun(c, false)
+	})
+
+	app.Post("/:id/end", auth.require(ScopeWriteClientMetrics, ScopeWriteServerMetrics), func(c *fiber.Ctx) error {
+		return updateRun(c, true)
 	})
 
+	registerCampaignRoutes(app, db, auth)
+	registerSampleRoutes(app, db, auth)
+	registerBatchRoutes(app, db, auth)
+	registerImportRoutes(app, db, auth)
+	registerFlagRoutes(app, db, auth, flagConfig)
+	registerStatsRoutes(app, db, auth)
+	registerKruskalRoutes(app, db, auth)
+	registerCompareRoutes(app, db, auth)
+	registerErrorRoutes(app, db, auth)
+	registerExportRoutes(app, db, auth)
+	registerLegacyCsvRoute(app, db, auth)
+	registerRunLogRoutes(app, db, auth)
+	registerCustomRoutes(app, db, auth)
+	registerAnnotationRoutes(app, db, auth)
+	registerEventRoutes(app, auth)
+	registerDashboardRoutes(app, db, auth)
+
 	app.Listen(":" + port)
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB returns a migrated SQLite database in a temporary directory.
+func openTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	db := openEmptyTestDB(t)
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// openEmptyTestDB returns an empty SQLite database in a temporary directory.
+func openEmptyTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	db, err := openDatabase("sqlite:" + filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Discard
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is one versioned change of the database. Migrations run in order,
+// each in its own transaction, and are recorded in schema_migrations so they
+// run exactly once per database. They must only use column names, never the
+// current TestRun fields, since those may have been renamed by a later
+// migration.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration.
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// models are created and extended by AutoMigrate after the migrations ran.
+// Adding tables or nullable columns needs no migration.
+var models = []any{&TestRun{}, &Campaign{}, &Batch{}, &RunSample{}, &RunFlag{}, &APIKey{}, &RunLogEntry{}, &RunCustomMetric{}, &RunLabel{}, &RunExclusion{}, &RunAnnotation{}}
+
+var migrations = []Migration{
+	{Version: 1, Name: "run-states", Up: migrateRunStates},
+	{Version: 2, Name: "derived-metrics", Up: migrateDerivedMetrics},
+	{Version: 3, Name: "unit-explicit-times", Up: migrateUnitExplicitTimes},
+	{Version: 4, Name: "error-taxonomy", Up: migrateErrorTaxonomy},
+	{Version: 5, Name: "bigint-protocol-codes", Up: migrateBigintProtocolCodes},
+}
+
+// migrateDatabase brings the database up to the current schema. A new
+// database is created from the models directly. Databases from before
+// schema_migrations existed start at version 0; the first migrations check
+// the columns they add, since older collectors added them on startup.
+func migrateDatabase(db *gorm.DB) error {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return err
+	}
+
+	if !db.Migrator().HasTable(&TestRun{}) {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(models...); err != nil {
+				return err
+			}
+			for _, m := range migrations {
+				if err := tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	applied := map[int]bool{}
+	done := []SchemaMigration{}
+	if err := db.Find(&done).Error; err != nil {
+		return err
+	}
+	for _, m := range done {
+		applied[m.Version] = true
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("applied migration %d %s", m.Version, m.Name)
+	}
+
+	return db.AutoMigrate(models...)
+}
+
+// migrateRunStates adds the run lifecycle state and derives it for runs that
+// ended before states existed.
+func migrateRunStates(tx *gorm.DB) error {
+	if tx.Migrator().HasColumn("test_runs", "state") {
+		return nil
+	}
+	if err := tx.Exec("ALTER TABLE test_runs ADD COLUMN state text NOT NULL DEFAULT 'created'").Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("ALTER TABLE test_runs ADD COLUMN state_reason text").Error; err != nil {
+		return err
+	}
+	return backfillRunStates(tx)
+}
+
+// migrateDerivedMetrics normalizes transfer timestamps to milliseconds and
+// stores the metrics derived from them. The old throughput_mbps column was
+// never written by any client and is overwritten.
+func migrateDerivedMetrics(tx *gorm.DB) error {
+	if tx.Migrator().HasColumn("test_runs", "transfer_duration_ms") {
+		return nil
+	}
+	if err := tx.Exec("ALTER TABLE test_runs ADD COLUMN transfer_duration_ms integer").Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("ALTER TABLE test_runs ADD COLUMN bandwidth_efficiency real").Error; err != nil {
+		return err
+	}
+
+	rows := []struct {
+		ID                int64
+		TransferStartUnix int64
+		TransferEndUnix   int64
+		BytesPayload      int64
+		BytesSentTotal    int64
+	}{}
+	return tx.Table("test_runs").Select("id, transfer_start_unix, transfer_end_unix, bytes_payload, bytes_sent_total").FindInBatches(&rows, 500, func(*gorm.DB, int) error {
+		for _, row := range rows {
+			run := TestRun{
+				TransferStartUnixMs: normalizeUnixMillis(row.TransferStartUnix),
+				TransferEndUnixMs:   normalizeUnixMillis(row.TransferEndUnix),
+				BytesPayload:        row.BytesPayload,
+				BytesSentTotal:      row.BytesSentTotal,
+			}
+			deriveRunMetrics(&run)
+
+			err := tx.Table("test_runs").Where("id = ?", row.ID).Updates(map[string]any{
+				"transfer_start_unix":  run.TransferStartUnixMs,
+				"transfer_end_unix":    run.TransferEndUnixMs,
+				"transfer_duration_ms": run.TransferDurationMs,
+				"throughput_mbps":      run.ThroughputMbps,
+				"bandwidth_efficiency": run.BandwidthEfficiency,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// legacyTransferUnits are the units each protocol reported its transfer
+// timestamps in before they were normalized on write: the Go clients and
+// servers used time.Now().Unix(), the WebRTC server Date.now() and the WebRTC
+// client Date.now() / 1000.
+var legacyTransferUnits = map[Protocol]struct{ Start, End string }{
+	ProtocolHTTP3:        {Start: "s", End: "s"},
+	ProtocolWebSockets:   {Start: "s", End: "s"},
+	ProtocolWebTransport: {Start: "s", End: "s"},
+	ProtocolWebRTC:       {Start: "ms", End: "s"},
+}
+
+// migrateUnitExplicitTimes renames every time column to carry its unit and
+// converts the remaining values in seconds to milliseconds. Each column is
+// only converted together with its rename, so a column that already carries
+// its unit is never scaled again. Timestamps already normalized by the
+// derived-metrics migration or by newer collectors are above
+// unixMillisThreshold and left alone.
+func migrateUnitExplicitTimes(tx *gorm.DB) error {
+	renames := []struct {
+		From, To string
+		Scale    func(tx *gorm.DB, col string) error
+	}{
+		{"transfer_start_unix", "transfer_start_unix_ms", func(tx *gorm.DB, col string) error {
+			return scaleLegacyTransferTimes(tx, col, true)
+		}},
+		{"transfer_end_unix", "transfer_end_unix_ms", func(tx *gorm.DB, col string) error {
+			return scaleLegacyTransferTimes(tx, col, false)
+		}},
+		{"connection_duration", "connection_duration_ms", nil},
+		{"stream_duration", "stream_duration_ms", func(tx *gorm.DB, col string) error {
+			return tx.Table("test_runs").Where(col+" <> 0").Update(col, gorm.Expr(col+" * 1000")).Error
+		}},
+	}
+
+	for _, r := range renames {
+		if !tx.Migrator().HasColumn("test_runs", r.From) {
+			continue
+		}
+		if err := tx.Exec("ALTER TABLE test_runs RENAME COLUMN " + r.From + " TO " + r.To).Error; err != nil {
+			return err
+		}
+		if r.Scale == nil {
+			continue
+		}
+		if err := r.Scale(tx, r.To); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaleLegacyTransferTimes converts the transfer start or end timestamps in
+// col of the protocols that reported them in seconds to milliseconds.
+func scaleLegacyTransferTimes(tx *gorm.DB, col string, start bool) error {
+	for protocol, units := range legacyTransferUnits {
+		unit := units.End
+		if start {
+			unit = units.Start
+		}
+		if unit != "s" {
+			continue
+		}
+		err := tx.Table("test_runs").
+			Where("protocol = ? AND "+col+" > 0 AND "+col+" < ?", protocol, int64(unixMillisThreshold)).
+			Update(col, gorm.Expr(col+" * 1000")).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateErrorTaxonomy adds the structured error fields and classifies the
+// stored error messages. Before, only clients reported errors.
+func migrateErrorTaxonomy(tx *gorm.DB) error {
+	columns := [][2]string{
+		{"error_phase", "text"},
+		{"error_code", "text"},
+		{"error_protocol_code", "bigint"},
+		{"error_protocol_code_kind", "text"},
+		{"error_side", "text"},
+	}
+	for _, c := range columns {
+		if tx.Migrator().HasColumn("test_runs", c[0]) {
+			continue
+		}
+		if err := tx.Exec("ALTER TABLE test_runs ADD COLUMN " + c[0] + " " + c[1]).Error; err != nil {
+			return err
+		}
+	}
+
+	rows := []struct {
+		ID    int64
+		Error string
+	}{}
+	return tx.Table("test_runs").Select("id, error").Where("error <> ''").FindInBatches(&rows, 500, func(*gorm.DB, int) error {
+		for _, row := range rows {
+			phase, code := classifyLegacyError(row.Error)
+			err := tx.Table("test_runs").Where("id = ?", row.ID).Updates(map[string]any{
+				"error_phase": phase,
+				"error_code":  code,
+				"error_side":  SideClient,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// migrateBigintProtocolCodes widens error_protocol_code, which the
+// error-taxonomy migration added as a 32 bit integer on PostgreSQL, to hold
+// QUIC error codes of up to 2^62. SQLite integers are 64 bit already.
+func migrateBigintProtocolCodes(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return tx.Exec("ALTER TABLE test_runs ALTER COLUMN error_protocol_code TYPE bigint").Error
+}
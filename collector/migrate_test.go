@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// baselineTestRun is the test_runs table of collectors from before
+// schema_migrations existed, which created it with AutoMigrate on startup.
+type baselineTestRun struct {
+	ID                     int64 `gorm:"primaryKey;autoIncrement"`
+	Protocol               Protocol
+	Enviroment             Enviroment
+	TimeSlot               TimeSlot
+	TestBegin              time.Time
+	TestEnd                time.Time
+	ClientID               int
+	ParallelClients        int
+	TransferStartUnix      int64
+	TransferEndUnix        int64
+	ThroughputMbps         float64
+	BytesSentTotal         int64
+	BytesPayload           int64
+	CpuClientPercentBefore float64
+	CpuClientPercentAfter  float64
+	CpuClientPercentWhile  float64
+	CpuServerPercentBefore float64
+	CpuServerPercentAfter  float64
+	CpuServerPercentWhile  float64
+	RamClientBytesBefore   int64
+	RamClientBytesAfter    int64
+	RamClientBytesWhile    int64
+	RamServerBytesBefore   int64
+	RamServerBytesAfter    int64
+	RamServerBytesWhile    int64
+	LostPackets            int64
+	Retransmissions        int64
+	ConnectionDuration     int64
+	StreamDuration         int64
+	Error                  string
+}
+
+func (baselineTestRun) TableName() string { return "test_runs" }
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	db := openEmptyTestDB(t)
+	if err := db.AutoMigrate(&baselineTestRun{}); err != nil {
+		t.Fatal(err)
+	}
+
+	begin := time.Date(2025, 4, 16, 0, 25, 11, 0, time.UTC)
+	stored := []baselineTestRun{
+		// Go clients reported seconds
+		{Protocol: ProtocolHTTP3, TestBegin: begin, TestEnd: begin.Add(5 * time.Second), TransferStartUnix: 1744755912, TransferEndUnix: 1744755916, BytesPayload: 312214163, BytesSentTotal: 313357583, ConnectionDuration: 5000, StreamDuration: 4},
+		// the WebRTC server reported its start in milliseconds
+		{Protocol: ProtocolWebRTC, TestBegin: begin, TestEnd: begin.Add(5 * time.Second), TransferStartUnix: 1744755912500, TransferEndUnix: 1744755916, BytesPayload: 1000000, BytesSentTotal: 1250000, Error: "Failed to dial WebSockets: unexpected EOF"},
+		{Protocol: ProtocolWebSockets, TestBegin: begin},
+	}
+	if err := db.Create(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	// a second run finds every migration applied
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := []TestRun{}
+	if err := db.Order("id").Find(&runs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	http3 := runs[0]
+	if http3.TransferStartUnixMs != 1744755912000 || http3.TransferEndUnixMs != 1744755916000 {
+		t.Errorf("http3: got transfer %d..%d, want milliseconds", http3.TransferStartUnixMs, http3.TransferEndUnixMs)
+	}
+	if http3.ConnectionDurationMs != 5000 || http3.StreamDurationMs != 4000 {
+		t.Errorf("http3: got connection %d ms and stream %d ms, want 5000 and 4000", http3.ConnectionDurationMs, http3.StreamDurationMs)
+	}
+	if http3.TransferDurationMs == nil || *http3.TransferDurationMs != 4000 {
+		t.Errorf("http3: got transfer duration %v, want 4000", http3.TransferDurationMs)
+	}
+	if want := 312214163 * 8 / 4.0 / 1e6; http3.ThroughputMbps == nil || math.Abs(*http3.ThroughputMbps-want) > 1e-9 {
+		t.Errorf("http3: got throughput %v, want %v", http3.ThroughputMbps, want)
+	}
+	if want := 312214163 / 313357583.0; http3.BandwidthEfficiency == nil || math.Abs(*http3.BandwidthEfficiency-want) > 1e-12 {
+		t.Errorf("http3: got bandwidth efficiency %v, want %v", http3.BandwidthEfficiency, want)
+	}
+	if http3.State != RunStateCompleted {
+		t.Errorf("http3: got state %s, want completed", http3.State)
+	}
+
+	webrtc := runs[1]
+	if webrtc.TransferStartUnixMs != 1744755912500 || webrtc.TransferEndUnixMs != 1744755916000 {
+		t.Errorf("webrtc: got transfer %d..%d", webrtc.TransferStartUnixMs, webrtc.TransferEndUnixMs)
+	}
+	if webrtc.TransferDurationMs == nil || *webrtc.TransferDurationMs != 3500 {
+		t.Errorf("webrtc: got transfer duration %v, want 3500", webrtc.TransferDurationMs)
+	}
+	if webrtc.State != RunStateFailed || webrtc.ErrorCode == "" || webrtc.ErrorSide != SideClient {
+		t.Errorf("webrtc: got state %s, error code %q, side %q", webrtc.State, webrtc.ErrorCode, webrtc.ErrorSide)
+	}
+
+	if runs[2].State != RunStateCreated || runs[2].TransferDurationMs != nil {
+		t.Errorf("websockets: got state %s and transfer duration %v, want created without", runs[2].State, runs[2].TransferDurationMs)
+	}
+
+	// the renamed columns are not scaled again
+	if err := db.Transaction(migrateUnitExplicitTimes); err != nil {
+		t.Fatal(err)
+	}
+	again := TestRun{}
+	if err := db.First(&again, http3.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if again.StreamDurationMs != 4000 || again.TransferStartUnixMs != 1744755912000 {
+		t.Errorf("rerun: got stream %d ms and transfer start %d", again.StreamDurationMs, again.TransferStartUnixMs)
+	}
+}
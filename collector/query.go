@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	defaultRunsLimit = 100
+	maxRunsLimit     = 1000
+)
+
+// RunFilter narrows down a selection of runs. Empty fields do not filter,
+// except that excluded runs are left out unless IncludeExcluded is set.
+type RunFilter struct {
+	Protocols       []Protocol
+	Enviroments     []Enviroment
+	TimeSlots       []TimeSlot
+	ParallelClients []int
+	ClientIDs       []int
+	CampaignIDs     []int64
+	BatchIDs        []int64
+	States          []RunState
+	BeginFrom       *time.Time
+	BeginTo         *time.Time
+	HasError        *bool
+	ErrorPhases     []string
+	ErrorCodes      []string
+	ExcludeFlagged  bool
+	ExcludeFlags    []string // rules to exclude, all rules if empty
+	Labels          []LabelCondition
+	Metrics         []MetricCondition // custom metrics, see custom.go
+	IncludeExcluded bool              // see annotations.go
+}
+
+// RunQuery is a filtered, sorted and paginated selection of runs.
+type RunQuery struct {
+	RunFilter
+	Sort   string // DB column name
+	Desc   bool
+	Limit  int
+	Cursor *runCursor
+}
+
+// runCursor points behind the last returned run. It carries the sort value of
+// that run plus its ID as tie-breaker, so pages stay stable while new runs are
+// being inserted.
+type runCursor struct {
+	Sort  string          `json:"s"`
+	Desc  bool            `json:"d"`
+	Value json.RawMessage `json:"v"`
+	ID    int64           `json:"id"`
+}
+
+var testRunSchema = func() *schema.Schema {
+	s, err := schema.Parse(&TestRun{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}()
+
+func parseRunFilter(c *fiber.Ctx) (RunFilter, error) {
+	return parseRunFilterFrom(func(key string) string { return c.Query(key) })
+}
+
+// parseRunFilterFrom reads a filter from any source of query parameters, e.g.
+// the prefixed selections of /compare.
+func parseRunFilterFrom(query func(string) string) (RunFilter, error) {
+	f := RunFilter{}
+
+	for _, v := range splitQuery(query("protocol")) {
+		f.Protocols = append(f.Protocols, Protocol(v))
+	}
+	for _, v := range splitQuery(query("enviroment")) {
+		f.Enviroments = append(f.Enviroments, Enviroment(v))
+	}
+	for _, v := range splitQuery(query("time_slot")) {
+		f.TimeSlots = append(f.TimeSlots, TimeSlot(v))
+	}
+
+	var err error
+	if f.ParallelClients, err = splitQueryInts(query("parallel_clients")); err != nil {
+		return f, fmt.Errorf("parallel_clients: %w", err)
+	}
+	if f.ClientIDs, err = splitQueryInts(query("client_id")); err != nil {
+		return f, fmt.Errorf("client_id: %w", err)
+	}
+	if f.CampaignIDs, err = splitQueryInt64s(query("campaign_id")); err != nil {
+		return f, fmt.Errorf("campaign_id: %w", err)
+	}
+	if f.BatchIDs, err = splitQueryInt64s(query("batch_id")); err != nil {
+		return f, fmt.Errorf("batch_id: %w", err)
+	}
+
+	for _, v := range splitQuery(query("state")) {
+		state, err := parseRunState(v)
+		if err != nil {
+			return f, fmt.Errorf("state: %w", err)
+		}
+		f.States = append(f.States, state)
+	}
+
+	if v := query("begin_from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("begin_from: %w", err)
+		}
+		f.BeginFrom = &t
+	}
+	if v := query("begin_to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("begin_to: %w", err)
+		}
+		f.BeginTo = &t
+	}
+
+	if v := query("error"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("error: %w", err)
+		}
+		f.HasError = &b
+	}
+	f.ErrorPhases = splitQuery(query("error_phase"))
+	f.ErrorCodes = splitQuery(query("error_code"))
+
+	// exclude_flagged is either a boolean or a list of flag rules
+	if v := query("exclude_flagged"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			f.ExcludeFlagged = b
+		} else {
+			for _, rule := range splitQuery(v) {
+				if !slices.Contains(flagRules, rule) {
+					return f, fmt.Errorf("exclude_flagged: unknown flag rule %q", rule)
+				}
+				f.ExcludeFlags = append(f.ExcludeFlags, rule)
+			}
+			f.ExcludeFlagged = true
+		}
+	}
+
+	if v := query("include_excluded"); v != "" {
+		if f.IncludeExcluded, err = strconv.ParseBool(v); err != nil {
+			return f, fmt.Errorf("include_excluded: %w", err)
+		}
+	}
+
+	if f.Labels, err = parseLabelConditions(query("label")); err != nil {
+		return f, fmt.Errorf("label: %w", err)
+	}
+	if f.Metrics, err = parseMetricConditions(query("metric")); err != nil {
+		return f, fmt.Errorf("metric: %w", err)
+	}
+
+	return f, nil
+}
+
+func parseRunQuery(c *fiber.Ctx) (RunQuery, error) {
+	filter, err := parseRunFilter(c)
+	if err != nil {
+		return RunQuery{}, err
+	}
+
+	q := RunQuery{RunFilter: filter, Sort: "id", Limit: defaultRunsLimit}
+
+	if v := c.Query("sort"); v != "" {
+		q.Desc = strings.HasPrefix(v, "-")
+		q.Sort = strings.TrimPrefix(v, "-")
+		if _, ok := testRunSchema.FieldsByDBName[q.Sort]; !ok {
+			return q, fmt.Errorf("sort: unknown column %q", q.Sort)
+		}
+	}
+
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return q, fmt.Errorf("limit: must be a positive integer")
+		}
+		q.Limit = min(n, maxRunsLimit)
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return q, fmt.Errorf("cursor: %w", err)
+		}
+		cur := &runCursor{}
+		if err := json.Unmarshal(raw, cur); err != nil {
+			return q, fmt.Errorf("cursor: %w", err)
+		}
+		if cur.Sort != q.Sort || cur.Desc != q.Desc {
+			return q, errors.New("cursor: does not match the requested sort order")
+		}
+		q.Cursor = cur
+	}
+
+	return q, nil
+}
+
+func splitQuery(v string) []string {
+	if v == "" {
+		return nil
+	}
+	parts := strings.Split(v, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+func splitQueryInts(v string) ([]int, error) {
+	parts := splitQuery(v)
+	ints := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+func splitQueryInt64s(v string) ([]int64, error) {
+	parts := splitQuery(v)
+	ints := make([]int64, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// Apply adds the filter conditions to a TestRun query.
+func (f RunFilter) Apply(tx *gorm.DB) *gorm.DB {
+	if len(f.Protocols) > 0 {
+		tx = tx.Where("protocol IN ?", f.Protocols)
+	}
+	if len(f.Enviroments) > 0 {
+		tx = tx.Where("enviroment IN ?", f.Enviroments)
+	}
+	if len(f.TimeSlots) > 0 {
+		tx = tx.Where("time_slot IN ?", f.TimeSlots)
+	}
+	if len(f.ParallelClients) > 0 {
+		tx = tx.Where("parallel_clients IN ?", f.ParallelClients)
+	}
+	if len(f.ClientIDs) > 0 {
+		tx = tx.Where("client_id IN ?", f.ClientIDs)
+	}
+	if len(f.CampaignIDs) > 0 {
+		tx = tx.Where("campaign_id IN ?", f.CampaignIDs)
+	}
+	if len(f.BatchIDs) > 0 {
+		tx = tx.Where("batch_id IN ?", f.BatchIDs)
+	}
+	if len(f.States) > 0 {
+		tx = tx.Where("state IN ?", f.States)
+	}
+	if f.BeginFrom != nil {
+		tx = tx.Where("test_begin >= ?", *f.BeginFrom)
+	}
+	if f.BeginTo != nil {
+		tx = tx.Where("test_begin < ?", *f.BeginTo)
+	}
+	if f.HasError != nil {
+		if *f.HasError {
+			tx = tx.Where("error <> ''")
+		} else {
+			tx = tx.Where("(error = '' OR error IS NULL)")
+		}
+	}
+	if len(f.ErrorPhases) > 0 {
+		tx = tx.Where("error_phase IN ?", f.ErrorPhases)
+	}
+	if len(f.ErrorCodes) > 0 {
+		tx = tx.Where("error_code IN ?", f.ErrorCodes)
+	}
+	if f.ExcludeFlagged {
+		flagged := tx.Session(&gorm.Session{NewDB: true}).Model(&RunFlag{}).Select("run_id")
+		if len(f.ExcludeFlags) > 0 {
+			flagged = flagged.Where("rule IN ?", f.ExcludeFlags)
+		}
+		tx = tx.Where("id NOT IN (?)", flagged)
+	}
+	if !f.IncludeExcluded {
+		excluded := tx.Session(&gorm.Session{NewDB: true}).Model(&RunExclusion{}).Select("run_id")
+		tx = tx.Where("id NOT IN (?)", excluded)
+	}
+	for _, cond := range f.Labels {
+		labeled := tx.Session(&gorm.Session{NewDB: true}).Model(&RunLabel{}).Select("run_id").Where("name = ? AND value IN ?", cond.Name, cond.Values)
+		tx = tx.Where("id IN (?)", labeled)
+	}
+	for _, cond := range f.Metrics {
+		measured := tx.Session(&gorm.Session{NewDB: true}).Model(&RunCustomMetric{}).Select("run_id").Where("name = ?", cond.Name)
+		if cond.Op != "" {
+			measured = measured.Where("value "+cond.Op+" ?", cond.Value)
+		}
+		tx = tx.Where("id IN (?)", measured)
+	}
+	return tx
+}
+
+// listRuns returns one page of runs and the cursor of the next page, which is
+// empty when there are no more runs. Runs without a value in a nullable sort
+// column come last in either direction, ordered by ID, since comparisons with
+// NULL are never true and would end the pagination at the first of them.
+func listRuns(db *gorm.DB, q RunQuery) ([]TestRun, string, error) {
+	field := testRunSchema.FieldsByDBName[q.Sort]
+	nullable := field.FieldType.Kind() == reflect.Pointer
+
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+
+	tx := q.Apply(db.Model(&TestRun{}))
+
+	if q.Cursor != nil {
+		value := reflect.New(field.FieldType)
+		if err := json.Unmarshal(q.Cursor.Value, value.Interface()); err != nil {
+			return nil, "", fmt.Errorf("cursor: %w", err)
+		}
+		col, v := q.Sort, value.Elem().Interface()
+		switch {
+		case col == "id":
+			tx = tx.Where(fmt.Sprintf("id %s ?", op), q.Cursor.ID)
+		case nullable && value.Elem().IsNil():
+			tx = tx.Where(fmt.Sprintf("(%s IS NULL AND id %s ?)", col, op), q.Cursor.ID)
+		case nullable:
+			tx = tx.Where(fmt.Sprintf("(%s IS NULL OR %s %s ? OR (%s = ? AND id %s ?))", col, col, op, col, op), v, v, q.Cursor.ID)
+		default:
+			tx = tx.Where(fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", col, op, col, op), v, v, q.Cursor.ID)
+		}
+	}
+
+	order := fmt.Sprintf("%s %s", q.Sort, dir)
+	if nullable {
+		order = fmt.Sprintf("%s IS NULL, %s", q.Sort, order)
+	}
+	if q.Sort != "id" {
+		order += ", id " + dir
+	}
+
+	runs := []TestRun{}
+	if err := tx.Order(order).Limit(q.Limit + 1).Find(&runs).Error; err != nil {
+		return nil, "", err
+	}
+
+	if len(runs) <= q.Limit {
+		return runs, "", nil
+	}
+
+	runs = runs[:q.Limit]
+	last := runs[len(runs)-1]
+
+	value, err := json.Marshal(reflect.ValueOf(last).FieldByName(field.Name).Interface())
+	if err != nil {
+		return nil, "", err
+	}
+
+	raw, err := json.Marshal(runCursor{Sort: q.Sort, Desc: q.Desc, Value: value, ID: last.ID})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return runs, base64.RawURLEncoding.EncodeToString(raw), nil
+}
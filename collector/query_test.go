@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+// TestListRunsPagesAcrossNulls pages through runs sorted by a nullable
+// column in both directions. Every run has to show up exactly once, the ones
+// without a value last.
+func TestListRunsPagesAcrossNulls(t *testing.T) {
+	db := openTestDB(t)
+
+	throughputs := []*float64{nil, ptr(3.0), nil, ptr(1.0), ptr(3.0), nil, ptr(2.0)}
+	for _, tp := range throughputs {
+		run := createTestRun(t, db, ProtocolHTTP3, 1)
+		if err := db.Model(&run).Update("throughput_mbps", tp).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, desc := range []bool{false, true} {
+		q := RunQuery{Sort: "throughput_mbps", Desc: desc, Limit: 2}
+		seen := []TestRun{}
+		for page := 0; ; page++ {
+			if page > len(throughputs) {
+				t.Fatal("pagination does not end")
+			}
+			runs, next, err := listRuns(db, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen = append(seen, runs...)
+			if next == "" {
+				break
+			}
+			raw, err := base64.RawURLEncoding.DecodeString(next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.Cursor = &runCursor{}
+			if err := json.Unmarshal(raw, q.Cursor); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(seen) != len(throughputs) {
+			t.Fatalf("desc=%v: paged through %d runs, want %d", desc, len(seen), len(throughputs))
+		}
+		values := []float64{}
+		nulls := []int64{}
+		for i, run := range seen {
+			if run.ThroughputMbps == nil {
+				nulls = append(nulls, run.ID)
+				continue
+			}
+			if len(nulls) > 0 {
+				t.Errorf("desc=%v: run %d with a value after runs without one", desc, run.ID)
+			}
+			values = append(values, *run.ThroughputMbps)
+			if i > 0 && seen[i-1].ThroughputMbps != nil && *seen[i-1].ThroughputMbps == *run.ThroughputMbps && seen[i-1].ID > run.ID != desc {
+				t.Errorf("desc=%v: ties not ordered by ID", desc)
+			}
+		}
+		want := []float64{1, 2, 3, 3}
+		if desc {
+			slices.Reverse(want)
+		}
+		if !slices.Equal(values, want) {
+			t.Errorf("desc=%v: throughputs %v, want %v", desc, values, want)
+		}
+		if !slices.IsSortedFunc(nulls, func(a, b int64) int {
+			if desc {
+				return int(b - a)
+			}
+			return int(a - b)
+		}) || len(nulls) != 3 {
+			t.Errorf("desc=%v: runs without throughput %v, want 3 ordered by ID", desc, nulls)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
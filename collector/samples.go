@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// RunSample is one resource measurement taken by a client or server while a
+// run is transferring.
+type RunSample struct {
+	ID               int64 `gorm:"primaryKey;autoIncrement"`
+	RunID            int64 `gorm:"index"`
+	Side             Side
+	TimestampMs      int64   // unix timestamp in milliseconds
+	CpuPercent       float64 // system wide CPU usage
+	RamUsedBytes     int64   // system wide used memory
+	RssBytes         int64   // resident set size of the sampling process
+	BytesTransferred int64   // payload bytes sent (server) or received (client) so far
+}
+
+type sampleDto struct {
+	TimestampMs      int64
+	CpuPercent       float64
+	RamUsedBytes     int64
+	RssBytes         int64
+	BytesTransferred int64
+}
+
+func validateSamples(samples []sampleDto) error {
+	verr := &ValidationError{}
+	for i, s := range samples {
+		field := "Samples[" + strconv.Itoa(i) + "]"
+		if s.TimestampMs <= 0 {
+			verr.add(field+".TimestampMs", FieldErrorRange, "must be a positive unix timestamp in milliseconds")
+		}
+		if s.CpuPercent < 0 || s.CpuPercent > 100 {
+			verr.add(field+".CpuPercent", FieldErrorRange, "%v is outside of 0-100", s.CpuPercent)
+		}
+		if s.RamUsedBytes < 0 {
+			verr.add(field+".RamUsedBytes", FieldErrorRange, "must not be negative")
+		}
+		if s.RssBytes < 0 {
+			verr.add(field+".RssBytes", FieldErrorRange, "must not be negative")
+		}
+		if s.BytesTransferred < 0 {
+			verr.add(field+".BytesTransferred", FieldErrorRange, "must not be negative")
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// deriveResourceFields computes the Before/While/After CPU and RAM fields of
+// one side from its sample series: Before is the first sample, After the last
+// one and While the mean of all samples in between (or of all samples if
+// there are less than three).
+func deriveResourceFields(samples []RunSample, side Side) map[string]any {
+	if len(samples) == 0 {
+		return map[string]any{}
+	}
+
+	sorted := append([]RunSample(nil), samples...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].TimestampMs < sorted[j].TimestampMs })
+
+	while := sorted
+	if len(sorted) >= 3 {
+		while = sorted[1 : len(sorted)-1]
+	}
+
+	cpuWhile, ramWhile := 0.0, 0.0
+	for _, s := range while {
+		cpuWhile += s.CpuPercent
+		ramWhile += float64(s.RamUsedBytes)
+	}
+	cpuWhile /= float64(len(while))
+	ramWhile /= float64(len(while))
+
+	first, last := sorted[0], sorted[len(sorted)-1]
+
+	prefix := map[Side][2]string{SideClient: {"CpuClient", "RamClient"}, SideServer: {"CpuServer", "RamServer"}}[side]
+	return map[string]any{
+		prefix[0] + "PercentBefore": first.CpuPercent,
+		prefix[0] + "PercentWhile":  cpuWhile,
+		prefix[0] + "PercentAfter":  last.CpuPercent,
+		prefix[1] + "BytesBefore":   first.RamUsedBytes,
+		prefix[1] + "BytesWhile":    int64(ramWhile),
+		prefix[1] + "BytesAfter":    last.RamUsedBytes,
+	}
+}
+
+// ingestSamples stores the samples of one side and re-derives that side's
+// Before/While/After fields from the complete series in the same transaction.
+func ingestSamples(db *gorm.DB, runID int64, side Side, dtos []sampleDto) (int64, error) {
+	var version int64
+
+	db, pending := deferRunEvents(db)
+	err := transactionInEventOrder(db, func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&TestRun{}).Where("id = ?", runID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrRunNotFound
+		}
+
+		samples := make([]RunSample, len(dtos))
+		for i, s := range dtos {
+			samples[i] = RunSample{
+				RunID:            runID,
+				Side:             side,
+				TimestampMs:      s.TimestampMs,
+				CpuPercent:       s.CpuPercent,
+				RamUsedBytes:     s.RamUsedBytes,
+				RssBytes:         s.RssBytes,
+				BytesTransferred: s.BytesTransferred,
+			}
+		}
+		if err := tx.CreateInBatches(&samples, 500).Error; err != nil {
+			return err
+		}
+
+		series := []RunSample{}
+		if err := tx.Where("run_id = ? AND side = ?", runID, side).Find(&series).Error; err != nil {
+			return err
+		}
+
+		v, err := applyRunUpdate(tx, runID, deriveResourceFields(series, side), nil)
+		version = v
+		return err
+	}, pending.release)
+
+	return version, err
+}
+
+func registerSampleRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	app.Post("/:id/samples", auth.require(ScopeWriteClientMetrics, ScopeWriteServerMetrics), func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		dto := struct {
+			Side    Side
+			Samples []sampleDto
+		}{}
+		if err := c.BodyParser(&dto); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		side := dto.Side
+		if side == SideAny {
+			if side, err = parseSide(c.Get("X-Collector-Side")); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+		if side, err = authorizeSide(c, side); err != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+		}
+		if side != SideClient && side != SideServer {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("Side must be %q or %q", SideClient, SideServer)})
+		}
+
+		if len(dto.Samples) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "no samples given"})
+		}
+
+		var verr *ValidationError
+		if err := validateSamples(dto.Samples); errors.As(err, &verr) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid samples", "fields": verr.Fields})
+		}
+
+		version, err := ingestSamples(withWriteSource(db, requestWriteSource(c, side)), id, side, dto.Samples)
+		if errors.Is(err, ErrRunNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		c.Set("ETag", fmt.Sprintf("%d", version))
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/runs/:id/samples", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		tx := db.Where("run_id = ?", id)
+		if side := c.Query("side"); side != "" {
+			tx = tx.Where("side = ?", side)
+		}
+
+		samples := []RunSample{}
+		if err := tx.Order("timestamp_ms, id").Find(&samples).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(samples)
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestDeriveResourceFields(t *testing.T) {
+	sample := func(ts int64, cpu float64, ram int64) RunSample {
+		return RunSample{TimestampMs: ts, CpuPercent: cpu, RamUsedBytes: ram}
+	}
+
+	tests := []struct {
+		name    string
+		samples []RunSample
+		side    Side
+		want    map[string]any
+	}{
+		{"no samples", nil, SideClient, map[string]any{}},
+		{
+			"one sample is before, while and after",
+			[]RunSample{sample(1, 10, 100)},
+			SideClient,
+			map[string]any{
+				"CpuClientPercentBefore": 10.0, "CpuClientPercentWhile": 10.0, "CpuClientPercentAfter": 10.0,
+				"RamClientBytesBefore": int64(100), "RamClientBytesWhile": int64(100), "RamClientBytesAfter": int64(100),
+			},
+		},
+		{
+			"two samples, while is their mean",
+			[]RunSample{sample(2, 30, 300), sample(1, 10, 100)},
+			SideServer,
+			map[string]any{
+				"CpuServerPercentBefore": 10.0, "CpuServerPercentWhile": 20.0, "CpuServerPercentAfter": 30.0,
+				"RamServerBytesBefore": int64(100), "RamServerBytesWhile": int64(200), "RamServerBytesAfter": int64(300),
+			},
+		},
+		{
+			"while leaves out the first and last sample",
+			[]RunSample{sample(4, 5, 500), sample(2, 40, 201), sample(1, 1, 100), sample(3, 60, 400)},
+			SideClient,
+			map[string]any{
+				"CpuClientPercentBefore": 1.0, "CpuClientPercentWhile": 50.0, "CpuClientPercentAfter": 5.0,
+				"RamClientBytesBefore": int64(100), "RamClientBytesWhile": int64(300), "RamClientBytesAfter": int64(500),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deriveResourceFields(tt.samples, tt.side); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deriveResourceFields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestIngestSamples streams the samples of both sides one by one, as the
+// sampler sends them during a transfer, and checks that the run's fields are
+// derived from the complete series of each side after every one.
+func TestIngestSamples(t *testing.T) {
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolHTTP3, 1)
+
+	if _, err := ingestSamples(db, 9999, SideClient, []sampleDto{{TimestampMs: 1}}); !errors.Is(err, ErrRunNotFound) {
+		t.Fatalf("ingestSamples of an unknown run = %v, want %v", err, ErrRunNotFound)
+	}
+
+	client := []sampleDto{
+		{TimestampMs: 1000, CpuPercent: 5, RamUsedBytes: 1000},
+		{TimestampMs: 1250, CpuPercent: 50, RamUsedBytes: 3000},
+		{TimestampMs: 1500, CpuPercent: 70, RamUsedBytes: 5000},
+		{TimestampMs: 1750, CpuPercent: 8, RamUsedBytes: 2000},
+	}
+	server := []sampleDto{
+		{TimestampMs: 1000, CpuPercent: 2, RamUsedBytes: 100},
+		{TimestampMs: 1250, CpuPercent: 30, RamUsedBytes: 500},
+	}
+
+	version := run.Version
+	ingest := func(side Side, s sampleDto) {
+		t.Helper()
+		v, err := ingestSamples(db, run.ID, side, []sampleDto{s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != version+1 {
+			t.Errorf("version %d after a sample, want %d", v, version+1)
+		}
+		version = v
+	}
+
+	for i, s := range client {
+		ingest(SideClient, s)
+
+		stored := TestRun{}
+		if err := db.First(&stored, run.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.CpuClientPercentBefore != 5 || stored.RamClientBytesBefore != 1000 {
+			t.Errorf("sample %d: before %v%% %d bytes, want the first sample", i, stored.CpuClientPercentBefore, stored.RamClientBytesBefore)
+		}
+		if stored.CpuClientPercentAfter != s.CpuPercent || stored.RamClientBytesAfter != s.RamUsedBytes {
+			t.Errorf("sample %d: after %v%% %d bytes, want the latest sample", i, stored.CpuClientPercentAfter, stored.RamClientBytesAfter)
+		}
+	}
+	for _, s := range server {
+		ingest(SideServer, s)
+	}
+
+	stored := TestRun{}
+	if err := db.First(&stored, run.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	got := []any{
+		stored.CpuClientPercentBefore, stored.CpuClientPercentWhile, stored.CpuClientPercentAfter,
+		stored.RamClientBytesBefore, stored.RamClientBytesWhile, stored.RamClientBytesAfter,
+		stored.CpuServerPercentBefore, stored.CpuServerPercentWhile, stored.CpuServerPercentAfter,
+		stored.RamServerBytesBefore, stored.RamServerBytesWhile, stored.RamServerBytesAfter,
+	}
+	want := []any{
+		5.0, 60.0, 8.0,
+		int64(1000), int64(4000), int64(2000),
+		2.0, 16.0, 30.0,
+		int64(100), int64(300), int64(500),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("derived fields %v, want %v", got, want)
+	}
+
+	var count int64
+	if err := db.Model(&RunSample{}).Where("run_id = ?", run.ID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != int64(len(client)+len(server)) {
+		t.Errorf("%d samples stored, want %d", count, len(client)+len(server))
+	}
+}
+
+func TestSampleRoutes(t *testing.T) {
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolHTTP3, 1)
+
+	path := fmt.Sprintf("/%d/samples", run.ID)
+
+	app := fiber.New()
+	registerSampleRoutes(app, db, newKeyStore(db, "legacy"))
+
+	tests := []struct {
+		name, path, side, body string
+		status                 int
+	}{
+		{"client", path, "client", `{"Samples":[{"TimestampMs":1000,"CpuPercent":10}]}`, 204},
+		{"side in the body", path, "", `{"Side":"server","Samples":[{"TimestampMs":1000,"CpuPercent":20}]}`, 204},
+		{"no side", path, "", `{"Samples":[{"TimestampMs":1000}]}`, 400},
+		{"no samples", path, "client", `{"Samples":[]}`, 400},
+		{"invalid sample", path, "client", `{"Samples":[{"TimestampMs":1000,"CpuPercent":101}]}`, 400},
+		{"unknown run", "/9999/samples", "client", `{"Samples":[{"TimestampMs":1000}]}`, 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-KEY", "legacy")
+			if tt.side != "" {
+				req.Header.Set("X-Collector-Side", tt.side)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	stored := TestRun{}
+	if err := db.First(&stored, run.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.CpuClientPercentWhile != 10 || stored.CpuServerPercentWhile != 20 {
+		t.Errorf("CPU while client %v%%, server %v%%, want 10%% and 20%%", stored.CpuClientPercentWhile, stored.CpuServerPercentWhile)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Side identifies which component of a run is allowed to write a metric.
+type Side string
+
+const (
+	SideAny    Side = ""
+	SideClient Side = "client"
+	SideServer Side = "server"
+)
+
+type MetricKind string
+
+const (
+	MetricKindInt    MetricKind = "int"
+	MetricKindFloat  MetricKind = "float"
+	MetricKindString MetricKind = "string"
+)
+
+// MetricField describes one writable TestRun field. It is built from the
+// `metric` struct tag, whose format is
+//
+//	metric:"[name][,unit=<unit>][,min=<n>][,max=<n>][,side=client|server][,enum=<name>][,alias=<name>[:<unit>]]..."
+//
+// An empty name defaults to the Go field name, which is also the key used in
+// update payloads. Pointer fields are optional metrics of the pointed-to
+// type. enum restricts a string field to one of the values in metricEnums,
+// or empty. Aliases accept the old payload keys of renamed fields. An
+// alias with its own unit is converted to the unit of the field, e.g.
+// "alias=StreamDuration:s" on a field with unit=ms multiplies by 1000.
+type MetricField struct {
+	Name    string        `json:"name"`
+	Field   string        `json:"field"`
+	Kind    MetricKind    `json:"kind"`
+	Unit    string        `json:"unit,omitempty"`
+	Min     *float64      `json:"min,omitempty"`
+	Max     *float64      `json:"max,omitempty"`
+	Side    Side          `json:"side,omitempty"`
+	Enum    []string      `json:"enum,omitempty"`
+	Aliases []MetricAlias `json:"aliases,omitempty"`
+
+	scale float64 // factor from the payload unit to Unit, set for aliases only
+}
+
+type MetricAlias struct {
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+}
+
+// unitScales are the supported conversions between time units.
+var unitScales = map[[2]string]float64{
+	{"s", "ms"}:  1e3,
+	{"s", "us"}:  1e6,
+	{"ms", "us"}: 1e3,
+}
+
+func unitScale(from, to string) (float64, bool) {
+	if from == to {
+		return 1, true
+	}
+	f, ok := unitScales[[2]string{from, to}]
+	return f, ok
+}
+
+// FieldError is a single rejected key of an update payload.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	FieldErrorUnknown      = "unknown_field"
+	FieldErrorType         = "type_mismatch"
+	FieldErrorRange        = "out_of_range"
+	FieldErrorSide         = "side_not_allowed"
+	FieldErrorInvalidValue = "invalid_value"
+)
+
+// ValidationError collects every rejected key of an update payload, so a
+// client sees all problems at once instead of fixing them one by one.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid metrics: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field, code, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+var runMetrics = mustBuildMetricSchema(reflect.TypeOf(TestRun{}))
+
+var runMetricsByName = func() map[string]MetricField {
+	m := make(map[string]MetricField, len(runMetrics))
+	for _, f := range runMetrics {
+		m[f.Name] = f
+		for _, a := range f.Aliases {
+			alias := f
+			alias.Name = a.Name
+			alias.scale, _ = unitScale(a.Unit, f.Unit)
+			m[a.Name] = alias
+		}
+	}
+	return m
+}()
+
+func mustBuildMetricSchema(t reflect.Type) []MetricField {
+	fields, err := buildMetricSchema(t)
+	if err != nil {
+		panic(err)
+	}
+	return fields
+}
+
+func buildMetricSchema(t reflect.Type) ([]MetricField, error) {
+	fields := []MetricField{}
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("metric")
+		if !ok || tag == "-" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		field := MetricField{Name: parts[0], Field: sf.Name}
+		if field.Name == "" {
+			field.Name = sf.Name
+		}
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		switch ft.Kind() {
+		case reflect.Int, reflect.Int64:
+			field.Kind = MetricKindInt
+		case reflect.Float64:
+			field.Kind = MetricKindFloat
+		case reflect.String:
+			field.Kind = MetricKindString
+		default:
+			return nil, fmt.Errorf("metric %s: unsupported type %s", sf.Name, sf.Type)
+		}
+
+		for _, opt := range parts[1:] {
+			k, v, _ := strings.Cut(opt, "=")
+			switch k {
+			case "unit":
+				field.Unit = v
+			case "min", "max":
+				n, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, fmt.Errorf("metric %s: invalid %s: %w", sf.Name, k, err)
+				}
+				if k == "min" {
+					field.Min = &n
+				} else {
+					field.Max = &n
+				}
+			case "side":
+				switch Side(v) {
+				case SideClient, SideServer:
+					field.Side = Side(v)
+				default:
+					return nil, fmt.Errorf("metric %s: invalid side %q", sf.Name, v)
+				}
+			case "enum":
+				values, ok := metricEnums[v]
+				if !ok || field.Kind != MetricKindString {
+					return nil, fmt.Errorf("metric %s: invalid enum %q", sf.Name, v)
+				}
+				field.Enum = values
+			case "alias":
+				name, unit, _ := strings.Cut(v, ":")
+				field.Aliases = append(field.Aliases, MetricAlias{Name: name, Unit: unit})
+			default:
+				return nil, fmt.Errorf("metric %s: unknown option %q", sf.Name, k)
+			}
+		}
+
+		for i, a := range field.Aliases {
+			if a.Unit == "" {
+				field.Aliases[i].Unit = field.Unit
+			} else if _, ok := unitScale(a.Unit, field.Unit); !ok {
+				return nil, fmt.Errorf("metric %s: cannot convert alias %s from %s to %s", sf.Name, a.Name, a.Unit, field.Unit)
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// convert checks a raw payload value against the field definition and returns
+// the value to store. JSON numbers are accepted for int fields and truncated,
+// since some clients report fractional timestamps. Integers in strings are
+// kept exact, for values a JSON number cannot hold, like QUIC error codes
+// above 2^53.
+func (f MetricField) convert(raw any, side Side, verr *ValidationError) (any, bool) {
+	if f.Side != SideAny && side != SideAny && f.Side != side {
+		verr.add(f.Name, FieldErrorSide, "may only be written by the %s, not the %s", f.Side, side)
+		return nil, false
+	}
+
+	var num float64
+	switch f.Kind {
+	case MetricKindString:
+		s, ok := raw.(string)
+		if !ok {
+			verr.add(f.Name, FieldErrorType, "expected string, got %s", jsonTypeName(raw))
+			return nil, false
+		}
+		if f.Enum != nil && s != "" && !slices.Contains(f.Enum, s) {
+			verr.add(f.Name, FieldErrorInvalidValue, "%q is not one of %s", s, strings.Join(f.Enum, ", "))
+			return nil, false
+		}
+		return s, true
+	case MetricKindInt, MetricKindFloat:
+		switch v := raw.(type) {
+		case float64:
+			num = v
+		case string:
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && f.Kind == MetricKindInt {
+				if !f.checkRange(float64(n), verr) {
+					return nil, false
+				}
+				if f.scale != 0 {
+					n *= int64(f.scale)
+				}
+				return n, true
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				verr.add(f.Name, FieldErrorType, "expected number, got non-numeric string %q", v)
+				return nil, false
+			}
+			num = n
+		default:
+			verr.add(f.Name, FieldErrorType, "expected number, got %s", jsonTypeName(raw))
+			return nil, false
+		}
+	}
+
+	if math.IsNaN(num) || math.IsInf(num, 0) {
+		verr.add(f.Name, FieldErrorInvalidValue, "must be a finite number")
+		return nil, false
+	}
+	if !f.checkRange(num, verr) {
+		return nil, false
+	}
+
+	if f.scale != 0 {
+		num *= f.scale
+	}
+
+	if f.Kind == MetricKindInt {
+		return int64(num), true
+	}
+	return num, true
+}
+
+func (f MetricField) checkRange(num float64, verr *ValidationError) bool {
+	if f.Min != nil && num < *f.Min {
+		verr.add(f.Name, FieldErrorRange, "%v is below the minimum of %v", num, *f.Min)
+		return false
+	}
+	if f.Max != nil && num > *f.Max {
+		verr.add(f.Name, FieldErrorRange, "%v is above the maximum of %v", num, *f.Max)
+		return false
+	}
+	return true
+}
+
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// parseSide reads the writing component from the X-Collector-Side header.
+// Callers that do not send the header (older clients) are not restricted.
+func parseSide(header string) (Side, error) {
+	switch strings.ToLower(header) {
+	case "", "any":
+		return SideAny, nil
+	case string(SideClient):
+		return SideClient, nil
+	case string(SideServer):
+		return SideServer, nil
+	default:
+		return SideAny, fmt.Errorf("invalid X-Collector-Side %q", header)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseRunUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		dto  map[string]any
+		side Side
+		want map[string]any // expected fields, nil if rejected
+		code string         // code of the rejected field
+	}{
+		{"int metric", map[string]any{"BytesPayload": 1000.0}, SideServer, map[string]any{"BytesPayload": int64(1000)}, ""},
+		{"fraction truncated", map[string]any{"LostPackets": 3.7}, SideClient, map[string]any{"LostPackets": int64(3)}, ""},
+		{"numeric string", map[string]any{"CpuClientPercentWhile": "12.5"}, SideClient, map[string]any{"CpuClientPercentWhile": 12.5}, ""},
+		{"integer string kept exact", map[string]any{"ErrorProtocolCode": "4611686018427387903"}, SideAny, map[string]any{"ErrorProtocolCode": int64(4611686018427387903)}, ""},
+		{"integer string below min", map[string]any{"ErrorProtocolCode": "-1"}, SideAny, nil, FieldErrorRange},
+		{"alias with unit", map[string]any{"StreamDuration": 2.5}, SideAny, map[string]any{"StreamDurationMs": int64(2500)}, ""},
+		{"seconds normalized", map[string]any{"TransferStartUnix": 1700000000.0}, SideServer, map[string]any{"TransferStartUnixMs": int64(1700000000000)}, ""},
+		{"unknown", map[string]any{"Bogus": 1.0}, SideAny, nil, FieldErrorUnknown},
+		{"wrong type", map[string]any{"BytesPayload": true}, SideAny, nil, FieldErrorType},
+		{"below min", map[string]any{"RamClientBytesWhile": -1.0}, SideAny, nil, FieldErrorRange},
+		{"above max", map[string]any{"CpuServerPercentWhile": 101.0}, SideAny, nil, FieldErrorRange},
+		{"other side", map[string]any{"CpuServerPercentWhile": 1.0}, SideClient, nil, FieldErrorSide},
+		{"enum", map[string]any{"ErrorPhase": "teatime"}, SideAny, nil, FieldErrorInvalidValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseRunUpdate(tt.dto, tt.side)
+			if tt.want == nil {
+				verr := &ValidationError{}
+				if !errors.As(err, &verr) || len(verr.Fields) != 1 || verr.Fields[0].Code != tt.code {
+					t.Fatalf("error %v, want one field rejected with %s", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("fields %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseRunUpdateReportsAllFields checks that every rejected key is
+// reported at once, sorted by name.
+func TestParseRunUpdateReportsAllFields(t *testing.T) {
+	_, err := parseRunUpdate(map[string]any{"Zeta": 1.0, "BytesPayload": "x", "Alpha": 1.0, "LostPackets": 1.0}, SideAny)
+	verr := &ValidationError{}
+	if !errors.As(err, &verr) {
+		t.Fatalf("error %v, want a ValidationError", err)
+	}
+	got := []string{}
+	for _, f := range verr.Fields {
+		got = append(got, f.Field)
+	}
+	if want := []string{"Alpha", "BytesPayload", "Zeta"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rejected %v, want %v", got, want)
+	}
+}
+
+func TestBuildMetricSchemaRejectsInvalidTags(t *testing.T) {
+	for _, typ := range []any{
+		struct {
+			A bool `metric:""`
+		}{},
+		struct {
+			A int64 `metric:",side=both"`
+		}{},
+		struct {
+			A int64 `metric:",unit=ms,alias=B:bytes"`
+		}{},
+		struct {
+			A int64 `metric:",color=red"`
+		}{},
+	} {
+		if _, err := buildMetricSchema(reflect.TypeOf(typ)); err == nil {
+			t.Errorf("schema of %T built, want an error", typ)
+		}
+	}
+}
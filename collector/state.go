@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RunState is the lifecycle state of a run. Runs start as created and end in
+// one of the terminal states completed, failed, timed_out or aborted.
+type RunState string
+
+const (
+	RunStateCreated      RunState = "created"
+	RunStateConnecting   RunState = "connecting"
+	RunStateTransferring RunState = "transferring"
+	RunStateCompleted    RunState = "completed"
+	RunStateFailed       RunState = "failed"
+	RunStateTimedOut     RunState = "timed_out"
+	RunStateAborted      RunState = "aborted"
+)
+
+// runStateTransitions lists the states a run may move to from each
+// non-terminal state. Repeating a non-terminal state is allowed, so clients
+// can resend a state report without failing.
+var runStateTransitions = map[RunState][]RunState{
+	RunStateCreated:      {RunStateCreated, RunStateConnecting, RunStateTransferring, RunStateCompleted, RunStateFailed, RunStateTimedOut, RunStateAborted},
+	RunStateConnecting:   {RunStateConnecting, RunStateTransferring, RunStateCompleted, RunStateFailed, RunStateTimedOut, RunStateAborted},
+	RunStateTransferring: {RunStateTransferring, RunStateCompleted, RunStateFailed, RunStateTimedOut, RunStateAborted},
+}
+
+var runStates = []RunState{RunStateCreated, RunStateConnecting, RunStateTransferring, RunStateCompleted, RunStateFailed, RunStateTimedOut, RunStateAborted}
+
+var ErrInvalidTransition = errors.New("invalid run state transition")
+
+func parseRunState(v string) (RunState, error) {
+	if !slices.Contains(runStates, RunState(v)) {
+		return "", fmt.Errorf("unknown run state %q", v)
+	}
+	return RunState(v), nil
+}
+
+func (s RunState) Terminal() bool {
+	_, ok := runStateTransitions[s]
+	return !ok
+}
+
+func (s RunState) CanTransitionTo(to RunState) bool {
+	return slices.Contains(runStateTransitions[s], to)
+}
+
+// runStatesLeadingTo returns every state a run may be in to move to the
+// given state.
+func runStatesLeadingTo(to RunState) []RunState {
+	from := []RunState{}
+	for _, s := range runStates {
+		if s.CanTransitionTo(to) {
+			from = append(from, s)
+		}
+	}
+	return from
+}
+
+// backfillRunStates derives the state of runs stored before the state column
+// existed: runs with an error failed, whether they reported an end or not,
+// runs with an end and no error are completed, all others stay created and
+// are picked up by the watchdog.
+func backfillRunStates(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&TestRun{}).Where("error <> ''").Update("state", RunStateFailed).Error; err != nil {
+			return err
+		}
+		return tx.Model(&TestRun{}).Where("test_end > ?", time.Time{}).Where("(error = '' OR error IS NULL)").Update("state", RunStateCompleted).Error
+	})
+}
+
+// startRunWatchdog periodically marks runs as timed_out that are still not in
+// a terminal state the given deadline after they began, e.g. because the
+// client crashed before reporting "@end".
+func startRunWatchdog(db *gorm.DB, deadline, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if n, err := timeOutStaleRuns(db, deadline, time.Now()); err != nil {
+				log.Printf("watchdog: %v", err)
+			} else if n > 0 {
+				log.Printf("watchdog: %d runs timed out", n)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func timeOutStaleRuns(db *gorm.DB, deadline time.Duration, now time.Time) (int, error) {
+	stale := []TestRun{}
+	err := db.Select("id", "state").
+		Where("state IN ?", runStatesLeadingTo(RunStateTimedOut)).
+		Where("test_begin < ?", now.Add(-deadline)).
+		Find(&stale).Error
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, run := range stale {
+		fields := map[string]any{
+			"State":       RunStateTimedOut,
+			"StateReason": fmt.Sprintf("no end reported within %s, last state was %s", deadline, run.State),
+		}
+
+		// the run may have ended since it was selected, which is not an error
+		_, err := applyRunUpdate(withWriteSource(db, WriteSource{Component: "watchdog"}), run.ID, fields, nil)
+		if errors.Is(err, ErrInvalidTransition) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
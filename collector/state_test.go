@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfillRunStates(t *testing.T) {
+	db := openTestDB(t)
+	end := time.Now()
+
+	tests := []struct {
+		testEnd time.Time
+		error   string
+		want    RunState
+	}{
+		{end, "", RunStateCompleted},
+		{end, "WEBSOCKETS: CONNECTION CLOSED", RunStateFailed},
+		{time.Time{}, "Failed to dial WebSockets: unexpected EOF", RunStateFailed},
+		{time.Time{}, "", RunStateCreated},
+	}
+
+	ids := make([]int64, len(tests))
+	for i, tt := range tests {
+		run := createTestRun(t, db, ProtocolWebSockets, 1)
+		if err := db.Model(&run).Updates(map[string]any{"TestEnd": tt.testEnd, "Error": tt.error}).Error; err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = run.ID
+	}
+
+	if err := backfillRunStates(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range tests {
+		run := TestRun{}
+		if err := db.First(&run, ids[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+		if run.State != tt.want {
+			t.Errorf("end %v, error %q: got %s, want %s", !tt.testEnd.IsZero(), tt.error, run.State, tt.want)
+		}
+		if imported, _ := importedRunState(run); tt.want != RunStateCreated && imported != tt.want {
+			t.Errorf("end %v, error %q: imported as %s, want %s", !tt.testEnd.IsZero(), tt.error, imported, tt.want)
+		}
+	}
+}
+
+func TestRunStatesLeadingTo(t *testing.T) {
+	active := []RunState{RunStateCreated, RunStateConnecting, RunStateTransferring}
+	tests := []struct {
+		to   RunState
+		want []RunState
+	}{
+		{RunStateCreated, []RunState{RunStateCreated}},
+		{RunStateConnecting, []RunState{RunStateCreated, RunStateConnecting}},
+		{RunStateTransferring, active},
+		{RunStateCompleted, active},
+		{RunStateFailed, active},
+		{RunStateTimedOut, active},
+		{RunStateAborted, active},
+	}
+	for _, tt := range tests {
+		if got := runStatesLeadingTo(tt.to); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("runStatesLeadingTo(%s) = %v, want %v", tt.to, got, tt.want)
+		}
+	}
+}
+
+// TestRunStateTransitions walks a run through its lifecycle with "@state"
+// and "@end" updates. Invalid transitions are rejected, but the metrics
+// that come with them are still written.
+func TestRunStateTransitions(t *testing.T) {
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolHTTP3, 1)
+
+	steps := []struct {
+		update map[string]any
+		want   RunState
+		err    error
+	}{
+		{map[string]any{"@state": "connecting"}, RunStateConnecting, nil},
+		{map[string]any{"@state": "transferring"}, RunStateTransferring, nil},
+		{map[string]any{"@state": "transferring", "LostPackets": 1.0}, RunStateTransferring, nil},
+		{map[string]any{"@state": "connecting"}, RunStateTransferring, ErrInvalidTransition},
+		{map[string]any{"@end": true, "LostPackets": 2.0}, RunStateCompleted, nil},
+		{map[string]any{"@state": "transferring", "LostPackets": 3.0}, RunStateCompleted, ErrInvalidTransition},
+		{map[string]any{"@end": true, "Error": "late failure"}, RunStateCompleted, ErrInvalidTransition},
+		{map[string]any{"@state": "aborted", "@reason": "too late"}, RunStateCompleted, ErrInvalidTransition},
+	}
+	for i, step := range steps {
+		fields, err := parseRunUpdate(step.update, SideClient)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if _, err := applyRunUpdate(db, run.ID, fields, nil); !errors.Is(err, step.err) {
+			t.Errorf("step %d %v: error %v, want %v", i, step.update, err, step.err)
+		}
+
+		stored := TestRun{}
+		if err := db.First(&stored, run.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.State != step.want {
+			t.Errorf("step %d %v: state %s, want %s", i, step.update, stored.State, step.want)
+		}
+		if lost, ok := step.update["LostPackets"].(float64); ok && stored.LostPackets != int64(lost) {
+			t.Errorf("step %d %v: LostPackets %d, want %v", i, step.update, stored.LostPackets, lost)
+		}
+	}
+}
+
+func TestTimeOutStaleRuns(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+
+	tests := []struct {
+		state RunState
+		begin time.Time
+		want  RunState
+	}{
+		{RunStateCreated, now.Add(-2 * time.Hour), RunStateTimedOut},
+		{RunStateConnecting, now.Add(-2 * time.Hour), RunStateTimedOut},
+		{RunStateTransferring, now.Add(-2 * time.Hour), RunStateTimedOut},
+		{RunStateTransferring, now.Add(-30 * time.Minute), RunStateTransferring},
+		{RunStateCompleted, now.Add(-2 * time.Hour), RunStateCompleted},
+		{RunStateFailed, now.Add(-2 * time.Hour), RunStateFailed},
+	}
+
+	ids := make([]int64, len(tests))
+	for i, tt := range tests {
+		run := createTestRun(t, db, ProtocolHTTP3, 1)
+		if err := db.Model(&run).Updates(map[string]any{"State": tt.state, "TestBegin": tt.begin}).Error; err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = run.ID
+	}
+
+	if n, err := timeOutStaleRuns(db, time.Hour, now); err != nil || n != 3 {
+		t.Fatalf("timeOutStaleRuns = %d, %v, want 3 runs timed out", n, err)
+	}
+	if n, err := timeOutStaleRuns(db, time.Hour, now); err != nil || n != 0 {
+		t.Errorf("second timeOutStaleRuns = %d, %v, want none", n, err)
+	}
+
+	for i, tt := range tests {
+		run := TestRun{}
+		if err := db.First(&run, ids[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+		if run.State != tt.want {
+			t.Errorf("%s run begun %s ago: %s, want %s", tt.state, now.Sub(tt.begin), run.State, tt.want)
+		}
+		if tt.want == RunStateTimedOut && !strings.Contains(run.StateReason, "last state was "+string(tt.state)) {
+			t.Errorf("%s run timed out with reason %q", tt.state, run.StateReason)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Summary holds the descriptive statistics of one metric within one group.
+// Quantiles use linear interpolation between the closest ranks, the same
+// method pandas and numpy use by default. StdDev is the sample standard
+// deviation and is nil for less than two values.
+type Summary struct {
+	Count  int      `json:"count"`
+	Mean   float64  `json:"mean"`
+	StdDev *float64 `json:"stddev"`
+	Min    float64  `json:"min"`
+	P5     float64  `json:"p5"`
+	P25    float64  `json:"p25"`
+	Median float64  `json:"median"`
+	P75    float64  `json:"p75"`
+	P95    float64  `json:"p95"`
+	P99    float64  `json:"p99"`
+	Max    float64  `json:"max"`
+	IQR    float64  `json:"iqr"`
+}
+
+// StatMetric is a numeric value that can be extracted from a run.
+type StatMetric struct {
+	Name  string
+	Value func(TestRun) float64
+}
+
+// statMetrics lists every numeric metric of TestRun plus the derived ones.
+var statMetrics = func() []StatMetric {
+	metrics := []StatMetric{}
+	for _, f := range runMetrics {
+		if f.Kind != MetricKindInt && f.Kind != MetricKindFloat {
+			continue
+		}
+		field := f.Field
+		metrics = append(metrics, StatMetric{Name: f.Name, Value: func(r TestRun) float64 {
+			v := reflect.ValueOf(r).FieldByName(field)
+			if v.Kind() == reflect.Pointer {
+				if v.IsNil() {
+					return math.NaN()
+				}
+				v = v.Elem()
+			}
+			if v.CanInt() {
+				return float64(v.Int())
+			}
+			return v.Float()
+		}})
+	}
+	metrics = append(metrics,
+		StatMetric{Name: "TransferDurationMs", Value: func(r TestRun) float64 { return floatOrNaN(r.TransferDurationMs) }},
+		StatMetric{Name: "ThroughputMbps", Value: func(r TestRun) float64 { return floatOrNaN(r.ThroughputMbps) }},
+		StatMetric{Name: "BandwidthEfficiency", Value: func(r TestRun) float64 { return floatOrNaN(r.BandwidthEfficiency) }},
+	)
+	return metrics
+}()
+
+var statMetricsByName = func() map[string]StatMetric {
+	m := make(map[string]StatMetric, len(statMetrics))
+	for _, metric := range statMetrics {
+		m[metric.Name] = metric
+	}
+	return m
+}()
+
+// statGroupColumns are the columns runs can be grouped by.
+var statGroupColumns = map[string]func(TestRun) string{
+	"protocol":         func(r TestRun) string { return string(r.Protocol) },
+	"enviroment":       func(r TestRun) string { return string(r.Enviroment) },
+	"time_slot":        func(r TestRun) string { return string(r.TimeSlot) },
+	"parallel_clients": func(r TestRun) string { return strconv.Itoa(r.ParallelClients) },
+	"state":            func(r TestRun) string { return string(r.State) },
+	"error_phase":      func(r TestRun) string { return r.ErrorPhase },
+	"error_code":       func(r TestRun) string { return r.ErrorCode },
+}
+
+// statGroupValue returns how to get a group column's value from a run, one of
+// statGroupColumns or a label like "label.tls.cipher". Runs without the
+// label are grouped under the empty value.
+func statGroupValue(col string) (func(TestRun) string, bool) {
+	if f, ok := statGroupColumns[col]; ok {
+		return f, true
+	}
+	if name, ok := strings.CutPrefix(col, labelGroupPrefix); ok && isCustomName(name) {
+		return func(r TestRun) string { return r.Labels[name] }, true
+	}
+	return nil, false
+}
+
+type StatGroup struct {
+	Key     map[string]string  `json:"key"`
+	Metrics map[string]Summary `json:"metrics"`
+}
+
+func parseGroupBy(v string) ([]string, error) {
+	cols := splitQuery(v)
+	if len(cols) == 0 {
+		return []string{"protocol"}, nil
+	}
+	for _, col := range cols {
+		if _, ok := statGroupValue(col); !ok {
+			return nil, fmt.Errorf("group_by: unknown column %q", col)
+		}
+	}
+	return cols, nil
+}
+
+// groupRuns splits runs by the given columns. Groups are sorted by their key.
+func groupRuns(runs []TestRun, groupBy []string) ([]map[string]string, [][]TestRun) {
+	values := make([]func(TestRun) string, len(groupBy))
+	for i, col := range groupBy {
+		values[i], _ = statGroupValue(col)
+	}
+
+	index := map[string]int{}
+	keys := []map[string]string{}
+	groups := [][]TestRun{}
+
+	for _, run := range runs {
+		key := make(map[string]string, len(groupBy))
+		parts := make([]string, len(groupBy))
+		for i, col := range groupBy {
+			key[col] = values[i](run)
+			parts[i] = key[col]
+		}
+
+		id := strings.Join(parts, "\x00")
+		i, ok := index[id]
+		if !ok {
+			i = len(groups)
+			index[id] = i
+			keys = append(keys, key)
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], run)
+	}
+
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		for _, col := range groupBy {
+			ka, kb := keys[order[a]][col], keys[order[b]][col]
+			if ka == kb {
+				continue
+			}
+			if col == "parallel_clients" {
+				na, _ := strconv.Atoi(ka)
+				nb, _ := strconv.Atoi(kb)
+				return na < nb
+			}
+			return ka < kb
+		}
+		return false
+	})
+
+	sortedKeys := make([]map[string]string, len(order))
+	sortedGroups := make([][]TestRun, len(order))
+	for i, o := range order {
+		sortedKeys[i] = keys[o]
+		sortedGroups[i] = groups[o]
+	}
+	return sortedKeys, sortedGroups
+}
+
+// describeRuns computes the summary of every stat metric and every custom
+// metric of the runs per group. NaN and infinite values (e.g. a missing
+// derived metric) are skipped, metrics without any finite value are left out.
+func describeRuns(runs []TestRun, groupBy []string) []StatGroup {
+	keys, groups := groupRuns(runs, groupBy)
+	metrics := append(append([]StatMetric{}, statMetrics...), customStatMetrics(runs)...)
+
+	result := make([]StatGroup, len(groups))
+	for i, group := range groups {
+		result[i] = StatGroup{Key: keys[i], Metrics: map[string]Summary{}}
+		for _, m := range metrics {
+			values := metricValues(group, m)
+			if len(values) == 0 {
+				continue
+			}
+			result[i].Metrics[m.Name] = describe(values)
+		}
+	}
+	return result
+}
+
+func metricValues(runs []TestRun, m StatMetric) []float64 {
+	values := make([]float64, 0, len(runs))
+	for _, run := range runs {
+		v := m.Value(run)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func describe(values []float64) Summary {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(n)
+
+	s := Summary{
+		Count:  n,
+		Mean:   mean,
+		Min:    sorted[0],
+		P5:     quantile(sorted, 0.05),
+		P25:    quantile(sorted, 0.25),
+		Median: quantile(sorted, 0.5),
+		P75:    quantile(sorted, 0.75),
+		P95:    quantile(sorted, 0.95),
+		P99:    quantile(sorted, 0.99),
+		Max:    sorted[n-1],
+	}
+	s.IQR = s.P75 - s.P25
+
+	if n > 1 {
+		ss := 0.0
+		for _, v := range sorted {
+			ss += (v - mean) * (v - mean)
+		}
+		std := math.Sqrt(ss / float64(n-1))
+		s.StdDev = &std
+	}
+
+	return s
+}
+
+// quantile expects sorted values.
+func quantile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	pos := p * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo))
+}
+
+func exportStatsToCsv(groups []StatGroup, groupBy []string) string {
+	header := append(append([]string{}, groupBy...), "metric", "count", "mean", "stddev", "min", "p5", "p25", "median", "p75", "p95", "p99", "max", "iqr")
+	lines := []string{strings.Join(header, ";")}
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+
+	// the TestRun metrics in their usual order, then the custom ones
+	names := []string{}
+	for _, m := range statMetrics {
+		names = append(names, m.Name)
+	}
+	custom := []string{}
+	for _, g := range groups {
+		for name := range g.Metrics {
+			if _, ok := statMetricsByName[name]; !ok && !slices.Contains(custom, name) {
+				custom = append(custom, name)
+			}
+		}
+	}
+	sort.Strings(custom)
+	names = append(names, custom...)
+
+	for _, g := range groups {
+		for _, name := range names {
+			s, ok := g.Metrics[name]
+			if !ok {
+				continue
+			}
+
+			std := ""
+			if s.StdDev != nil {
+				std = f(*s.StdDev)
+			}
+
+			line := []string{}
+			for _, col := range groupBy {
+				line = append(line, g.Key[col])
+			}
+			line = append(line, name, strconv.Itoa(s.Count), f(s.Mean), std, f(s.Min), f(s.P5), f(s.P25), f(s.Median), f(s.P75), f(s.P95), f(s.P99), f(s.Max), f(s.IQR))
+			lines = append(lines, strings.Join(line, ";"))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func registerStatsRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	app.Get("/stats", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		filter, err := parseRunFilter(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		groupBy, err := parseGroupBy(c.Query("group_by"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		runs := []TestRun{}
+		if err := filter.Apply(db).Find(&runs).Error; err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := attachCustomValues(db, runs); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		groups := describeRuns(runs, groupBy)
+
+		if c.Query("format") == "csv" || (c.Query("format") == "" && c.Accepts(fiber.MIMEApplicationJSON, "text/csv") == "text/csv") {
+			c.Set("Content-Type", "text/csv")
+			c.Set("Content-Disposition", "attachment; filename=descriptive_stats.csv")
+			return c.SendString(exportStatsToCsv(groups, groupBy))
+		}
+
+		return c.JSON(fiber.Map{"group_by": groupBy, "groups": groups})
+	})
+}
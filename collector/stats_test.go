@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var analyzerRuns struct {
+	once sync.Once
+	runs []TestRun
+	err  error
+}
+
+// loadAnalyzerRuns imports the cleaned results the analyzer's statistics in
+// assets/output were computed from and returns their error-free runs, the
+// ones the analyzer uses. The import runs once for all tests.
+func loadAnalyzerRuns(t *testing.T) []TestRun {
+	analyzerRuns.once.Do(func() {
+		db := openTestDB(t)
+		f, err := os.Open("../assets/results_clean.csv")
+		if err != nil {
+			analyzerRuns.err = err
+			return
+		}
+		defer f.Close()
+		if _, err := importRunsCsv(db, f, ImportOptions{Mode: ImportModeSkip}); err != nil {
+			analyzerRuns.err = err
+			return
+		}
+
+		hasError := false
+		analyzerRuns.err = RunFilter{HasError: &hasError}.Apply(db).Find(&analyzerRuns.runs).Error
+	})
+	if analyzerRuns.err != nil {
+		t.Fatal(analyzerRuns.err)
+	}
+	return analyzerRuns.runs
+}
+
+// TestDescribeRunsMatchesAnalyzer imports the cleaned results of the analyzer
+// and checks the statistics of the error-free runs against the
+// descriptive_stats.csv it generated with pandas' describe().round(2).
+func TestDescribeRunsMatchesAnalyzer(t *testing.T) {
+	runs := loadAnalyzerRuns(t)
+	groupBy := []string{"protocol", "enviroment", "parallel_clients", "time_slot"}
+	groups := map[string]StatGroup{}
+	for _, g := range describeRuns(runs, groupBy) {
+		groups[groupKeyID(g.Key, groupBy)] = g
+	}
+
+	// the analyzer's columns are named like the Cleaner's, its transfer
+	// duration is in seconds
+	metrics := map[string]struct {
+		Name  string
+		Scale float64
+	}{
+		"ThroughputMbps":      {"ThroughputMbps", 1},
+		"BandwidthEfficiency": {"BandwidthEfficiency", 1},
+		"TransferDuration":    {"TransferDurationMs", 1e-3},
+	}
+	for column, dbColumn := range cleanerColumns {
+		if field, ok := testRunSchema.FieldsByDBName[dbColumn]; ok {
+			if _, ok := statMetricsByName[field.Name]; ok {
+				metrics[column] = struct {
+					Name  string
+					Scale float64
+				}{field.Name, 1}
+			}
+		}
+	}
+
+	expected, err := os.Open("../assets/output/stats/descriptive_stats.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expected.Close()
+	r := csv.NewReader(expected)
+	r.Comma = ';'
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, stats, rows := records[0], records[1], records[2:]
+
+	round := func(v float64) float64 { return math.Round(v*100) / 100 }
+	compared := 0
+	for _, row := range rows {
+		id := strings.Join(row[:4], "\x00")
+		group, ok := groups[id]
+		if !ok {
+			t.Errorf("no group %s", strings.Join(row[:4], "/"))
+			continue
+		}
+
+		for i := 4; i < len(row); i++ {
+			metric, ok := metrics[header[i]]
+			if !ok {
+				continue // ConnectionDuration is not imported
+			}
+			want, err := strconv.ParseFloat(row[i], 64)
+			if err != nil {
+				continue // no standard deviation of a single value
+			}
+			s := group.Metrics[metric.Name]
+			got := map[string]float64{
+				"count": float64(s.Count), "mean": s.Mean, "min": s.Min, "25%": s.P25, "50%": s.Median, "75%": s.P75, "max": s.Max,
+			}[stats[i]]
+			if stats[i] == "std" {
+				if s.StdDev == nil {
+					t.Errorf("%s %s: no std, want %v", strings.Join(row[:4], "/"), header[i], want)
+					continue
+				}
+				got = *s.StdDev
+			}
+			if stats[i] != "count" {
+				got = round(got * metric.Scale)
+			}
+			// pandas and Go may round a value on the .005 boundary apart
+			if math.Abs(got-want) > 0.01+1e-12*math.Abs(want) {
+				t.Errorf("%s %s %s: %v, want %v", strings.Join(row[:4], "/"), header[i], stats[i], got, want)
+			}
+			compared++
+		}
+	}
+	if compared == 0 {
+		t.Fatal("nothing compared")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Charts of the dashboard are rendered to SVG on the server, so the dashboard
+// needs no JavaScript and every chart can be saved as a file for the thesis.
+
+const (
+	chartWidth  = 760
+	chartHeight = 380
+	plotLeft    = 70
+	plotRight   = chartWidth - 20
+	plotTop     = 64
+	plotBottom  = chartHeight - 56
+)
+
+// chartPalette is seaborn's "deep" palette, the default of analyzer/gen_plots.py.
+var chartPalette = []string{"#4c72b0", "#dd8452", "#55a868", "#c44e52", "#8172b3", "#937860", "#da8bc3", "#8c8c8c", "#ccb974", "#64b5cd"}
+
+// chartSeries is one named row of values, NaN where there is no value.
+type chartSeries struct {
+	Name   string
+	Values []float64
+}
+
+// barChart draws one bar per category and series, grouped by category.
+type barChart struct {
+	Title      string
+	YLabel     string
+	Categories []string
+	Series     []chartSeries
+}
+
+// boxChart draws one box plot per category. Whiskers reach the most extreme
+// values within 1.5 IQR of the box, values beyond are drawn as outliers, as
+// seaborn does.
+type boxChart struct {
+	Title      string
+	YLabel     string
+	Categories []string
+	Values     [][]float64
+}
+
+// lineChart draws one line per series over numeric X values, e.g. the number
+// of parallel clients.
+type lineChart struct {
+	Title  string
+	XLabel string
+	YLabel string
+	X      []float64
+	Series []chartSeries
+}
+
+type svgCanvas struct {
+	b strings.Builder
+}
+
+func newSvgCanvas(title string) *svgCanvas {
+	s := &svgCanvas{}
+	fmt.Fprintf(&s.b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" font-family="sans-serif" font-size="12" role="img">`,
+		chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(&s.b, `<title>%s</title><rect width="100%%" height="100%%" fill="#fff"/>`, html.EscapeString(title))
+	fmt.Fprintf(&s.b, `<text x="%d" y="24" text-anchor="middle" font-size="15" font-weight="bold">%s</text>`, chartWidth/2, html.EscapeString(title))
+	return s
+}
+
+func (s *svgCanvas) String() string {
+	return s.b.String() + "</svg>"
+}
+
+func (s *svgCanvas) text(x, y float64, anchor string, size int, content string) {
+	fmt.Fprintf(&s.b, `<text x="%.1f" y="%.1f" text-anchor="%s" font-size="%d">%s</text>`, x, y, anchor, size, html.EscapeString(content))
+}
+
+func (s *svgCanvas) noData() string {
+	s.text(chartWidth/2, chartHeight/2, "middle", 14, "no data")
+	return s.String()
+}
+
+// legend draws the series names in one row below the title.
+func (s *svgCanvas) legend(names []string) {
+	if len(names) < 2 {
+		return
+	}
+	x := float64(plotLeft)
+	for i, name := range names {
+		fmt.Fprintf(&s.b, `<rect x="%.1f" y="36" width="12" height="12" fill="%s"/>`, x, chartPalette[i%len(chartPalette)])
+		s.text(x+16, 46, "start", 12, name)
+		x += 28 + 7*float64(len(name))
+	}
+}
+
+// yAxis draws the grid and labels of a linear axis from lo to hi and returns
+// the function mapping values to y coordinates.
+func (s *svgCanvas) yAxis(lo, hi float64, label string) func(float64) float64 {
+	ticks, step := niceTicks(lo, hi, 6)
+	lo, hi = ticks[0], ticks[len(ticks)-1]
+	y := func(v float64) float64 {
+		return plotBottom - (v-lo)/(hi-lo)*(plotBottom-plotTop)
+	}
+
+	for _, t := range ticks {
+		fmt.Fprintf(&s.b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#ccc" stroke-dasharray="4 3"/>`, plotLeft, plotRight, y(t), y(t))
+		s.text(plotLeft-6, y(t)+4, "end", 11, formatTick(t, step))
+	}
+	fmt.Fprintf(&s.b, `<line x1="%d" x2="%d" y1="%d" y2="%d" stroke="#333"/>`, plotLeft, plotLeft, plotTop, plotBottom)
+	fmt.Fprintf(&s.b, `<line x1="%d" x2="%d" y1="%d" y2="%d" stroke="#333"/>`, plotLeft, plotRight, plotBottom, plotBottom)
+	fmt.Fprintf(&s.b, `<text transform="translate(16 %d) rotate(-90)" text-anchor="middle">%s</text>`, (plotTop+plotBottom)/2, html.EscapeString(label))
+
+	return y
+}
+
+// categoryAxis labels the bands of a category axis and returns their width.
+func (s *svgCanvas) categoryAxis(categories []string) float64 {
+	band := float64(plotRight-plotLeft) / float64(len(categories))
+	for i, c := range categories {
+		s.text(plotLeft+band*(float64(i)+0.5), plotBottom+18, "middle", 12, c)
+	}
+	return band
+}
+
+func (c barChart) SVG() string {
+	s := newSvgCanvas(c.Title)
+
+	lo, hi := 0.0, math.Inf(-1)
+	for _, series := range c.Series {
+		for _, v := range series.Values {
+			if !math.IsNaN(v) {
+				lo, hi = math.Min(lo, v), math.Max(hi, v)
+			}
+		}
+	}
+	if math.IsInf(hi, -1) || len(c.Categories) == 0 {
+		return s.noData()
+	}
+
+	names := make([]string, len(c.Series))
+	for i, series := range c.Series {
+		names[i] = series.Name
+	}
+	s.legend(names)
+	y := s.yAxis(lo, hi, c.YLabel)
+	band := s.categoryAxis(c.Categories)
+
+	width := band * 0.8 / float64(len(c.Series))
+	for i := range c.Categories {
+		for j, series := range c.Series {
+			v := series.Values[i]
+			if math.IsNaN(v) {
+				continue
+			}
+			x := plotLeft + band*float64(i) + band*0.1 + width*float64(j)
+			top, bottom := math.Min(y(v), y(0)), math.Max(y(v), y(0))
+			fmt.Fprintf(&s.b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s</title></rect>`,
+				x, top, width*0.95, bottom-top, chartPalette[j%len(chartPalette)], html.EscapeString(fmt.Sprintf("%s %s: %s", c.Categories[i], series.Name, formatValue(v))))
+			if len(c.Series)*len(c.Categories) <= 24 {
+				s.text(x+width*0.475, top-4, "middle", 10, formatValue(v))
+			}
+		}
+	}
+
+	return s.String()
+}
+
+func (c boxChart) SVG() string {
+	s := newSvgCanvas(c.Title)
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, values := range c.Values {
+		for _, v := range values {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	if math.IsInf(hi, -1) {
+		return s.noData()
+	}
+
+	y := s.yAxis(lo, hi, c.YLabel)
+	labels := make([]string, len(c.Categories))
+	for i, category := range c.Categories {
+		labels[i] = fmt.Sprintf("%s (n=%d)", category, len(c.Values[i]))
+	}
+	band := s.categoryAxis(labels)
+
+	for i, values := range c.Values {
+		if len(values) == 0 {
+			continue
+		}
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		q1, median, q3 := quantile(sorted, 0.25), quantile(sorted, 0.5), quantile(sorted, 0.75)
+		lowFence, highFence := q1-1.5*(q3-q1), q3+1.5*(q3-q1)
+		whiskerLo, whiskerHi := q1, q3
+		for _, v := range sorted {
+			if v >= lowFence {
+				whiskerLo = math.Min(v, q1)
+				break
+			}
+		}
+		for j := len(sorted) - 1; j >= 0; j-- {
+			if sorted[j] <= highFence {
+				whiskerHi = math.Max(sorted[j], q3)
+				break
+			}
+		}
+
+		color := chartPalette[i%len(chartPalette)]
+		center := plotLeft + band*(float64(i)+0.5)
+		half := math.Min(band*0.3, 40)
+
+		fmt.Fprintf(&s.b, `<line x1="%.1f" x2="%.1f" y1="%.1f" y2="%.1f" stroke="#333"/>`, center, center, y(whiskerLo), y(q1))
+		fmt.Fprintf(&s.b, `<line x1="%.1f" x2="%.1f" y1="%.1f" y2="%.1f" stroke="#333"/>`, center, center, y(q3), y(whiskerHi))
+		fmt.Fprintf(&s.b, `<line x1="%.1f" x2="%.1f" y1="%.1f" y2="%.1f" stroke="#333"/>`, center-half/2, center+half/2, y(whiskerLo), y(whiskerLo))
+		fmt.Fprintf(&s.b, `<line x1="%.1f" x2="%.1f" y1="%.1f" y2="%.1f" stroke="#333"/>`, center-half/2, center+half/2, y(whiskerHi), y(whiskerHi))
+		fmt.Fprintf(&s.b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" stroke="#333"><title>%s</title></rect>`,
+			center-half, y(q3), 2*half, math.Max(y(q1)-y(q3), 0.5), color,
+			html.EscapeString(fmt.Sprintf("%s: q1 %s, median %s, q3 %s", c.Categories[i], formatValue(q1), formatValue(median), formatValue(q3))))
+		fmt.Fprintf(&s.b, `<line x1="%.1f" x2="%.1f" y1="%.1f" y2="%.1f" stroke="#333" stroke-width="2"/>`, center-half, center+half, y(median), y(median))
+
+		for _, v := range sorted {
+			if v < whiskerLo || v > whiskerHi {
+				fmt.Fprintf(&s.b, `<circle cx="%.1f" cy="%.1f" r="2.5" fill="none" stroke="#333"/>`, center, y(v))
+			}
+		}
+	}
+
+	return s.String()
+}
+
+func (c lineChart) SVG() string {
+	s := newSvgCanvas(c.Title)
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, series := range c.Series {
+		for _, v := range series.Values {
+			if !math.IsNaN(v) {
+				lo, hi = math.Min(lo, v), math.Max(hi, v)
+			}
+		}
+	}
+	if math.IsInf(hi, -1) || len(c.X) == 0 {
+		return s.noData()
+	}
+
+	names := make([]string, len(c.Series))
+	for i, series := range c.Series {
+		names[i] = series.Name
+	}
+	s.legend(names)
+	y := s.yAxis(math.Min(lo, 0), hi, c.YLabel)
+
+	xLo, xHi := c.X[0], c.X[len(c.X)-1]
+	x := func(v float64) float64 {
+		if xHi == xLo {
+			return (plotLeft + plotRight) / 2
+		}
+		return plotLeft + 20 + (v-xLo)/(xHi-xLo)*(plotRight-plotLeft-40)
+	}
+	for _, v := range c.X {
+		s.text(x(v), plotBottom+18, "middle", 12, formatValue(v))
+	}
+	s.text((plotLeft+plotRight)/2, plotBottom+40, "middle", 12, c.XLabel)
+
+	for i, series := range c.Series {
+		color := chartPalette[i%len(chartPalette)]
+
+		// missing values break the line
+		points := []string{}
+		flush := func() {
+			if len(points) > 1 {
+				fmt.Fprintf(&s.b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, strings.Join(points, " "), color)
+			}
+			points = points[:0]
+		}
+		for j, v := range series.Values {
+			if math.IsNaN(v) {
+				flush()
+				continue
+			}
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(c.X[j]), y(v)))
+		}
+		flush()
+
+		for j, v := range series.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			fmt.Fprintf(&s.b, `<circle cx="%.1f" cy="%.1f" r="4" fill="%s"><title>%s</title></circle>`,
+				x(c.X[j]), y(v), color, html.EscapeString(fmt.Sprintf("%s, %s %s: %s", series.Name, formatValue(c.X[j]), c.XLabel, formatValue(v))))
+			s.text(x(c.X[j]), y(v)-8, "middle", 9, formatValue(v))
+		}
+	}
+
+	return s.String()
+}
+
+// niceTicks covers lo to hi with about n ticks at a step of 1, 2 or 5 times a
+// power of ten.
+func niceTicks(lo, hi float64, n int) ([]float64, float64) {
+	if hi == lo {
+		if lo == 0 {
+			hi = 1
+		} else {
+			lo, hi = lo-math.Abs(lo)/2, hi+math.Abs(hi)/2
+		}
+	}
+
+	raw := (hi - lo) / float64(n-1)
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	step := magnitude * 10
+	for _, f := range []float64{1, 2, 5} {
+		if raw <= f*magnitude {
+			step = f * magnitude
+			break
+		}
+	}
+
+	ticks := []float64{}
+	for i := math.Floor(lo / step); i <= math.Ceil(hi/step); i++ {
+		ticks = append(ticks, i*step)
+	}
+	return ticks, step
+}
+
+func formatTick(v, step float64) string {
+	decimals := 0
+	if step < 1 {
+		decimals = int(math.Ceil(-math.Log10(step)))
+	}
+	return fmt.Sprintf("%.*f", decimals, v)
+}
+
+// formatValue prints values like the annotations of analyzer/gen_plots.py.
+func formatValue(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e6 {
+		return fmt.Sprintf("%.0f", v)
+	}
+	if math.Abs(v) >= 10 {
+		return fmt.Sprintf("%.1f", v)
+	}
+	return fmt.Sprintf("%.2f", v)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRunNotFound     = errors.New("run not found")
+	ErrVersionConflict = errors.New("run was modified concurrently")
+)
+
+// parseRunUpdate validates an update payload against the TestRun metric
+// schema and converts it into a column map. Only the keys present in the
+// payload end up in the map, so a partial update never touches the columns
+// written by the other side (client or server) of the run. Every rejected key
+// is reported in the returned *ValidationError.
+//
+// The control key "@state" moves the run to another state, optionally with a
+// "@reason". "@end" sets TestEnd and completes the run, or fails it when the
+// payload carries an Error. Errors without phase and code are classified
+// from their message, see errors.go. Namespaced keys like
+// "quic.handshake_rtt_ms" are custom metrics (numbers) or labels (strings),
+// collected in the Metrics and Labels fields, see custom.go.
+func parseRunUpdate(dto map[string]any, side Side) (map[string]any, error) {
+	fields := map[string]any{}
+	verr := &ValidationError{}
+
+	for key, raw := range dto {
+		if strings.HasPrefix(key, "@") {
+			switch key {
+			case "@end", "@version":
+			case "@state":
+				v, ok := raw.(string)
+				if !ok {
+					verr.add(key, FieldErrorType, "expected string, got %s", jsonTypeName(raw))
+					continue
+				}
+				state, err := parseRunState(v)
+				if err != nil {
+					verr.add(key, FieldErrorInvalidValue, "%v", err)
+					continue
+				}
+				fields["State"] = state
+				if _, ok := dto["@reason"]; !ok {
+					fields["StateReason"] = ""
+				}
+			case "@reason":
+				v, ok := raw.(string)
+				if !ok {
+					verr.add(key, FieldErrorType, "expected string, got %s", jsonTypeName(raw))
+					continue
+				}
+				if _, ok := dto["@state"]; !ok {
+					verr.add(key, FieldErrorInvalidValue, "only allowed together with @state")
+					continue
+				}
+				fields["StateReason"] = v
+			default:
+				verr.add(key, FieldErrorUnknown, "unknown control key")
+			}
+			continue
+		}
+
+		field, ok := runMetricsByName[key]
+		if !ok && isCustomName(key) {
+			parseCustomValue(fields, key, raw, verr)
+			continue
+		} else if !ok {
+			verr.add(key, FieldErrorUnknown, "not a known metric")
+			continue
+		}
+
+		if v, ok := field.convert(raw, side, verr); ok {
+			if field.Unit == "unix_ms" {
+				v = normalizeUnixMillis(v.(int64))
+			}
+			fields[field.Field] = v
+		}
+	}
+
+	if _, ok := dto["@end"]; ok {
+		if state, ok := fields["State"].(RunState); ok && !state.Terminal() {
+			verr.add("@state", FieldErrorInvalidValue, "must be a terminal state when combined with @end, got %q", state)
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		sort.Slice(verr.Fields, func(i, j int) bool { return verr.Fields[i].Field < verr.Fields[j].Field })
+		return nil, verr
+	}
+
+	completeErrorFields(fields, side)
+
+	if _, ok := dto["@end"]; ok {
+		fields["TestEnd"] = time.Now()
+		if _, ok := fields["State"]; !ok {
+			fields["State"] = RunStateCompleted
+			if e, _ := fields["Error"].(string); e != "" {
+				fields["State"] = RunStateFailed
+			}
+			fields["StateReason"] = ""
+		}
+	}
+
+	return fields, nil
+}
+
+// parseExpectedVersion reads the optional "@version" key of an update payload.
+// When given, the update only applies if the run is still at that version.
+func parseExpectedVersion(dto map[string]any) (*int64, error) {
+	val, ok := dto["@version"]
+	if !ok {
+		return nil, nil
+	}
+
+	var version int64
+	switch v := val.(type) {
+	case float64:
+		version = int64(v)
+	case string:
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("@version: %w", err)
+		}
+		version = parsed
+	default:
+		return nil, fmt.Errorf("@version: type %T not supported", v)
+	}
+
+	return &version, nil
+}
+
+// applyRunUpdate writes the given columns of a run in a single transaction and
+// bumps its version. Columns missing from fields are left untouched, so
+// concurrent updates from client and server for the same run never overwrite
+// each other. A new State is only written if the run's current state may
+// transition to it. Otherwise the state change is ignored but the other fields
+// are still written, e.g. the metrics of an "@end" arriving after the watchdog
+// timed the run out, and ErrInvalidTransition is returned along with the new
+// version, or a zero version if the update carried nothing else. Updates of
+// transfer timestamps or byte counts recompute the derived metrics. The
+// written fields are logged with the source db was prepared with, see
+// updatelog.go. Once the update is committed, its events are published in the
+// order of the run's versions, see events.go. It returns the new version of
+// the run.
+func applyRunUpdate(db *gorm.DB, id int64, fields map[string]any, expectedVersion *int64) (int64, error) {
+	var run TestRun
+	var transitionErr error
+
+	err := transactionInEventOrder(db, func(tx *gorm.DB) error {
+		updates := make(map[string]any, len(fields)+1)
+		for k, v := range fields {
+			if k != "Metrics" && k != "Labels" && k != "State" && k != "StateReason" {
+				updates[k] = v
+			}
+		}
+		updates["Version"] = gorm.Expr("version + 1")
+
+		q := tx.Model(&TestRun{}).Where("id = ?", id)
+		if expectedVersion != nil {
+			q = q.Where("version = ?", *expectedVersion)
+		}
+
+		// the state is written first and on its own, so an invalid
+		// transition does not keep the rest of the update from being written
+		if state, ok := fields["State"].(RunState); ok {
+			stateUpdates := map[string]any{"State": state}
+			if reason, ok := fields["StateReason"]; ok {
+				stateUpdates["StateReason"] = reason
+			}
+			res := q.Session(&gorm.Session{}).Where("state IN ?", runStatesLeadingTo(state)).Updates(stateUpdates)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				current, err := currentRunVersion(tx, id, expectedVersion)
+				if err != nil {
+					return err
+				}
+				transitionErr = fmt.Errorf("%w from %s to %s", ErrInvalidTransition, current.State, state)
+
+				fields = maps.Clone(fields)
+				delete(fields, "State")
+				delete(fields, "StateReason")
+				if len(fields) == 0 {
+					return transitionErr
+				}
+			}
+		}
+
+		res := q.Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			if _, err := currentRunVersion(tx, id, expectedVersion); err != nil {
+				return err
+			}
+			return ErrVersionConflict
+		}
+
+		if err := writeCustomValues(tx, id, fields); err != nil {
+			return err
+		}
+
+		if touchesDerivedMetrics(fields) {
+			if err := refreshDerivedMetrics(tx, id); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Select("id", "campaign_id", "batch_id", "protocol", "state", "state_reason", "version").Where("id = ?", id).Take(&run).Error; err != nil {
+			return err
+		}
+		return appendRunLog(tx, run.ID, run.Version, fields, false)
+	}, func() {
+		publishRunEvents(db, runUpdateEvents(run, fields)...)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return run.Version, transitionErr
+}
+
+// currentRunVersion returns the version and state of a run an update did not
+// apply to, or ErrRunNotFound or ErrVersionConflict if that is why.
+func currentRunVersion(tx *gorm.DB, id int64, expectedVersion *int64) (TestRun, error) {
+	current := TestRun{}
+	if err := tx.Select("version", "state").Where("id = ?", id).Take(&current).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return current, ErrRunNotFound
+	} else if err != nil {
+		return current, err
+	}
+	if expectedVersion != nil && current.Version != *expectedVersion {
+		return current, ErrVersionConflict
+	}
+	return current, nil
+}
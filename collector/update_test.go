@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentRunUpdates hammers one run with updates of disjoint client
+// and server fields from as many goroutines. Every field has to survive and
+// every update has to count once in the version.
+func TestConcurrentRunUpdates(t *testing.T) {
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolHTTP3, 1)
+
+	fields := []MetricField{}
+	for _, f := range runMetrics {
+		if f.Side != SideAny && f.Unit != "unix_ms" && (f.Kind == MetricKindInt || f.Kind == MetricKindFloat) {
+			fields = append(fields, f)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(fields))
+	for i, f := range fields {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			update, err := parseRunUpdate(map[string]any{f.Name: float64(i + 1)}, f.Side)
+			if err == nil {
+				_, err = applyRunUpdate(db, run.ID, update, nil)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	stored := TestRun{}
+	if err := db.First(&stored, run.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	v := reflect.ValueOf(stored)
+	for i, f := range fields {
+		got := v.FieldByName(f.Field)
+		if (got.CanInt() && got.Int() != int64(i+1)) || (got.CanFloat() && got.Float() != float64(i+1)) {
+			t.Errorf("%s is %v, want %d", f.Field, got, i+1)
+		}
+	}
+	if stored.Version != int64(len(fields)) {
+		t.Errorf("version %d, want %d", stored.Version, len(fields))
+	}
+}
+
+// TestLateEndKeepsMetrics reports the end of a run after the watchdog timed
+// it out. The metrics have to be stored even though the run stays timed_out.
+func TestLateEndKeepsMetrics(t *testing.T) {
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolWebSockets, 1)
+	if err := db.Model(&run).Update("test_begin", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := timeOutStaleRuns(db, time.Minute, time.Now()); err != nil || n != 1 {
+		t.Fatalf("timed out %d runs, %v", n, err)
+	}
+
+	update, err := parseRunUpdate(map[string]any{"BytesPayload": float64(1 << 20), "@end": true}, SideServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := applyRunUpdate(db, run.ID, update, nil)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidTransition)
+	}
+	if version != 2 {
+		t.Errorf("got version %d, want 2", version)
+	}
+
+	stored := TestRun{}
+	if err := db.First(&stored, run.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != RunStateTimedOut || stored.StateReason == "" {
+		t.Errorf("got state %s (%q), want it to stay timed_out", stored.State, stored.StateReason)
+	}
+	if stored.BytesPayload != 1<<20 || stored.TestEnd.IsZero() {
+		t.Errorf("got payload %d and end %v, want the late end's", stored.BytesPayload, stored.TestEnd)
+	}
+
+	// a state change alone has nothing else to write
+	version, err = applyRunUpdate(db, run.ID, map[string]any{"State": RunStateCompleted, "StateReason": ""}, nil)
+	if !errors.Is(err, ErrInvalidTransition) || version != 0 {
+		t.Errorf("got version %d, %v, want 0, %v", version, err, ErrInvalidTransition)
+	}
+	if err := db.First(&stored, run.ID).Error; err != nil || stored.Version != 2 {
+		t.Errorf("got version %d, %v, want it unchanged", stored.Version, err)
+	}
+}
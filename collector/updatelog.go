@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// RunLogEntry is one write to a run in its append-only update log. Every
+// change of a run's fields is logged in the transaction that makes it, with
+// the component that made it, so the log tells who wrote which field when,
+// and replaying it rebuilds the run.
+type RunLogEntry struct {
+	ID        int64  `gorm:"primaryKey;autoIncrement"`
+	RunID     int64  `gorm:"index"`
+	Version   int64  // version of the run after the write
+	Snapshot  bool   // the run's complete state: fields not in Fields are zero, e.g. on creation or import
+	Source    string // the name of the writer's API key, or the part of the collector that wrote, e.g. "watchdog"
+	Side      Side   // side the fields were validated for
+	Host      string // host the write came from, X-Collector-Host or else the remote address
+	RequestID string // X-Request-ID of the request that wrote
+	Time      time.Time
+	Fields    map[string]json.RawMessage `gorm:"serializer:json"` // TestRun field names, JSON values
+}
+
+// runLogOmitted are the TestRun fields that are not logged: the ID and
+// version the entry has anyway, the derived metrics, which are recomputed on
+// replay, and the flagger's bookkeeping.
+var runLogOmitted = append([]string{"ID", "Version", "FlaggedVersion"}, derivedMetricColumns...)
+
+var ErrRunLogIncomplete = errors.New("run was stored before its updates were logged")
+
+// WriteSource is who writes to runs through a db prepared with
+// withWriteSource. It ends up in the update log.
+type WriteSource struct {
+	Component string
+	Side      Side
+	Host      string
+	RequestID string
+}
+
+type writeSourceKey struct{}
+
+// withWriteSource returns db with the source the run writes through it are
+// logged with.
+func withWriteSource(db *gorm.DB, src WriteSource) *gorm.DB {
+	return db.WithContext(context.WithValue(db.Statement.Context, writeSourceKey{}, src))
+}
+
+// writeSourceOf returns the source db was prepared with. Writes without one
+// are the collector's own.
+func writeSourceOf(db *gorm.DB) WriteSource {
+	if src, ok := db.Statement.Context.Value(writeSourceKey{}).(WriteSource); ok {
+		return src
+	}
+	return WriteSource{Component: "collector"}
+}
+
+// requestWriteSource is the source of writes made on behalf of a request.
+func requestWriteSource(c *fiber.Ctx, side Side) WriteSource {
+	src := WriteSource{Side: side, Host: c.Get("X-Collector-Host"), RequestID: c.GetRespHeader(fiber.HeaderXRequestID)}
+	if key := requestKey(c); key != nil {
+		src.Component = key.Name
+	}
+	if src.Host == "" {
+		src.Host = c.IP()
+	}
+	return src
+}
+
+// appendRunLog logs a write of fields to a run, with the source tx was
+// prepared with.
+func appendRunLog(tx *gorm.DB, runID, version int64, fields map[string]any, snapshot bool) error {
+	return tx.Create(newRunLogEntry(tx, runID, version, fields, snapshot)).Error
+}
+
+func newRunLogEntry(tx *gorm.DB, runID, version int64, fields map[string]any, snapshot bool) *RunLogEntry {
+	src := writeSourceOf(tx)
+	entry := &RunLogEntry{
+		RunID:     runID,
+		Version:   version,
+		Snapshot:  snapshot,
+		Source:    src.Component,
+		Side:      src.Side,
+		Host:      src.Host,
+		RequestID: src.RequestID,
+		Time:      time.Now(),
+		Fields:    make(map[string]json.RawMessage, len(fields)),
+	}
+	for k, v := range fields {
+		if slices.Contains(runLogOmitted, k) {
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			raw, _ = json.Marshal(fmt.Sprint(v))
+		}
+		entry.Fields[k] = raw
+	}
+	return entry
+}
+
+// runSnapshot returns the fields of a run that are not zero, the Fields of a
+// snapshot entry.
+func runSnapshot(run TestRun) map[string]any {
+	fields := map[string]any{}
+	v := reflect.ValueOf(run)
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); !f.IsZero() {
+			fields[v.Type().Field(i).Name] = f.Interface()
+		}
+	}
+	return fields
+}
+
+// logRunSnapshots logs the complete state of freshly stored runs.
+func logRunSnapshots(tx *gorm.DB, runs []TestRun) error {
+	entries := make([]*RunLogEntry, len(runs))
+	for i, run := range runs {
+		entries[i] = newRunLogEntry(tx, run.ID, run.Version, runSnapshot(run), true)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(entries, 500).Error
+}
+
+func loadRunLog(db *gorm.DB, id int64) ([]RunLogEntry, error) {
+	entries := []RunLogEntry{}
+	return entries, db.Where("run_id = ?", id).Order("id").Find(&entries).Error
+}
+
+// FieldProvenance is who last wrote a field of a run.
+type FieldProvenance struct {
+	Source    string
+	Side      Side `json:",omitempty"`
+	Host      string
+	RequestID string `json:",omitempty"`
+	Time      time.Time
+	Version   int64
+}
+
+// runProvenance returns the last write of every field in the log.
+func runProvenance(entries []RunLogEntry) map[string]FieldProvenance {
+	provenance := map[string]FieldProvenance{}
+	for _, e := range entries {
+		if e.Snapshot {
+			clear(provenance)
+		}
+		for field := range e.Fields {
+			provenance[field] = FieldProvenance{Source: e.Source, Side: e.Side, Host: e.Host, RequestID: e.RequestID, Time: e.Time, Version: e.Version}
+		}
+	}
+	return provenance
+}
+
+// replayRunLog rebuilds a run from its log: starting at the last snapshot,
+// the logged fields are applied in order and the derived metrics computed.
+func replayRunLog(entries []RunLogEntry, id int64) (TestRun, error) {
+	start := -1
+	for i, e := range entries {
+		if e.Snapshot {
+			start = i
+		}
+	}
+	if start < 0 {
+		return TestRun{}, ErrRunLogIncomplete
+	}
+
+	run := TestRun{}
+	v := reflect.ValueOf(&run).Elem()
+	for _, e := range entries[start:] {
+		if e.Snapshot {
+			run = TestRun{}
+		}
+		for name, raw := range e.Fields {
+			f := v.FieldByName(name)
+			if !f.IsValid() {
+				return run, fmt.Errorf("entry %d: unknown field %s", e.ID, name)
+			}
+			target := reflect.New(f.Type())
+			if err := json.Unmarshal(raw, target.Interface()); err != nil {
+				return run, fmt.Errorf("entry %d: %s: %w", e.ID, name, err)
+			}
+			// custom values are written by name, not as a whole
+			if f.Kind() == reflect.Map && !f.IsNil() {
+				iter := target.Elem().MapRange()
+				for iter.Next() {
+					f.SetMapIndex(iter.Key(), iter.Value())
+				}
+				continue
+			}
+			f.Set(target.Elem())
+		}
+		run.Version = e.Version
+	}
+	run.ID = id
+	deriveRunMetrics(&run)
+
+	return run, nil
+}
+
+// RunDifference is a field whose stored value differs from the replayed one.
+type RunDifference struct {
+	Field    string `json:"field"`
+	Stored   any    `json:"stored"`
+	Replayed any    `json:"replayed"`
+}
+
+func diffReplayedRun(stored, replayed TestRun) []RunDifference {
+	diffs := []RunDifference{}
+	s, r := reflect.ValueOf(stored), reflect.ValueOf(replayed)
+	for i := 0; i < s.NumField(); i++ {
+		name := s.Type().Field(i).Name
+		if name == "FlaggedVersion" {
+			continue
+		}
+		a, b := s.Field(i).Interface(), r.Field(i).Interface()
+		if t, ok := a.(time.Time); ok && t.Equal(b.(time.Time)) {
+			continue
+		}
+		if !reflect.DeepEqual(a, b) {
+			diffs = append(diffs, RunDifference{Field: name, Stored: a, Replayed: b})
+		}
+	}
+	return diffs
+}
+
+func registerRunLogRoutes(app *fiber.App, db *gorm.DB, auth *keyStore) {
+	app.Get("/runs/:id/log", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		entries, err := loadRunLog(db, id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(entries)
+	})
+
+	// the run rebuilt from its log, together with every field in which it
+	// differs from the stored run
+	app.Get("/runs/:id/replay", auth.require(ScopeRead), func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		stored := TestRun{}
+		if err := db.First(&stored, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		runs := []TestRun{stored}
+		if err := attachCustomValues(db, runs); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		stored = runs[0]
+
+		entries, err := loadRunLog(db, id)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		replayed, err := replayRunLog(entries, id)
+		if errors.Is(err, ErrRunLogIncomplete) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		} else if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{"run": replayed, "entries": len(entries), "differences": diffReplayedRun(stored, replayed)})
+	})
+}
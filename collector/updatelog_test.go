@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// TestReplayRunLog writes a run as its runner, server and client do, with
+// state reports, samples, custom values and updates after its end, and
+// rebuilds it from its log. The replay has to match the stored run.
+func TestReplayRunLog(t *testing.T) {
+	db := openTestDB(t)
+
+	run := TestRun{Protocol: ProtocolHTTP3, Enviroment: "local", TimeSlot: "morning", ParallelClients: 2, TestBegin: time.Now(), State: RunStateCreated}
+	err := withWriteSource(db, WriteSource{Component: "runner"}).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&run).Error; err != nil {
+			return err
+		}
+		return appendRunLog(tx, run.ID, run.Version, runSnapshot(run), true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := WriteSource{Component: "http3-client", Side: SideClient, Host: "client-1"}
+	server := WriteSource{Component: "http3-server", Side: SideServer, Host: "server-1"}
+	updates := []struct {
+		src WriteSource
+		dto map[string]any
+		err error
+	}{
+		{client, map[string]any{"@state": "connecting"}, nil},
+		{server, map[string]any{"TransferStartUnixMs": 1700000000000.0, "BytesPayload": 2000000.0, "quic.version": "v1"}, nil},
+		{client, map[string]any{"@state": "transferring", "quic.handshake_rtt_ms": 12.5}, nil},
+		{client, map[string]any{"@state": "connecting", "Retransmissions": 4.0}, ErrInvalidTransition},
+		{server, map[string]any{"CpuServerPercentWhile": 12.5, "quic.version": "v2"}, nil},
+		{client, map[string]any{"@end": true, "TransferEndUnixMs": 1700000002000.0, "LostPackets": 3.0, "BytesSentTotal": 2100000.0}, nil},
+		{server, map[string]any{"@state": "failed", "@reason": "late", "ErrorCode": "eof", "Error": "closed"}, ErrInvalidTransition},
+		{client, map[string]any{"@end": true, "StreamDurationMs": 1900.0}, ErrInvalidTransition},
+	}
+	for i, u := range updates {
+		fields, err := parseRunUpdate(u.dto, u.src.Side)
+		if err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+		if _, err := applyRunUpdate(withWriteSource(db, u.src), run.ID, fields, nil); !errors.Is(err, u.err) {
+			t.Fatalf("update %d %v: error %v, want %v", i, u.dto, err, u.err)
+		}
+	}
+	samples := []sampleDto{{TimestampMs: 1700000000000, CpuPercent: 10, RamUsedBytes: 100}, {TimestampMs: 1700000001000, CpuPercent: 30, RamUsedBytes: 300}}
+	if _, err := ingestSamples(withWriteSource(db, client), run.ID, SideClient, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func() (TestRun, TestRun) {
+		t.Helper()
+		stored := []TestRun{{}}
+		if err := db.First(&stored[0], run.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := attachCustomValues(db, stored); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := loadRunLog(db, run.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed, err := replayRunLog(entries, run.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored[0], replayed
+	}
+
+	stored, replayed := load()
+	if diffs := diffReplayedRun(stored, replayed); len(diffs) > 0 {
+		t.Errorf("replayed run differs from the stored one: %+v", diffs)
+	}
+	if stored.State != RunStateCompleted || stored.Retransmissions != 4 || stored.Error != "closed" || stored.StreamDurationMs != 1900 {
+		t.Errorf("stored %s run, retransmissions %d, error %q, stream duration %d: the fields of rejected transitions are lost",
+			stored.State, stored.Retransmissions, stored.Error, stored.StreamDurationMs)
+	}
+	if replayed.Labels["quic.version"] != "v2" || replayed.Metrics["quic.handshake_rtt_ms"] != 12.5 || replayed.CpuClientPercentWhile != 20 {
+		t.Errorf("replayed labels %v, metrics %v, CPU while %v", replayed.Labels, replayed.Metrics, replayed.CpuClientPercentWhile)
+	}
+	if replayed.ThroughputMbps == nil || *replayed.ThroughputMbps != 8 {
+		t.Errorf("replayed throughput %v, want it derived", floatOrNaN(replayed.ThroughputMbps))
+	}
+
+	// a write that bypasses the log shows up as a difference
+	if err := db.Model(&TestRun{}).Where("id = ?", run.ID).Update("lost_packets", 99).Error; err != nil {
+		t.Fatal(err)
+	}
+	stored, replayed = load()
+	diffs := diffReplayedRun(stored, replayed)
+	if len(diffs) != 1 || diffs[0].Field != "LostPackets" || diffs[0].Stored != int64(99) || diffs[0].Replayed != int64(3) {
+		t.Errorf("got differences %+v, want LostPackets stored as 99 and replayed as 3", diffs)
+	}
+
+	app := fiber.New()
+	registerRunLogRoutes(app, db, newKeyStore(db, "legacy"))
+	req := httptest.NewRequest("GET", fmt.Sprintf("/runs/%d/replay", run.ID), nil)
+	req.Header.Set("X-API-KEY", "legacy")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	result := struct {
+		Entries     int
+		Differences []RunDifference
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK || result.Entries != len(updates)+2 || len(result.Differences) != 1 {
+		t.Errorf("replay route: status %d, %d entries, differences %+v", resp.StatusCode, result.Entries, result.Differences)
+	}
+}
+
+func TestReplayRunLogWithoutSnapshot(t *testing.T) {
+	db := openTestDB(t)
+	run := createTestRun(t, db, ProtocolHTTP3, 1)
+	if _, err := applyRunUpdate(db, run.ID, map[string]any{"LostPackets": int64(1)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := loadRunLog(db, run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replayRunLog(entries, run.ID); !errors.Is(err, ErrRunLogIncomplete) {
+		t.Errorf("replay of a run stored before its log: %v, want %v", err, ErrRunLogIncomplete)
+	}
+}
@@ -14,15 +14,18 @@ import (
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
-	"github.com/shirou/gopsutil/v4/cpu"
-	"github.com/shirou/gopsutil/v4/mem"
+
+	"collectclient"
 )
 
 const URL = "https://localhost:2501"
 const REMOTE_URL = "https://thkm25_http3.nauri.io:2501"
 
+var collector = collectclient.MustNew(collectclient.ConfigFromEnv(collectclient.SideClient))
+
 func main() {
 	url, runID := parseArguments()
+	defer collector.Close()
 
 	tr := &http3.Transport{
 		TLSClientConfig: &tls.Config{
@@ -35,26 +38,15 @@ func main() {
 		Transport: tr,
 	}
 
+	sampler := collector.StartSampler(runID)
 	connectEstablishTime := time.Now()
-	cpuBefore := getCpuUsagePercentage()
-	ramBefore := getRamUsageBytes()
-	cpuWhile := float64(0)
-	ramWhile := uint64(0)
 	lost, recv := getPacketStats()
 
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		cpuWhile = getCpuUsagePercentage()
-		ramWhile = getRamUsageBytes()
-	}()
-
+	collector.State(runID, collectclient.StateConnecting)
 	resp, err := client.Get(url + "/stream?runID=" + fmt.Sprintf("%d", runID))
 	if err != nil {
-		collectMetrics(runID, map[string]any{
-			"@end":  true,
-			"Error": fmt.Sprintf("Failed to GET: %v", err),
-		})
-		log.Fatalf("Failed to GET: %v", err)
+		collector.Fail(runID, failure(collectclient.PhaseDial, err).DialOrHandshake())
+		collector.Fatalf("Failed to GET: %v", err)
 	}
 
 	defer resp.Body.Close()
@@ -66,6 +58,8 @@ func main() {
 
 	defer output.Close()
 
+	body := sampler.Writer(output)
+
 	for {
 		buf := make([]byte, 1024)
 		n, err := resp.Body.Read(buf)
@@ -73,34 +67,26 @@ func main() {
 			if err == http.ErrBodyReadAfterClose || err == io.EOF || err.Error() == "204 No Content" {
 				log.Println("Connection closed by server")
 			} else {
-				collectMetrics(runID, map[string]any{
-					"@end":  true,
-					"Error": fmt.Sprintf("Failed to read response body: %v", err),
-				})
-				log.Fatalf("Failed to read response body: %v", err)
+				collector.Fail(runID, failure(collectclient.PhaseRead, err))
+				collector.Fatalf("Failed to read response body: %v", err)
 			}
 			break
 		}
 
-		output.Write(buf[:n])
+		body.Write(buf[:n])
 	}
 
-	cpuAfter := getCpuUsagePercentage()
-	ramAfter := getRamUsageBytes()
+	transferEnd := time.Now().UnixMilli()
+	connectionDuration := time.Since(connectEstablishTime).Milliseconds()
 	lostAfter, recvAfter := getPacketStats()
 
-	collectMetrics(runID, map[string]any{
-		"@end":                   true,
-		"TransferEndUnix":        time.Now().Unix(),
-		"ConnectionDuration":     time.Since(connectEstablishTime).Milliseconds(),
-		"CpuClientPercentBefore": cpuBefore,
-		"CpuClientPercentWhile":  cpuWhile,
-		"CpuClientPercentAfter":  cpuAfter,
-		"RamClientBytesBefore":   ramBefore,
-		"RamClientBytesWhile":    ramWhile,
-		"RamClientBytesAfter":    ramAfter,
-		"LostPackets":            lostAfter - lost,
-		"BytesSentTotal":         recvAfter - recv,
+	sampler.Stop()
+	collector.Metrics(runID, map[string]any{
+		"@end":                 true,
+		"TransferEndUnixMs":    transferEnd,
+		"ConnectionDurationMs": connectionDuration,
+		"LostPackets":          lostAfter - lost,
+		"BytesSentTotal":       recvAfter - recv,
 	})
 }
 
@@ -131,22 +117,6 @@ func parseArguments() (string, int) {
 	return url, runId
 }
 
-func getCpuUsagePercentage() float64 {
-	percentages, err := cpu.Percent(500*time.Millisecond, false)
-	if err != nil || len(percentages) == 0 {
-		return 0.0
-	}
-	return percentages[0]
-}
-
-func getRamUsageBytes() uint64 {
-	vmStat, err := mem.VirtualMemory()
-	if err != nil {
-		return 0
-	}
-	return vmStat.Used
-}
-
 // Returns netstat -e output for lost packets, and bytes received (sent)
 func getPacketStats() (int64, int64) {
 	cmd, err := exec.Command("netstat", "-e").Output()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -10,14 +11,18 @@ import (
 	"time"
 
 	"github.com/quic-go/quic-go/http3"
-	"github.com/shirou/gopsutil/v4/cpu"
-	"github.com/shirou/gopsutil/v4/mem"
+
+	"collectclient"
 )
 
 var assetsDir = path.Join("..", "assets")
 var videoFile = path.Join(assetsDir, "sample_video.mp4")
 
+var collector = collectclient.MustNew(collectclient.ConfigFromEnv(collectclient.SideServer))
+
 func main() {
+	collector.FlushOnExit()
+
 	stat, err := os.Stat(videoFile)
 	if err != nil {
 		log.Fatalf("Failed to get file info: %v", err)
@@ -69,47 +74,35 @@ func streamVideo(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
 	w.Header().Set("Accept-Ranges", "bytes")
 
-	transferStart := time.Now().Unix()
-	cpuBefore := getCpuUsagePercentage()
-	ramBefore := getRamUsageBytes()
-	cpuWhile := float64(0)
-	ramWhile := uint64(0)
-
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		cpuWhile = getCpuUsagePercentage()
-		ramWhile = getRamUsageBytes()
-	}()
-
-	http.ServeContent(w, r, videoFile, stat.ModTime(), video)
-
-	cpuAfter := getCpuUsagePercentage()
-	ramAfter := getRamUsageBytes()
-
-	collectMetrics(runID, map[string]any{
-		"TransferStartUnix":      transferStart,
-		"BytesPayload":           stat.Size(),
-		"CpuServerPercentBefore": cpuBefore,
-		"CpuServerPercentWhile":  cpuWhile,
-		"CpuServerPercentAfter":  cpuAfter,
-		"RamServerBytesBefore":   ramBefore,
-		"RamServerBytesWhile":    ramWhile,
-		"RamServerBytesAfter":    ramAfter,
+	sampler := collector.StartSampler(runID)
+	transferStart := time.Now().UnixMilli()
+
+	cw := &countingResponseWriter{ResponseWriter: w, body: sampler.Writer(w)}
+	http.ServeContent(cw, r, videoFile, stat.ModTime(), video)
+	if cw.err != nil {
+		log.Printf("Failed to write response: %v", cw.err)
+		collector.Fail(runID, failure(collectclient.PhaseWrite, cw.err))
+	}
+
+	sampler.Stop()
+	collector.Metrics(runID, map[string]any{
+		"TransferStartUnixMs": transferStart,
+		"BytesPayload":        stat.Size(),
 	})
 }
 
-func getCpuUsagePercentage() float64 {
-	percentages, err := cpu.Percent(500*time.Millisecond, false)
-	if err != nil || len(percentages) == 0 {
-		return 0.0
-	}
-	return percentages[0]
+// countingResponseWriter lets the sampler count the bytes ServeContent writes.
+// It keeps the first write error, which ServeContent does not return.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	body io.Writer
+	err  error
 }
 
-func getRamUsageBytes() uint64 {
-	vmStat, err := mem.VirtualMemory()
-	if err != nil {
-		return 0
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.body.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
 	}
-	return vmStat.Used
+	return n, err
 }
@@ -8,6 +8,26 @@ const os = require('os');
 
 const [runID, isLocal] = parseArguments();
 
+// Resource samples are taken every SAMPLE_INTERVAL_MS (default 250 ms) while a
+// transfer is running and sent right away, so a crash loses at most the
+// running interval. The first sample covers the time before the transfer
+// since the previous sample of the process, the last one the interval after
+// it.
+const sampleIntervalMs = parseInt(process.env.SAMPLE_INTERVAL_MS || '250', 10);
+
+// CPU times of the latest sample of the process, a new sampler starts from
+// them so its first sample needs no interval to wait for.
+let lastCpuInfo = cpuInfo();
+
+// The collector key of the WebRTC clients, it needs the write-client-metrics scope.
+const collectorApiKey = process.env.COLLECTOR_API_KEY;
+if (!collectorApiKey) {
+  console.error('[COLLECTOR] No collector API key, set COLLECTOR_API_KEY');
+  process.exit(1);
+}
+
+// a signaling error ends the run only after it was reported as connecting
+const reportedConnecting = collectMetrics({ "@state": "connecting" });
 const ws = new WebSocket(isLocal ? 'ws://localhost:2502' : 'wss://thkm25_webrtc.nauri.io');
 let peer;
 
@@ -17,6 +37,11 @@ ws.on('open', () => {
   ws.send(`INIT_${runID}`);
 });
 
+ws.on('error', err => {
+  console.error('Signaling error:', err);
+  reportedConnecting.then(() => collectMetrics({ "@end": true, ...errorFields('dial', err) }));
+});
+
 ws.on('message', (message) => {
   if (message.toString() === 'ACK') {
     handle();
@@ -27,6 +52,7 @@ async function handle() {
   peer = new Peer({ initiator: false, wrtc });
 
   let connectionEstablished = 0;
+  let connected = false;
 
   peer.on('signal', data => {
     console.log('WebRTC signal recv:', data);
@@ -47,13 +73,9 @@ async function handle() {
     }
   });
 
-  const cpuBefore = await getCpuUsagePercentage();
-  const ramBefore = await getRamUsageBytes();
-  let cpuWhile = 0;
-  let ramWhile = 0;
+  const sampler = startSampler();
   const [lost, recv] = await getPacketStats();
 
-  let first = true;
   const fileStream = fs.createWriteStream(`output${runID}.mp4`);
   peer.on('data', chunk => {
     if (chunk.toString() === '__EOF__') {
@@ -62,21 +84,14 @@ async function handle() {
       peer.destroy();
 
       (async () => {
-        const cpuAfter = await getCpuUsagePercentage();
-        const ramAfter = await getRamUsageBytes();
-        const [lostAfter, recvAfter] = await getPacketStats();
         const connectionEnd = Date.now();
+        const [lostAfter, recvAfter] = await getPacketStats();
 
+        await sampler.stop();
         await collectMetrics({
           "@end": true,
-          "TransferEndUnix": connectionEnd / 1000,
-          "ConnectionDuration": connectionEnd - connectionEstablished,
-          "CpuClientPercentBefore": cpuBefore,
-          "CpuClientPercentWhile": cpuWhile,
-          "CpuClientPercentAfter": cpuAfter,
-          "RamClientBytesBefore": ramBefore,
-          "RamClientBytesWhile": ramWhile,
-          "RamClientBytesAfter": ramAfter,
+          "TransferEndUnixMs": connectionEnd,
+          "ConnectionDurationMs": connectionEnd - connectionEstablished,
           "LostPackets": lostAfter - lost,
           "BytesSentTotal": recvAfter - recv,
         });
@@ -85,21 +100,41 @@ async function handle() {
     }
   
     fileStream.write(Buffer.from(chunk));
-
-    if (first) {
-      first = false;
-      (async () => {
-        cpuWhile = await getCpuUsagePercentage();
-        ramWhile = await getRamUsageBytes();
-      })();
-    }
+    sampler.add(chunk.length);
+  });
+  peer.on('connect', () => {
+    connected = true;
   });
+
   peer.on('close', () => {
     console.log('WebRTC connection closed');
     ws.close();
   });
 
-  peer.on('error', err => console.error('Peer error:', err));
+  peer.on('error', err => {
+    console.error('Peer error:', err);
+    collectMetrics({ "@end": true, ...errorFields(connected ? 'read' : 'handshake', err) });
+  });
+}
+
+// Stable error codes of Node.js socket errors and simple-peer errors, see
+// errors.go of the collector. Everything else is reported as unknown.
+const errorCodes = {
+  ECONNREFUSED: 'connection_refused',
+  ECONNRESET: 'connection_reset',
+  EPIPE: 'connection_closed',
+  ENOTFOUND: 'dns',
+  ETIMEDOUT: 'timeout',
+  ERR_ICE_CONNECTION_FAILURE: 'ice_failure',
+  ERR_CONNECTION_FAILURE: 'ice_failure',
+};
+
+function errorFields(phase, err) {
+  return {
+    "Error": String((err && err.message) || err),
+    "ErrorPhase": phase,
+    "ErrorCode": errorCodes[err && err.code] || 'unknown',
+  };
 }
 
 async function collectMetrics(data) {
@@ -107,7 +142,9 @@ async function collectMetrics(data) {
     console.log(data);
     await axios.put(`https://thkm25_collect.nauri.io/${runID}/update`, data, {
       headers: {
-        'X-API-KEY': 'thk_masterthesis_2025_hwtwswrtc'
+        'X-API-KEY': collectorApiKey,
+        'X-Collector-Side': 'client',
+        'X-Collector-Host': os.hostname()
       }
     });
     console.log('[COLLECTOR] Metrics collected!');
@@ -116,6 +153,21 @@ async function collectMetrics(data) {
   }
 }
 
+async function collectSamples(samples) {
+  try {
+    await axios.post(`https://thkm25_collect.nauri.io/${runID}/samples`, { Samples: samples }, {
+      headers: {
+        'X-API-KEY': collectorApiKey,
+        'X-Collector-Side': 'client',
+        'X-Collector-Host': os.hostname()
+      }
+    });
+    console.log(`[COLLECTOR] ${samples.length} samples collected!`);
+  } catch (error) {
+    console.error('[COLLECTOR] Error collecting samples:', error);
+  }
+}
+
 function parseArguments() {
   const args = process.argv;
   const runIDArg = args.find(arg => arg.startsWith('-r'));
@@ -125,22 +177,50 @@ function parseArguments() {
   return [runID, isLocal];
 }
 
-function getCpuUsagePercentage() {
-  return new Promise((resolve) => {
-    const start = cpuInfo();
+function startSampler() {
+  const sampler = { transferred: 0, last: lastCpuInfo };
+
+  const sample = () => {
+    const now = cpuInfo();
+    const idleDiff = now.idle - sampler.last.idle;
+    const totalDiff = now.total - sampler.last.total;
+    sampler.last = now;
+    lastCpuInfo = now;
+
+    return collectSamples([{
+      TimestampMs: Date.now(),
+      CpuPercent: totalDiff > 0 ? Math.min(Math.max(100 - (idleDiff / totalDiff) * 100, 0), 100) : 0,
+      RamUsedBytes: getRamUsageBytes(),
+      RssBytes: process.memoryUsage.rss(),
+      BytesTransferred: sampler.transferred
+    }]);
+  };
+
+  // the first transferred byte moves the run to transferring
+  sampler.add = n => {
+    if (sampler.transferred === 0 && n > 0) {
+      collectMetrics({ "@state": "transferring" });
+    }
+    sampler.transferred += n;
+  };
 
-    setTimeout(() => {
-      const end = cpuInfo();
+  sample();
+  const timer = setInterval(sample, sampleIntervalMs);
 
-      const idleDiff = end.idle - start.idle;
-      const totalDiff = end.total - start.total;
+  sampler.stop = async () => {
+    clearInterval(timer);
+    await sleep(sampleIntervalMs);
+    await sample();
+  };
 
-      const usage = 100 - Math.round((idleDiff / totalDiff) * 100);
-      resolve(usage);
-    }, 100);
-  });
+  return sampler;
 }
 
+function sleep(ms) {
+  return new Promise(resolve => setTimeout(resolve, ms));
+}
+
+
 function cpuInfo() {
   const cpus = os.cpus();
 
@@ -157,7 +237,7 @@ function cpuInfo() {
   return { idle, total };
 }
 
-async function getRamUsageBytes() {
+function getRamUsageBytes() {
   const total = os.totalmem();
   const free = os.freemem();
   return total - free;
@@ -6,6 +6,24 @@ const wrtc = require('@roamhq/wrtc');
 const axios = require('axios');
 const os = require('os');
 
+// Resource samples are taken every SAMPLE_INTERVAL_MS (default 250 ms) while a
+// transfer is running and sent right away, so a crash loses at most the
+// running interval. The first sample covers the time before the transfer
+// since the previous sample of the process, the last one the interval after
+// it.
+const sampleIntervalMs = parseInt(process.env.SAMPLE_INTERVAL_MS || '250', 10);
+
+// CPU times of the latest sample of the process, a new sampler starts from
+// them so its first sample needs no interval to wait for.
+let lastCpuInfo = cpuInfo();
+
+// The collector key of the WebRTC servers, it needs the write-server-metrics scope.
+const collectorApiKey = process.env.COLLECTOR_API_KEY;
+if (!collectorApiKey) {
+  console.error('[COLLECTOR] No collector API key, set COLLECTOR_API_KEY');
+  process.exit(1);
+}
+
 const wss = new WebSocket.Server({ port: 2502 });
 
 wss.on('connection', ws => {
@@ -23,6 +41,7 @@ wss.on('connection', ws => {
 
 async function handle(runID, ws) {
   const peer = new Peer({ initiator: true, wrtc });
+  let connected = false;
 
   peer.on('signal', data => {
     console.log('WebRTC signal recv:', data);
@@ -41,18 +60,11 @@ async function handle(runID, ws) {
 
   peer.on('connect', async () => {
     console.log('WebRTC connected, streaming file...');
+    connected = true;
     const filePath = path.join(__dirname, '..', 'assets', 'sample_video.mp4');
 
+    const sampler = startSampler(runID);
     const transferStartUnix = Date.now();
-    const cpuBefore = await getCpuUsagePercentage();
-    const ramBefore = await getRamUsageBytes();
-    let cpuWhile = 0;
-    let ramWhile = 0;
-
-    setTimeout(async () => {
-      cpuWhile = await getCpuUsagePercentage();
-      ramWhile = await getRamUsageBytes();
-    }, 500);
 
     let chunks = 0;
     let procs = 0;
@@ -66,18 +78,10 @@ async function handle(runID, ws) {
       console.log('File sent');
 
       (async () => {
-        const cpuAfter = await getCpuUsagePercentage();
-        const ramAfter = await getRamUsageBytes();
-
+        await sampler.stop();
         await collectMetrics(runID, {
-          "TransferStartUnix": transferStartUnix,
-          "BytesPayload": fs.statSync(filePath).size,
-          "CpuServerPercentBefore": cpuBefore,
-          "CpuServerPercentWhile": cpuWhile,
-          "CpuServerPercentAfter": cpuAfter,
-          "RamServerBytesBefore": ramBefore,
-          "RamServerBytesWhile": ramWhile,
-          "RamServerBytesAfter": ramAfter
+          "TransferStartUnixMs": transferStartUnix,
+          "BytesPayload": fs.statSync(filePath).size
         });
       })();
     };
@@ -91,6 +95,7 @@ async function handle(runID, ws) {
           setTimeout(sendChunk, 50);
         } else {
           peer.send(chunk);
+          sampler.add(chunk.length);
           procs++;
 
           finish();
@@ -108,7 +113,30 @@ async function handle(runID, ws) {
     console.log('WebRTC connection closed');
   });
 
-  peer.on('error', err => console.error('Peer error:', err));
+  peer.on('error', err => {
+    console.error('Peer error:', err);
+    collectMetrics(runID, errorFields(connected ? 'write' : 'handshake', err));
+  });
+}
+
+// Stable error codes of Node.js socket errors and simple-peer errors, see
+// errors.go of the collector. Everything else is reported as unknown.
+const errorCodes = {
+  ECONNREFUSED: 'connection_refused',
+  ECONNRESET: 'connection_reset',
+  EPIPE: 'connection_closed',
+  ENOTFOUND: 'dns',
+  ETIMEDOUT: 'timeout',
+  ERR_ICE_CONNECTION_FAILURE: 'ice_failure',
+  ERR_CONNECTION_FAILURE: 'ice_failure',
+};
+
+function errorFields(phase, err) {
+  return {
+    "Error": String((err && err.message) || err),
+    "ErrorPhase": phase,
+    "ErrorCode": errorCodes[err && err.code] || 'unknown',
+  };
 }
 
 wss.on('listening', () => console.log('Server started on port 2502'));
@@ -117,7 +145,9 @@ async function collectMetrics(runID, data) {
   try {
     await axios.put(`https://thkm25_collect.nauri.io/${runID}/update`, data, {
       headers: {
-        'X-API-KEY': 'thk_masterthesis_2025_hwtwswrtc'
+        'X-API-KEY': collectorApiKey,
+        'X-Collector-Side': 'server',
+        'X-Collector-Host': os.hostname()
       }
     });
     console.log('[COLLECTOR] Metrics collected!');
@@ -126,20 +156,63 @@ async function collectMetrics(runID, data) {
   }
 }
 
-function getCpuUsagePercentage() {
-  return new Promise((resolve) => {
-    const start = cpuInfo();
+function startSampler(runID) {
+  const sampler = { transferred: 0, last: lastCpuInfo };
+
+  const sample = () => {
+    const now = cpuInfo();
+    const idleDiff = now.idle - sampler.last.idle;
+    const totalDiff = now.total - sampler.last.total;
+    sampler.last = now;
+    lastCpuInfo = now;
+
+    return collectSamples(runID, [{
+      TimestampMs: Date.now(),
+      CpuPercent: totalDiff > 0 ? Math.min(Math.max(100 - (idleDiff / totalDiff) * 100, 0), 100) : 0,
+      RamUsedBytes: getRamUsageBytes(),
+      RssBytes: process.memoryUsage.rss(),
+      BytesTransferred: sampler.transferred
+    }]);
+  };
+
+  // the first transferred byte moves the run to transferring
+  sampler.add = n => {
+    if (sampler.transferred === 0 && n > 0) {
+      collectMetrics(runID, { "@state": "transferring" });
+    }
+    sampler.transferred += n;
+  };
 
-    setTimeout(() => {
-      const end = cpuInfo();
+  sample();
+  const timer = setInterval(sample, sampleIntervalMs);
 
-      const idleDiff = end.idle - start.idle;
-      const totalDiff = end.total - start.total;
+  sampler.stop = async () => {
+    clearInterval(timer);
+    await sleep(sampleIntervalMs);
+    await sample();
+  };
 
-      const usage = 100 - Math.round((idleDiff / totalDiff) * 100);
-      resolve(usage);
-    }, 100);
-  });
+  return sampler;
+}
+
+function sleep(ms) {
+  return new Promise(resolve => setTimeout(resolve, ms));
+}
+
+
+async function collectSamples(runID, samples) {
+  try {
+    await axios.post(`https://thkm25_collect.nauri.io/${runID}/samples`, { Samples: samples }, {
+      headers: {
+        'X-API-KEY': collectorApiKey,
+        'X-Collector-Side': 'server',
+        'X-Collector-Host': os.hostname()
+      }
+    });
+    console.log(`[COLLECTOR] ${samples.length} samples collected!`);
+  } catch (error) {
+    console.error('[COLLECTOR] Error collecting samples:', error);
+  }
 }
 
 function cpuInfo() {
@@ -158,7 +231,7 @@ function cpuInfo() {
   return { idle, total };
 }
 
-async function getRamUsageBytes() {
+function getRamUsageBytes() {
   const total = os.totalmem();
   const free = os.freemem();
   return total - free;
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"collectclient"
+)
+
+// failure classifies err like collectclient.NewFailure and adds the close
+// code of WebSocket close errors.
+func failure(phase string, err error) collectclient.Failure {
+	f := collectclient.NewFailure(phase, err)
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return f.WithProtocolCode(collectclient.CodeWebSocketClose, collectclient.KindWebSocketClose, uint64(closeErr.Code))
+	}
+	return f
+}
+
+// dialFailure classifies an error of websocket.Dialer.Dial, which connects,
+// handshakes TLS and upgrades in one call. resp is only set if the server
+// answered the upgrade request.
+func dialFailure(err error, resp *http.Response) collectclient.Failure {
+	f := failure(collectclient.PhaseUpgrade, err)
+
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, websocket.ErrBadHandshake) && resp != nil:
+		return f.WithProtocolCode(collectclient.CodeHTTPStatus, collectclient.KindHTTPStatus, uint64(resp.StatusCode))
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		f.Phase = collectclient.PhaseDial
+	case f.Code == collectclient.CodeTLS:
+		f.Phase = collectclient.PhaseHandshake
+	}
+	return f
+}
@@ -10,38 +10,30 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/shirou/gopsutil/v4/cpu"
-	"github.com/shirou/gopsutil/v4/mem"
+
+	"collectclient"
 )
 
 const URL = "ws://localhost:2503"
 const REMOTE_URL = "wss://thkm25_websockets.nauri.io"
 
+var collector = collectclient.MustNew(collectclient.ConfigFromEnv(collectclient.SideClient))
+
 func main() {
 	url, runID := parseArguments()
+	defer collector.Close()
 
-	conn, _, err := websocket.DefaultDialer.Dial(url+"/stream?runID="+fmt.Sprintf("%d", runID), nil)
+	collector.State(runID, collectclient.StateConnecting)
+	conn, resp, err := websocket.DefaultDialer.Dial(url+"/stream?runID="+fmt.Sprintf("%d", runID), nil)
 	if err != nil {
-		collectMetrics(runID, map[string]any{
-			"@end":  true,
-			"Error": fmt.Sprintf("Failed to dial WebSockets: %v", err),
-		})
-		log.Fatalf("Failed to dial WebSockets: %v", err)
+		collector.Fail(runID, dialFailure(err, resp))
+		collector.Fatalf("Failed to dial WebSockets: %v", err)
 	}
 
 	connectEstablishTime := time.Now()
-	cpuBefore := getCpuUsagePercentage()
-	ramBefore := getRamUsageBytes()
-	cpuWhile := float64(0)
-	ramWhile := uint64(0)
+	sampler := collector.StartSampler(runID)
 	lost, recv := getPacketStats()
 
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		cpuWhile = getCpuUsagePercentage()
-		ramWhile = getRamUsageBytes()
-	}()
-
 	defer conn.Close()
 
 	file, err := os.Create(fmt.Sprintf("output_%d.mp4", runID))
@@ -52,28 +44,20 @@ func main() {
 	defer file.Close()
 
 	defer func() {
-		cpuAfter := getCpuUsagePercentage()
-		ramAfter := getRamUsageBytes()
+		transferEnd := time.Now().UnixMilli()
+		connectionDuration := time.Since(connectEstablishTime).Milliseconds()
 		lostAfter, recvAfter := getPacketStats()
-
-		collectMetrics(runID, map[string]any{
-			"@end":                   true,
-			"TransferEndUnix":        time.Now().Unix(),
-			"ConnectionDuration":     time.Since(connectEstablishTime).Milliseconds(),
-			"CpuClientPercentBefore": cpuBefore,
-			"CpuClientPercentWhile":  cpuWhile,
-			"CpuClientPercentAfter":  cpuAfter,
-			"RamClientBytesBefore":   ramBefore,
-			"RamClientBytesWhile":    ramWhile,
-			"RamClientBytesAfter":    ramAfter,
-			"LostPackets":            lostAfter - lost,
-			"BytesSentTotal":         recvAfter - recv,
+		sampler.Stop()
+
+		collector.Metrics(runID, map[string]any{
+			"@end":                 true,
+			"TransferEndUnixMs":    transferEnd,
+			"ConnectionDurationMs": connectionDuration,
+			"LostPackets":          lostAfter - lost,
+			"BytesSentTotal":       recvAfter - recv,
 		})
 
-		log.Printf("Connection duration: %d ms", time.Since(connectEstablishTime).Milliseconds())
-		log.Printf("CPU usage before: %.2f%%", cpuBefore)
-		log.Printf("CPU usage while: %.2f%%", cpuWhile)
-		log.Printf("CPU usage after: %.2f%%", cpuAfter)
+		log.Printf("Connection duration: %d ms", connectionDuration)
 	}()
 
 	for {
@@ -83,12 +67,8 @@ func main() {
 				break
 			}
 
-			collectMetrics(runID, map[string]any{
-				"@end":  true,
-				"Error": fmt.Sprintf("Failed to read message: %v", err),
-			})
-
-			log.Fatalf("Failed to read message: %v", err)
+			collector.Fail(runID, failure(collectclient.PhaseRead, err))
+			collector.Fatalf("Failed to read message: %v", err)
 		}
 
 		n, err := file.Write(message)
@@ -96,6 +76,8 @@ func main() {
 			log.Fatalf("Failed to write to file: %v", err)
 		}
 
+		sampler.Add(n)
+
 		log.Printf("Wrote %d bytes", n)
 	}
 
@@ -129,22 +111,6 @@ func parseArguments() (string, int) {
 	return url, runId
 }
 
-func getCpuUsagePercentage() float64 {
-	percentages, err := cpu.Percent(500*time.Millisecond, false)
-	if err != nil || len(percentages) == 0 {
-		return 0.0
-	}
-	return percentages[0]
-}
-
-func getRamUsageBytes() uint64 {
-	vmStat, err := mem.VirtualMemory()
-	if err != nil {
-		return 0
-	}
-	return vmStat.Used
-}
-
 // Returns netstat -e output for lost packets, and bytes received (sent)
 func getPacketStats() (int64, int64) {
 	cmd, err := exec.Command("netstat", "-e").Output()
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gorilla/websocket"
+
+	"collectclient"
+)
+
+// failure classifies err like collectclient.NewFailure and adds the close
+// code of WebSocket close errors.
+func failure(phase string, err error) collectclient.Failure {
+	f := collectclient.NewFailure(phase, err)
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return f.WithProtocolCode(collectclient.CodeWebSocketClose, collectclient.KindWebSocketClose, uint64(closeErr.Code))
+	}
+	return f
+}
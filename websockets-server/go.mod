@@ -3,8 +3,8 @@ module websockets-server
 go 1.23.4
 
 require (
+	collectclient v0.0.0
 	github.com/gorilla/websocket v1.5.3
-	github.com/shirou/gopsutil v3.21.11+incompatible
 )
 
 require (
@@ -12,9 +12,11 @@ require (
 	github.com/go-ole/go-ole v1.2.6 // indirect
 	github.com/lufia/plan9stats v0.0.0-20211012122336-39d0f177ccd0 // indirect
 	github.com/power-devops/perfstat v0.0.0-20210106213030-5aafc221ea8c // indirect
-	github.com/shirou/gopsutil/v4 v4.25.3
+	github.com/shirou/gopsutil/v4 v4.25.3 // indirect
 	github.com/tklauser/go-sysconf v0.3.12 // indirect
 	github.com/tklauser/numcpus v0.6.1 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 )
+
+replace collectclient => ../collectclient
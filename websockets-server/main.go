@@ -10,15 +10,19 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/shirou/gopsutil/v4/cpu"
-	"github.com/shirou/gopsutil/v4/mem"
+
+	"collectclient"
 )
 
 var assetsDir = path.Join("..", "assets")
 var videoFile = path.Join(assetsDir, "sample_video.mp4")
 var upgrader = websocket.Upgrader{}
 
+var collector = collectclient.MustNew(collectclient.ConfigFromEnv(collectclient.SideServer))
+
 func main() {
+	collector.FlushOnExit()
+
 	stat, err := os.Stat(videoFile)
 	if err != nil {
 		log.Fatalf("Failed to get file info: %v", err)
@@ -66,6 +70,7 @@ func streamVideo(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade to WebSocket: %v", err)
+		collector.Fail(runID, failure(collectclient.PhaseUpgrade, err))
 		http.Error(w, "Failed to upgrade to WebSocket", http.StatusInternalServerError)
 		return
 	}
@@ -89,17 +94,9 @@ func streamVideo(w http.ResponseWriter, r *http.Request) {
 
 	defer file.Close()
 
-	transferStart := time.Now().Unix()
-	cpuBefore := getCpuUsagePercentage()
-	ramBefore := getRamUsageBytes()
-	cpuWhile := float64(0)
-	ramWhile := uint64(0)
-
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		cpuWhile = getCpuUsagePercentage()
-		ramWhile = getRamUsageBytes()
-	}()
+	sampler := collector.StartSampler(runID)
+	defer sampler.Stop()
+	transferStart := time.Now().UnixMilli()
 
 	buf := make([]byte, chunkSize)
 	for {
@@ -116,40 +113,19 @@ func streamVideo(w http.ResponseWriter, r *http.Request) {
 
 		if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
 			log.Printf("Failed to write message: %v", err)
+			collector.Fail(runID, failure(collectclient.PhaseWrite, err))
 			http.Error(w, "Failed to write message", http.StatusInternalServerError)
 			return
 		}
+
+		sampler.Add(n)
 	}
 
-	cpuAfter := getCpuUsagePercentage()
-	ramAfter := getRamUsageBytes()
-
-	collectMetrics(runID, map[string]any{
-		"TransferStartUnix":      transferStart,
-		"BytesPayload":           stat.Size(),
-		"CpuServerPercentBefore": cpuBefore,
-		"CpuServerPercentWhile":  cpuWhile,
-		"CpuServerPercentAfter":  cpuAfter,
-		"RamServerBytesBefore":   ramBefore,
-		"RamServerBytesWhile":    ramWhile,
-		"RamServerBytesAfter":    ramAfter,
+	sampler.Stop()
+	collector.Metrics(runID, map[string]any{
+		"TransferStartUnixMs": transferStart,
+		"BytesPayload":        stat.Size(),
 	})
 
 	log.Println("Video sent")
 }
-
-func getCpuUsagePercentage() float64 {
-	percentages, err := cpu.Percent(500*time.Millisecond, false)
-	if err != nil || len(percentages) == 0 {
-		return 0.0
-	}
-	return percentages[0]
-}
-
-func getRamUsageBytes() uint64 {
-	vmStat, err := mem.VirtualMemory()
-	if err != nil {
-		return 0
-	}
-	return vmStat.Used
-}
@@ -3,8 +3,9 @@ module webtransport-client
 go 1.23.4
 
 require (
+	collectclient v0.0.0
+	github.com/quic-go/quic-go v0.44.0
 	github.com/quic-go/webtransport-go v0.8.0
-	github.com/shirou/gopsutil/v4 v4.25.3
 )
 
 require (
@@ -16,7 +17,7 @@ require (
 	github.com/onsi/ginkgo/v2 v2.12.0 // indirect
 	github.com/power-devops/perfstat v0.0.0-20210106213030-5aafc221ea8c // indirect
 	github.com/quic-go/qpack v0.4.0 // indirect
-	github.com/quic-go/quic-go v0.44.0 // indirect
+	github.com/shirou/gopsutil/v4 v4.25.3 // indirect
 	github.com/tklauser/go-sysconf v0.3.12 // indirect
 	github.com/tklauser/numcpus v0.6.1 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
@@ -29,3 +30,5 @@ require (
 	golang.org/x/text v0.15.0 // indirect
 	golang.org/x/tools v0.21.0 // indirect
 )
+
+replace collectclient => ../collectclient
@@ -13,15 +13,18 @@ import (
 	"time"
 
 	"github.com/quic-go/webtransport-go"
-	"github.com/shirou/gopsutil/v4/cpu"
-	"github.com/shirou/gopsutil/v4/mem"
+
+	"collectclient"
 )
 
 const URL = "https://localhost:2504"
 const REMOTE_URL = "https://thkm25_webtransport.nauri.io:2504"
 
+var collector = collectclient.MustNew(collectclient.ConfigFromEnv(collectclient.SideClient))
+
 func main() {
 	url, runID := parseArguments()
+	defer collector.Close()
 
 	d := webtransport.Dialer{
 		TLSClientConfig: &tls.Config{
@@ -29,40 +32,25 @@ func main() {
 		},
 	}
 
+	collector.State(runID, collectclient.StateConnecting)
 	resp, sess, err := d.Dial(context.Background(), url+"/stream?runID="+fmt.Sprintf("%d", runID), nil)
 	if err != nil {
-		collectMetrics(runID, map[string]any{
-			"@end":  true,
-			"Error": fmt.Sprintf("Failed to dial: %v", err),
-		})
-		log.Fatalf("Failed to dial: %v", err)
+		collector.Fail(runID, dialFailure(err, resp))
+		collector.Fatalf("Failed to dial: %v", err)
 	}
 
 	connectEstablishTime := time.Now()
-	cpuBefore := getCpuUsagePercentage()
-	ramBefore := getRamUsageBytes()
-	cpuWhile := float64(0)
-	ramWhile := uint64(0)
+	sampler := collector.StartSampler(runID)
 	lost, recv := getPacketStats()
 
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		cpuWhile = getCpuUsagePercentage()
-		ramWhile = getRamUsageBytes()
-	}()
-
 	defer sess.CloseWithError(0, "bye")
 
 	log.Printf("Connected: %v", resp.Status)
 
 	stream, err := sess.AcceptUniStream(context.Background())
 	if err != nil {
-		collectMetrics(runID, map[string]any{
-			"@end":  true,
-			"Error": fmt.Sprintf("Could not accept stream: %v", err),
-		})
-
-		log.Fatalf("Could not accept stream: %v", err)
+		collector.Fail(runID, failure(collectclient.PhaseStreamOpen, err))
+		collector.Fatalf("Could not accept stream: %v", err)
 	}
 
 	file, err := os.Create(fmt.Sprintf("output_%d.mp4", runID))
@@ -72,32 +60,23 @@ func main() {
 
 	defer file.Close()
 
-	n, err := io.Copy(file, stream)
+	n, err := io.Copy(sampler.Writer(file), stream)
 	if err != nil {
-		collectMetrics(runID, map[string]any{
-			"@end":  true,
-			"Error": fmt.Sprintf("Could not copy stream data: %v", err),
-		})
-
-		log.Fatalf("Could not copy stream data: %v", err)
+		collector.Fail(runID, failure(collectclient.PhaseRead, err))
+		collector.Fatalf("Could not copy stream data: %v", err)
 	}
 
-	cpuAfter := getCpuUsagePercentage()
-	ramAfter := getRamUsageBytes()
+	transferEnd := time.Now().UnixMilli()
+	connectionDuration := time.Since(connectEstablishTime).Milliseconds()
 	lostAfter, recvAfter := getPacketStats()
 
-	collectMetrics(runID, map[string]any{
-		"@end":                   true,
-		"TransferEndUnix":        time.Now().Unix(),
-		"ConnectionDuration":     time.Since(connectEstablishTime).Milliseconds(),
-		"CpuClientPercentBefore": cpuBefore,
-		"CpuClientPercentWhile":  cpuWhile,
-		"CpuClientPercentAfter":  cpuAfter,
-		"RamClientBytesBefore":   ramBefore,
-		"RamClientBytesWhile":    ramWhile,
-		"RamClientBytesAfter":    ramAfter,
-		"LostPackets":            lostAfter - lost,
-		"BytesSentTotal":         recvAfter - recv,
+	sampler.Stop()
+	collector.Metrics(runID, map[string]any{
+		"@end":                 true,
+		"TransferEndUnixMs":    transferEnd,
+		"ConnectionDurationMs": connectionDuration,
+		"LostPackets":          lostAfter - lost,
+		"BytesSentTotal":       recvAfter - recv,
 	})
 
 	log.Printf("Successfully received %d bytes", n)
@@ -130,22 +109,6 @@ func parseArguments() (string, int) {
 	return url, runId
 }
 
-func getCpuUsagePercentage() float64 {
-	percentages, err := cpu.Percent(500*time.Millisecond, false)
-	if err != nil || len(percentages) == 0 {
-		return 0.0
-	}
-	return percentages[0]
-}
-
-func getRamUsageBytes() uint64 {
-	vmStat, err := mem.VirtualMemory()
-	if err != nil {
-		return 0
-	}
-	return vmStat.Used
-}
-
 // Returns netstat -e output for lost packets, and bytes received (sent)
 func getPacketStats() (int64, int64) {
 	cmd, err := exec.Command("netstat", "-e").Output()
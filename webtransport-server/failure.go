@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+
+	"collectclient"
+)
+
+// failure classifies err like collectclient.NewFailure and adds the error
+// codes of WebTransport and QUIC.
+func failure(phase string, err error) collectclient.Failure {
+	f := collectclient.NewFailure(phase, err)
+
+	var sessionErr *webtransport.SessionError
+	var wtStreamErr *webtransport.StreamError
+	var idleErr *quic.IdleTimeoutError
+	var handshakeErr *quic.HandshakeTimeoutError
+	var streamErr *quic.StreamError
+	var appErr *quic.ApplicationError
+	var transportErr *quic.TransportError
+
+	switch {
+	case errors.As(err, &sessionErr):
+		return f.WithProtocolCode(collectclient.CodeSessionClosed, collectclient.KindWebTransportSession, uint64(sessionErr.ErrorCode))
+	case errors.As(err, &wtStreamErr):
+		return f.WithProtocolCode(collectclient.CodeStreamReset, collectclient.KindWebTransportStream, uint64(wtStreamErr.ErrorCode))
+	case errors.As(err, &idleErr):
+		f.Code = collectclient.CodeIdleTimeout
+	case errors.As(err, &handshakeErr):
+		f.Code = collectclient.CodeHandshakeTimeout
+	case errors.As(err, &streamErr):
+		return f.WithProtocolCode(collectclient.CodeStreamReset, collectclient.KindQUICApplication, uint64(streamErr.ErrorCode))
+	case errors.As(err, &appErr):
+		return f.WithProtocolCode(collectclient.CodeApplicationError, collectclient.KindQUICApplication, uint64(appErr.ErrorCode))
+	case errors.As(err, &transportErr):
+		code := collectclient.CodeTransportError
+		if transportErr.ErrorCode.IsCryptoError() {
+			code = collectclient.CodeTLS
+		}
+		return f.WithProtocolCode(code, collectclient.KindQUICTransport, uint64(transportErr.ErrorCode))
+	}
+	return f
+}
@@ -11,15 +11,19 @@ import (
 
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
-	"github.com/shirou/gopsutil/v4/cpu"
-	"github.com/shirou/gopsutil/v4/mem"
+
+	"collectclient"
 )
 
 var assetsDir = path.Join("..", "assets")
 var videoFile = path.Join(assetsDir, "sample_video.mp4")
 var webtransportSrv *webtransport.Server
 
+var collector = collectclient.MustNew(collectclient.ConfigFromEnv(collectclient.SideServer))
+
 func main() {
+	collector.FlushOnExit()
+
 	stat, err := os.Stat(videoFile)
 	if err != nil {
 		log.Fatalf("Failed to get file info: %v", err)
@@ -60,6 +64,7 @@ func streamVideo(w http.ResponseWriter, r *http.Request) {
 	sess, err := webtransportSrv.Upgrade(w, r)
 	if err != nil {
 		log.Printf("Failed to upgrade to WebTransport: %v", err)
+		collector.Fail(runID, failure(collectclient.PhaseUpgrade, err))
 		http.Error(w, "Failed to upgrade to WebTransport", http.StatusInternalServerError)
 		return
 	}
@@ -69,6 +74,7 @@ func streamVideo(w http.ResponseWriter, r *http.Request) {
 	stream, err := sess.OpenUniStream()
 	if err != nil {
 		log.Printf("Failed to open stream: %v", err)
+		collector.Fail(runID, failure(collectclient.PhaseStreamOpen, err))
 		http.Error(w, "Failed to open stream", http.StatusInternalServerError)
 		return
 	}
@@ -91,55 +97,24 @@ func streamVideo(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Streaming video (%d bytes): %s", stat.Size(), videoFile)
 
-	transferStart := time.Now().Unix()
-	cpuBefore := getCpuUsagePercentage()
-	ramBefore := getRamUsageBytes()
-	cpuWhile := float64(0)
-	ramWhile := uint64(0)
+	sampler := collector.StartSampler(runID)
+	defer sampler.Stop()
+	transferStart := time.Now().UnixMilli()
 
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		cpuWhile = getCpuUsagePercentage()
-		ramWhile = getRamUsageBytes()
-	}()
-
-	_, err = io.Copy(stream, file)
+	_, err = io.Copy(sampler.Writer(stream), file)
 	if err != nil {
 		log.Printf("Error while streaming: %v", err)
+		collector.Fail(runID, failure(collectclient.PhaseWrite, err))
 		return
 	}
 
 	stream.Close()
 
-	cpuAfter := getCpuUsagePercentage()
-	ramAfter := getRamUsageBytes()
-
-	collectMetrics(runID, map[string]any{
-		"TransferStartUnix":      transferStart,
-		"BytesPayload":           stat.Size(),
-		"CpuServerPercentBefore": cpuBefore,
-		"CpuServerPercentWhile":  cpuWhile,
-		"CpuServerPercentAfter":  cpuAfter,
-		"RamServerBytesBefore":   ramBefore,
-		"RamServerBytesWhile":    ramWhile,
-		"RamServerBytesAfter":    ramAfter,
+	sampler.Stop()
+	collector.Metrics(runID, map[string]any{
+		"TransferStartUnixMs": transferStart,
+		"BytesPayload":        stat.Size(),
 	})
 
 	log.Println("Streaming finished successfully")
 }
-
-func getCpuUsagePercentage() float64 {
-	percentages, err := cpu.Percent(500*time.Millisecond, false)
-	if err != nil || len(percentages) == 0 {
-		return 0.0
-	}
-	return percentages[0]
-}
-
-func getRamUsageBytes() uint64 {
-	vmStat, err := mem.VirtualMemory()
-	if err != nil {
-		return 0
-	}
-	return vmStat.Used
-}